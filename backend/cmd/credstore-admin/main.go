@@ -0,0 +1,329 @@
+package main
+
+import (
+	"credential-store/internal/repository"
+	"credential-store/internal/services"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+)
+
+const usage = `Usage: credstore-admin <command> [flags]
+
+Commands:
+  reencrypt         Re-encrypt all stored secrets under a new master key
+  verify-audit      Check the audit log hash chain and signed checkpoints
+  generate-jwt-key  Create a key pair for signing access tokens
+
+Run "credstore-admin <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(0)
+	// Same configuration as the server; a missing .env is fine
+	godotenv.Load()
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "reencrypt":
+		os.Exit(reencrypt(os.Args[2:]))
+	case "verify-audit":
+		os.Exit(verifyAudit(os.Args[2:]))
+	case "generate-jwt-key":
+		os.Exit(generateJWTKey(os.Args[2:]))
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// reencrypt decrypts with the key-ring the server is configured with (the
+// compromised one) and re-encrypts under NEW_ENCRYPTION_KEY. The server must be
+// stopped while it runs. Keys are read from the environment only, never from
+// flags, so they don't show up in the process list.
+func reencrypt(args []string) int {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "compute every change and check the current key-ring opens everything, without writing")
+	verifyOnly := fs.Bool("verify-only", false, "only check that everything opens under the new key")
+	batchSize := fs.Int("batch-size", 100, "records per transaction")
+	newVersion := fs.Int("new-key-version", 0, "version of the new key (default: highest current version + 1)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `Usage: credstore-admin reencrypt [flags]
+
+Re-encrypts every credential, folder key, document key and TOTP secret under a
+new master key. The current key-ring is configured exactly as for the server
+(ENCRYPTION_KEY, ENCRYPTION_OLD_KEYS, ENCRYPTION_KEY_PROVIDER, ...); the new
+key is read from NEW_ENCRYPTION_KEY. Stop the server first. An interrupted run
+can be started again and picks up where it stopped.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *batchSize < 1 {
+		log.Println("-batch-size must be positive")
+		return 2
+	}
+
+	provider, err := services.NewKeyProviderFromEnv()
+	if err != nil {
+		log.Println("Failed to configure key provider:", err)
+		return 1
+	}
+	oldEncryption, err := services.NewEncryptionService(provider)
+	if err != nil {
+		log.Println("Failed to load current encryption keys:", err)
+		return 1
+	}
+
+	version := *newVersion
+	if version == 0 {
+		version = oldEncryption.MaxVersion() + 1
+	}
+	newEncryption, err := services.NewEncryptionService(&services.StaticKeyProvider{
+		Secret:  os.Getenv("NEW_ENCRYPTION_KEY"),
+		Version: version,
+		DevMode: services.IsDevMode(),
+	})
+	if err != nil {
+		log.Println("NEW_ENCRYPTION_KEY:", err)
+		return 1
+	}
+
+	db, err := openDB()
+	if err != nil {
+		log.Println("Failed to connect to database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	migration, err := services.NewKeyMigrationService(repository.NewKeyMigrationRepository(db), oldEncryption, newEncryption)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	opts := services.KeyMigrationOptions{
+		BatchSize: *batchSize,
+		DryRun:    *dryRun,
+		Progress: func(stage string, stats services.KeyMigrationStats) {
+			log.Printf("%-20s %d/%d scanned, %d rewritten, %d skipped, %d failed",
+				stage, stats.Scanned, stats.Total, stats.Rewritten, stats.Skipped, stats.Failed)
+		},
+	}
+
+	if !*verifyOnly {
+		if *dryRun {
+			log.Printf("Dry run: re-encrypting under key version %d, nothing will be written", version)
+		} else {
+			log.Printf("Re-encrypting under key version %d", version)
+		}
+		report, err := migration.Run(opts)
+		if err != nil {
+			log.Println("Re-encryption aborted:", err)
+			return 1
+		}
+		printReport("Re-encryption", report)
+		if report.Failed() > 0 {
+			log.Println("Some records could not be re-encrypted; see the log above")
+			return 1
+		}
+	}
+
+	// After a dry run nothing is under the new key yet, so check the current
+	// key-ring instead
+	log.Println("Verifying")
+	report, err := migration.Verify(opts, *dryRun)
+	if err != nil {
+		log.Println("Verification aborted:", err)
+		return 1
+	}
+	printReport("Verification", report)
+	if report.Failed() > 0 {
+		log.Println("Verification failed; see the log above")
+		return 1
+	}
+
+	if !*dryRun {
+		log.Printf("Done. Configure the server with the new key as ENCRYPTION_KEY and ENCRYPTION_KEY_VERSION=%d, "+
+			"and remove the old key from ENCRYPTION_OLD_KEYS.", version)
+	}
+	return 0
+}
+
+// verifyAudit walks the audit log and its checkpoints. It only needs the
+// database and the public keys, so it can run against a replica or a restored
+// backup while the server keeps going.
+func verifyAudit(args []string) int {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the full report as JSON")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `Usage: credstore-admin verify-audit [flags]
+
+Checks that no audit event was removed, inserted, edited or reordered, and that
+every checkpoint carries a valid signature over an event still in the log.
+Checkpoint signatures are checked against AUDIT_SIGNING_KEY and
+AUDIT_VERIFY_KEYS. Exits with status 1 if anything is wrong.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	signer, err := services.NewAuditSignerFromEnv()
+	if err != nil {
+		log.Println("Failed to configure audit keys:", err)
+		return 1
+	}
+
+	db, err := openDB()
+	if err != nil {
+		log.Println("Failed to connect to database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	report, err := services.NewAuditService(repository.NewAuditRepository(db), signer).Verify()
+	if err != nil {
+		log.Println("Verification aborted:", err)
+		return 1
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		log.Printf("%d events (%d recorded before chaining), last event %d", report.Events, report.UnchainedEvents, report.LastEventID)
+		log.Printf("%d checkpoints, last covers event %d", report.Checkpoints, report.LastCheckpointEvent)
+		for _, p := range report.Problems {
+			if p.CheckpointID != 0 {
+				log.Printf("  checkpoint %d (event %d): %s", p.CheckpointID, p.EventID, p.Problem)
+			} else {
+				log.Printf("  event %d: %s", p.EventID, p.Problem)
+			}
+		}
+		if report.ProblemCount > len(report.Problems) {
+			log.Printf("  ... and %d more", report.ProblemCount-len(report.Problems))
+		}
+	}
+
+	if !report.OK {
+		log.Printf("Audit log verification FAILED with %d problems", report.ProblemCount)
+		return 1
+	}
+	if report.Checkpoints == 0 {
+		log.Println("Chain is intact, but there are no checkpoints; truncation of the newest events cannot be detected")
+	} else {
+		log.Println("Audit log is intact")
+	}
+	return 0
+}
+
+// generateJWTKey writes a new access token signing key and its public half
+// for JWT_SIGNING_KEYS and, once retired, JWT_VERIFY_KEYS.
+func generateJWTKey(args []string) int {
+	fs := flag.NewFlagSet("generate-jwt-key", flag.ExitOnError)
+	alg := fs.String("alg", "EdDSA", "EdDSA or RS256")
+	bits := fs.Int("bits", 3072, "RSA key size")
+	out := fs.String("out", "", "file for the private key; the public key goes next to it, ending in .pub.pem")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `Usage: credstore-admin generate-jwt-key -out FILE [flags]
+
+Creates a key pair for signing access tokens. Add the private key to
+JWT_SIGNING_KEYS, with "@" and a start time at least a day ahead when
+rotating, so services that cache the JWKS learn the new key first.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+	private, public, kid, err := services.GenerateTokenSigningKey(*alg, *bits)
+	if err != nil {
+		log.Println("Failed to generate key:", err)
+		return 1
+	}
+	publicOut := strings.TrimSuffix(*out, ".pem") + ".pub.pem"
+	if err := os.MkdirAll(filepath.Dir(*out), 0700); err != nil {
+		log.Println("Failed to write key:", err)
+		return 1
+	}
+	// O_EXCL, so an existing key is never overwritten
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Println("Failed to write key:", err)
+		return 1
+	}
+	_, err = f.Write(private)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.WriteFile(publicOut, public, 0644)
+	}
+	if err != nil {
+		log.Println("Failed to write key:", err)
+		return 1
+	}
+
+	log.Printf("Wrote %s key %s to %s, public key to %s", *alg, kid, *out, publicOut)
+	return 0
+}
+
+func printReport(title string, report *services.KeyMigrationReport) {
+	log.Printf("%s summary:", title)
+	for _, row := range []struct {
+		name  string
+		stats services.KeyMigrationStats
+	}{
+		{"folders", report.Folders},
+		{"credentials", report.Credentials},
+		{"documents", report.Documents},
+		{"mfa secrets", report.MFASecrets},
+	} {
+		log.Printf("  %-12s %d scanned, %d rewritten, %d skipped, %d failed",
+			row.name, row.stats.Scanned, row.stats.Rewritten, row.stats.Skipped, row.stats.Failed)
+	}
+}
+
+func openDB() (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"),
+	)
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
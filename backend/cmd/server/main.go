@@ -5,10 +5,16 @@ import (
 	"credential-store/internal/middleware"
 	"credential-store/internal/repository"
 	"credential-store/internal/services"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -40,44 +46,242 @@ func main() {
 	documentRepo := repository.NewDocumentRepository(db)
 	groupRepo := repository.NewGroupRepository(db)
 	serviceRepo := repository.NewServiceRepository(db)
+	sealRepo := repository.NewSealRepository(db)
+	auditRepo := repository.NewAuditRepository(db)
+	sessionRepo := repository.NewSessionRepository(db)
+	mfaRepo := repository.NewMFARepository(db)
+	webauthnRepo := repository.NewWebAuthnRepository(db)
+	authPolicyRepo := repository.NewAuthPolicyRepository(db)
+	apiTokenRepo := repository.NewAPITokenRepository(db)
+	serviceAccountRepo := repository.NewServiceAccountRepository(db)
+	loginThrottleRepo := repository.NewLoginThrottleRepository(db)
+	passwordHistoryRepo := repository.NewPasswordHistoryRepository(db)
+	passwordTokenRepo := repository.NewPasswordTokenRepository(db)
 
-	authService := services.NewAuthService(userRepo)
-	encryptionService := services.NewEncryptionService()
-	credService := services.NewCredentialService(credRepo, encryptionService)
-	folderService := services.NewFolderService(folderRepo)
+	ldapConfig, err := services.NewLDAPConfigFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure LDAP: ", err)
+	}
+	var ldapDirectory *services.LDAPDirectory
+	// Left a nil interface without LDAP, so logins only check local passwords
+	var authenticator services.Authenticator
+	if ldapConfig != nil {
+		ldapDirectory = services.NewLDAPDirectory(ldapConfig)
+		authenticator = ldapDirectory
+		log.Printf("Authenticating directory users against %s", ldapConfig.URL)
+	}
+
+	passwordPolicy, err := services.NewPasswordPolicy(services.PasswordRules{
+		MinLength:           envInt("PASSWORD_MIN_LENGTH", 12),
+		MinCharacterClasses: envInt("PASSWORD_MIN_CHARACTER_CLASSES", 3),
+		MinStrength:         envInt("PASSWORD_MIN_STRENGTH", 3),
+		History:             envInt("PASSWORD_HISTORY", 5),
+	}, os.Getenv("PASSWORD_BREACHED_LIST_FILE"))
+	if err != nil {
+		log.Fatal("Failed to load the breached password list: ", err)
+	}
+	// Still signs the short-lived MFA challenge, WebAuthn ceremony and single
+	// sign-on flow tokens, which only this server reads
+	if os.Getenv("JWT_SECRET") == "" {
+		log.Fatal("JWT_SECRET is required")
+	}
+	tokenSigner, err := services.NewTokenSignerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load access token signing keys: ", err)
+	}
+	log.Printf("Signing access tokens with key %s", tokenSigner.KeyID())
+	tokenCacheTTL := envDuration("TOKEN_GENERATION_CACHE_TTL", 5*time.Second)
+	authService := services.NewAuthService(userRepo, authPolicyRepo, webauthnRepo, passwordHistoryRepo, authenticator,
+		passwordPolicy, tokenSigner, envDuration("ACCESS_TOKEN_TTL", 15*time.Minute), tokenCacheTTL)
+	sessionService := services.NewSessionService(sessionRepo, userRepo, authService,
+		envDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour), envDuration("SESSION_MAX_AGE", 30*24*time.Hour), tokenCacheTTL)
+	encryptionService := initEncryption()
+	folderKeyService := services.NewFolderKeyService(folderRepo, encryptionService)
+	credService, err := services.NewCredentialService(credRepo, folderRepo, encryptionService, folderKeyService)
+	if err != nil {
+		log.Fatal("Failed to configure credential encryption:", err)
+	}
+	keyRotationService := services.NewKeyRotationService(credRepo, folderRepo, documentRepo, mfaRepo,
+		encryptionService, credService)
+	mfaIssuer := envString("MFA_ISSUER", "Credential Store")
+	mfaService := services.NewMFAService(mfaRepo, webauthnRepo, groupRepo, userRepo, authService, encryptionService,
+		mfaIssuer)
+	webauthnService := services.NewWebAuthnService(webauthnRepo, userRepo, mfaService, authService,
+		envString("WEBAUTHN_RP_ID", "localhost"), envString("WEBAUTHN_RP_NAME", mfaIssuer),
+		strings.Split(envString("WEBAUTHN_ORIGINS", "http://localhost:5173,http://localhost:3000"), ","))
+	oidcConfig, err := services.NewOIDCConfigFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure single sign-on: ", err)
+	}
+	var oidcService *services.OIDCService
+	if oidcConfig != nil {
+		oidcService = services.NewOIDCService(oidcConfig, authService)
+		log.Printf("Single sign-on through %s", oidcConfig.Issuer)
+	}
+	apiTokenService := services.NewAPITokenService(apiTokenRepo, userRepo, folderRepo,
+		envDuration("API_TOKEN_DEFAULT_TTL", 90*24*time.Hour), envDuration("API_TOKEN_MAX_TTL", 365*24*time.Hour))
+	serviceAccountService := services.NewServiceAccountService(serviceAccountRepo, groupRepo)
+	loginThrottle := services.NewLoginThrottleService(loginThrottleRepo, userRepo, services.LoginThrottlePolicy{
+		AccountThreshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		IPThreshold:      envInt("LOGIN_IP_LOCKOUT_THRESHOLD", 100),
+		LockoutDuration:  envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		BackoffBase:      envDuration("LOGIN_BACKOFF_BASE", time.Second),
+		BackoffMax:       envDuration("LOGIN_BACKOFF_MAX", time.Minute),
+		Window:           envDuration("LOGIN_FAILURE_WINDOW", time.Hour),
+	})
+	loginThrottle.StartCleanup(time.Hour)
+	smtpConfig, err := services.NewSMTPConfigFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure email: ", err)
+	}
+	// Left a nil interface without SMTP, which turns invitations and resets off
+	var mailer services.Mailer
+	if smtpConfig != nil {
+		mailer = services.NewSMTPMailer(smtpConfig)
+		log.Printf("Sending email through %s:%d", smtpConfig.Host, smtpConfig.Port)
+	}
+	passwordResetService := services.NewPasswordResetService(passwordTokenRepo, userRepo, authService, mailer,
+		envString("APP_URL", "http://localhost:5173"), envDuration("INVITE_TTL", 72*time.Hour),
+		envDuration("PASSWORD_RESET_TTL", time.Hour))
+	passwordResetService.StartCleanup(time.Hour)
+	folderService := services.NewFolderService(folderRepo, folderKeyService)
+	sealService := services.NewSealService(sealRepo, encryptionService, folderKeyService)
 	groupService := services.NewGroupService(groupRepo)
 	serviceService := services.NewServiceService(serviceRepo)
+	auditSigner, err := services.NewAuditSignerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure audit signing:", err)
+	}
+	auditService := services.NewAuditService(auditRepo, auditSigner)
+	auditService.StartCheckpoints(envDuration("AUDIT_CHECKPOINT_INTERVAL", 5*time.Minute))
+	initAuditSinks(auditService)
+	// Expired accounts are refused at once; the job marks them suspended, and
+	// suspends idle users when USER_IDLE_DAYS is set
+	accountExpiryService := services.NewAccountExpiryService(userRepo, authService, sessionService, auditService,
+		time.Duration(envInt("USER_IDLE_DAYS", 0))*24*time.Hour)
+	accountExpiryService.StartSuspender(envDuration("USER_EXPIRY_CHECK_INTERVAL", time.Hour))
+	var ldapSyncService *services.LDAPSyncService
+	if ldapDirectory != nil {
+		ldapSyncService = services.NewLDAPSyncService(ldapDirectory, userRepo, groupRepo, authService, sessionService,
+			auditService)
+		ldapSyncService.StartSync(envDuration("LDAP_SYNC_INTERVAL", 15*time.Minute))
+	}
+
+	authHandler := handlers.NewAuthHandler(authService, sessionService, mfaService, oidcService, loginThrottle,
+		auditService)
+	sessionHandler := handlers.NewSessionHandler(sessionService, auditService)
+	passwordResetHandler := handlers.NewPasswordResetHandler(passwordResetService, sessionService, auditService)
+	mfaHandler := handlers.NewMFAHandler(mfaService, authService, sessionService, loginThrottle, auditService)
+	webauthnHandler := handlers.NewWebAuthnHandler(webauthnService, mfaService, authService, sessionService, loginThrottle,
+		auditService)
+	apiTokenHandler := handlers.NewAPITokenHandler(apiTokenService, authService, auditService)
+	serviceAccountHandler := handlers.NewServiceAccountHandler(serviceAccountService, auditService)
+	credHandler := handlers.NewCredentialHandler(credService, auditService)
+	folderHandler := handlers.NewFolderHandler(folderService, auditService)
+	documentHandler := handlers.NewDocumentHandler(documentRepo, encryptionService, auditService)
+	groupHandler := handlers.NewGroupHandler(groupService, auditService)
+	serviceHandler := handlers.NewServiceHandler(serviceService, auditService)
+	sysHandler := handlers.NewSysHandler(keyRotationService, sealService, auditService)
+	auditHandler := handlers.NewAuditHandler(auditService)
+
+	revealLimiter := middleware.NewRateLimiter(envInt("CREDENTIAL_REVEAL_LIMIT", 30), time.Minute)
+	resetLimiter := middleware.NewRateLimiter(envInt("PASSWORD_RESET_LIMIT", 5), 15*time.Minute)
+	// Login steps after the password, on top of the throttle counting wrong
+	// second factors per account and IP
+	loginStepLimiter := middleware.NewRateLimiter(envInt("LOGIN_STEP_LIMIT", 30), time.Minute)
+	loginStepLimit := middleware.RateLimitPerIP(loginStepLimiter)
+
+	requireAuth := middleware.AuthMiddleware(authService, sessionService, apiTokenService, serviceAccountService)
 
-	authHandler := handlers.NewAuthHandler(authService)
-	credHandler := handlers.NewCredentialHandler(credService)
-	folderHandler := handlers.NewFolderHandler(folderService)
-	documentHandler := handlers.NewDocumentHandler(documentRepo)
-	groupHandler := handlers.NewGroupHandler(groupService)
-	serviceHandler := handlers.NewServiceHandler(serviceService)
+	// Public keys for services that verify our access tokens
+	r.GET("/.well-known/jwks.json", authHandler.JWKS)
 
 	api := r.Group("/api")
+	// Registered before the route groups so it also sees requests they reject
+	api.Use(middleware.AuditRejected(auditService))
 	{
 		auth := api.Group("/auth")
 		{
 			auth.POST("/login", authHandler.Login)
 			// Signup only for admins
-			auth.POST("/signup", middleware.AuthMiddleware(), middleware.AdminMiddleware(), authHandler.Signup)
-			auth.PUT("/change-password", middleware.AuthMiddleware(), authHandler.ChangePassword)
+			auth.POST("/signup", requireAuth, middleware.AdminMiddleware(), authHandler.Signup)
+			auth.PUT("/change-password", requireAuth, authHandler.ChangePassword)
+			auth.GET("/password-policy", authHandler.PasswordPolicy)
+			// Forgotten passwords, and invitations, are set through an emailed link
+			auth.POST("/reset/request", middleware.RateLimitPerIP(resetLimiter), passwordResetHandler.RequestReset)
+			auth.POST("/reset/verify", passwordResetHandler.VerifyToken)
+			auth.POST("/reset", passwordResetHandler.Reset)
+			// Refresh and logout take the refresh token, so they work once the access token has expired
+			auth.POST("/refresh", sessionHandler.Refresh)
+			auth.POST("/logout", sessionHandler.Logout)
+			auth.GET("/sessions", requireAuth, sessionHandler.ListOwn)
+			auth.DELETE("/sessions/:sessionId", requireAuth, sessionHandler.RevokeOwn)
+			// Personal access tokens for automation
+			auth.POST("/tokens", requireAuth, apiTokenHandler.Create)
+			auth.GET("/tokens", requireAuth, apiTokenHandler.ListOwn)
+			auth.DELETE("/tokens/:tokenId", requireAuth, apiTokenHandler.RevokeOwn)
+			// Single sign-on through the OpenID Connect provider, if configured
+			auth.GET("/oidc", authHandler.OIDCInfo)
+			auth.POST("/oidc/begin", authHandler.OIDCBegin)
+			auth.POST("/oidc/callback", loginStepLimit, authHandler.OIDCCallback)
+			// Second login step; these take the challenge token from /login
+			auth.POST("/mfa/verify", loginStepLimit, mfaHandler.Verify)
+			auth.POST("/mfa/setup", loginStepLimit, mfaHandler.Setup)
+			auth.GET("/mfa", requireAuth, mfaHandler.Status)
+			auth.POST("/mfa/totp", requireAuth, mfaHandler.Enroll)
+			auth.POST("/mfa/totp/enable", requireAuth, mfaHandler.Enable)
+			auth.DELETE("/mfa/totp", requireAuth, mfaHandler.Disable)
+			auth.POST("/mfa/recovery-codes", requireAuth, mfaHandler.RegenerateRecoveryCodes)
+			// Security keys and passkeys; login works as the second step or on its own
+			auth.POST("/webauthn/login/begin", loginStepLimit, webauthnHandler.BeginLogin)
+			auth.POST("/webauthn/login/finish", loginStepLimit, webauthnHandler.FinishLogin)
+			auth.POST("/webauthn/register/begin", requireAuth, webauthnHandler.BeginRegistration)
+			auth.POST("/webauthn/register/finish", requireAuth, webauthnHandler.FinishRegistration)
+			auth.GET("/webauthn/credentials", requireAuth, webauthnHandler.List)
+			auth.DELETE("/webauthn/credentials/:credentialId", requireAuth, webauthnHandler.Delete)
+			auth.GET("/policy", requireAuth, middleware.AdminMiddleware(), authHandler.GetPolicy)
+			auth.PUT("/policy", requireAuth, middleware.AdminMiddleware(), authHandler.UpdatePolicy)
 		}
 
 		// User management (admin only)
 		users := api.Group("/users")
-		users.Use(middleware.AuthMiddleware(), middleware.AdminMiddleware())
+		users.Use(requireAuth, middleware.AdminMiddleware())
 		{
 			users.POST("", authHandler.CreateUser)
+			users.POST("/invite", passwordResetHandler.Invite)
+			users.POST("/:id/invite", passwordResetHandler.ResendInvite)
 			users.GET("", authHandler.GetAllUsers)
 			users.PUT("/:id", authHandler.UpdateUser)
 			users.DELETE("/:id", authHandler.DeleteUser)
+			users.GET("/:id/sessions", sessionHandler.ListForUser)
+			users.DELETE("/:id/sessions", sessionHandler.RevokeAllForUser)
+			users.DELETE("/:id/sessions/:sessionId", sessionHandler.RevokeForUser)
+			users.DELETE("/:id/mfa", mfaHandler.Reset)
+			users.POST("/:id/unlock", authHandler.UnlockUser)
+			users.PUT("/:id/status", authHandler.UpdateUserStatus)
+			users.PUT("/:id/expiry", authHandler.UpdateUserExpiry)
+			users.GET("/:id/tokens", apiTokenHandler.ListForUser)
+			users.DELETE("/:id/tokens/:tokenId", apiTokenHandler.RevokeForUser)
+		}
+
+		// Service accounts for automation (admin only)
+		serviceAccounts := api.Group("/service-accounts")
+		serviceAccounts.Use(requireAuth, middleware.AdminMiddleware())
+		{
+			serviceAccounts.POST("", serviceAccountHandler.Create)
+			serviceAccounts.GET("", serviceAccountHandler.GetAll)
+			serviceAccounts.GET("/:id", serviceAccountHandler.GetByID)
+			serviceAccounts.PUT("/:id", serviceAccountHandler.Update)
+			serviceAccounts.DELETE("/:id", serviceAccountHandler.Delete)
+			serviceAccounts.GET("/:id/credentials", serviceAccountHandler.ListCredentials)
+			serviceAccounts.POST("/:id/keys", serviceAccountHandler.CreateKey)
+			serviceAccounts.POST("/:id/certificates", serviceAccountHandler.AddCertificate)
+			serviceAccounts.DELETE("/:id/credentials/:credentialId", serviceAccountHandler.RevokeCredential)
 		}
 
 		// Group management (admin only)
 		groups := api.Group("/groups")
-		groups.Use(middleware.AuthMiddleware(), middleware.AdminMiddleware())
+		groups.Use(requireAuth, middleware.AdminMiddleware())
 		{
 			groups.POST("", groupHandler.Create)
 			groups.GET("", groupHandler.GetAll)
@@ -87,7 +291,7 @@ func main() {
 		}
 
 		folders := api.Group("/folders")
-		folders.Use(middleware.AuthMiddleware())
+		folders.Use(requireAuth)
 		{
 			folders.GET("", folderHandler.GetAll)
 			folders.POST("", middleware.AdminMiddleware(), folderHandler.Create)
@@ -95,18 +299,22 @@ func main() {
 			folders.DELETE("/:id", middleware.AdminMiddleware(), folderHandler.Delete)
 		}
 
+		requireUnsealed := middleware.SealMiddleware(encryptionService.IsSealed)
+
 		credentials := api.Group("/credentials")
-		credentials.Use(middleware.AuthMiddleware())
+		credentials.Use(requireAuth, requireUnsealed)
 		{
 			credentials.POST("", middleware.AdminMiddleware(), credHandler.Create)
 			credentials.GET("", credHandler.GetAll)
 			credentials.GET("/:id", credHandler.GetByID)
 			credentials.PUT("/:id", middleware.AdminMiddleware(), credHandler.Update)
 			credentials.DELETE("/:id", middleware.AdminMiddleware(), credHandler.Delete)
+			credentials.POST("/:id/reveal", middleware.RateLimitPerUser(revealLimiter), credHandler.Reveal)
+			credentials.GET("/:id/reveals", middleware.AdminMiddleware(), credHandler.GetReveals)
 		}
 
 		documents := api.Group("/documents")
-		documents.Use(middleware.AuthMiddleware())
+		documents.Use(requireAuth, requireUnsealed)
 		{
 			documents.POST("", middleware.AdminMiddleware(), documentHandler.Upload)
 			documents.GET("", documentHandler.GetAll)
@@ -117,7 +325,7 @@ func main() {
 		}
 
 		servicesGroup := api.Group("/services")
-		servicesGroup.Use(middleware.AuthMiddleware())
+		servicesGroup.Use(requireAuth)
 		{
 			servicesGroup.POST("", middleware.AdminMiddleware(), serviceHandler.Create)
 			servicesGroup.GET("", serviceHandler.GetAll)
@@ -125,6 +333,34 @@ func main() {
 			servicesGroup.PUT("/:id", middleware.AdminMiddleware(), serviceHandler.Update)
 			servicesGroup.DELETE("/:id", middleware.AdminMiddleware(), serviceHandler.Delete)
 		}
+
+		// Audit log (admin only)
+		audit := api.Group("/audit")
+		audit.Use(requireAuth, middleware.AdminMiddleware())
+		{
+			audit.GET("/events", auditHandler.Query)
+			audit.GET("/verify", auditHandler.Verify)
+		}
+
+		sys := api.Group("/sys")
+		{
+			// Key holders submit unseal shares without needing an account
+			sys.GET("/seal-status", sysHandler.SealStatus)
+			sys.POST("/unseal", sysHandler.Unseal)
+
+			// Key management (admin only)
+			sys.POST("/init", requireAuth, middleware.AdminMiddleware(), sysHandler.Init)
+			sys.POST("/seal", requireAuth, middleware.AdminMiddleware(), sysHandler.Seal)
+			sys.POST("/rewrap", requireAuth, middleware.AdminMiddleware(), sysHandler.StartRewrap)
+			sys.GET("/rewrap", requireAuth, middleware.AdminMiddleware(), sysHandler.RewrapStatus)
+
+			// LDAP group sync (admin only), if LDAP is configured
+			if ldapSyncService != nil {
+				directoryHandler := handlers.NewDirectoryHandler(ldapSyncService, auditService)
+				sys.POST("/directory-sync", requireAuth, middleware.AdminMiddleware(), directoryHandler.Sync)
+				sys.GET("/directory-sync", requireAuth, middleware.AdminMiddleware(), directoryHandler.Status)
+			}
+		}
 	}
 
 	port := os.Getenv("PORT")
@@ -132,8 +368,132 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	r.Run(":" + port)
+	serve(r, port)
+}
+
+// serve listens on port, over HTTPS if TLS_CERT_FILE and TLS_KEY_FILE are set.
+// Clients may then present a certificate to sign in as a service account; with
+// TLS_CLIENT_CA_FILE it must also be issued by one of those CAs.
+func serve(r *gin.Engine, port string) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		log.Printf("Server starting on port %s", port)
+		r.Run(":" + port)
+		return
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: tls.RequestClientCert}
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatal("Failed to read TLS_CLIENT_CA_FILE: ", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			log.Fatal("TLS_CLIENT_CA_FILE contains no certificates")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	server := &http.Server{Addr: ":" + port, Handler: r, TLSConfig: tlsConfig}
+	log.Printf("Server starting on port %s with TLS", port)
+	log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+}
+
+// envInt reads an integer setting, falling back to def when it is unset.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s must be an integer", name)
+	}
+	return value
+}
+
+// envDuration reads a duration setting such as "5m", falling back to def when
+// it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		log.Fatalf("%s must be a positive duration such as 5m", name)
+	}
+	return value
+}
+
+// initAuditSinks streams audit events to the syslog collector and/or file
+// configured in the environment, on top of the database.
+func initAuditSinks(auditService *services.AuditService) {
+	buffer := envInt("AUDIT_SINK_BUFFER", 10000)
+
+	if addr := os.Getenv("AUDIT_SYSLOG_ADDR"); addr != "" {
+		format, err := services.AuditFormatterByName(envString("AUDIT_SYSLOG_FORMAT", "cef"))
+		if err != nil {
+			log.Fatal("AUDIT_SYSLOG_FORMAT: ", err)
+		}
+		sink, err := services.NewSyslogAuditSink(addr, format, os.Getenv("AUDIT_SYSLOG_CA_FILE"))
+		if err != nil {
+			log.Fatal("Failed to configure syslog audit sink: ", err)
+		}
+		auditService.AddSink("syslog", sink, buffer)
+		log.Printf("Streaming audit events to syslog at %s", addr)
+	}
+
+	if path := os.Getenv("AUDIT_FILE_PATH"); path != "" {
+		format, err := services.AuditFormatterByName(envString("AUDIT_FILE_FORMAT", "json"))
+		if err != nil {
+			log.Fatal("AUDIT_FILE_FORMAT: ", err)
+		}
+		maxBytes := int64(envInt("AUDIT_FILE_MAX_SIZE_MB", 100)) << 20
+		sink, err := services.NewFileAuditSink(path, format, maxBytes, envInt("AUDIT_FILE_MAX_BACKUPS", 10))
+		if err != nil {
+			log.Fatal("Failed to open audit log file: ", err)
+		}
+		auditService.AddSink("file", sink, buffer)
+		log.Printf("Writing audit events to %s", path)
+	}
+}
+
+// envString reads a setting, falling back to def when it is unset.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// initEncryption loads the master key-ring, or starts sealed when SEAL_MODE=shamir
+// so the key only ever arrives through /api/sys/unseal.
+func initEncryption() *services.EncryptionService {
+	var encryptionService *services.EncryptionService
+	if os.Getenv("SEAL_MODE") == "shamir" {
+		log.Println("Starting sealed; submit unseal shares to /api/sys/unseal")
+		encryptionService = services.NewSealedEncryptionService()
+	} else {
+		keyProvider, err := services.NewKeyProviderFromEnv()
+		if err != nil {
+			log.Fatal("Failed to configure key provider:", err)
+		}
+		encryptionService, err = services.NewEncryptionService(keyProvider)
+		if err != nil {
+			log.Fatal("Failed to load encryption keys:", err)
+		}
+	}
+
+	// Rows from before per-record binding stay readable until a re-wrap has
+	// moved them over
+	if os.Getenv("ENCRYPTION_REQUIRE_AAD") == "false" {
+		log.Println("Accepting ciphertexts not bound to their record until the next clean re-wrap")
+		encryptionService.AllowUnbound(true)
+	}
+	return encryptionService
 }
 
 func initDB() *sql.DB {
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const errOutsideTokenFolder = "this API token is limited to another folder"
+
+type APITokenHandler struct {
+	apiTokenService *services.APITokenService
+	authService     *services.AuthService
+	auditService    *services.AuditService
+}
+
+func NewAPITokenHandler(apiTokenService *services.APITokenService, authService *services.AuthService,
+	auditService *services.AuditService) *APITokenHandler {
+	return &APITokenHandler{
+		apiTokenService: apiTokenService,
+		authService:     authService,
+		auditService:    auditService,
+	}
+}
+
+// Create issues a personal access token for the caller. The token is in this
+// response only.
+func (h *APITokenHandler) Create(c *gin.Context) {
+	var req models.CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API token"})
+		return
+	}
+
+	resp, err := h.apiTokenService.Create(user, &req)
+	details := "name=" + req.Name + " scopes=" + strings.Join(req.Scopes, ",") + folderAuditDetails(req.FolderID)
+	if err != nil {
+		recordAudit(h.auditService, c, "api_token.create", "api_token", nil, services.AuditFailure,
+			details+": "+err.Error())
+		if errors.Is(err, services.ErrInvalidTokenScope) || errors.Is(err, services.ErrAPITokenLifetime) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API token"})
+		return
+	}
+	recordAudit(h.auditService, c, "api_token.create", "api_token", resp.APIToken.ID, services.AuditSuccess, details)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, resp)
+}
+
+// ListOwn lists the caller's API tokens.
+func (h *APITokenHandler) ListOwn(c *gin.Context) {
+	h.list(c, c.GetInt("user_id"))
+}
+
+// RevokeOwn revokes one of the caller's API tokens.
+func (h *APITokenHandler) RevokeOwn(c *gin.Context) {
+	h.revoke(c, c.GetInt("user_id"))
+}
+
+// ListForUser lists another user's API tokens (admin).
+func (h *APITokenHandler) ListForUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.list(c, userID)
+}
+
+// RevokeForUser revokes one of another user's API tokens (admin).
+func (h *APITokenHandler) RevokeForUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.revoke(c, userID)
+}
+
+func (h *APITokenHandler) list(c *gin.Context, userID int) {
+	tokens, err := h.apiTokenService.List(userID)
+	recordAudit(h.auditService, c, "api_token.list", "user", userID, auditOutcome(err), auditError(err))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch API tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *APITokenHandler) revoke(c *gin.Context, userID int) {
+	tokenID, err := strconv.Atoi(c.Param("tokenId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	err = h.apiTokenService.Revoke(userID, tokenID)
+	recordAudit(h.auditService, c, "api_token.revoke", "api_token", tokenID, auditOutcome(err), auditError(err))
+	if errors.Is(err, services.ErrAPITokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API token"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// tokenFolder returns the folder the request's API token is limited to, if
+// any.
+func tokenFolder(c *gin.Context) (int, bool) {
+	folderID, ok := c.Get("api_token_folder_id")
+	if !ok {
+		return 0, false
+	}
+	return folderID.(int), true
+}
@@ -3,17 +3,39 @@ package handlers
 import (
 	"credential-store/internal/models"
 	"credential-store/internal/services"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type AuthHandler struct {
-	authService *services.AuthService
+	authService    *services.AuthService
+	sessionService *services.SessionService
+	mfaService     *services.MFAService
+	oidcService    *services.OIDCService
+	loginThrottle  *services.LoginThrottleService
+	auditService   *services.AuditService
 }
 
-func NewAuthHandler(authService *services.AuthService) *AuthHandler {
-	return &AuthHandler{authService: authService}
+// NewAuthHandler takes a nil oidcService when single sign-on is not
+// configured.
+func NewAuthHandler(authService *services.AuthService, sessionService *services.SessionService,
+	mfaService *services.MFAService, oidcService *services.OIDCService, loginThrottle *services.LoginThrottleService,
+	auditService *services.AuditService) *AuthHandler {
+	return &AuthHandler{
+		authService:    authService,
+		sessionService: sessionService,
+		mfaService:     mfaService,
+		oidcService:    oidcService,
+		loginThrottle:  loginThrottle,
+		auditService:   auditService,
+	}
 }
 
 func (h *AuthHandler) Signup(c *gin.Context) {
@@ -25,20 +47,25 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 
 	user, err := h.authService.Signup(&req)
 	if err != nil {
+		recordAudit(h.auditService, c, "user.create", "user", req.Email, services.AuditFailure, err.Error())
+		if passwordRejected(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
 		return
 	}
+	recordAudit(h.auditService, c, "user.create", "user", user.ID, services.AuditSuccess, userAuditDetails(user))
 
-	token, err := h.authService.GenerateToken(user)
+	// The new user's token belongs to a session like any other login's, so
+	// logging out or revoking their sessions ends it
+	resp, err := h.sessionService.Start(user, services.AuthMethodPassword, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		sessionStartError(h.auditService, c, user, err)
 		return
 	}
+	recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditSuccess, "signup")
 
-	c.JSON(http.StatusCreated, models.AuthResponse{
-		Token: token,
-		User:  *user,
-	})
+	c.JSON(http.StatusCreated, resp)
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -48,16 +75,231 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	user, token, err := h.authService.Login(&req)
+	// Throttled before the password is checked, and alike for every email,
+	// so a locked out login learns nothing
+	attempt, ok := reserveLogin(h.loginThrottle, h.auditService, c, req.Email, "auth.login")
+	if !ok {
+		return
+	}
+
+	user, change, err := h.authService.Login(&req)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		loginFailed(h.loginThrottle, h.auditService, c, req.Email, attempt)
+	} else if err != nil {
+		releaseLogin(h.loginThrottle, attempt)
+	}
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		outcome, status, message := services.AuditFailure, http.StatusInternalServerError, "failed to log in"
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			status, message = http.StatusUnauthorized, err.Error()
+		case errors.Is(err, services.ErrAccountSuspended), errors.Is(err, services.ErrAccountExpired),
+			errors.Is(err, services.ErrNoMappedGroup), errors.Is(err, services.ErrExternalAccountConflict),
+			errors.Is(err, services.ErrLocalAccountConflict):
+			outcome, status, message = services.AuditDenied, http.StatusForbidden, err.Error()
+		case errors.Is(err, services.ErrDirectoryUnavailable):
+			status, message = http.StatusServiceUnavailable, err.Error()
+		}
+		recordAudit(h.auditService, c, "auth.login", "user", req.Email, outcome, err.Error())
+		c.JSON(status, gin.H{"error": message})
 		return
 	}
+	h.auditProvisioning(c, user, change)
 
-	c.JSON(http.StatusOK, models.AuthResponse{
-		Token: token,
-		User:  *user,
-	})
+	h.completeLogin(c, user, services.AuthMethodPassword, "auth.password", attempt)
+}
+
+// completeLogin follows a successful first factor (method, audited as
+// action): it answers with the MFA challenge when the user needs a second
+// factor, and opens the session otherwise. The throttled attempt, if any,
+// only counts as a success once the session is open.
+func (h *AuthHandler) completeLogin(c *gin.Context, user *models.User, method, action string,
+	attempt *services.LoginAttempt) {
+	// The request is unauthenticated; attribute the event to the user who
+	// just logged in
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+
+	challenge, err := h.mfaService.Challenge(user)
+	if err != nil || challenge != nil {
+		// Failures so far stay counted until the second factor is verified
+		releaseLogin(h.loginThrottle, attempt)
+	}
+	if errors.Is(err, services.ErrPhishingResistantRequired) {
+		recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditDenied, err.Error())
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditFailure, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log in"})
+		return
+	}
+	if challenge != nil {
+		// No session until the second factor is verified
+		recordAudit(h.auditService, c, action, "user", user.ID, services.AuditSuccess, "mfa required")
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
+
+	resp, err := h.sessionService.Start(user, method, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		releaseLogin(h.loginThrottle, attempt)
+		sessionStartError(h.auditService, c, user, err)
+		return
+	}
+	loginSucceeded(h.loginThrottle, user, attempt)
+	details := ""
+	if method != services.AuthMethodPassword {
+		details = "method=" + method
+	}
+	recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditSuccess, details)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// reserveLogin reserves a login attempt for email, which is "" when the
+// account is not known yet, from the client. A throttled attempt is answered
+// with 429 and audited as action.
+func reserveLogin(throttle *services.LoginThrottleService, audit *services.AuditService, c *gin.Context,
+	email, action string) (*services.LoginAttempt, bool) {
+	attempt, wait, scope, err := throttle.Attempt(email, c.ClientIP())
+	if err != nil {
+		recordAudit(audit, c, action, "user", email, services.AuditFailure, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log in"})
+		return nil, false
+	}
+	if wait > 0 {
+		recordAudit(audit, c, action, "user", email, services.AuditDenied, "throttled by "+scope)
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": services.ErrLoginThrottled.Error()})
+		return nil, false
+	}
+	return attempt, true
+}
+
+// loginFailed settles an attempt with a wrong password or second factor as
+// failed, and records any lockout it causes.
+func loginFailed(throttle *services.LoginThrottleService, audit *services.AuditService, c *gin.Context,
+	email string, attempt *services.LoginAttempt) {
+	locked, err := throttle.Fail(attempt)
+	if err != nil {
+		log.Printf("Failed to record failed login: %v", err)
+	}
+	for _, scope := range locked {
+		if scope == services.ThrottleIP {
+			recordAudit(audit, c, "auth.lockout", "ip", c.ClientIP(), services.AuditDenied, "email="+email)
+		} else {
+			recordAudit(audit, c, "auth.lockout", "user", email, services.AuditDenied, "")
+		}
+	}
+}
+
+// releaseLogin takes back an attempt that neither failed nor finished the
+// login. attempt is nil for logins that aren't throttled.
+func releaseLogin(throttle *services.LoginThrottleService, attempt *services.LoginAttempt) {
+	if attempt == nil {
+		return
+	}
+	if err := throttle.Release(attempt); err != nil {
+		log.Printf("Failed to release login attempt: %v", err)
+	}
+}
+
+// loginSucceeded forgets the failed logins of a user who now has a session.
+func loginSucceeded(throttle *services.LoginThrottleService, user *models.User, attempt *services.LoginAttempt) {
+	if attempt == nil {
+		return
+	}
+	if err := throttle.Succeed(attempt); err != nil {
+		log.Printf("Failed to reset failed logins of user %d: %v", user.ID, err)
+	}
+}
+
+// OIDCInfo tells the login page whether to offer single sign-on.
+func (h *AuthHandler) OIDCInfo(c *gin.Context) {
+	if h.oidcService == nil {
+		c.JSON(http.StatusOK, models.OIDCInfo{Enabled: false})
+		return
+	}
+	c.JSON(http.StatusOK, models.OIDCInfo{Enabled: true, Name: h.oidcService.Name()})
+}
+
+// OIDCBegin starts a single sign-on login.
+func (h *AuthHandler) OIDCBegin(c *gin.Context) {
+	if h.oidcService == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	resp, err := h.oidcService.Begin()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// OIDCCallback completes a single sign-on login with the code and state the
+// identity provider redirected back with.
+func (h *AuthHandler) OIDCCallback(c *gin.Context) {
+	if h.oidcService == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+		return
+	}
+
+	var req models.OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, change, err := h.oidcService.Complete(&req)
+	if err != nil {
+		outcome := services.AuditFailure
+		if errors.Is(err, services.ErrNoMappedGroup) || errors.Is(err, services.ErrOIDCUnverified) ||
+			errors.Is(err, services.ErrExternalAccountConflict) || errors.Is(err, services.ErrLocalAccountConflict) ||
+			errors.Is(err, services.ErrAccountSuspended) || errors.Is(err, services.ErrAccountExpired) {
+			outcome = services.AuditDenied
+		}
+		recordAudit(h.auditService, c, "auth.oidc", "", nil, outcome, err.Error())
+		switch {
+		case errors.Is(err, services.ErrOIDCFlow), errors.Is(err, services.ErrOIDCFailed):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case outcome == services.AuditDenied:
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log in"})
+		}
+		return
+	}
+	h.auditProvisioning(c, user, change)
+
+	h.completeLogin(c, user, services.AuthMethodOIDC, "auth.oidc", nil)
+}
+
+// auditProvisioning records the account an identity provider's login created
+// or updated, attributed to that user.
+func (h *AuthHandler) auditProvisioning(c *gin.Context, user *models.User, change string) {
+	if change == "" {
+		return
+	}
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+	recordAudit(h.auditService, c, change, "user", user.ID, services.AuditSuccess,
+		userAuditDetails(user)+" source="+user.AuthSource)
+}
+
+// sessionStartError answers a login whose session could not be opened.
+func sessionStartError(audit *services.AuditService, c *gin.Context, user *models.User, err error) {
+	if errors.Is(err, services.ErrAccountSuspended) || errors.Is(err, services.ErrAccountExpired) {
+		recordAudit(audit, c, "auth.login", "user", user.ID, services.AuditDenied, err.Error())
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(audit, c, "auth.login", "user", user.ID, services.AuditFailure, err.Error())
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start session"})
 }
 
 func (h *AuthHandler) CreateUser(c *gin.Context) {
@@ -69,19 +311,35 @@ func (h *AuthHandler) CreateUser(c *gin.Context) {
 
 	user, err := h.authService.Signup(&req)
 	if err != nil {
+		recordAudit(h.auditService, c, "user.create", "user", req.Email, services.AuditFailure, err.Error())
+		if passwordRejected(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
 		return
 	}
+	recordAudit(h.auditService, c, "user.create", "user", user.ID, services.AuditSuccess, userAuditDetails(user))
 
 	c.JSON(http.StatusCreated, user)
 }
 
 func (h *AuthHandler) GetAllUsers(c *gin.Context) {
 	users, err := h.authService.GetAllUsers()
+	var locked map[int]time.Time
+	if err == nil {
+		locked, err = h.loginThrottle.LockedOut(users)
+	}
+	recordAudit(h.auditService, c, "user.list", "user", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch users"})
 		return
 	}
+	for i := range users {
+		if until, ok := locked[users[i].ID]; ok {
+			users[i].LockedUntil = &until
+		}
+		users[i].PendingInvite = users[i].AuthSource == services.AuthSourceLocal && users[i].Password == ""
+	}
 
 	c.JSON(http.StatusOK, users)
 }
@@ -96,16 +354,31 @@ func (h *AuthHandler) UpdateUser(c *gin.Context) {
 
 	user, err := h.authService.UpdateUser(id, &req)
 	if err != nil {
+		recordAudit(h.auditService, c, "user.update", "user", id, services.AuditFailure, err.Error())
+		if passwordRejected(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
 		return
 	}
+	details := userAuditDetails(user)
+	if req.Password != "" {
+		details += " password=changed"
+		// A password reset also ends every session the old password opened
+		if _, err := h.sessionService.RevokeAll(user.ID, services.SessionPasswordChange); err != nil {
+			details += " (failed to revoke sessions: " + err.Error() + ")"
+		}
+	}
+	recordAudit(h.auditService, c, "user.update", "user", id, services.AuditSuccess, details)
 
 	c.JSON(http.StatusOK, user)
 }
 
 func (h *AuthHandler) DeleteUser(c *gin.Context) {
 	id := c.Param("id")
-	if err := h.authService.DeleteUser(id); err != nil {
+	err := h.authService.DeleteUser(id)
+	recordAudit(h.auditService, c, "user.delete", "user", id, auditOutcome(err), auditError(err))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user"})
 		return
 	}
@@ -113,6 +386,118 @@ func (h *AuthHandler) DeleteUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
 }
 
+// UnlockUser lifts a login lockout and forgets the user's failed logins.
+func (h *AuthHandler) UnlockUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	unlocked, err := h.loginThrottle.Unlock(id)
+	details := auditError(err)
+	if err == nil && !unlocked {
+		details = "no failed logins"
+	}
+	recordAudit(h.auditService, c, "user.unlock", "user", id, auditOutcome(err), details)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user unlocked"})
+}
+
+// UpdateUserStatus suspends or reactivates a user (admin). Suspending ends
+// the user's sessions; admins can't suspend themselves.
+func (h *AuthHandler) UpdateUserStatus(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req models.UpdateUserStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	action := "user.reactivate"
+	if req.Status == services.UserSuspended {
+		action = "user.suspend"
+		if id == c.GetInt("user_id") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you can't suspend your own account"})
+			return
+		}
+	}
+
+	user, err := h.authService.UpdateStatus(id, req.Status)
+	if err != nil {
+		recordAudit(h.auditService, c, action, "user", id, services.AuditFailure, err.Error())
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		case errors.Is(err, services.ErrAccountExpired):
+			c.JSON(http.StatusConflict, gin.H{"error": "the account has expired; move its expiry date first"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user status"})
+		}
+		return
+	}
+	details := ""
+	if req.Status == services.UserSuspended {
+		details = "reason=" + services.SuspendedByAdmin
+		if _, err := h.sessionService.RevokeAll(id, services.SessionSuspended); err != nil {
+			details += " (failed to revoke sessions: " + err.Error() + ")"
+		}
+	}
+	recordAudit(h.auditService, c, action, "user", id, services.AuditSuccess, details)
+
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateUserExpiry sets or clears the date a user's account stops working
+// (admin).
+func (h *AuthHandler) UpdateUserExpiry(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req models.UpdateUserExpiryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && id == c.GetInt("user_id") && !time.Now().Before(*req.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you can't expire your own account"})
+		return
+	}
+
+	user, err := h.authService.SetExpiry(id, req.ExpiresAt)
+	details := "expires_at=never"
+	if req.ExpiresAt != nil {
+		details = "expires_at=" + req.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if err != nil {
+		details = err.Error()
+	}
+	recordAudit(h.auditService, c, "user.expiry", "user", id, auditOutcome(err), details)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user expiry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
 func (h *AuthHandler) ChangePassword(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -126,11 +511,108 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
-	if err := h.authService.ChangePassword(userID.(int), req.CurrentPassword, req.NewPassword); err != nil {
+	err := h.authService.ChangePassword(userID.(int), req.CurrentPassword, req.NewPassword)
+	recordAudit(h.auditService, c, "auth.password_change", "user", userID, auditOutcome(err), auditError(err))
+	if passwordRejected(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The change invalidated every token of the user, including the one used
+	// for this request; end the other sessions and hand this client a new one,
+	// authenticated the same way as the one it replaces
+	method, err := h.sessionService.AuthMethod(c.GetInt("session_id"))
+	if err != nil {
+		method = services.AuthMethodPassword
+	}
+	if _, err := h.sessionService.RevokeAll(userID.(int), services.SessionPasswordChange); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password changed, but failed to end other sessions"})
+		return
+	}
+	user, err := h.authService.GetUser(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password changed; please log in again"})
+		return
+	}
+	resp, err := h.sessionService.Start(user, method, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password changed; please log in again"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Password changed successfully",
+		"token":         resp.Token,
+		"refresh_token": resp.RefreshToken,
+		"expires_in":    resp.ExpiresIn,
+	})
+}
+
+// JWKS publishes the keys that verify access tokens, including those
+// scheduled to sign later.
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=900")
+	c.Data(http.StatusOK, "application/json", h.authService.JWKS())
+}
+
+// PasswordPolicy tells clients what new passwords must look like.
+func (h *AuthHandler) PasswordPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, h.authService.PasswordPolicy())
+}
+
+// passwordRejected answers with the broken rules if err is a password policy
+// violation, and reports whether it did.
+func passwordRejected(c *gin.Context, err error) bool {
+	var policyErr *services.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "password does not meet the policy", "violations": policyErr.Violations})
+	return true
+}
+
+// GetPolicy returns the login policy (admin).
+func (h *AuthHandler) GetPolicy(c *gin.Context) {
+	policy, err := h.authService.Policy()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// UpdatePolicy changes the login policy (admin).
+func (h *AuthHandler) UpdatePolicy(c *gin.Context) {
+	var req models.UpdateAuthPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+	policy, withoutKeys, err := h.authService.UpdatePolicy(c.GetInt("user_id"), &req)
+	if err != nil {
+		recordAudit(h.auditService, c, "auth.policy_update", "auth_policy", nil, services.AuditFailure, err.Error())
+		if errors.Is(err, services.ErrNoSecurityKey) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update policy"})
+		return
+	}
+	recordAudit(h.auditService, c, "auth.policy_update", "auth_policy", nil, services.AuditSuccess,
+		fmt.Sprintf("admin_require_phishing_resistant=%t", policy.AdminRequirePhishingResistant))
+
+	c.JSON(http.StatusOK, gin.H{
+		"policy":                     policy,
+		"admins_without_security_key": withoutKeys,
+	})
 }
 
+// userAuditDetails describes the access a user account grants.
+func userAuditDetails(user *models.User) string {
+	return fmt.Sprintf("email=%s role=%s group=%s", user.Email, user.Role, user.UserGroup)
+}
@@ -3,18 +3,23 @@ package handlers
 import (
 	"credential-store/internal/models"
 	"credential-store/internal/services"
+	"database/sql"
+	"errors"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 type CredentialHandler struct {
-	credService *services.CredentialService
+	credService  *services.CredentialService
+	auditService *services.AuditService
 }
 
-func NewCredentialHandler(credService *services.CredentialService) *CredentialHandler {
-	return &CredentialHandler{credService: credService}
+func NewCredentialHandler(credService *services.CredentialService, auditService *services.AuditService) *CredentialHandler {
+	return &CredentialHandler{credService: credService, auditService: auditService}
 }
 
 func (h *CredentialHandler) Create(c *gin.Context) {
@@ -24,28 +29,49 @@ func (h *CredentialHandler) Create(c *gin.Context) {
 		return
 	}
 
+	if folderID, limited := tokenFolder(c); limited && (req.FolderID == nil || *req.FolderID != folderID) {
+		recordAudit(h.auditService, c, "credential.create", "credential", nil, services.AuditDenied,
+			"outside the API token's folder")
+		c.JSON(http.StatusForbidden, gin.H{"error": errOutsideTokenFolder})
+		return
+	}
+
 	userID := c.GetInt("user_id")
 	cred, err := h.credService.Create(userID, &req)
 	if err != nil {
+		recordAudit(h.auditService, c, "credential.create", "credential", nil, services.AuditFailure, err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create credential: " + err.Error()})
 		return
 	}
 
+	recordAudit(h.auditService, c, "credential.create", "credential", cred.ID, services.AuditSuccess,
+		"service="+cred.ServiceName+folderAuditDetails(cred.FolderID))
+
 	c.JSON(http.StatusCreated, cred)
 }
 
 func (h *CredentialHandler) GetAll(c *gin.Context) {
-	userID := c.GetInt("user_id")
 	role := c.GetString("role")
 	userGroup := c.GetString("user_group")
 	isAdmin := role == "admin"
 
-	credentials, err := h.credService.GetAll(userID, isAdmin, userGroup)
+	credentials, err := h.credService.GetAll(isAdmin, userGroup)
+	recordAudit(h.auditService, c, "credential.list", "credential", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch credentials"})
 		return
 	}
 
+	if folderID, limited := tokenFolder(c); limited {
+		inFolder := make([]models.CredentialSummary, 0, len(credentials))
+		for _, cred := range credentials {
+			if cred.FolderID != nil && *cred.FolderID == folderID {
+				inFolder = append(inFolder, cred)
+			}
+		}
+		credentials = inFolder
+	}
+
 	c.JSON(http.StatusOK, credentials)
 }
 
@@ -56,13 +82,29 @@ func (h *CredentialHandler) GetByID(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetInt("user_id")
+	if h.outsideTokenFolder(c, "credential.read", id) {
+		return
+	}
+
 	role := c.GetString("role")
+	userGroup := c.GetString("user_group")
 	isAdmin := role == "admin"
 
-	cred, err := h.credService.GetByID(id, userID, isAdmin)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	cred, err := h.credService.GetByID(id, isAdmin, userGroup)
+	outcome := auditOutcome(err)
+	if errors.Is(err, services.ErrCredentialAccessDenied) {
+		outcome = services.AuditDenied
+	}
+	recordAudit(h.auditService, c, "credential.read", "credential", id, outcome, auditError(err))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		return
+	case errors.Is(err, services.ErrCredentialAccessDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch credential"})
 		return
 	}
 
@@ -82,11 +124,23 @@ func (h *CredentialHandler) Update(c *gin.Context) {
 		return
 	}
 
+	if h.outsideTokenFolder(c, "credential.update", id) {
+		return
+	}
+	// Nor may the token move it out
+	if folderID, limited := tokenFolder(c); limited && req.FolderID != nil && *req.FolderID != folderID {
+		recordAudit(h.auditService, c, "credential.update", "credential", id, services.AuditDenied,
+			"outside the API token's folder")
+		c.JSON(http.StatusForbidden, gin.H{"error": errOutsideTokenFolder})
+		return
+	}
+
 	userID := c.GetInt("user_id")
 	role := c.GetString("role")
 	isAdmin := role == "admin"
 
 	cred, err := h.credService.Update(id, userID, isAdmin, &req)
+	recordAudit(h.auditService, c, "credential.update", "credential", id, auditOutcome(err), credentialUpdateDetails(&req, err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -106,10 +160,142 @@ func (h *CredentialHandler) Delete(c *gin.Context) {
 	role := c.GetString("role")
 	isAdmin := role == "admin"
 
-	if err := h.credService.Delete(id, userID, isAdmin); err != nil {
+	if h.outsideTokenFolder(c, "credential.delete", id) {
+		return
+	}
+
+	err = h.credService.Delete(id, userID, isAdmin)
+	recordAudit(h.auditService, c, "credential.delete", "credential", id, auditOutcome(err), auditError(err))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "credential deleted"})
 }
+
+func (h *CredentialHandler) Reveal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	var req models.RevealCredentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if h.outsideTokenFolder(c, "credential.reveal", id) {
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	isAdmin := c.GetString("role") == "admin"
+	userGroup := c.GetString("user_group")
+
+	revealed, err := h.credService.Reveal(id, userID, c.GetInt("service_account_id"), isAdmin, userGroup, req.Field,
+		c.ClientIP())
+	outcome, details := auditOutcome(err), "field="+req.Field
+	if errors.Is(err, services.ErrCredentialAccessDenied) {
+		outcome = services.AuditDenied
+	}
+	if err != nil {
+		details += ": " + err.Error()
+	}
+	recordAudit(h.auditService, c, "credential.reveal", "credential", id, outcome, details)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		return
+	case errors.Is(err, services.ErrCredentialAccessDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrIntegrity):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reveal credential"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, revealed)
+}
+
+func (h *CredentialHandler) GetReveals(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	if h.outsideTokenFolder(c, "credential.reveals.list", id) {
+		return
+	}
+
+	reveals, err := h.credService.GetReveals(id)
+	recordAudit(h.auditService, c, "credential.reveals.list", "credential", id, auditOutcome(err), auditError(err))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch reveal history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reveals)
+}
+
+// outsideTokenFolder answers the request and returns true when it comes with
+// an API token limited to a folder the credential is not in.
+func (h *CredentialHandler) outsideTokenFolder(c *gin.Context, action string, id int) bool {
+	folderID, limited := tokenFolder(c)
+	if !limited {
+		return false
+	}
+
+	credFolder, err := h.credService.FolderOf(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		return true
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch credential"})
+		return true
+	}
+	if credFolder == nil || *credFolder != folderID {
+		recordAudit(h.auditService, c, action, "credential", id, services.AuditDenied, "outside the API token's folder")
+		c.JSON(http.StatusForbidden, gin.H{"error": errOutsideTokenFolder})
+		return true
+	}
+	return false
+}
+
+func folderAuditDetails(folderID *int) string {
+	if folderID == nil {
+		return ""
+	}
+	return " folder=" + strconv.Itoa(*folderID)
+}
+
+// credentialUpdateDetails names the fields an update replaced, never their values.
+func credentialUpdateDetails(req *models.UpdateCredentialRequest, err error) string {
+	var changed []string
+	for field, set := range map[string]bool{
+		"service_name": req.ServiceName != "",
+		"username":     req.Username != "",
+		"password":     req.Password != "",
+		"notes":        req.Notes != "",
+	} {
+		if set {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+
+	details := "changed=" + strings.Join(changed, ",") + folderAuditDetails(req.FolderID)
+	if err != nil {
+		details += ": " + err.Error()
+	}
+	return details
+}
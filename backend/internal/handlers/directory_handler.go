@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"credential-store/internal/services"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DirectoryHandler struct {
+	syncService  *services.LDAPSyncService
+	auditService *services.AuditService
+}
+
+func NewDirectoryHandler(syncService *services.LDAPSyncService, auditService *services.AuditService) *DirectoryHandler {
+	return &DirectoryHandler{
+		syncService:  syncService,
+		auditService: auditService,
+	}
+}
+
+// Sync runs a directory sync now rather than waiting for the next interval.
+func (h *DirectoryHandler) Sync(c *gin.Context) {
+	report, err := h.syncService.Sync()
+	recordAudit(h.auditService, c, "sys.directory_sync.start", "", nil, auditOutcome(err), auditError(err))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrDirectorySyncInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrDirectoryUnavailable):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *DirectoryHandler) Status(c *gin.Context) {
+	c.JSON(http.StatusOK, h.syncService.Status())
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,12 +19,14 @@ import (
 )
 
 type DocumentHandler struct {
-	repo      *repository.DocumentRepository
-	s3Service *services.S3Service
-	useS3     bool
+	repo       *repository.DocumentRepository
+	encryption *services.EncryptionService
+	audit      *services.AuditService
+	s3Service  *services.S3Service
+	useS3      bool
 }
 
-func NewDocumentHandler(repo *repository.DocumentRepository) *DocumentHandler {
+func NewDocumentHandler(repo *repository.DocumentRepository, encryption *services.EncryptionService, audit *services.AuditService) *DocumentHandler {
 	// Try to initialize S3 service
 	s3Service, err := services.NewS3Service()
 	useS3 := err == nil && s3Service != nil
@@ -37,9 +41,11 @@ func NewDocumentHandler(repo *repository.DocumentRepository) *DocumentHandler {
 	}
 
 	return &DocumentHandler{
-		repo:      repo,
-		s3Service: s3Service,
-		useS3:     useS3,
+		repo:       repo,
+		encryption: encryption,
+		audit:      audit,
+		s3Service:  s3Service,
+		useS3:      useS3,
 	}
 }
 
@@ -64,18 +70,41 @@ func (h *DocumentHandler) Upload(c *gin.Context) {
 	ext := filepath.Ext(header.Filename)
 	filename := fmt.Sprintf("%d_%s%s", time.Now().Unix(), strconv.Itoa(int(time.Now().UnixNano())), ext)
 
-	var fileSize int64
+	docID, err := h.repo.NextID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document info"})
+		return
+	}
 
-	if h.useS3 {
-		// Upload to S3
-		fileBytes, err := io.ReadAll(file)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
-			return
-		}
-		fileSize = int64(len(fileBytes))
+	// Every document gets its own data key, wrapped by the master key and
+	// bound to the document
+	dataKey, err := services.NewDataKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt file"})
+		return
+	}
+	defer wipeKey(dataKey)
+
+	wrappedKey, err := h.encryption.WrapKeyWithAAD(dataKey, services.DocumentKeyAAD(docID))
+	if errors.Is(err, services.ErrSealed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "vault is sealed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt file"})
+		return
+	}
 
-		err = h.s3Service.UploadFromBytes(filename, fileBytes, header.Header.Get("Content-Type"))
+	plaintext := &countingReader{r: file}
+	encrypted, err := services.NewEncryptingReader(dataKey, plaintext)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt file"})
+		return
+	}
+
+	if h.useS3 {
+		// Upload to S3; the object is ciphertext, so its content type is opaque
+		err = h.s3Service.Upload(filename, encrypted, "application/octet-stream")
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload to S3"})
 			return
@@ -92,7 +121,7 @@ func (h *DocumentHandler) Upload(c *gin.Context) {
 		}
 		defer dst.Close()
 
-		fileSize, err = io.Copy(dst, file)
+		_, err = io.Copy(dst, encrypted)
 		if err != nil {
 			os.Remove(filePath)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
@@ -105,12 +134,14 @@ func (h *DocumentHandler) Upload(c *gin.Context) {
 
 	// Save to database
 	doc := &models.Document{
+		ID:               docID,
 		Filename:         filename,
 		OriginalFilename: header.Filename,
-		FileSize:         fileSize,
+		FileSize:         plaintext.n,
 		MimeType:         header.Header.Get("Content-Type"),
 		UploadedBy:       userID.(int),
 		Description:      description,
+		WrappedKey:       wrappedKey,
 	}
 
 	err = h.repo.Create(doc)
@@ -121,15 +152,18 @@ func (h *DocumentHandler) Upload(c *gin.Context) {
 		} else {
 			os.Remove(filepath.Join("./uploads", filename))
 		}
+		recordAudit(h.audit, c, "document.upload", "document", nil, services.AuditFailure, "filename="+header.Filename+": "+err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document info"})
 		return
 	}
 
+	recordAudit(h.audit, c, "document.upload", "document", doc.ID, services.AuditSuccess, "filename="+header.Filename)
 	c.JSON(http.StatusOK, doc)
 }
 
 func (h *DocumentHandler) GetAll(c *gin.Context) {
 	documents, err := h.repo.GetAll()
+	recordAudit(h.audit, c, "document.list", "document", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch documents"})
 		return
@@ -181,12 +215,20 @@ func (h *DocumentHandler) View(c *gin.Context) {
 		if exists {
 			canView, _ := h.repo.CheckPermission(doc.ID, userGroup.(string), "view")
 			if !canView {
+				recordAudit(h.audit, c, "document.view", "document", doc.ID, services.AuditDenied, "")
 				c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this document"})
 				return
 			}
 		}
 	}
 
+	recordAudit(h.audit, c, "document.view", "document", doc.ID, services.AuditSuccess, "")
+
+	if doc.WrappedKey != "" {
+		h.serveEncrypted(c, doc, "inline")
+		return
+	}
+
 	if h.useS3 {
 		// Stream file from S3 through backend (hides AWS credentials)
 		fileBytes, err := h.s3Service.Download(doc.Filename)
@@ -232,12 +274,20 @@ func (h *DocumentHandler) Download(c *gin.Context) {
 		if exists {
 			canDownload, _ := h.repo.CheckPermission(doc.ID, userGroup.(string), "download")
 			if !canDownload {
+				recordAudit(h.audit, c, "document.download", "document", doc.ID, services.AuditDenied, "")
 				c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to download this document"})
 				return
 			}
 		}
 	}
 
+	recordAudit(h.audit, c, "document.download", "document", doc.ID, services.AuditSuccess, "")
+
+	if doc.WrappedKey != "" {
+		h.serveEncrypted(c, doc, "attachment")
+		return
+	}
+
 	if h.useS3 {
 		// Stream file from S3 through backend (hides AWS credentials)
 		fileBytes, err := h.s3Service.Download(doc.Filename)
@@ -263,6 +313,56 @@ func (h *DocumentHandler) Download(c *gin.Context) {
 	}
 }
 
+// serveEncrypted decrypts a stored document on the fly. Decryption fails if the
+// stored file was modified, but by then the response may have started, so a
+// tampered file shows up as a truncated download and an error in the log.
+func (h *DocumentHandler) serveEncrypted(c *gin.Context, doc *models.Document, disposition string) {
+	dataKey, err := h.encryption.UnwrapKeyWithAAD(doc.WrappedKey, services.DocumentKeyAAD(doc.ID))
+	if errors.Is(err, services.ErrSealed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "vault is sealed"})
+		return
+	}
+	if errors.Is(err, services.ErrUnboundCiphertext) {
+		log.Printf("Document %d: refusing a data key not bound to the document", doc.ID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt file"})
+		return
+	}
+	defer wipeKey(dataKey)
+
+	var stored io.ReadCloser
+	if h.useS3 {
+		// Stream file from S3 through backend (hides AWS credentials)
+		stored, err = h.s3Service.Open(doc.Filename)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file"})
+			return
+		}
+	} else {
+		stored, err = os.Open(filepath.Join("./uploads", doc.Filename))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+	}
+	defer stored.Close()
+
+	plaintext, err := services.NewDecryptingReader(dataKey, stored)
+	if err != nil {
+		log.Printf("Document %d: %v", doc.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt file"})
+		return
+	}
+
+	c.DataFromReader(http.StatusOK, doc.FileSize, doc.MimeType, plaintext, map[string]string{
+		"Content-Disposition": fmt.Sprintf("%s; filename=%s", disposition, doc.OriginalFilename),
+	})
+	for _, e := range c.Errors {
+		log.Printf("Document %d: %v", doc.ID, e.Err)
+	}
+}
+
 func (h *DocumentHandler) UpdatePermission(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -277,6 +377,11 @@ func (h *DocumentHandler) UpdatePermission(c *gin.Context) {
 	}
 
 	err = h.repo.UpdatePermission(id, req.UserGroup, req.CanView, req.CanDownload)
+	details := fmt.Sprintf("group=%s view=%t download=%t", req.UserGroup, req.CanView, req.CanDownload)
+	if err != nil {
+		details += ": " + err.Error()
+	}
+	recordAudit(h.audit, c, "document.permission.update", "document", id, auditOutcome(err), details)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update permission"})
 		return
@@ -308,6 +413,7 @@ func (h *DocumentHandler) Delete(c *gin.Context) {
 
 	// Delete from database
 	err = h.repo.Delete(id)
+	recordAudit(h.audit, c, "document.delete", "document", id, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete document"})
 		return
@@ -315,3 +421,22 @@ func (h *DocumentHandler) Delete(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// countingReader counts the plaintext bytes of an upload on their way to the
+// encrypting reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func wipeKey(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -3,6 +3,8 @@ package handlers
 import (
 	"credential-store/internal/models"
 	"credential-store/internal/services"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -11,10 +13,11 @@ import (
 
 type FolderHandler struct {
 	folderService *services.FolderService
+	auditService  *services.AuditService
 }
 
-func NewFolderHandler(folderService *services.FolderService) *FolderHandler {
-	return &FolderHandler{folderService: folderService}
+func NewFolderHandler(folderService *services.FolderService, auditService *services.AuditService) *FolderHandler {
+	return &FolderHandler{folderService: folderService, auditService: auditService}
 }
 
 func (h *FolderHandler) GetAll(c *gin.Context) {
@@ -22,11 +25,22 @@ func (h *FolderHandler) GetAll(c *gin.Context) {
 	role := c.GetString("role")
 
 	folders, err := h.folderService.GetAllWithPermissions(userGroup, role)
+	recordAudit(h.auditService, c, "folder.list", "folder", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch folders"})
 		return
 	}
 
+	if folderID, limited := tokenFolder(c); limited {
+		var inScope []models.FolderWithPermissions
+		for _, folder := range folders {
+			if folder.ID == folderID {
+				inScope = append(inScope, folder)
+			}
+		}
+		folders = inScope
+	}
+
 	c.JSON(http.StatusOK, folders)
 }
 
@@ -38,6 +52,15 @@ func (h *FolderHandler) Create(c *gin.Context) {
 	}
 
 	folder, err := h.folderService.Create(&req)
+	if err != nil {
+		recordAudit(h.auditService, c, "folder.create", "folder", nil, services.AuditFailure, "name="+req.Name+": "+err.Error())
+	} else {
+		recordAudit(h.auditService, c, "folder.create", "folder", folder.ID, services.AuditSuccess, "name="+req.Name)
+	}
+	if errors.Is(err, services.ErrSealed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create folder"})
 		return
@@ -67,7 +90,13 @@ func (h *FolderHandler) UpdatePermission(c *gin.Context) {
 		CanDelete: req.CanDelete,
 	}
 
-	if err := h.folderService.UpdatePermission(perm); err != nil {
+	err = h.folderService.UpdatePermission(perm)
+	details := fmt.Sprintf("group=%s read=%t write=%t delete=%t", perm.UserGroup, perm.CanRead, perm.CanWrite, perm.CanDelete)
+	if err != nil {
+		details += ": " + err.Error()
+	}
+	recordAudit(h.auditService, c, "folder.permission.update", "folder", folderID, auditOutcome(err), details)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update permission"})
 		return
 	}
@@ -82,7 +111,9 @@ func (h *FolderHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := h.folderService.Delete(folderID); err != nil {
+	err = h.folderService.Delete(folderID)
+	recordAudit(h.auditService, c, "folder.delete", "folder", folderID, auditOutcome(err), auditError(err))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete folder"})
 		return
 	}
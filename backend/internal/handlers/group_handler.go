@@ -10,10 +10,11 @@ import (
 
 type GroupHandler struct {
 	groupService *services.GroupService
+	auditService *services.AuditService
 }
 
-func NewGroupHandler(groupService *services.GroupService) *GroupHandler {
-	return &GroupHandler{groupService: groupService}
+func NewGroupHandler(groupService *services.GroupService, auditService *services.AuditService) *GroupHandler {
+	return &GroupHandler{groupService: groupService, auditService: auditService}
 }
 
 func (h *GroupHandler) Create(c *gin.Context) {
@@ -24,6 +25,11 @@ func (h *GroupHandler) Create(c *gin.Context) {
 	}
 
 	group, err := h.groupService.Create(&req)
+	if err != nil {
+		recordAudit(h.auditService, c, "group.create", "group", nil, services.AuditFailure, err.Error())
+	} else {
+		recordAudit(h.auditService, c, "group.create", "group", group.ID, services.AuditSuccess, "name="+group.Name)
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -34,6 +40,7 @@ func (h *GroupHandler) Create(c *gin.Context) {
 
 func (h *GroupHandler) GetAll(c *gin.Context) {
 	groups, err := h.groupService.GetAll()
+	recordAudit(h.auditService, c, "group.list", "group", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch groups"})
 		return
@@ -45,6 +52,7 @@ func (h *GroupHandler) GetAll(c *gin.Context) {
 func (h *GroupHandler) GetByID(c *gin.Context) {
 	id := c.Param("id")
 	group, err := h.groupService.GetByID(id)
+	recordAudit(h.auditService, c, "group.read", "group", id, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
 		return
@@ -62,6 +70,7 @@ func (h *GroupHandler) Update(c *gin.Context) {
 	}
 
 	group, err := h.groupService.Update(id, &req)
+	recordAudit(h.auditService, c, "group.update", "group", id, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update group"})
 		return
@@ -72,7 +81,9 @@ func (h *GroupHandler) Update(c *gin.Context) {
 
 func (h *GroupHandler) Delete(c *gin.Context) {
 	id := c.Param("id")
-	if err := h.groupService.Delete(id); err != nil {
+	err := h.groupService.Delete(id)
+	recordAudit(h.auditService, c, "group.delete", "group", id, auditOutcome(err), auditError(err))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MFAHandler struct {
+	mfaService     *services.MFAService
+	authService    *services.AuthService
+	sessionService *services.SessionService
+	loginThrottle  *services.LoginThrottleService
+	auditService   *services.AuditService
+}
+
+func NewMFAHandler(mfaService *services.MFAService, authService *services.AuthService,
+	sessionService *services.SessionService, loginThrottle *services.LoginThrottleService,
+	auditService *services.AuditService) *MFAHandler {
+	return &MFAHandler{
+		mfaService:     mfaService,
+		authService:    authService,
+		sessionService: sessionService,
+		loginThrottle:  loginThrottle,
+		auditService:   auditService,
+	}
+}
+
+// Verify completes a login with the challenge token from /api/auth/login and
+// a TOTP or recovery code. Wrong codes are throttled like wrong passwords,
+// against the same account and IP.
+func (h *MFAHandler) Verify(c *gin.Context) {
+	var req models.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give either code or recovery_code"})
+		return
+	}
+
+	challenged, err := h.mfaService.ChallengedUser(req.ChallengeToken)
+	if err != nil {
+		recordAudit(h.auditService, c, "auth.mfa_verify", "", nil, services.AuditFailure, err.Error())
+		mfaError(c, err, "failed to verify code")
+		return
+	}
+	attempt, ok := reserveLogin(h.loginThrottle, h.auditService, c, challenged.Email, "auth.mfa_verify")
+	if !ok {
+		return
+	}
+
+	user, recoveryCodes, err := h.mfaService.VerifyChallenge(&req)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidMFACode) {
+			loginFailed(h.loginThrottle, h.auditService, c, challenged.Email, attempt)
+		} else {
+			releaseLogin(h.loginThrottle, attempt)
+		}
+		recordAudit(h.auditService, c, "auth.mfa_verify", "user", challenged.ID, services.AuditFailure, err.Error())
+		mfaError(c, err, "failed to verify code")
+		return
+	}
+
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+	method := services.AuthMethodTOTP
+	if req.RecoveryCode != "" {
+		method = services.AuthMethodRecoveryCode
+	}
+	details := "method=" + method
+	recordAudit(h.auditService, c, "auth.mfa_verify", "user", user.ID, services.AuditSuccess, details)
+	if recoveryCodes != nil {
+		recordAudit(h.auditService, c, "mfa.enable", "user", user.ID, services.AuditSuccess, "at login")
+	}
+
+	resp, err := h.sessionService.Start(user, method, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		releaseLogin(h.loginThrottle, attempt)
+		sessionStartError(h.auditService, c, user, err)
+		return
+	}
+	loginSucceeded(h.loginThrottle, user, attempt)
+	recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditSuccess, details)
+
+	resp.RecoveryCodes = recoveryCodes
+	c.JSON(http.StatusOK, resp)
+}
+
+// Setup starts enrollment during login, for members of a group that requires
+// MFA who have not set it up yet.
+func (h *MFAHandler) Setup(c *gin.Context) {
+	var req models.MFAChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enrollment, err := h.mfaService.SetupWithChallenge(req.ChallengeToken)
+	if err != nil {
+		mfaError(c, err, "failed to start enrollment")
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func (h *MFAHandler) Status(c *gin.Context) {
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	status, err := h.mfaService.Status(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch MFA status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Enroll generates a new TOTP secret for the caller. It takes effect once
+// confirmed through Enable.
+func (h *MFAHandler) Enroll(c *gin.Context) {
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	enrollment, err := h.mfaService.BeginEnrollment(user)
+	recordAudit(h.auditService, c, "mfa.enroll", "user", user.ID, auditOutcome(err), auditError(err))
+	if err != nil {
+		mfaError(c, err, "failed to start enrollment")
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func (h *MFAHandler) Enable(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	codes, err := h.mfaService.Enable(userID, req.Code)
+	recordAudit(h.auditService, c, "mfa.enable", "user", userID, auditOutcome(err), auditError(err))
+	if err != nil {
+		mfaError(c, err, "failed to enable two-factor authentication")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (h *MFAHandler) Disable(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	err = h.mfaService.Disable(user, req.Code)
+	recordAudit(h.auditService, c, "mfa.disable", "user", user.ID, auditOutcome(err), auditError(err))
+	if err != nil {
+		mfaError(c, err, "failed to disable two-factor authentication")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes.
+func (h *MFAHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	codes, err := h.mfaService.RegenerateRecoveryCodes(userID, req.Code)
+	recordAudit(h.auditService, c, "mfa.recovery_codes", "user", userID, auditOutcome(err), auditError(err))
+	if err != nil {
+		mfaError(c, err, "failed to generate recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Reset removes another user's second factor (admin). If their group requires
+// MFA they set it up again at their next login.
+func (h *MFAHandler) Reset(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	err = h.mfaService.Reset(userID)
+	recordAudit(h.auditService, c, "mfa.reset", "user", userID, auditOutcome(err), auditError(err))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication reset"})
+}
+
+func mfaError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrInvalidMFAChallenge):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFAAlreadyEnabled), errors.Is(err, services.ErrMFANotEnabled),
+		errors.Is(err, services.ErrMFAEnrollmentMissing):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFARequiredByGroup), errors.Is(err, services.ErrPhishingResistantRequired),
+		errors.Is(err, services.ErrMFASetupNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrSealed):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PasswordResetHandler struct {
+	resetService   *services.PasswordResetService
+	sessionService *services.SessionService
+	auditService   *services.AuditService
+}
+
+func NewPasswordResetHandler(resetService *services.PasswordResetService, sessionService *services.SessionService,
+	auditService *services.AuditService) *PasswordResetHandler {
+	return &PasswordResetHandler{
+		resetService:   resetService,
+		sessionService: sessionService,
+		auditService:   auditService,
+	}
+}
+
+// Invite creates a user without a password and emails them a link to choose
+// one (admin).
+func (h *PasswordResetHandler) Invite(c *gin.Context) {
+	var req models.InviteUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.resetService.Invite(&req)
+	if user == nil {
+		recordAudit(h.auditService, c, "user.invite", "user", req.Email, services.AuditFailure, err.Error())
+		h.inviteFailed(c, err)
+		return
+	}
+	details := userAuditDetails(user)
+	if err != nil {
+		details += " (" + err.Error() + ")"
+	}
+	recordAudit(h.auditService, c, "user.invite", "user", user.ID, services.AuditSuccess, details)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "the user was created, but the invitation email could not be sent; try sending it again",
+			"user":  user,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// ResendInvite emails a new invitation to a user who hasn't chosen a password
+// yet, retiring the old one (admin).
+func (h *PasswordResetHandler) ResendInvite(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	_, err = h.resetService.ResendInvite(id)
+	recordAudit(h.auditService, c, "user.invite", "user", id, auditOutcome(err), auditError(err))
+	if err != nil {
+		h.inviteFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "invitation sent"})
+}
+
+func (h *PasswordResetHandler) inviteFailed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMailNotConfigured):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUserExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotInvited):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMailDelivery):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "the invitation email could not be sent; try again later"})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to invite user"})
+	}
+}
+
+// RequestReset emails a password reset link, if the email belongs to a local
+// account. The answer is the same either way.
+func (h *PasswordResetHandler) RequestReset(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.resetService.RequestReset(req.Email)
+	recordAudit(h.auditService, c, "auth.password_reset_request", "user", req.Email, auditOutcome(err), auditError(err))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "password reset is not available; contact your administrator"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "if an account exists for this email, a link to reset its password is on its way"})
+}
+
+// VerifyToken tells the reset page whose password a link sets, and whether
+// it is an invitation.
+func (h *PasswordResetHandler) VerifyToken(c *gin.Context) {
+	var req models.PasswordTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := h.resetService.Verify(req.Token)
+	if errors.Is(err, services.ErrInvalidResetToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check the link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
+
+// Reset sets a new password with an emailed link and ends the user's
+// sessions.
+func (h *PasswordResetHandler) Reset(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, token, err := h.resetService.Reset(req.Token, req.Password)
+	action := "auth.password_reset"
+	if token != nil && token.Purpose == services.PasswordTokenInvite {
+		action = "user.invite_accept"
+	}
+	if err != nil {
+		if token != nil {
+			recordAudit(h.auditService, c, action, "user", token.UserID, services.AuditFailure, err.Error())
+		}
+		if passwordRejected(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrInvalidResetToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set the password"})
+		return
+	}
+
+	// The request is unauthenticated; attribute the event to the user the
+	// link was for
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+	details := ""
+	if _, err := h.sessionService.RevokeAll(user.ID, services.SessionPasswordChange); err != nil {
+		details = "failed to revoke sessions: " + err.Error()
+	}
+	recordAudit(h.auditService, c, action, "user", user.ID, services.AuditSuccess, details)
+
+	c.JSON(http.StatusOK, gin.H{"message": "password set; you can now log in"})
+}
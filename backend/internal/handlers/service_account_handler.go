@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceAccountHandler manages service accounts and their keys and
+// certificates (admin).
+type ServiceAccountHandler struct {
+	serviceAccountService *services.ServiceAccountService
+	auditService          *services.AuditService
+}
+
+func NewServiceAccountHandler(serviceAccountService *services.ServiceAccountService,
+	auditService *services.AuditService) *ServiceAccountHandler {
+	return &ServiceAccountHandler{serviceAccountService: serviceAccountService, auditService: auditService}
+}
+
+func (h *ServiceAccountHandler) Create(c *gin.Context) {
+	var req models.CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.serviceAccountService.Create(&req)
+	details := "name=" + req.Name + " user_group=" + req.UserGroup
+	if err != nil {
+		recordAudit(h.auditService, c, "service_account.create", "service_account", nil, services.AuditFailure,
+			details+": "+err.Error())
+		h.error(c, err, "failed to create service account")
+		return
+	}
+	recordAudit(h.auditService, c, "service_account.create", "service_account", account.ID, services.AuditSuccess, details)
+
+	c.JSON(http.StatusCreated, account)
+}
+
+func (h *ServiceAccountHandler) GetAll(c *gin.Context) {
+	accounts, err := h.serviceAccountService.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch service accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+func (h *ServiceAccountHandler) GetByID(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	account, err := h.serviceAccountService.Get(id)
+	if err != nil {
+		h.error(c, err, "failed to fetch service account")
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+func (h *ServiceAccountHandler) Update(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.serviceAccountService.Update(id, &req)
+	details := serviceAccountUpdateDetails(&req)
+	if err != nil {
+		details += ": " + err.Error()
+	}
+	recordAudit(h.auditService, c, "service_account.update", "service_account", id, auditOutcome(err), details)
+	if err != nil {
+		h.error(c, err, "failed to update service account")
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+func (h *ServiceAccountHandler) Delete(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	err := h.serviceAccountService.Delete(id)
+	recordAudit(h.auditService, c, "service_account.delete", "service_account", id, auditOutcome(err), auditError(err))
+	if err != nil {
+		h.error(c, err, "failed to delete service account")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "service account deleted"})
+}
+
+// ListCredentials lists an account's keys and certificates that still work.
+func (h *ServiceAccountHandler) ListCredentials(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	creds, err := h.serviceAccountService.Credentials(id)
+	if err != nil {
+		h.error(c, err, "failed to fetch service account credentials")
+		return
+	}
+
+	c.JSON(http.StatusOK, creds)
+}
+
+// CreateKey issues an API key for the account. The key is in this response
+// only.
+func (h *ServiceAccountHandler) CreateKey(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateServiceAccountKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.serviceAccountService.CreateKey(id, &req)
+	details := fmt.Sprintf("service_account=%d kind=%s name=%s", id, services.ServiceAccountKey, req.Name)
+	if err != nil {
+		recordAudit(h.auditService, c, "service_account.credential.create", "service_account_credential", nil,
+			services.AuditFailure, details+": "+err.Error())
+		h.error(c, err, "failed to create service account key")
+		return
+	}
+	recordAudit(h.auditService, c, "service_account.credential.create", "service_account_credential",
+		resp.Credential.ID, services.AuditSuccess, details)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, resp)
+}
+
+// AddCertificate pins a client certificate to the account.
+func (h *ServiceAccountHandler) AddCertificate(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+
+	var req models.AddServiceAccountCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cred, err := h.serviceAccountService.AddCertificate(id, &req)
+	details := fmt.Sprintf("service_account=%d kind=%s name=%s", id, services.ServiceAccountCertificate, req.Name)
+	if err != nil {
+		recordAudit(h.auditService, c, "service_account.credential.create", "service_account_credential", nil,
+			services.AuditFailure, details+": "+err.Error())
+		h.error(c, err, "failed to add certificate")
+		return
+	}
+	recordAudit(h.auditService, c, "service_account.credential.create", "service_account_credential", cred.ID,
+		services.AuditSuccess, details+" fingerprint="+cred.Fingerprint)
+
+	c.JSON(http.StatusCreated, cred)
+}
+
+func (h *ServiceAccountHandler) RevokeCredential(c *gin.Context) {
+	id, ok := serviceAccountID(c)
+	if !ok {
+		return
+	}
+	credentialID, err := strconv.Atoi(c.Param("credentialId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	err = h.serviceAccountService.RevokeCredential(id, credentialID)
+	recordAudit(h.auditService, c, "service_account.credential.revoke", "service_account_credential", credentialID,
+		auditOutcome(err), auditError(err))
+	if err != nil {
+		h.error(c, err, "failed to revoke service account credential")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *ServiceAccountHandler) error(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrServiceAccountNotFound), errors.Is(err, services.ErrServiceAccountCredentialNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrServiceAccountExists), errors.Is(err, services.ErrCertificateAlreadyPinned):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUnknownGroup), errors.Is(err, services.ErrInvalidCertificate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func serviceAccountID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service account ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+func serviceAccountUpdateDetails(req *models.UpdateServiceAccountRequest) string {
+	details := ""
+	if req.UserGroup != "" {
+		details += " user_group=" + req.UserGroup
+	}
+	if req.Disabled != nil {
+		details += " disabled=" + strconv.FormatBool(*req.Disabled)
+	}
+	if req.Description != nil {
+		details += " description"
+	}
+	if details == "" {
+		return ""
+	}
+	return details[1:]
+}
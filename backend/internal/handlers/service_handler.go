@@ -10,10 +10,11 @@ import (
 
 type ServiceHandler struct {
 	serviceService *services.ServiceService
+	auditService   *services.AuditService
 }
 
-func NewServiceHandler(serviceService *services.ServiceService) *ServiceHandler {
-	return &ServiceHandler{serviceService: serviceService}
+func NewServiceHandler(serviceService *services.ServiceService, auditService *services.AuditService) *ServiceHandler {
+	return &ServiceHandler{serviceService: serviceService, auditService: auditService}
 }
 
 func (h *ServiceHandler) Create(c *gin.Context) {
@@ -25,6 +26,11 @@ func (h *ServiceHandler) Create(c *gin.Context) {
 
 	userID, _ := c.Get("user_id")
 	service, err := h.serviceService.CreateService(&req, userID.(int))
+	if err != nil {
+		recordAudit(h.auditService, c, "service.create", "service", nil, services.AuditFailure, err.Error())
+	} else {
+		recordAudit(h.auditService, c, "service.create", "service", service.ID, services.AuditSuccess, "name="+service.ServiceName)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create service"})
 		return
@@ -34,21 +40,21 @@ func (h *ServiceHandler) Create(c *gin.Context) {
 }
 
 func (h *ServiceHandler) GetAll(c *gin.Context) {
-	userID, _ := c.Get("user_id")
-	userGroup, _ := c.Get("user_group")
-
-	services, err := h.serviceService.GetAllServices(userID.(int), userGroup.(string))
+	// Service accounts have no user id; they see services by group only
+	list, err := h.serviceService.GetAllServices(c.GetInt("user_id"), c.GetString("user_group"))
+	recordAudit(h.auditService, c, "service.list", "service", nil, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch services"})
 		return
 	}
 
-	c.JSON(http.StatusOK, services)
+	c.JSON(http.StatusOK, list)
 }
 
 func (h *ServiceHandler) GetByID(c *gin.Context) {
 	id := c.Param("id")
 	service, err := h.serviceService.GetServiceByID(id)
+	recordAudit(h.auditService, c, "service.read", "service", id, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
 		return
@@ -66,6 +72,7 @@ func (h *ServiceHandler) Update(c *gin.Context) {
 	}
 
 	service, err := h.serviceService.UpdateService(id, &req)
+	recordAudit(h.auditService, c, "service.update", "service", id, auditOutcome(err), auditError(err))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update service"})
 		return
@@ -76,7 +83,9 @@ func (h *ServiceHandler) Update(c *gin.Context) {
 
 func (h *ServiceHandler) Delete(c *gin.Context) {
 	id := c.Param("id")
-	if err := h.serviceService.DeleteService(id); err != nil {
+	err := h.serviceService.DeleteService(id)
+	recordAudit(h.auditService, c, "service.delete", "service", id, auditOutcome(err), auditError(err))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete service"})
 		return
 	}
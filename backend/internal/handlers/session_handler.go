@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionHandler struct {
+	sessionService *services.SessionService
+	auditService   *services.AuditService
+}
+
+func NewSessionHandler(sessionService *services.SessionService, auditService *services.AuditService) *SessionHandler {
+	return &SessionHandler{sessionService: sessionService, auditService: auditService}
+}
+
+func (h *SessionHandler) Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, sessionID, err := h.sessionService.Refresh(req.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		var target interface{}
+		if sessionID != 0 {
+			target = sessionID
+		}
+		outcome := services.AuditFailure
+		if errors.Is(err, services.ErrRefreshTokenReused) || errors.Is(err, services.ErrPhishingResistantRequired) {
+			outcome = services.AuditDenied
+		}
+		recordAudit(h.auditService, c, "auth.refresh", "session", target, outcome, err.Error())
+
+		if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) ||
+			errors.Is(err, services.ErrPhishingResistantRequired) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh session"})
+		return
+	}
+
+	c.Set("user_id", resp.User.ID)
+	c.Set("email", resp.User.Email)
+	recordAudit(h.auditService, c, "auth.refresh", "session", sessionID, services.AuditSuccess, "")
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Logout ends the session of the refresh token given. It works without a valid
+// access token, so an expired client can still log out.
+func (h *SessionHandler) Logout(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, err := h.sessionService.Logout(req.RefreshToken)
+	if sessionID != 0 || err != nil {
+		recordAudit(h.auditService, c, "auth.logout", "session", sessionID, auditOutcome(err), auditError(err))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// ListOwn lists the caller's active sessions.
+func (h *SessionHandler) ListOwn(c *gin.Context) {
+	h.list(c, c.GetInt("user_id"))
+}
+
+// RevokeOwn ends one of the caller's sessions.
+func (h *SessionHandler) RevokeOwn(c *gin.Context) {
+	h.revoke(c, c.GetInt("user_id"))
+}
+
+// ListForUser lists another user's active sessions (admin).
+func (h *SessionHandler) ListForUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.list(c, userID)
+}
+
+// RevokeForUser ends one of another user's sessions (admin).
+func (h *SessionHandler) RevokeForUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.revoke(c, userID)
+}
+
+// RevokeAllForUser ends every session of a user (admin).
+func (h *SessionHandler) RevokeAllForUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	count, err := h.sessionService.RevokeAll(userID, services.SessionRevoked)
+	details := fmt.Sprintf("sessions=%d", count)
+	if err != nil {
+		details = err.Error()
+	}
+	recordAudit(h.auditService, c, "session.revoke_all", "user", userID, auditOutcome(err), details)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": count})
+}
+
+func (h *SessionHandler) list(c *gin.Context, userID int) {
+	sessions, err := h.sessionService.List(userID, c.GetInt("session_id"))
+	recordAudit(h.auditService, c, "session.list", "user", userID, auditOutcome(err), auditError(err))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+func (h *SessionHandler) revoke(c *gin.Context, userID int) {
+	sessionID, err := strconv.Atoi(c.Param("sessionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	err = h.sessionService.Revoke(userID, sessionID)
+	recordAudit(h.auditService, c, "session.revoke", "session", sessionID, auditOutcome(err), auditError(err))
+	if errors.Is(err, services.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SysHandler struct {
+	keyRotationService *services.KeyRotationService
+	sealService        *services.SealService
+	auditService       *services.AuditService
+}
+
+func NewSysHandler(keyRotationService *services.KeyRotationService, sealService *services.SealService,
+	auditService *services.AuditService) *SysHandler {
+	return &SysHandler{
+		keyRotationService: keyRotationService,
+		sealService:        sealService,
+		auditService:       auditService,
+	}
+}
+
+func (h *SysHandler) StartRewrap(c *gin.Context) {
+	err := h.keyRotationService.Start()
+	recordAudit(h.auditService, c, "sys.rewrap.start", "", nil, auditOutcome(err), auditError(err))
+	if err != nil {
+		if errors.Is(err, services.ErrSealed) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, h.keyRotationService.Status())
+}
+
+func (h *SysHandler) RewrapStatus(c *gin.Context) {
+	recordAudit(h.auditService, c, "sys.rewrap.status", "", nil, services.AuditSuccess, "")
+	c.JSON(http.StatusOK, h.keyRotationService.Status())
+}
+
+func (h *SysHandler) SealStatus(c *gin.Context) {
+	status, err := h.sealService.Status()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read seal status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *SysHandler) Init(c *gin.Context) {
+	var req models.InitSealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.sealService.Init(&req)
+	recordAudit(h.auditService, c, "sys.seal.init", "", nil, auditOutcome(err), auditError(err))
+	if err != nil {
+		if errors.Is(err, services.ErrSealAlreadyInitialized) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *SysHandler) Unseal(c *gin.Context) {
+	var req models.UnsealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Reset {
+		recordAudit(h.auditService, c, "sys.unseal.reset", "", nil, services.AuditSuccess, "")
+		h.sealService.ResetProgress()
+		h.SealStatus(c)
+		return
+	}
+
+	// The share itself is never recorded
+	status, err := h.sealService.SubmitShare(req.Share)
+	recordAudit(h.auditService, c, "sys.unseal", "", nil, auditOutcome(err), auditError(err))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrSealNotInitialized):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrInvalidShare), errors.Is(err, services.ErrUnsealFailed):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unseal"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *SysHandler) Seal(c *gin.Context) {
+	h.sealService.Seal()
+	recordAudit(h.auditService, c, "sys.seal", "", nil, services.AuditSuccess, "")
+	h.SealStatus(c)
+}
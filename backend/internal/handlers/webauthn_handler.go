@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebAuthnHandler struct {
+	webauthnService *services.WebAuthnService
+	mfaService      *services.MFAService
+	authService     *services.AuthService
+	sessionService  *services.SessionService
+	loginThrottle   *services.LoginThrottleService
+	auditService    *services.AuditService
+}
+
+func NewWebAuthnHandler(webauthnService *services.WebAuthnService, mfaService *services.MFAService,
+	authService *services.AuthService, sessionService *services.SessionService,
+	loginThrottle *services.LoginThrottleService, auditService *services.AuditService) *WebAuthnHandler {
+	return &WebAuthnHandler{
+		webauthnService: webauthnService,
+		mfaService:      mfaService,
+		authService:     authService,
+		sessionService:  sessionService,
+		loginThrottle:   loginThrottle,
+		auditService:    auditService,
+	}
+}
+
+// BeginRegistration starts adding a security key or passkey for the caller.
+func (h *WebAuthnHandler) BeginRegistration(c *gin.Context) {
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	options, err := h.webauthnService.BeginRegistration(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+func (h *WebAuthnHandler) FinishRegistration(c *gin.Context) {
+	var req models.WebAuthnRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	cred, err := h.webauthnService.FinishRegistration(userID, &req)
+	if err != nil {
+		recordAudit(h.auditService, c, "webauthn.register", "user", userID, services.AuditFailure, err.Error())
+		webauthnError(c, err, "failed to register security key")
+		return
+	}
+	recordAudit(h.auditService, c, "webauthn.register", "webauthn_credential", cred.ID, services.AuditSuccess, "name="+cred.Name)
+
+	c.JSON(http.StatusCreated, cred)
+}
+
+// BeginLogin starts a security key login: as the second factor with the
+// challenge token of a password login, or passwordless with a passkey.
+func (h *WebAuthnHandler) BeginLogin(c *gin.Context) {
+	var req models.WebAuthnLoginBeginRequest
+	// The body is optional for passkey logins
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	options, err := h.webauthnService.BeginLogin(req.ChallengeToken)
+	if err != nil {
+		webauthnError(c, err, "failed to start login")
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// FinishLogin completes a security key or passkey login. Failed assertions
+// are throttled like wrong passwords: against the account and IP as a second
+// factor, against the IP alone for a passkey, whose user isn't known yet.
+func (h *WebAuthnHandler) FinishLogin(c *gin.Context) {
+	var req models.WebAuthnLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	email := ""
+	if req.ChallengeToken != "" {
+		challenged, err := h.mfaService.ChallengedUser(req.ChallengeToken)
+		if err != nil {
+			recordAudit(h.auditService, c, "auth.webauthn", "", nil, services.AuditFailure, err.Error())
+			webauthnError(c, err, "failed to verify security key")
+			return
+		}
+		email = challenged.Email
+	}
+	attempt, ok := reserveLogin(h.loginThrottle, h.auditService, c, email, "auth.webauthn")
+	if !ok {
+		return
+	}
+
+	user, method, err := h.webauthnService.FinishLogin(&req)
+	if err != nil {
+		if errors.Is(err, services.ErrWebAuthnFailed) {
+			loginFailed(h.loginThrottle, h.auditService, c, email, attempt)
+		} else {
+			releaseLogin(h.loginThrottle, attempt)
+		}
+		recordAudit(h.auditService, c, "auth.webauthn", "", nil, services.AuditFailure, err.Error())
+		webauthnError(c, err, "failed to verify security key")
+		return
+	}
+
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+	details := "method=" + method
+
+	resp, err := h.sessionService.Start(user, method, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		releaseLogin(h.loginThrottle, attempt)
+		sessionStartError(h.auditService, c, user, err)
+		return
+	}
+	loginSucceeded(h.loginThrottle, user, attempt)
+	recordAudit(h.auditService, c, "auth.login", "user", user.ID, services.AuditSuccess, details)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// List lists the caller's security keys and passkeys.
+func (h *WebAuthnHandler) List(c *gin.Context) {
+	creds, err := h.webauthnService.List(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch security keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, creds)
+}
+
+func (h *WebAuthnHandler) Delete(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("credentialId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	user, err := h.authService.GetUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	err = h.webauthnService.Delete(user, id)
+	recordAudit(h.auditService, c, "webauthn.delete", "webauthn_credential", id, auditOutcome(err), auditError(err))
+	if err != nil {
+		webauthnError(c, err, "failed to delete security key")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func webauthnError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrWebAuthnFailed), errors.Is(err, services.ErrWebAuthnCeremony),
+		errors.Is(err, services.ErrInvalidMFAChallenge):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrWebAuthnRegistered), errors.Is(err, services.ErrNoSecurityKey):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrWebAuthnNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFARequiredByGroup), errors.Is(err, services.ErrPhishingResistantRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
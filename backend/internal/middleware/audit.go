@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditRejected records requests turned away by middleware before reaching a
+// handler (missing or invalid token, non-admin, sealed vault, rate limit).
+// Handlers record their own events.
+func AuditRejected(audit *services.AuditService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !c.IsAborted() {
+			return
+		}
+		status := c.Writer.Status()
+		if status != http.StatusUnauthorized && status != http.StatusForbidden &&
+			status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+			return
+		}
+
+		event := &models.AuditEvent{
+			Action:    "request.rejected",
+			IPAddress: c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Outcome:   services.AuditDenied,
+			Details:   fmt.Sprintf("%s %s: %d", c.Request.Method, c.FullPath(), status),
+		}
+		if userID, ok := c.Get("user_id"); ok {
+			id := userID.(int)
+			event.ActorID = &id
+			event.ActorEmail = c.GetString("email")
+		}
+		if accountID, ok := c.Get("service_account_id"); ok {
+			id := accountID.(int)
+			event.ActorID = &id
+			event.ActorType = services.ActorTypeServiceAccount
+			event.ActorEmail = c.GetString("email")
+		}
+		audit.Record(event)
+	}
+}
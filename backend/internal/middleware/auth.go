@@ -1,20 +1,46 @@
 package middleware
 
 import (
+	"credential-store/internal/services"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware accepts a valid access token whose generation is still the
+// user's current one, so tokens of deleted, demoted, suspended or
+// re-passworded users stop working immediately rather than at expiry; so do
+// those of expired accounts and of sessions that were logged out or revoked.
+// Personal access tokens are accepted too, in the Authorization header only,
+// on the endpoints their scopes cover. Service accounts authenticate with an
+// API key in the header, or with a pinned client certificate when there is no
+// token at all.
+func AuthMiddleware(authService *services.AuthService, sessionService *services.SessionService,
+	apiTokenService *services.APITokenService, serviceAccountService *services.ServiceAccountService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var tokenString string
 		
 		// Try to get token from Authorization header first
 		authHeader := c.GetHeader("Authorization")
+		cert := clientCertificate(c)
+		if isServiceAccountKey(authHeader) || (authHeader == "" && c.Query("token") == "" && cert != nil) {
+			if !authenticateServiceAccount(c, serviceAccountService, strings.TrimPrefix(authHeader, "Bearer "), cert) {
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+		if isAPIToken(authHeader) {
+			if !authenticateAPIToken(c, apiTokenService, strings.TrimPrefix(authHeader, "Bearer ")) {
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
 		if authHeader != "" {
 			tokenString = strings.Replace(authHeader, "Bearer ", "", 1)
 		} else {
@@ -28,24 +54,40 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := authService.ParseToken(tokenString)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
+		userID := int(claims["user_id"].(float64))
+		// Tokens from before generations existed count as generation 0
+		generation, _ := claims["gen"].(float64)
+		if err := authService.CheckToken(userID, int(generation)); err != nil {
+			if errors.Is(err, services.ErrTokenRevoked) || errors.Is(err, services.ErrAccountSuspended) ||
+				errors.Is(err, services.ErrAccountExpired) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unable to verify token"})
+			}
 			c.Abort()
 			return
 		}
+		sessionID, hasSession := claims["sid"].(float64)
+		if hasSession {
+			if err := sessionService.CheckSession(int(sessionID), userID); err != nil {
+				if errors.Is(err, services.ErrSessionEnded) {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				} else {
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unable to verify token"})
+				}
+				c.Abort()
+				return
+			}
+		}
 
-		c.Set("user_id", int(claims["user_id"].(float64)))
+		c.Set("user_id", userID)
 		c.Set("email", claims["email"].(string))
 		c.Set("role", claims["role"].(string))
 		
@@ -55,6 +97,9 @@ func AuthMiddleware() gin.HandlerFunc {
 		} else {
 			c.Set("user_group", "junior") // default for old tokens
 		}
+		if hasSession {
+			c.Set("session_id", int(sessionID))
+		}
 
 		c.Next()
 	}
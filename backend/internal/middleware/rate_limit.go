@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimiter allows up to limit hits per key in each fixed window.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	hits  int
+}
+
+// NewRateLimiter returns a limiter; a limit of 0 or less disables it.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// Allow records a hit for key. When the limit is reached it returns false and
+// how long until the window resets.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.sweep(now)
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.hits >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.hits++
+	return true, 0
+}
+
+// sweep drops expired windows, at most once per window, so the map doesn't
+// grow without bound.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// RateLimitPerUser limits requests per authenticated user or service account;
+// it must run after AuthMiddleware.
+func RateLimitPerUser(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strconv.Itoa(c.GetInt("user_id"))
+		if accountID, ok := c.Get("service_account_id"); ok {
+			key = "sa:" + strconv.Itoa(accountID.(int))
+		}
+		rateLimit(c, limiter, key)
+	}
+}
+
+// RateLimitPerIP limits requests per client IP, for unauthenticated routes.
+func RateLimitPerIP(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rateLimit(c, limiter, "ip:"+c.ClientIP())
+	}
+}
+
+func rateLimit(c *gin.Context, limiter *RateLimiter, key string) {
+	allowed, retryAfter := limiter.Allow(key)
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many requests, try again later"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
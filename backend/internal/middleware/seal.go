@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SealMiddleware rejects requests with 503 while the vault is sealed.
+func SealMiddleware(isSealed func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isSealed() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "vault is sealed"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/services"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceAccountRole is set as the role of service accounts. It is never
+// "admin", so admin-only endpoints stay closed to them.
+const serviceAccountRole = "service_account"
+
+// authenticateServiceAccount checks a service account API key, or the client
+// certificate from the TLS handshake if key is empty, and sets up the context
+// with the account's group. Service accounts have no user_id. They may call
+// the same endpoints as API tokens, with their group's permissions. It
+// answers the request itself and returns false if the account is refused.
+func authenticateServiceAccount(c *gin.Context, serviceAccountService *services.ServiceAccountService, key string,
+	cert *x509.Certificate) bool {
+	var account *models.ServiceAccount
+	var err error
+	if key != "" {
+		account, _, err = serviceAccountService.AuthenticateKey(key, c.ClientIP())
+	} else {
+		account, _, err = serviceAccountService.AuthenticateCertificate(cert, c.ClientIP())
+	}
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidServiceAccountCredential) || errors.Is(err, services.ErrServiceAccountDisabled) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unable to verify service account"})
+		}
+		return false
+	}
+
+	c.Set("service_account_id", account.ID)
+	c.Set("email", account.Name)
+	c.Set("role", serviceAccountRole)
+	c.Set("user_group", account.UserGroup)
+
+	if _, ok := apiTokenRoutes[c.Request.Method+" "+c.FullPath()]; !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "service accounts cannot be used for this endpoint"})
+		return false
+	}
+	return true
+}
+
+func isServiceAccountKey(header string) bool {
+	return strings.HasPrefix(header, "Bearer "+services.ServiceAccountKeyPrefix)
+}
+
+// clientCertificate returns the certificate the client presented during the
+// TLS handshake, if any.
+func clientCertificate(c *gin.Context) *x509.Certificate {
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return c.Request.TLS.PeerCertificates[0]
+}
@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	ActorID    *int      `json:"actor_id"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	ActorType  string    `json:"actor_type,omitempty"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type,omitempty"`
+	TargetID   string    `json:"target_id,omitempty"`
+	IPAddress  string    `json:"ip_address,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Details    string    `json:"details,omitempty"`
+	PrevHash   string    `json:"prev_hash,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+}
+
+// AuditQuery filters the audit log. Action may end in ".*" to match a prefix,
+// e.g. "credential.*".
+type AuditQuery struct {
+	UserID           int       `form:"user_id"`
+	ServiceAccountID int       `form:"service_account_id"`
+	TargetType       string    `form:"target_type"`
+	TargetID         string    `form:"target_id"`
+	Action           string    `form:"action"`
+	Outcome          string    `form:"outcome"`
+	From             time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To               time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit            int       `form:"limit"`
+	Offset           int       `form:"offset"`
+}
+
+// AuditCheckpoint is a signed snapshot of the audit chain head.
+type AuditCheckpoint struct {
+	ID        int       `json:"id"`
+	EventID   int64     `json:"event_id"`
+	EventHash string    `json:"event_hash"`
+	KeyID     string    `json:"key_id"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditChainProblem struct {
+	EventID      int64  `json:"event_id,omitempty"`
+	CheckpointID int    `json:"checkpoint_id,omitempty"`
+	Problem      string `json:"problem"`
+}
+
+type AuditVerifyReport struct {
+	OK                  bool                `json:"ok"`
+	Events              int                 `json:"events"`
+	UnchainedEvents     int                 `json:"unchained_events"`
+	LastEventID         int64               `json:"last_event_id"`
+	Checkpoints         int                 `json:"checkpoints"`
+	LastCheckpointID    int                 `json:"last_checkpoint_id,omitempty"`
+	LastCheckpointEvent int64               `json:"last_checkpoint_event_id,omitempty"`
+	ProblemCount        int                 `json:"problem_count"`
+	Problems            []AuditChainProblem `json:"problems"`
+}
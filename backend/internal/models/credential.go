@@ -14,6 +14,30 @@ type Credential struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+// CredentialSummary is what list and get responses carry: no secret values,
+// which are only handed out one field at a time by the reveal endpoint.
+type CredentialSummary struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	FolderID    *int      `json:"folder_id"`
+	ServiceName string    `json:"service_name"`
+	HasNotes    bool      `json:"has_notes"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (c *Credential) Summary() CredentialSummary {
+	return CredentialSummary{
+		ID:          c.ID,
+		UserID:      c.UserID,
+		FolderID:    c.FolderID,
+		ServiceName: c.ServiceName,
+		HasNotes:    c.Notes != "",
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.UpdatedAt,
+	}
+}
+
 type CreateCredentialRequest struct {
 	FolderID    *int   `json:"folder_id"`
 	ServiceName string `json:"service_name" binding:"required"`
@@ -29,3 +53,28 @@ type UpdateCredentialRequest struct {
 	Password    string `json:"password"`
 	Notes       string `json:"notes"`
 }
+
+type RevealCredentialRequest struct {
+	Field string `json:"field" binding:"required,oneof=username password notes"`
+}
+
+type RevealCredentialResponse struct {
+	CredentialID int    `json:"credential_id"`
+	Field        string `json:"field"`
+	Value        string `json:"value"`
+}
+
+type CredentialReveal struct {
+	ID           int `json:"id"`
+	CredentialID int `json:"credential_id"`
+	// UserID is 0 once the user is deleted; UserEmail, recorded at reveal
+	// time, still names them
+	UserID    int    `json:"user_id"`
+	UserEmail string `json:"user_email,omitempty"`
+	// Set instead of the user for reveals by a service account
+	ServiceAccountID   int       `json:"service_account_id,omitempty"`
+	ServiceAccountName string    `json:"service_account_name,omitempty"`
+	Field              string    `json:"field"`
+	IPAddress          string    `json:"ip_address"`
+	RevealedAt         time.Time `json:"revealed_at"`
+}
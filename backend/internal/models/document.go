@@ -11,6 +11,7 @@ type Document struct {
 	UploadedBy       int                    `json:"uploaded_by"`
 	UploaderEmail    string                 `json:"uploader_email,omitempty"`
 	Description      string                 `json:"description"`
+	WrappedKey       string                 `json:"-"`
 	Permissions      []DocumentPermission   `json:"permissions,omitempty"`
 	CreatedAt        time.Time              `json:"created_at"`
 	UpdatedAt        time.Time              `json:"updated_at"`
@@ -6,6 +6,7 @@ type Folder struct {
 	ID          int       `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
+	WrappedKey  string    `json:"-"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
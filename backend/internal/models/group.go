@@ -6,15 +6,18 @@ type Group struct {
 	ID          int       `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
+	RequireMFA  bool      `json:"require_mfa"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
 type CreateGroupRequest struct {
 	Name        string `json:"name" binding:"required"`
 	Description string `json:"description"`
+	RequireMFA  bool   `json:"require_mfa"`
 }
 
 type UpdateGroupRequest struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	RequireMFA  *bool  `json:"require_mfa"`
 }
@@ -0,0 +1,8 @@
+package models
+
+// WrappedKey is a data key stored wrapped by the master key-ring, with the id
+// of the folder or document it belongs to.
+type WrappedKey struct {
+	ID         int
+	WrappedKey string
+}
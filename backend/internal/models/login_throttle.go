@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginThrottle counts recent failed logins for an account or a source IP.
+type LoginThrottle struct {
+	Scope         string
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
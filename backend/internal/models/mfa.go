@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+type UserMFA struct {
+	UserID       int
+	TOTPSecret   string
+	Enabled      bool
+	EnabledAt    *time.Time
+	LastUsedStep int64
+}
+
+type RecoveryCode struct {
+	ID       int
+	CodeHash string
+}
+
+type MFAStatus struct {
+	Enabled                bool       `json:"enabled"`
+	EnabledAt              *time.Time `json:"enabled_at,omitempty"`
+	Required               bool       `json:"required"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+	SecurityKeys           int        `json:"security_keys"`
+}
+
+// TOTPEnrollment is shown once, to be scanned (as a QR code of
+// ProvisioningURI) or typed into an authenticator app.
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFAChallenge is the answer to a correct password when a second factor is
+// needed; the login completes at /api/auth/mfa/verify, or through
+// /api/auth/webauthn/login for a security key. Methods lists the factors the
+// user can complete it with.
+type MFAChallenge struct {
+	MFARequired      bool     `json:"mfa_required"`
+	MFASetupRequired bool     `json:"mfa_setup_required"`
+	Methods          []string `json:"methods"`
+	ChallengeToken   string   `json:"challenge_token"`
+	ExpiresIn        int      `json:"expires_in"`
+}
+
+type MFAChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+// MFAVerifyRequest takes either a TOTP code or a recovery code.
+type MFAVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -0,0 +1,21 @@
+package models
+
+type OIDCInfo struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name,omitempty"`
+}
+
+// OIDCBeginResponse sends the browser to AuthorizationURL; the frontend keeps
+// FlowToken and returns it with the code and state the provider redirects
+// back with.
+type OIDCBeginResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	FlowToken        string `json:"flow_token"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+type OIDCCallbackRequest struct {
+	Code      string `json:"code" binding:"required"`
+	State     string `json:"state" binding:"required"`
+	FlowToken string `json:"flow_token" binding:"required"`
+}
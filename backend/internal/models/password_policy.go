@@ -0,0 +1,19 @@
+package models
+
+// PasswordViolation is a rule a new password breaks. Code is one of
+// too_short, too_long, character_classes, too_weak, breached and
+// recently_used.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyInfo tells users what a password must look like. A zero
+// rule is not enforced.
+type PasswordPolicyInfo struct {
+	MinLength           int `json:"min_length"`
+	MaxBytes            int `json:"max_bytes"`
+	MinCharacterClasses int `json:"min_character_classes"`
+	MinStrength         int `json:"min_strength"`
+	History             int `json:"history"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// PasswordToken is an emailed link to set a password: an invitation to a new
+// user, or a password reset.
+type PasswordToken struct {
+	ID        int        `json:"-"`
+	UserID    int        `json:"-"`
+	Email     string     `json:"email"`
+	Purpose   string     `json:"purpose"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"-"`
+}
+
+type InviteUserRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	Role      string `json:"role"`
+	UserGroup string `json:"user_group"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type PasswordTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
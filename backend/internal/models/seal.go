@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+type SealConfig struct {
+	SecretShares    int       `json:"secret_shares"`
+	SecretThreshold int       `json:"secret_threshold"`
+	KeyVersion      int       `json:"key_version"`
+	KeyCheck        string    `json:"-"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type SealStatus struct {
+	Sealed      bool `json:"sealed"`
+	Initialized bool `json:"initialized"`
+	Shares      int  `json:"secret_shares,omitempty"`
+	Threshold   int  `json:"secret_threshold,omitempty"`
+	Progress    int  `json:"progress"`
+}
+
+type InitSealRequest struct {
+	SecretShares    int `json:"secret_shares" binding:"required,min=1,max=255"`
+	SecretThreshold int `json:"secret_threshold" binding:"required,min=1,max=255"`
+}
+
+type InitSealResponse struct {
+	Shares     []string `json:"shares"`
+	KeyVersion int      `json:"key_version"`
+}
+
+type UnsealRequest struct {
+	Share string `json:"share"`
+	Reset bool   `json:"reset"`
+}
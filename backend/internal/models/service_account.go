@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// ServiceAccount is a machine identity. It gets the folder permissions of
+// its group and is never an admin.
+type ServiceAccount struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	UserGroup   string    `json:"user_group"`
+	Disabled    bool      `json:"disabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ServiceAccountCredential is an API key or a pinned client certificate.
+// Prefix identifies keys, Subject certificates.
+type ServiceAccountCredential struct {
+	ID               int        `json:"id"`
+	ServiceAccountID int        `json:"service_account_id"`
+	Kind             string     `json:"kind"`
+	Name             string     `json:"name"`
+	Fingerprint      string     `json:"fingerprint,omitempty"`
+	Prefix           string     `json:"prefix,omitempty"`
+	Subject          string     `json:"subject,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP       string     `json:"last_used_ip,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+}
+
+type CreateServiceAccountRequest struct {
+	Name        string `json:"name" binding:"required,max=100"`
+	Description string `json:"description"`
+	UserGroup   string `json:"user_group" binding:"required"`
+}
+
+type UpdateServiceAccountRequest struct {
+	Description *string `json:"description"`
+	UserGroup   string  `json:"user_group"`
+	Disabled    *bool   `json:"disabled"`
+}
+
+type CreateServiceAccountKeyRequest struct {
+	Name          string `json:"name" binding:"required,max=100"`
+	ExpiresInDays int    `json:"expires_in_days" binding:"omitempty,min=1"`
+}
+
+type CreateServiceAccountKeyResponse struct {
+	Key        string                   `json:"key"`
+	Credential ServiceAccountCredential `json:"credential"`
+}
+
+// AddServiceAccountCertificateRequest pins a client certificate, PEM encoded.
+type AddServiceAccountCertificateRequest struct {
+	Name        string `json:"name" binding:"required,max=100"`
+	Certificate string `json:"certificate" binding:"required"`
+}
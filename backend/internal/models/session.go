@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type Session struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	IPAddress     string     `json:"ip_address,omitempty"`
+	UserAgent     string     `json:"user_agent,omitempty"`
+	AuthMethod    string     `json:"auth_method"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	Current       bool       `json:"current"`
+}
+
+// RefreshRequest is the body of both refresh and logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
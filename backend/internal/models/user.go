@@ -9,6 +9,35 @@ type User struct {
 	Role      string    `json:"role"`
 	UserGroup string    `json:"user_group"`
 	CreatedAt time.Time `json:"created_at"`
+	// TokenGeneration is embedded in access tokens; tokens from an older
+	// generation are rejected
+	TokenGeneration int `json:"-"`
+	// AuthSource is "local" for password accounts, or the identity provider
+	// that provisioned the user, which knows them as ExternalID
+	AuthSource string `json:"auth_source"`
+	ExternalID string `json:"-"`
+	// Status is "active" or "suspended"; SuspendedReason says who suspended
+	// the user
+	Status          string     `json:"status"`
+	SuspendedReason string     `json:"suspended_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+	// ExpiresAt, if set, is when the account stops working
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	LastLoginIP string     `json:"last_login_ip,omitempty"`
+	// LockedUntil is set in user lists while failed logins lock the user out
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// PendingInvite marks invited users who haven't chosen a password yet
+	PendingInvite bool `json:"pending_invite,omitempty"`
+}
+
+// ExternalIdentity is a user as vouched for by an identity provider, with the
+// group its claims map to.
+type ExternalIdentity struct {
+	Source     string
+	ExternalID string
+	Email      string
+	UserGroup  string
 }
 
 type LoginRequest struct {
@@ -18,7 +47,7 @@ type LoginRequest struct {
 
 type SignupRequest struct {
 	Email     string `json:"email" binding:"required,email"`
-	Password  string `json:"password" binding:"required,min=6"`
+	Password  string `json:"password" binding:"required"`
 	Role      string `json:"role"`
 	UserGroup string `json:"user_group"`
 }
@@ -30,12 +59,27 @@ type UpdateUserRequest struct {
 	UserGroup string `json:"user_group"`
 }
 
+// UpdateUserStatusRequest suspends or reactivates a user.
+type UpdateUserStatusRequest struct {
+	Status string `json:"status" binding:"required,oneof=active suspended"`
+}
+
+// UpdateUserExpiryRequest sets when an account stops working; null means
+// never.
+type UpdateUserExpiryRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	User         User   `json:"user"`
+	// Set once, when a login completed a required MFA enrollment
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 type ChangePasswordRequest struct {
 	CurrentPassword string `json:"current_password" binding:"required"`
-	NewPassword     string `json:"new_password" binding:"required,min=6"`
+	NewPassword     string `json:"new_password" binding:"required"`
 }
@@ -0,0 +1,70 @@
+package models
+
+import "time"
+
+type WebAuthnCredential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	UserHandle   []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	Name         string     `json:"name"`
+	AAGUID       string     `json:"aaguid,omitempty"`
+	Transports   []string   `json:"transports,omitempty"`
+	UserVerified bool       `json:"user_verified"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnOptions starts a ceremony. PublicKey goes to
+// navigator.credentials.create() or .get() with its base64url fields decoded;
+// CeremonyToken comes back with the result.
+type WebAuthnOptions struct {
+	CeremonyToken string      `json:"ceremony_token"`
+	PublicKey     interface{} `json:"publicKey"`
+}
+
+// WebAuthnCredentialResponse is a PublicKeyCredential from the browser, with
+// binary fields base64url encoded.
+type WebAuthnCredentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId" binding:"required"`
+	Type     string `json:"type" binding:"required"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" binding:"required"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+type WebAuthnRegisterRequest struct {
+	CeremonyToken string                     `json:"ceremony_token" binding:"required"`
+	Name          string                     `json:"name"`
+	Credential    WebAuthnCredentialResponse `json:"credential" binding:"required"`
+}
+
+// WebAuthnLoginBeginRequest takes the challenge token of a password login to
+// use a security key as the second factor; without it, the login is
+// passwordless with a passkey.
+type WebAuthnLoginBeginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+}
+
+type WebAuthnLoginRequest struct {
+	CeremonyToken  string                     `json:"ceremony_token" binding:"required"`
+	ChallengeToken string                     `json:"challenge_token"`
+	Credential     WebAuthnCredentialResponse `json:"credential" binding:"required"`
+}
+
+type AuthPolicy struct {
+	AdminRequirePhishingResistant bool      `json:"admin_require_phishing_resistant"`
+	UpdatedAt                     time.Time `json:"updated_at"`
+}
+
+type UpdateAuthPolicyRequest struct {
+	AdminRequirePhishingResistant *bool `json:"admin_require_phishing_resistant"`
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type APITokenRepository struct {
+	db *sql.DB
+}
+
+func NewAPITokenRepository(db *sql.DB) *APITokenRepository {
+	return &APITokenRepository{db: db}
+}
+
+func (r *APITokenRepository) Create(token *models.APIToken, tokenHash string) error {
+	query := `INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, folder_id, expires_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	return r.db.QueryRow(query, token.UserID, token.Name, token.Prefix, tokenHash, strings.Join(token.Scopes, " "),
+		token.FolderID, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (r *APITokenRepository) FindByHash(tokenHash string) (*models.APIToken, error) {
+	tokens, err := scanAPITokens(r.db.Query(apiTokenColumns+` WHERE token_hash = $1`, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &tokens[0], nil
+}
+
+// FindActiveByUser lists tokens that are neither revoked nor expired, newest
+// first.
+func (r *APITokenRepository) FindActiveByUser(userID int) ([]models.APIToken, error) {
+	query := apiTokenColumns + ` WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY created_at DESC`
+	return scanAPITokens(r.db.Query(query, userID, time.Now().UTC()))
+}
+
+func (r *APITokenRepository) Touch(id int, ip string) error {
+	_, err := r.db.Exec(`UPDATE api_tokens SET last_used_at = $1, last_used_ip = NULLIF($2, '') WHERE id = $3`,
+		time.Now().UTC(), ip, id)
+	return err
+}
+
+// Revoke returns false if the token belongs to someone else or was already
+// revoked.
+func (r *APITokenRepository) Revoke(id, userID int) (bool, error) {
+	query := `UPDATE api_tokens SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`
+	result, err := r.db.Exec(query, time.Now().UTC(), id, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+const apiTokenColumns = `SELECT id, user_id, name, prefix, scopes, folder_id, created_at, expires_at, last_used_at,
+			  COALESCE(last_used_ip, ''), revoked_at FROM api_tokens`
+
+func scanAPITokens(rows *sql.Rows, err error) ([]models.APIToken, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var t models.APIToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &scopes, &t.FolderID, &t.CreatedAt, &t.ExpiresAt,
+			&t.LastUsedAt, &t.LastUsedIP, &t.RevokedAt); err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+func (r *AuditRepository) Begin() (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+// LockChain serializes appends to the chain until tx ends.
+func (r *AuditRepository) LockChain(tx *sql.Tx) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_events'))`)
+	return err
+}
+
+// LastHash returns the hash at the head of the chain, or "" if nothing has
+// been chained yet.
+func (r *AuditRepository) LastHash(tx *sql.Tx) (string, error) {
+	var hash string
+	err := tx.QueryRow(`SELECT hash FROM audit_events WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1`).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// NextID reserves the id of the next event, which is part of its hash.
+func (r *AuditRepository) NextID(tx *sql.Tx) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT nextval(pg_get_serial_sequence('audit_events', 'id'))`).Scan(&id)
+	return id, err
+}
+
+func (r *AuditRepository) Insert(tx *sql.Tx, event *models.AuditEvent) error {
+	query := `INSERT INTO audit_events (id, occurred_at, actor_id, actor_email, action, target_type, target_id, ip_address,
+			  user_agent, outcome, details, prev_hash, hash, actor_type)
+			  VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), $10,
+			  NULLIF($11, ''), $12, $13, NULLIF($14, ''))`
+	_, err := tx.Exec(query, event.ID, event.OccurredAt, event.ActorID, event.ActorEmail, event.Action, event.TargetType,
+		event.TargetID, event.IPAddress, event.UserAgent, event.Outcome, event.Details, event.PrevHash, event.Hash,
+		event.ActorType)
+	return err
+}
+
+// FindAfter lists events by id, oldest first, for walking the chain.
+func (r *AuditRepository) FindAfter(afterID int64, limit int) ([]models.AuditEvent, error) {
+	return scanAuditEvents(r.db.Query(auditEventColumns+` WHERE id > $1 ORDER BY id LIMIT $2`, afterID, limit))
+}
+
+// Head returns the id and hash of the newest chained event; id is 0 if there
+// is none.
+func (r *AuditRepository) Head() (id int64, hash string, err error) {
+	err = r.db.QueryRow(`SELECT id, hash FROM audit_events WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1`).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	return
+}
+
+func (r *AuditRepository) CreateCheckpoint(cp *models.AuditCheckpoint) error {
+	query := `INSERT INTO audit_checkpoints (event_id, event_hash, key_id, signature, created_at)
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	return r.db.QueryRow(query, cp.EventID, cp.EventHash, cp.KeyID, cp.Signature, cp.CreatedAt).Scan(&cp.ID)
+}
+
+// LastCheckpoint returns nil if no checkpoint has been written.
+func (r *AuditRepository) LastCheckpoint() (*models.AuditCheckpoint, error) {
+	checkpoints, err := r.findCheckpoints(` ORDER BY id DESC LIMIT 1`)
+	if err != nil || len(checkpoints) == 0 {
+		return nil, err
+	}
+	return &checkpoints[0], nil
+}
+
+func (r *AuditRepository) FindCheckpoints() ([]models.AuditCheckpoint, error) {
+	return r.findCheckpoints(` ORDER BY id`)
+}
+
+func (r *AuditRepository) findCheckpoints(order string) ([]models.AuditCheckpoint, error) {
+	rows, err := r.db.Query(`SELECT id, event_id, event_hash, key_id, signature, created_at FROM audit_checkpoints` + order)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []models.AuditCheckpoint{}
+	for rows.Next() {
+		var cp models.AuditCheckpoint
+		if err := rows.Scan(&cp.ID, &cp.EventID, &cp.EventHash, &cp.KeyID, &cp.Signature, &cp.CreatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	return checkpoints, rows.Err()
+}
+
+// EventHash returns the stored hash of an event, and false if the event does
+// not exist.
+func (r *AuditRepository) EventHash(id int64) (string, bool, error) {
+	var hash string
+	err := r.db.QueryRow(`SELECT COALESCE(hash, '') FROM audit_events WHERE id = $1`, id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return hash, err == nil, err
+}
+
+// Find returns matching events, newest first.
+func (r *AuditRepository) Find(q *models.AuditQuery) ([]models.AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.UserID != 0 {
+		add("actor_id = $%d AND actor_type IS NULL", q.UserID)
+	}
+	if q.ServiceAccountID != 0 {
+		add("actor_id = $%d AND actor_type = 'service_account'", q.ServiceAccountID)
+	}
+	if q.TargetType != "" {
+		add("target_type = $%d", q.TargetType)
+	}
+	if q.TargetID != "" {
+		add("target_id = $%d", q.TargetID)
+	}
+	if strings.HasSuffix(q.Action, ".*") {
+		add("action LIKE $%d", strings.TrimSuffix(q.Action, "*")+"%")
+	} else if q.Action != "" {
+		add("action = $%d", q.Action)
+	}
+	if q.Outcome != "" {
+		add("outcome = $%d", q.Outcome)
+	}
+	if !q.From.IsZero() {
+		add("occurred_at >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("occurred_at < $%d", q.To)
+	}
+
+	query := auditEventColumns
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, q.Limit, q.Offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	return scanAuditEvents(r.db.Query(query, args...))
+}
+
+const auditEventColumns = `SELECT id, occurred_at, actor_id, COALESCE(actor_email, ''), action, COALESCE(target_type, ''),
+			  COALESCE(target_id, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), outcome, COALESCE(details, ''),
+			  COALESCE(prev_hash, ''), COALESCE(hash, ''), COALESCE(actor_type, '')
+			  FROM audit_events`
+
+func scanAuditEvents(rows *sql.Rows, err error) ([]models.AuditEvent, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		if err := rows.Scan(&event.ID, &event.OccurredAt, &event.ActorID, &event.ActorEmail, &event.Action,
+			&event.TargetType, &event.TargetID, &event.IPAddress, &event.UserAgent, &event.Outcome, &event.Details,
+			&event.PrevHash, &event.Hash, &event.ActorType); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type AuthPolicyRepository struct {
+	db *sql.DB
+}
+
+func NewAuthPolicyRepository(db *sql.DB) *AuthPolicyRepository {
+	return &AuthPolicyRepository{db: db}
+}
+
+func (r *AuthPolicyRepository) Get() (*models.AuthPolicy, error) {
+	policy := &models.AuthPolicy{}
+	query := `SELECT admin_require_phishing_resistant, updated_at FROM auth_policy`
+	err := r.db.QueryRow(query).Scan(&policy.AdminRequirePhishingResistant, &policy.UpdatedAt)
+	return policy, err
+}
+
+func (r *AuthPolicyRepository) Update(policy *models.AuthPolicy) error {
+	policy.UpdatedAt = time.Now().UTC()
+	query := `UPDATE auth_policy SET admin_require_phishing_resistant = $1, updated_at = $2`
+	_, err := r.db.Exec(query, policy.AdminRequirePhishingResistant, policy.UpdatedAt)
+	return err
+}
@@ -13,11 +13,19 @@ func NewCredentialRepository(db *sql.DB) *CredentialRepository {
 	return &CredentialRepository{db: db}
 }
 
+// NextID reserves an id for a credential that is about to be created, since the
+// id is part of what its ciphertext is bound to.
+func (r *CredentialRepository) NextID() (int, error) {
+	var id int
+	err := r.db.QueryRow(`SELECT nextval(pg_get_serial_sequence('credentials', 'id'))`).Scan(&id)
+	return id, err
+}
+
 func (r *CredentialRepository) Create(cred *models.Credential) error {
-	query := `INSERT INTO credentials (user_id, folder_id, service_name, username, password, notes) 
-			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at`
-	return r.db.QueryRow(query, cred.UserID, cred.FolderID, cred.ServiceName, cred.Username, cred.Password, cred.Notes).
-		Scan(&cred.ID, &cred.CreatedAt, &cred.UpdatedAt)
+	query := `INSERT INTO credentials (id, user_id, folder_id, service_name, username, password, notes) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at, updated_at`
+	return r.db.QueryRow(query, cred.ID, cred.UserID, cred.FolderID, cred.ServiceName, cred.Username, cred.Password, cred.Notes).
+		Scan(&cred.CreatedAt, &cred.UpdatedAt)
 }
 
 func (r *CredentialRepository) FindByUserID(userID int) ([]models.Credential, error) {
@@ -87,17 +95,10 @@ func (r *CredentialRepository) Delete(id int) error {
 	return err
 }
 
-func (r *CredentialRepository) FindByUserGroup(userGroup string) ([]models.Credential, error) {
-	query := `
-		SELECT DISTINCT c.id, c.user_id, c.folder_id, c.service_name, c.username, c.password, c.notes, c.created_at, c.updated_at 
-		FROM credentials c
-		LEFT JOIN folders f ON c.folder_id = f.id
-		LEFT JOIN folder_permissions fp ON f.id = fp.folder_id
-		WHERE c.folder_id IS NULL 
-		   OR (fp.user_group = $1 AND fp.can_read = true)
-		ORDER BY c.created_at DESC`
-	
-	rows, err := r.db.Query(query, userGroup)
+func (r *CredentialRepository) FindBatchAfter(afterID, limit int) ([]models.Credential, error) {
+	query := `SELECT id, user_id, folder_id, service_name, username, password, notes, created_at, updated_at 
+			  FROM credentials WHERE id > $1 ORDER BY id LIMIT $2`
+	rows, err := r.db.Query(query, afterID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -112,5 +113,55 @@ func (r *CredentialRepository) FindByUserGroup(userGroup string) ([]models.Crede
 		}
 		credentials = append(credentials, cred)
 	}
-	return credentials, nil
+	return credentials, rows.Err()
+}
+
+// ReplaceSealedFields writes re-encrypted field values only if the row still
+// holds the values in old, so a concurrent user update is never overwritten.
+// It reports whether the row was changed.
+func (r *CredentialRepository) ReplaceSealedFields(old, updated *models.Credential) (bool, error) {
+	query := `UPDATE credentials SET username = $1, password = $2, notes = $3 
+			  WHERE id = $4 AND username = $5 AND password = $6 AND COALESCE(notes, '') = $7`
+	result, err := r.db.Exec(query, updated.Username, updated.Password, updated.Notes, 
+		old.ID, old.Username, old.Password, old.Notes)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// RecordReveal stores who revealed a field by id and also by email or name,
+// so the history still names them after they are deleted.
+func (r *CredentialRepository) RecordReveal(reveal *models.CredentialReveal) error {
+	query := `INSERT INTO credential_reveals (credential_id, user_id, user_email, service_account_id, service_account_name, field, ip_address)
+			  VALUES ($1, NULLIF($2, 0), (SELECT email FROM users WHERE id = $2),
+			          NULLIF($3, 0), (SELECT name FROM service_accounts WHERE id = $3), $4, $5)
+			  RETURNING id, COALESCE(user_email, ''), COALESCE(service_account_name, ''), revealed_at`
+	return r.db.QueryRow(query, reveal.CredentialID, reveal.UserID, reveal.ServiceAccountID, reveal.Field,
+		reveal.IPAddress).Scan(&reveal.ID, &reveal.UserEmail, &reveal.ServiceAccountName, &reveal.RevealedAt)
+}
+
+func (r *CredentialRepository) FindReveals(credentialID int) ([]models.CredentialReveal, error) {
+	query := `SELECT cr.id, cr.credential_id, COALESCE(cr.user_id, 0), COALESCE(cr.user_email, ''),
+			  COALESCE(cr.service_account_id, 0), COALESCE(cr.service_account_name, ''), cr.field,
+			  COALESCE(cr.ip_address, ''), cr.revealed_at
+			  FROM credential_reveals cr
+			  WHERE cr.credential_id = $1 ORDER BY cr.revealed_at DESC`
+	rows, err := r.db.Query(query, credentialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reveals := []models.CredentialReveal{}
+	for rows.Next() {
+		var reveal models.CredentialReveal
+		if err := rows.Scan(&reveal.ID, &reveal.CredentialID, &reveal.UserID, &reveal.UserEmail,
+			&reveal.ServiceAccountID, &reveal.ServiceAccountName, &reveal.Field, &reveal.IPAddress, &reveal.RevealedAt); err != nil {
+			return nil, err
+		}
+		reveals = append(reveals, reveal)
+	}
+	return reveals, rows.Err()
 }
@@ -13,6 +13,15 @@ func NewDocumentRepository(db *sql.DB) *DocumentRepository {
 	return &DocumentRepository{db: db}
 }
 
+// NextID reserves an id for a document about to be created, so its data key
+// can be bound to the id before the row exists.
+func (r *DocumentRepository) NextID() (int, error) {
+	var id int
+	err := r.db.QueryRow(`SELECT nextval(pg_get_serial_sequence('documents', 'id'))`).Scan(&id)
+	return id, err
+}
+
+// Create inserts a document under the id reserved with NextID.
 func (r *DocumentRepository) Create(doc *models.Document) error {
 	tx, err := r.db.Begin()
 	if err != nil {
@@ -21,18 +30,20 @@ func (r *DocumentRepository) Create(doc *models.Document) error {
 	defer tx.Rollback()
 
 	query := `
-		INSERT INTO documents (filename, original_filename, file_size, mime_type, uploaded_by, description)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO documents (id, filename, original_filename, file_size, mime_type, uploaded_by, description, wrapped_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
 		RETURNING id, created_at, updated_at
 	`
 	err = tx.QueryRow(
 		query,
+		doc.ID,
 		doc.Filename,
 		doc.OriginalFilename,
 		doc.FileSize,
 		doc.MimeType,
 		doc.UploadedBy,
 		doc.Description,
+		doc.WrappedKey,
 	).Scan(&doc.ID, &doc.CreatedAt, &doc.UpdatedAt)
 	if err != nil {
 		return err
@@ -153,7 +164,8 @@ func (r *DocumentRepository) CheckPermission(documentID int, userGroup string, p
 func (r *DocumentRepository) GetByID(id int) (*models.Document, error) {
 	query := `
 		SELECT d.id, d.filename, d.original_filename, d.file_size, d.mime_type, 
-		       d.uploaded_by, u.email as uploader_email, d.description, d.created_at, d.updated_at
+		       d.uploaded_by, u.email as uploader_email, d.description, COALESCE(d.wrapped_key, ''),
+		       d.created_at, d.updated_at
 		FROM documents d
 		LEFT JOIN users u ON d.uploaded_by = u.id
 		WHERE d.id = $1
@@ -168,6 +180,7 @@ func (r *DocumentRepository) GetByID(id int) (*models.Document, error) {
 		&doc.UploadedBy,
 		&doc.UploaderEmail,
 		&doc.Description,
+		&doc.WrappedKey,
 		&doc.CreatedAt,
 		&doc.UpdatedAt,
 	)
@@ -180,6 +193,38 @@ func (r *DocumentRepository) GetByID(id int) (*models.Document, error) {
 	return &doc, nil
 }
 
+// FindWrappedKeys returns the wrapped key of every encrypted document, by document id.
+func (r *DocumentRepository) FindWrappedKeys() (map[int]string, error) {
+	query := `SELECT id, wrapped_key FROM documents WHERE wrapped_key IS NOT NULL`
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var wrappedKey string
+		if err := rows.Scan(&id, &wrappedKey); err != nil {
+			return nil, err
+		}
+		keys[id] = wrappedKey
+	}
+	return keys, rows.Err()
+}
+
+// ReplaceWrappedKey swaps a document's wrapped key only if it still holds oldKey.
+func (r *DocumentRepository) ReplaceWrappedKey(documentID int, oldKey, newKey string) (bool, error) {
+	query := `UPDATE documents SET wrapped_key = $1 WHERE id = $2 AND wrapped_key = $3`
+	result, err := r.db.Exec(query, newKey, documentID, oldKey)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
 func (r *DocumentRepository) Delete(id int) error {
 	query := `DELETE FROM documents WHERE id = $1`
 	_, err := r.db.Exec(query, id)
@@ -14,8 +14,8 @@ func NewFolderRepository(db *sql.DB) *FolderRepository {
 }
 
 func (r *FolderRepository) Create(folder *models.Folder) error {
-	query := `INSERT INTO folders (name, description) VALUES ($1, $2) RETURNING id, created_at`
-	return r.db.QueryRow(query, folder.Name, folder.Description).Scan(&folder.ID, &folder.CreatedAt)
+	query := `INSERT INTO folders (name, description, wrapped_key) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return r.db.QueryRow(query, folder.Name, folder.Description, folder.WrappedKey).Scan(&folder.ID, &folder.CreatedAt)
 }
 
 func (r *FolderRepository) FindAll() ([]models.Folder, error) {
@@ -90,8 +90,72 @@ func (r *FolderRepository) SetPermission(perm *models.FolderPermission) error {
 		perm.CanRead, perm.CanWrite, perm.CanDelete).Scan(&perm.ID)
 }
 
+// Delete removes the folder together with its credentials. The folder's wrapped
+// key goes with the row, so anything sealed under it is unrecoverable anyway.
 func (r *FolderRepository) Delete(folderID int) error {
-	query := `DELETE FROM folders WHERE id = $1`
-	_, err := r.db.Exec(query, folderID)
-	return err
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM credentials WHERE folder_id = $1`, folderID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM folders WHERE id = $1`, folderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *FolderRepository) GetWrappedKey(folderID int) (string, error) {
+	var wrappedKey string
+	query := `SELECT COALESCE(wrapped_key, '') FROM folders WHERE id = $1`
+	err := r.db.QueryRow(query, folderID).Scan(&wrappedKey)
+	return wrappedKey, err
+}
+
+// SetWrappedKeyIfEmpty stores a key for a folder that has none yet. It reports
+// false if another request got there first.
+func (r *FolderRepository) SetWrappedKeyIfEmpty(folderID int, wrappedKey string) (bool, error) {
+	query := `UPDATE folders SET wrapped_key = $1 WHERE id = $2 AND wrapped_key IS NULL`
+	result, err := r.db.Exec(query, wrappedKey, folderID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// FindWrappedKeys returns the wrapped key of every folder that has one, by folder id.
+func (r *FolderRepository) FindWrappedKeys() (map[int]string, error) {
+	query := `SELECT id, wrapped_key FROM folders WHERE wrapped_key IS NOT NULL`
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var wrappedKey string
+		if err := rows.Scan(&id, &wrappedKey); err != nil {
+			return nil, err
+		}
+		keys[id] = wrappedKey
+	}
+	return keys, rows.Err()
+}
+
+// ReplaceWrappedKey swaps a folder's wrapped key only if it still holds oldKey.
+func (r *FolderRepository) ReplaceWrappedKey(folderID int, oldKey, newKey string) (bool, error) {
+	query := `UPDATE folders SET wrapped_key = $1 WHERE id = $2 AND wrapped_key = $3`
+	result, err := r.db.Exec(query, newKey, folderID, oldKey)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
 }
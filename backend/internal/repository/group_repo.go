@@ -14,12 +14,12 @@ func NewGroupRepository(db *sql.DB) *GroupRepository {
 }
 
 func (r *GroupRepository) Create(group *models.Group) error {
-	query := `INSERT INTO groups (name, description) VALUES ($1, $2) RETURNING id, created_at`
-	return r.db.QueryRow(query, group.Name, group.Description).Scan(&group.ID, &group.CreatedAt)
+	query := `INSERT INTO groups (name, description, require_mfa) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return r.db.QueryRow(query, group.Name, group.Description, group.RequireMFA).Scan(&group.ID, &group.CreatedAt)
 }
 
 func (r *GroupRepository) FindAll() ([]models.Group, error) {
-	query := `SELECT id, name, description, created_at FROM groups ORDER BY name`
+	query := `SELECT id, name, description, require_mfa, created_at FROM groups ORDER BY name`
 	rows, err := r.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -29,7 +29,7 @@ func (r *GroupRepository) FindAll() ([]models.Group, error) {
 	var groups []models.Group
 	for rows.Next() {
 		var group models.Group
-		if err := rows.Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt); err != nil {
+		if err := rows.Scan(&group.ID, &group.Name, &group.Description, &group.RequireMFA, &group.CreatedAt); err != nil {
 			return nil, err
 		}
 		groups = append(groups, group)
@@ -39,8 +39,8 @@ func (r *GroupRepository) FindAll() ([]models.Group, error) {
 
 func (r *GroupRepository) FindByID(id int) (*models.Group, error) {
 	group := &models.Group{}
-	query := `SELECT id, name, description, created_at FROM groups WHERE id = $1`
-	err := r.db.QueryRow(query, id).Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt)
+	query := `SELECT id, name, description, require_mfa, created_at FROM groups WHERE id = $1`
+	err := r.db.QueryRow(query, id).Scan(&group.ID, &group.Name, &group.Description, &group.RequireMFA, &group.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +49,8 @@ func (r *GroupRepository) FindByID(id int) (*models.Group, error) {
 
 func (r *GroupRepository) FindByName(name string) (*models.Group, error) {
 	group := &models.Group{}
-	query := `SELECT id, name, description, created_at FROM groups WHERE name = $1`
-	err := r.db.QueryRow(query, name).Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt)
+	query := `SELECT id, name, description, require_mfa, created_at FROM groups WHERE name = $1`
+	err := r.db.QueryRow(query, name).Scan(&group.ID, &group.Name, &group.Description, &group.RequireMFA, &group.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -58,8 +58,8 @@ func (r *GroupRepository) FindByName(name string) (*models.Group, error) {
 }
 
 func (r *GroupRepository) Update(group *models.Group) error {
-	query := `UPDATE groups SET name = $1, description = $2 WHERE id = $3`
-	_, err := r.db.Exec(query, group.Name, group.Description, group.ID)
+	query := `UPDATE groups SET name = $1, description = $2, require_mfa = $3 WHERE id = $4`
+	_, err := r.db.Exec(query, group.Name, group.Description, group.RequireMFA, group.ID)
 	return err
 }
 
@@ -69,6 +69,17 @@ func (r *GroupRepository) Delete(id int) error {
 	return err
 }
 
+// RequiresMFA reports whether members of the group must use a second factor.
+// Unknown groups don't require one.
+func (r *GroupRepository) RequiresMFA(groupName string) (bool, error) {
+	var required bool
+	err := r.db.QueryRow(`SELECT require_mfa FROM groups WHERE name = $1`, groupName).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return required, err
+}
+
 func (r *GroupRepository) CountUsers(groupName string) (int, error) {
 	var count int
 	query := `SELECT COUNT(*) FROM users WHERE user_group = $1`
@@ -76,6 +87,12 @@ func (r *GroupRepository) CountUsers(groupName string) (int, error) {
 	return count, err
 }
 
+func (r *GroupRepository) CountServiceAccounts(groupName string) (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM service_accounts WHERE user_group = $1`, groupName).Scan(&count)
+	return count, err
+}
+
 func (r *GroupRepository) DeleteFolderPermissions(groupName string) error {
 	query := `DELETE FROM folder_permissions WHERE user_group = $1`
 	_, err := r.db.Exec(query, groupName)
@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+)
+
+// KeyMigrationRepository backs the offline re-encryption run by
+// credstore-admin. Everything except the listings happens inside transactions
+// owned by the caller, so each batch is committed or rolled back as a whole.
+type KeyMigrationRepository struct {
+	db *sql.DB
+}
+
+func NewKeyMigrationRepository(db *sql.DB) *KeyMigrationRepository {
+	return &KeyMigrationRepository{db: db}
+}
+
+func (r *KeyMigrationRepository) Begin() (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+// Totals counts folders, credentials, encrypted documents and TOTP secrets.
+func (r *KeyMigrationRepository) Totals() (folders, credentials, documents, mfaSecrets int, err error) {
+	query := `SELECT (SELECT COUNT(*) FROM folders),
+			  (SELECT COUNT(*) FROM credentials),
+			  (SELECT COUNT(*) FROM documents WHERE wrapped_key IS NOT NULL),
+			  (SELECT COUNT(*) FROM user_mfa)`
+	err = r.db.QueryRow(query).Scan(&folders, &credentials, &documents, &mfaSecrets)
+	return
+}
+
+// FindFolderKeysAfter lists folders by id; folders without a key have an empty WrappedKey.
+func (r *KeyMigrationRepository) FindFolderKeysAfter(tx *sql.Tx, afterID, limit int) ([]models.WrappedKey, error) {
+	query := `SELECT id, COALESCE(wrapped_key, '') FROM folders WHERE id > $1 ORDER BY id LIMIT $2`
+	return scanWrappedKeys(tx.Query(query, afterID, limit))
+}
+
+func (r *KeyMigrationRepository) SetFolderKey(tx *sql.Tx, folderID int, wrappedKey string) error {
+	_, err := tx.Exec(`UPDATE folders SET wrapped_key = $1 WHERE id = $2`, wrappedKey, folderID)
+	return err
+}
+
+// FindDocumentKeysAfter lists encrypted documents by id.
+func (r *KeyMigrationRepository) FindDocumentKeysAfter(tx *sql.Tx, afterID, limit int) ([]models.WrappedKey, error) {
+	query := `SELECT id, wrapped_key FROM documents WHERE wrapped_key IS NOT NULL AND id > $1 ORDER BY id LIMIT $2`
+	return scanWrappedKeys(tx.Query(query, afterID, limit))
+}
+
+func (r *KeyMigrationRepository) SetDocumentKey(tx *sql.Tx, documentID int, wrappedKey string) error {
+	_, err := tx.Exec(`UPDATE documents SET wrapped_key = $1 WHERE id = $2`, wrappedKey, documentID)
+	return err
+}
+
+// FindMFASecretsAfter lists TOTP secrets by user id, in the ID field.
+func (r *KeyMigrationRepository) FindMFASecretsAfter(tx *sql.Tx, afterUserID, limit int) ([]models.WrappedKey, error) {
+	query := `SELECT user_id, totp_secret FROM user_mfa WHERE user_id > $1 ORDER BY user_id LIMIT $2`
+	return scanWrappedKeys(tx.Query(query, afterUserID, limit))
+}
+
+func (r *KeyMigrationRepository) SetMFASecret(tx *sql.Tx, userID int, secret string) error {
+	_, err := tx.Exec(`UPDATE user_mfa SET totp_secret = $1 WHERE user_id = $2`, secret, userID)
+	return err
+}
+
+func (r *KeyMigrationRepository) FindFolderCredentials(tx *sql.Tx, folderID int) ([]models.Credential, error) {
+	query := `SELECT id, user_id, folder_id, service_name, username, password, COALESCE(notes, ''), created_at, updated_at
+			  FROM credentials WHERE folder_id = $1 ORDER BY id`
+	return scanCredentials(tx.Query(query, folderID))
+}
+
+func (r *KeyMigrationRepository) CountFolderCredentials(tx *sql.Tx, folderID int) (int, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM credentials WHERE folder_id = $1`, folderID).Scan(&count)
+	return count, err
+}
+
+// FindCredentialsAfter walks credentials by id, optionally only those outside folders.
+func (r *KeyMigrationRepository) FindCredentialsAfter(tx *sql.Tx, afterID, limit int, unfiledOnly bool) ([]models.Credential, error) {
+	query := `SELECT id, user_id, folder_id, service_name, username, password, COALESCE(notes, ''), created_at, updated_at
+			  FROM credentials WHERE id > $1 AND (NOT $3 OR folder_id IS NULL) ORDER BY id LIMIT $2`
+	return scanCredentials(tx.Query(query, afterID, limit, unfiledOnly))
+}
+
+func (r *KeyMigrationRepository) UpdateSealedFields(tx *sql.Tx, cred *models.Credential) error {
+	query := `UPDATE credentials SET username = $1, password = $2, notes = $3 WHERE id = $4`
+	_, err := tx.Exec(query, cred.Username, cred.Password, cred.Notes, cred.ID)
+	return err
+}
+
+func scanWrappedKeys(rows *sql.Rows, err error) ([]models.WrappedKey, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.WrappedKey
+	for rows.Next() {
+		var key models.WrappedKey
+		if err := rows.Scan(&key.ID, &key.WrappedKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func scanCredentials(rows *sql.Rows, err error) ([]models.Credential, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []models.Credential
+	for rows.Next() {
+		var cred models.Credential
+		if err := rows.Scan(&cred.ID, &cred.UserID, &cred.FolderID, &cred.ServiceName, &cred.Username,
+			&cred.Password, &cred.Notes, &cred.CreatedAt, &cred.UpdatedAt); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, cred)
+	}
+	return credentials, rows.Err()
+}
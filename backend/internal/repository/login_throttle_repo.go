@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type LoginThrottleRepository struct {
+	db *sql.DB
+}
+
+func NewLoginThrottleRepository(db *sql.DB) *LoginThrottleRepository {
+	return &LoginThrottleRepository{db: db}
+}
+
+func (r *LoginThrottleRepository) Begin() (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+// Reserve returns the row for key, creating it without failures if need be,
+// and locks it until tx ends so that concurrent logins take turns.
+func (r *LoginThrottleRepository) Reserve(tx *sql.Tx, scope, key string, now time.Time) (*models.LoginThrottle, error) {
+	query := `INSERT INTO login_throttles (scope, key, failures, last_failure_at) VALUES ($1, $2, 0, $3)
+			  ON CONFLICT (scope, key) DO UPDATE SET failures = login_throttles.failures
+			  RETURNING scope, key, failures, last_failure_at, locked_until`
+	t := &models.LoginThrottle{}
+	err := tx.QueryRow(query, scope, key, now).Scan(&t.Scope, &t.Key, &t.Failures, &t.LastFailureAt, &t.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RecordFailure counts a failed login at now. Failures before resetBefore are
+// forgotten, so the count starts over.
+func (r *LoginThrottleRepository) RecordFailure(tx *sql.Tx, scope, key string, now, resetBefore time.Time) (*models.LoginThrottle, error) {
+	query := `INSERT INTO login_throttles (scope, key, failures, last_failure_at) VALUES ($1, $2, 1, $3)
+			  ON CONFLICT (scope, key) DO UPDATE SET
+			  failures = CASE WHEN login_throttles.last_failure_at < $4 THEN 1 ELSE login_throttles.failures + 1 END,
+			  last_failure_at = $3
+			  RETURNING scope, key, failures, last_failure_at, locked_until`
+	t := &models.LoginThrottle{}
+	err := tx.QueryRow(query, scope, key, now, resetBefore).
+		Scan(&t.Scope, &t.Key, &t.Failures, &t.LastFailureAt, &t.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Refund takes back one failure counted for key.
+func (r *LoginThrottleRepository) Refund(scope, key string) error {
+	_, err := r.db.Exec(`UPDATE login_throttles SET failures = GREATEST(failures - 1, 0) WHERE scope = $1 AND key = $2`,
+		scope, key)
+	return err
+}
+
+func (r *LoginThrottleRepository) Lock(scope, key string, until time.Time) error {
+	_, err := r.db.Exec(`UPDATE login_throttles SET locked_until = $1 WHERE scope = $2 AND key = $3`, until, scope, key)
+	return err
+}
+
+// Delete forgets all failures for key, which also lifts a lockout. It reports
+// whether there was anything to forget.
+func (r *LoginThrottleRepository) Delete(scope, key string) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM login_throttles WHERE scope = $1 AND key = $2`, scope, key)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// FindLocked lists the keys of a scope locked out at now.
+func (r *LoginThrottleRepository) FindLocked(scope string, now time.Time) (map[string]time.Time, error) {
+	rows, err := r.db.Query(`SELECT key, locked_until FROM login_throttles WHERE scope = $1 AND locked_until > $2`,
+		scope, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locked := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var until time.Time
+		if err := rows.Scan(&key, &until); err != nil {
+			return nil, err
+		}
+		locked[key] = until
+	}
+	return locked, rows.Err()
+}
+
+// DeleteStale removes rows with no failure since before and no lockout in
+// force at now.
+func (r *LoginThrottleRepository) DeleteStale(before, now time.Time) (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM login_throttles WHERE last_failure_at < $1
+			  AND (locked_until IS NULL OR locked_until <= $2)`, before, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type MFARepository struct {
+	db *sql.DB
+}
+
+func NewMFARepository(db *sql.DB) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+// FindByUser returns nil if the user never started enrolling.
+func (r *MFARepository) FindByUser(userID int) (*models.UserMFA, error) {
+	mfa := &models.UserMFA{}
+	query := `SELECT user_id, totp_secret, enabled, enabled_at, last_used_step FROM user_mfa WHERE user_id = $1`
+	err := r.db.QueryRow(query, userID).Scan(&mfa.UserID, &mfa.TOTPSecret, &mfa.Enabled, &mfa.EnabledAt, &mfa.LastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mfa, nil
+}
+
+// SavePending stores a new secret awaiting its first code. It never replaces
+// an enabled secret.
+func (r *MFARepository) SavePending(userID int, secret string) (bool, error) {
+	query := `INSERT INTO user_mfa (user_id, totp_secret) VALUES ($1, $2)
+			  ON CONFLICT (user_id) DO UPDATE SET totp_secret = EXCLUDED.totp_secret, last_used_step = 0,
+			  created_at = CURRENT_TIMESTAMP
+			  WHERE user_mfa.enabled = FALSE`
+	result, err := r.db.Exec(query, userID, secret)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Enable switches MFA on and replaces the recovery codes, in one transaction.
+func (r *MFARepository) Enable(userID int, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE user_mfa SET enabled = TRUE, enabled_at = $1 WHERE user_id = $2`,
+		time.Now().UTC(), userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *MFARepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseStep records an accepted TOTP time step. It returns false if that step
+// or a later one was already used, i.e. the code is a replay.
+func (r *MFARepository) UseStep(userID int, step int64) (bool, error) {
+	result, err := r.db.Exec(`UPDATE user_mfa SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Delete removes the second factor and its recovery codes.
+func (r *MFARepository) Delete(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *MFARepository) FindUnusedRecoveryCodes(userID int) ([]models.RecoveryCode, error) {
+	rows, err := r.db.Query(`SELECT id, code_hash FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []models.RecoveryCode
+	for rows.Next() {
+		var code models.RecoveryCode
+		if err := rows.Scan(&code.ID, &code.CodeHash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// UseRecoveryCode returns false if the code was used concurrently.
+func (r *MFARepository) UseRecoveryCode(id int) (bool, error) {
+	result, err := r.db.Exec(`UPDATE mfa_recovery_codes SET used_at = $1 WHERE id = $2 AND used_at IS NULL`, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// FindSecrets returns every stored TOTP secret by user id, for key rotation.
+func (r *MFARepository) FindSecrets() (map[int]string, error) {
+	rows, err := r.db.Query(`SELECT user_id, totp_secret FROM user_mfa`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := make(map[int]string)
+	for rows.Next() {
+		var userID int
+		var secret string
+		if err := rows.Scan(&userID, &secret); err != nil {
+			return nil, err
+		}
+		secrets[userID] = secret
+	}
+	return secrets, rows.Err()
+}
+
+// ReplaceSecret swaps a re-encrypted secret in, unless it changed meanwhile.
+func (r *MFARepository) ReplaceSecret(userID int, oldSecret, newSecret string) (bool, error) {
+	result, err := r.db.Exec(`UPDATE user_mfa SET totp_secret = $1 WHERE user_id = $2 AND totp_secret = $3`,
+		newSecret, userID, oldSecret)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
@@ -0,0 +1,43 @@
+package repository
+
+import "database/sql"
+
+type PasswordHistoryRepository struct {
+	db *sql.DB
+}
+
+func NewPasswordHistoryRepository(db *sql.DB) *PasswordHistoryRepository {
+	return &PasswordHistoryRepository{db: db}
+}
+
+// Add records a password hash a user set and forgets all but their keep
+// most recent ones.
+func (r *PasswordHistoryRepository) Add(userID int, passwordHash string, keep int) error {
+	if _, err := r.db.Exec(`INSERT INTO password_history (user_id, password_hash) VALUES ($1, $2)`,
+		userID, passwordHash); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`DELETE FROM password_history WHERE user_id = $1 AND id NOT IN
+			  (SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`, userID, keep)
+	return err
+}
+
+// FindRecent returns the hashes of a user's last n passwords, newest first.
+func (r *PasswordHistoryRepository) FindRecent(userID, n int) ([]string, error) {
+	rows, err := r.db.Query(`SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2`,
+		userID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
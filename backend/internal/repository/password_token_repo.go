@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type PasswordTokenRepository struct {
+	db *sql.DB
+}
+
+func NewPasswordTokenRepository(db *sql.DB) *PasswordTokenRepository {
+	return &PasswordTokenRepository{db: db}
+}
+
+func (r *PasswordTokenRepository) Create(token *models.PasswordToken, tokenHash string) error {
+	query := `INSERT INTO password_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)
+			  RETURNING id, created_at`
+	return r.db.QueryRow(query, token.UserID, token.Purpose, tokenHash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (r *PasswordTokenRepository) FindByHash(tokenHash string) (*models.PasswordToken, error) {
+	t := &models.PasswordToken{}
+	query := `SELECT t.id, t.user_id, u.email, t.purpose, t.created_at, t.expires_at, t.used_at
+			  FROM password_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash = $1`
+	err := r.db.QueryRow(query, tokenHash).
+		Scan(&t.ID, &t.UserID, &t.Email, &t.Purpose, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Use marks a token used at now. It returns false if the token was already
+// used or has expired, so only one caller can use it.
+func (r *PasswordTokenRepository) Use(id int, now time.Time) (bool, error) {
+	result, err := r.db.Exec(`UPDATE password_tokens SET used_at = $1 WHERE id = $2 AND used_at IS NULL AND expires_at > $1`,
+		now, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// DeleteForUser removes a user's tokens for purpose, or all of them if
+// purpose is empty.
+func (r *PasswordTokenRepository) DeleteForUser(userID int, purpose string) error {
+	_, err := r.db.Exec(`DELETE FROM password_tokens WHERE user_id = $1 AND ($2 = '' OR purpose = $2)`, userID, purpose)
+	return err
+}
+
+// DeleteStale removes tokens that were used or expired before now.
+func (r *PasswordTokenRepository) DeleteStale(now time.Time) (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM password_tokens WHERE used_at IS NOT NULL OR expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
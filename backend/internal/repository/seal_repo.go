@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+)
+
+type SealRepository struct {
+	db *sql.DB
+}
+
+func NewSealRepository(db *sql.DB) *SealRepository {
+	return &SealRepository{db: db}
+}
+
+// Get returns the seal configuration, or nil if the vault was never initialized.
+func (r *SealRepository) Get() (*models.SealConfig, error) {
+	cfg := &models.SealConfig{}
+	query := `SELECT secret_shares, secret_threshold, key_version, key_check, created_at FROM seal_config WHERE id = 1`
+	err := r.db.QueryRow(query).Scan(&cfg.SecretShares, &cfg.SecretThreshold, &cfg.KeyVersion, &cfg.KeyCheck, &cfg.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Create stores the seal configuration. It reports false if one already exists.
+func (r *SealRepository) Create(cfg *models.SealConfig) (bool, error) {
+	query := `INSERT INTO seal_config (id, secret_shares, secret_threshold, key_version, key_check)
+			  VALUES (1, $1, $2, $3, $4) ON CONFLICT (id) DO NOTHING RETURNING created_at`
+	err := r.db.QueryRow(query, cfg.SecretShares, cfg.SecretThreshold, cfg.KeyVersion, cfg.KeyCheck).Scan(&cfg.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
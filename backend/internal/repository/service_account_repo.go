@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type ServiceAccountRepository struct {
+	db *sql.DB
+}
+
+func NewServiceAccountRepository(db *sql.DB) *ServiceAccountRepository {
+	return &ServiceAccountRepository{db: db}
+}
+
+func (r *ServiceAccountRepository) Create(account *models.ServiceAccount) error {
+	query := `INSERT INTO service_accounts (name, description, user_group) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return r.db.QueryRow(query, account.Name, account.Description, account.UserGroup).
+		Scan(&account.ID, &account.CreatedAt)
+}
+
+func (r *ServiceAccountRepository) FindAll() ([]models.ServiceAccount, error) {
+	return scanServiceAccounts(r.db.Query(serviceAccountColumns + ` ORDER BY name`))
+}
+
+func (r *ServiceAccountRepository) FindByID(id int) (*models.ServiceAccount, error) {
+	accounts, err := scanServiceAccounts(r.db.Query(serviceAccountColumns+` WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &accounts[0], nil
+}
+
+func (r *ServiceAccountRepository) FindByName(name string) (*models.ServiceAccount, error) {
+	accounts, err := scanServiceAccounts(r.db.Query(serviceAccountColumns+` WHERE name = $1`, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &accounts[0], nil
+}
+
+func (r *ServiceAccountRepository) Update(account *models.ServiceAccount) error {
+	query := `UPDATE service_accounts SET description = $1, user_group = $2, disabled = $3 WHERE id = $4`
+	_, err := r.db.Exec(query, account.Description, account.UserGroup, account.Disabled, account.ID)
+	return err
+}
+
+func (r *ServiceAccountRepository) Delete(id int) error {
+	result, err := r.db.Exec(`DELETE FROM service_accounts WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (r *ServiceAccountRepository) CreateCredential(cred *models.ServiceAccountCredential) error {
+	query := `INSERT INTO service_account_credentials (service_account_id, kind, name, fingerprint, prefix, subject, expires_at)
+			  VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7) RETURNING id, created_at`
+	return r.db.QueryRow(query, cred.ServiceAccountID, cred.Kind, cred.Name, cred.Fingerprint, cred.Prefix,
+		cred.Subject, cred.ExpiresAt).Scan(&cred.ID, &cred.CreatedAt)
+}
+
+func (r *ServiceAccountRepository) FindCredentialByFingerprint(kind, fingerprint string) (*models.ServiceAccountCredential, error) {
+	creds, err := scanServiceAccountCredentials(r.db.Query(serviceAccountCredentialColumns+
+		` WHERE kind = $1 AND fingerprint = $2`, kind, fingerprint))
+	if err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &creds[0], nil
+}
+
+// FindActiveCredentials lists an account's keys and certificates that are
+// neither revoked nor expired.
+func (r *ServiceAccountRepository) FindActiveCredentials(accountID int) ([]models.ServiceAccountCredential, error) {
+	query := serviceAccountCredentialColumns + ` WHERE service_account_id = $1 AND revoked_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > $2) ORDER BY created_at DESC`
+	return scanServiceAccountCredentials(r.db.Query(query, accountID, time.Now().UTC()))
+}
+
+func (r *ServiceAccountRepository) TouchCredential(id int, ip string) error {
+	_, err := r.db.Exec(`UPDATE service_account_credentials SET last_used_at = $1, last_used_ip = NULLIF($2, '') WHERE id = $3`,
+		time.Now().UTC(), ip, id)
+	return err
+}
+
+// RevokeCredential returns false if the credential belongs to another account
+// or was already revoked.
+func (r *ServiceAccountRepository) RevokeCredential(id, accountID int) (bool, error) {
+	query := `UPDATE service_account_credentials SET revoked_at = $1
+			  WHERE id = $2 AND service_account_id = $3 AND revoked_at IS NULL`
+	result, err := r.db.Exec(query, time.Now().UTC(), id, accountID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+const serviceAccountColumns = `SELECT id, name, COALESCE(description, ''), user_group, disabled, created_at FROM service_accounts`
+
+func scanServiceAccounts(rows *sql.Rows, err error) ([]models.ServiceAccount, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []models.ServiceAccount{}
+	for rows.Next() {
+		var a models.ServiceAccount
+		if err := rows.Scan(&a.ID, &a.Name, &a.Description, &a.UserGroup, &a.Disabled, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+const serviceAccountCredentialColumns = `SELECT id, service_account_id, kind, name, fingerprint, COALESCE(prefix, ''),
+			  COALESCE(subject, ''), created_at, expires_at, last_used_at, COALESCE(last_used_ip, ''), revoked_at
+			  FROM service_account_credentials`
+
+func scanServiceAccountCredentials(rows *sql.Rows, err error) ([]models.ServiceAccountCredential, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []models.ServiceAccountCredential{}
+	for rows.Next() {
+		var c models.ServiceAccountCredential
+		if err := rows.Scan(&c.ID, &c.ServiceAccountID, &c.Kind, &c.Name, &c.Fingerprint, &c.Prefix, &c.Subject,
+			&c.CreatedAt, &c.ExpiresAt, &c.LastUsedAt, &c.LastUsedIP, &c.RevokedAt); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"time"
+)
+
+type SessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+func (r *SessionRepository) Create(session *models.Session) error {
+	query := `INSERT INTO sessions (user_id, ip_address, user_agent, auth_method, expires_at)
+			  VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5) RETURNING id, created_at, last_used_at`
+	return r.db.QueryRow(query, session.UserID, session.IPAddress, session.UserAgent, session.AuthMethod, session.ExpiresAt).
+		Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt)
+}
+
+func (r *SessionRepository) FindByID(id int) (*models.Session, error) {
+	sessions, err := scanSessions(r.db.Query(sessionColumns+` WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &sessions[0], nil
+}
+
+// FindActiveByUser lists sessions that are neither revoked nor expired, most
+// recently used first.
+func (r *SessionRepository) FindActiveByUser(userID int) ([]models.Session, error) {
+	query := sessionColumns + ` WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY last_used_at DESC`
+	return scanSessions(r.db.Query(query, userID, time.Now().UTC()))
+}
+
+// Touch records a refresh and moves the expiry.
+func (r *SessionRepository) Touch(id int, ip, userAgent string, expiresAt time.Time) error {
+	query := `UPDATE sessions SET last_used_at = $1, ip_address = NULLIF($2, ''), user_agent = NULLIF($3, ''), expires_at = $4
+			  WHERE id = $5`
+	_, err := r.db.Exec(query, time.Now().UTC(), ip, userAgent, expiresAt, id)
+	return err
+}
+
+// Revoke ends a session, returning false if it belongs to someone else or was
+// already revoked.
+func (r *SessionRepository) Revoke(id, userID int, reason string) (bool, error) {
+	query := `UPDATE sessions SET revoked_at = $1, revoked_reason = $2 WHERE id = $3 AND user_id = $4 AND revoked_at IS NULL`
+	result, err := r.db.Exec(query, time.Now().UTC(), reason, id, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// RevokeAllForUser ends every active session of a user and returns how many
+// there were.
+func (r *SessionRepository) RevokeAllForUser(userID int, reason string) (int, error) {
+	query := `UPDATE sessions SET revoked_at = $1, revoked_reason = $2 WHERE user_id = $3 AND revoked_at IS NULL`
+	result, err := r.db.Exec(query, time.Now().UTC(), reason, userID)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+func (r *SessionRepository) CreateRefreshToken(sessionID int, tokenHash string) error {
+	_, err := r.db.Exec(`INSERT INTO refresh_tokens (session_id, token_hash) VALUES ($1, $2)`, sessionID, tokenHash)
+	return err
+}
+
+// UseRefreshToken marks a refresh token used and returns its session. reused
+// is true if the token had already been used; sql.ErrNoRows means it never
+// existed.
+func (r *SessionRepository) UseRefreshToken(tokenHash string) (sessionID int, reused bool, err error) {
+	query := `UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL RETURNING session_id`
+	err = r.db.QueryRow(query, time.Now().UTC(), tokenHash).Scan(&sessionID)
+	if err != sql.ErrNoRows {
+		return sessionID, false, err
+	}
+
+	err = r.db.QueryRow(`SELECT session_id FROM refresh_tokens WHERE token_hash = $1`, tokenHash).Scan(&sessionID)
+	if err != nil {
+		return 0, false, err
+	}
+	return sessionID, true, nil
+}
+
+const sessionColumns = `SELECT id, user_id, COALESCE(ip_address, ''), COALESCE(user_agent, ''), auth_method, created_at, last_used_at,
+			  expires_at, revoked_at, COALESCE(revoked_reason, '') FROM sessions`
+
+func scanSessions(rows *sql.Rows, err error) ([]models.Session, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.IPAddress, &s.UserAgent, &s.AuthMethod, &s.CreatedAt, &s.LastUsedAt,
+			&s.ExpiresAt, &s.RevokedAt, &s.RevokedReason); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"credential-store/internal/models"
 	"database/sql"
+	"time"
 )
 
 type UserRepository struct {
@@ -14,63 +15,152 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 }
 
 func (r *UserRepository) Create(user *models.User) error {
-	query := `INSERT INTO users (email, password, role, user_group) VALUES ($1, $2, $3, $4) RETURNING id, created_at`
-	return r.db.QueryRow(query, user.Email, user.Password, user.Role, user.UserGroup).Scan(&user.ID, &user.CreatedAt)
+	if user.AuthSource == "" {
+		user.AuthSource = "local"
+	}
+	query := `INSERT INTO users (email, password, role, user_group, auth_source, external_id)
+			  VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id, created_at, status`
+	return r.db.QueryRow(query, user.Email, user.Password, user.Role, user.UserGroup, user.AuthSource, user.ExternalID).
+		Scan(&user.ID, &user.CreatedAt, &user.Status)
 }
 
 func (r *UserRepository) FindByEmail(email string) (*models.User, error) {
-	user := &models.User{}
-	query := `SELECT id, email, password, role, user_group, created_at FROM users WHERE email = $1`
-	err := r.db.QueryRow(query, email).Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.UserGroup, &user.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return user, nil
+	return findUser(r.db.Query(userColumns+` WHERE email = $1`, email))
 }
 
 func (r *UserRepository) FindByID(id int) (*models.User, error) {
-	user := &models.User{}
-	query := `SELECT id, email, password, role, user_group, created_at FROM users WHERE id = $1`
-	err := r.db.QueryRow(query, id).Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.UserGroup, &user.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return user, nil
+	return findUser(r.db.Query(userColumns+` WHERE id = $1`, id))
 }
 
 func (r *UserRepository) FindAll() ([]models.User, error) {
-	query := `SELECT id, email, password, role, user_group, created_at FROM users ORDER BY created_at DESC`
-	rows, err := r.db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return scanUsers(r.db.Query(userColumns + ` ORDER BY created_at DESC`))
+}
 
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		if err := rows.Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.UserGroup, &user.CreatedAt); err != nil {
-			return nil, err
-		}
-		users = append(users, user)
-	}
-	return users, nil
+// FindByExternalID finds the user an identity provider knows as externalID.
+func (r *UserRepository) FindByExternalID(source, externalID string) (*models.User, error) {
+	return findUser(r.db.Query(userColumns+` WHERE auth_source = $1 AND external_id = $2`, source, externalID))
 }
 
-func (r *UserRepository) Update(user *models.User) error {
-	query := `UPDATE users SET email = $1, password = $2, role = $3, user_group = $4 WHERE id = $5`
-	_, err := r.db.Exec(query, user.Email, user.Password, user.Role, user.UserGroup, user.ID)
+// FindBySource lists the users provisioned from an identity provider.
+func (r *UserRepository) FindBySource(source string) ([]models.User, error) {
+	return scanUsers(r.db.Query(userColumns+` WHERE auth_source = $1 ORDER BY id`, source))
+}
+
+// FindExpired lists active users whose account expired by now.
+func (r *UserRepository) FindExpired(now time.Time) ([]models.User, error) {
+	return scanUsers(r.db.Query(userColumns+` WHERE status = 'active' AND expires_at <= $1 ORDER BY id`, now))
+}
+
+// FindInactive lists active users with no sign of life since before: no
+// login, session refresh, personal access token use or reactivation, and not
+// created since.
+func (r *UserRepository) FindInactive(before time.Time) ([]models.User, error) {
+	return scanUsers(r.db.Query(userColumns+` WHERE status = 'active'
+			  AND GREATEST(created_at, last_login_at, status_changed_at,
+			  (SELECT MAX(last_used_at) FROM sessions WHERE sessions.user_id = users.id),
+			  (SELECT MAX(last_used_at) FROM api_tokens WHERE api_tokens.user_id = users.id)) < $1
+			  ORDER BY id`, before))
+}
+
+// CountActiveAdmins counts the admins who can still log in at now.
+func (r *UserRepository) CountActiveAdmins(now time.Time) (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = 'admin' AND status = 'active'
+			  AND (expires_at IS NULL OR expires_at > $1)`, now).Scan(&count)
+	return count, err
+}
+
+// SetStatus suspends a user, for reason, or reactivates them, bumping the
+// token generation so a suspended user's tokens stop working at once.
+func (r *UserRepository) SetStatus(userID int, status, reason string, now time.Time) error {
+	query := `UPDATE users SET status = $1, suspended_reason = NULLIF($2, ''), status_changed_at = $3,
+			  token_generation = token_generation + 1 WHERE id = $4`
+	return updateUser(r.db.Exec(query, status, reason, now, userID))
+}
+
+// SetExpiry sets when the account stops working; nil means never.
+func (r *UserRepository) SetExpiry(userID int, expiresAt *time.Time) error {
+	return updateUser(r.db.Exec(`UPDATE users SET expires_at = $1 WHERE id = $2`, expiresAt, userID))
+}
+
+// RecordLogin remembers when and from where the user last logged in.
+func (r *UserRepository) RecordLogin(userID int, ip string, at time.Time) error {
+	_, err := r.db.Exec(`UPDATE users SET last_login_at = $1, last_login_ip = NULLIF($2, '') WHERE id = $3`, at, ip, userID)
 	return err
 }
 
+// Update saves the user and bumps its token generation, so tokens issued with
+// the old role or group stop working.
+func (r *UserRepository) Update(user *models.User) error {
+	query := `UPDATE users SET email = $1, password = $2, role = $3, user_group = $4, auth_source = $5, external_id = NULLIF($6, ''),
+			  token_generation = token_generation + 1
+			  WHERE id = $7 RETURNING token_generation`
+	return r.db.QueryRow(query, user.Email, user.Password, user.Role, user.UserGroup, user.AuthSource, user.ExternalID, user.ID).
+		Scan(&user.TokenGeneration)
+}
+
 func (r *UserRepository) Delete(id int) error {
 	query := `DELETE FROM users WHERE id = $1`
 	_, err := r.db.Exec(query, id)
 	return err
 }
 
+// UpdatePassword also bumps the token generation.
 func (r *UserRepository) UpdatePassword(userID int, hashedPassword string) error {
-	query := `UPDATE users SET password = $1 WHERE id = $2`
+	query := `UPDATE users SET password = $1, token_generation = token_generation + 1 WHERE id = $2`
 	_, err := r.db.Exec(query, hashedPassword, userID)
 	return err
 }
+
+// FindTokenState returns what decides whether a user's access tokens still
+// work, or sql.ErrNoRows for a deleted user.
+func (r *UserRepository) FindTokenState(userID int) (generation int, status string, expiresAt *time.Time, err error) {
+	err = r.db.QueryRow(`SELECT token_generation, status, expires_at FROM users WHERE id = $1`, userID).
+		Scan(&generation, &status, &expiresAt)
+	return generation, status, expiresAt, err
+}
+
+// updateUser returns sql.ErrNoRows if the user doesn't exist.
+func updateUser(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+const userColumns = `SELECT id, email, password, role, user_group, created_at, token_generation, auth_source,
+			  COALESCE(external_id, ''), status, COALESCE(suspended_reason, ''), status_changed_at, expires_at,
+			  last_login_at, COALESCE(last_login_ip, '') FROM users`
+
+func findUser(rows *sql.Rows, err error) (*models.User, error) {
+	users, err := scanUsers(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &users[0], nil
+}
+
+func scanUsers(rows *sql.Rows, err error) ([]models.User, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.UserGroup, &user.CreatedAt,
+			&user.TokenGeneration, &user.AuthSource, &user.ExternalID, &user.Status, &user.SuspendedReason,
+			&user.StatusChangedAt, &user.ExpiresAt, &user.LastLoginAt, &user.LastLoginIP); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
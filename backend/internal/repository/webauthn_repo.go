@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type WebAuthnRepository struct {
+	db *sql.DB
+}
+
+func NewWebAuthnRepository(db *sql.DB) *WebAuthnRepository {
+	return &WebAuthnRepository{db: db}
+}
+
+// Create returns false if the credential is already registered, to this or
+// another user.
+func (r *WebAuthnRepository) Create(cred *models.WebAuthnCredential) (bool, error) {
+	query := `INSERT INTO webauthn_credentials (user_id, credential_id, public_key, user_handle, sign_count, name,
+			  aaguid, transports, user_verified)
+			  VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')::uuid, NULLIF($8, ''), $9)
+			  ON CONFLICT (credential_id) DO NOTHING
+			  RETURNING id, created_at`
+	err := r.db.QueryRow(query, cred.UserID, cred.CredentialID, cred.PublicKey, cred.UserHandle, int64(cred.SignCount),
+		cred.Name, cred.AAGUID, strings.Join(cred.Transports, ","), cred.UserVerified).Scan(&cred.ID, &cred.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *WebAuthnRepository) FindByUser(userID int) ([]models.WebAuthnCredential, error) {
+	return scanWebAuthnCredentials(r.db.Query(webauthnColumns+` WHERE user_id = $1 ORDER BY id`, userID))
+}
+
+// FindByCredentialID returns sql.ErrNoRows for unknown credentials.
+func (r *WebAuthnRepository) FindByCredentialID(credentialID []byte) (*models.WebAuthnCredential, error) {
+	creds, err := scanWebAuthnCredentials(r.db.Query(webauthnColumns+` WHERE credential_id = $1`, credentialID))
+	if err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &creds[0], nil
+}
+
+func (r *WebAuthnRepository) CountByUser(userID int) (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1`, userID).Scan(&count)
+	return count, err
+}
+
+// UserHandle returns the handle of the user's existing credentials, or nil.
+func (r *WebAuthnRepository) UserHandle(userID int) ([]byte, error) {
+	var handle []byte
+	err := r.db.QueryRow(`SELECT user_handle FROM webauthn_credentials WHERE user_id = $1 LIMIT 1`, userID).Scan(&handle)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return handle, err
+}
+
+// RecordUse stores the new signature counter, unless another login with the
+// same credential got there first with a counter at least as high.
+func (r *WebAuthnRepository) RecordUse(id int, oldCount, newCount uint32) (bool, error) {
+	query := `UPDATE webauthn_credentials SET sign_count = $1, last_used_at = $2
+			  WHERE id = $3 AND (sign_count = $4 OR sign_count < $1)`
+	result, err := r.db.Exec(query, int64(newCount), time.Now().UTC(), id, int64(oldCount))
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// Delete returns false if the credential doesn't belong to the user.
+func (r *WebAuthnRepository) Delete(id, userID int) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (r *WebAuthnRepository) DeleteAllForUser(userID int) error {
+	_, err := r.db.Exec(`DELETE FROM webauthn_credentials WHERE user_id = $1`, userID)
+	return err
+}
+
+const webauthnColumns = `SELECT id, user_id, credential_id, public_key, user_handle, sign_count, name,
+			  COALESCE(aaguid::text, ''), COALESCE(transports, ''), user_verified, created_at, last_used_at
+			  FROM webauthn_credentials`
+
+func scanWebAuthnCredentials(rows *sql.Rows, err error) ([]models.WebAuthnCredential, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []models.WebAuthnCredential{}
+	for rows.Next() {
+		var c models.WebAuthnCredential
+		var signCount int64
+		var transports string
+		if err := rows.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.PublicKey, &c.UserHandle, &signCount, &c.Name,
+			&c.AAGUID, &transports, &c.UserVerified, &c.CreatedAt, &c.LastUsedAt); err != nil {
+			return nil, err
+		}
+		c.SignCount = uint32(signCount)
+		if transports != "" {
+			c.Transports = strings.Split(transports, ",")
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// accountExpiryActor is recorded as the actor of the expiry job's changes.
+const accountExpiryActor = "account-expiry"
+
+// AccountExpiryService suspends users whose account has expired and, when
+// idleAfter is set, users who haven't logged in, refreshed a session or used
+// a personal access token for that long. Their sessions end; their credentials and documents
+// stay. The last active admin is never suspended for inactivity, so someone
+// is always left to reactivate the others.
+type AccountExpiryService struct {
+	userRepo       *repository.UserRepository
+	authService    *AuthService
+	sessionService *SessionService
+	auditService   *AuditService
+	idleAfter      time.Duration
+}
+
+// NewAccountExpiryService leaves idle users alone when idleAfter is 0.
+func NewAccountExpiryService(userRepo *repository.UserRepository, authService *AuthService,
+	sessionService *SessionService, auditService *AuditService, idleAfter time.Duration) *AccountExpiryService {
+	return &AccountExpiryService{
+		userRepo:       userRepo,
+		authService:    authService,
+		sessionService: sessionService,
+		auditService:   auditService,
+		idleAfter:      idleAfter,
+	}
+}
+
+// Run suspends the expired and idle users once and returns how many it
+// suspended.
+func (s *AccountExpiryService) Run() (int, error) {
+	now := time.Now().UTC()
+	suspended := 0
+
+	expired, err := s.userRepo.FindExpired(now)
+	if err != nil {
+		return 0, err
+	}
+	for i := range expired {
+		details := "expired " + expired[i].ExpiresAt.Format(time.RFC3339)
+		if err := s.suspend(&expired[i], SuspendedExpired, details); err != nil {
+			log.Printf("Failed to suspend expired user %d: %v", expired[i].ID, err)
+			continue
+		}
+		suspended++
+	}
+
+	if s.idleAfter <= 0 {
+		return suspended, nil
+	}
+	idle, err := s.userRepo.FindInactive(now.Add(-s.idleAfter))
+	if err != nil {
+		return suspended, err
+	}
+	for i := range idle {
+		user := &idle[i]
+		if user.Role == "admin" {
+			admins, err := s.userRepo.CountActiveAdmins(now)
+			if err != nil {
+				return suspended, err
+			}
+			if admins <= 1 {
+				log.Printf("Not suspending idle user %d: it is the last active admin", user.ID)
+				continue
+			}
+		}
+		details := fmt.Sprintf("no activity for %s", humanDuration(s.idleAfter))
+		if err := s.suspend(user, SuspendedInactive, details); err != nil {
+			log.Printf("Failed to suspend idle user %d: %v", user.ID, err)
+			continue
+		}
+		suspended++
+	}
+	return suspended, nil
+}
+
+// StartSuspender runs the job every interval in the background.
+func (s *AccountExpiryService) StartSuspender(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := s.Run(); err != nil {
+				log.Printf("Account expiry job failed: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *AccountExpiryService) suspend(user *models.User, reason, details string) error {
+	if err := s.authService.SetStatus(user.ID, UserSuspended, reason); err != nil {
+		return err
+	}
+	if _, err := s.sessionService.RevokeAll(user.ID, SessionSuspended); err != nil {
+		details += " (failed to revoke sessions: " + err.Error() + ")"
+	}
+	s.auditService.Record(&models.AuditEvent{
+		ActorEmail: accountExpiryActor,
+		Action:     "user.suspend",
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Outcome:    AuditSuccess,
+		Details:    "reason=" + reason + " " + details,
+	})
+	return nil
+}
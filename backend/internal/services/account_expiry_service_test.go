@@ -0,0 +1,152 @@
+package services
+
+import (
+	"credential-store/internal/repository"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestAccountExpiry(t *testing.T, idleAfter time.Duration) (*AccountExpiryService, sqlmock.Sqlmock, auditRecorder) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// The chain itself is covered elsewhere; the events are read from a sink
+	auditDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { auditDB.Close() })
+
+	auth := testAuthService(t, db)
+	sessions := NewSessionService(repository.NewSessionRepository(db), auth.userRepo, auth, time.Hour, 24*time.Hour, time.Minute)
+	audit := NewAuditService(repository.NewAuditRepository(auditDB), nil)
+	events := make(auditRecorder, 32)
+	audit.AddSink("test", events, 32)
+	return NewAccountExpiryService(auth.userRepo, auth, sessions, audit, idleAfter), mock, events
+}
+
+func expectSuspend(mock sqlmock.Sqlmock, userID int, reason string) {
+	mock.ExpectExec("UPDATE users SET status").WithArgs(UserSuspended, reason, sqlmock.AnyArg(), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionSuspended, userID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+func expectActiveAdmins(mock sqlmock.Sqlmock, count int) {
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM users WHERE role = 'admin'").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestAccountExpirySuspendsExpiredAndIdleUsers(t *testing.T) {
+	s, mock, events := newTestAccountExpiry(t, 30*24*time.Hour)
+
+	expired := testUser(2, "contractor@example.com")
+	expiresAt := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	expired.ExpiresAt = &expiresAt
+	idle := testUser(3, "idle@example.com")
+
+	mock.ExpectQuery("WHERE status = 'active' AND expires_at <=").WillReturnRows(userRows(expired))
+	expectSuspend(mock, 2, SuspendedExpired)
+	// Logins, session refreshes and personal access tokens all count as
+	// activity
+	cutoff := &captureArg{}
+	mock.ExpectQuery("GREATEST\\(created_at, last_login_at, status_changed_at,\\s+" +
+		"\\(SELECT MAX\\(last_used_at\\) FROM sessions WHERE sessions.user_id = users.id\\),\\s+" +
+		"\\(SELECT MAX\\(last_used_at\\) FROM api_tokens WHERE api_tokens.user_id = users.id\\)\\) < \\$1").
+		WithArgs(cutoff).WillReturnRows(userRows(idle))
+	expectSuspend(mock, 3, SuspendedInactive)
+
+	suspended, err := s.Run()
+	if err != nil || suspended != 2 {
+		t.Fatalf("Run = %d, %v; want 2 suspended", suspended, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if at, ok := cutoff.value.(time.Time); !ok || time.Since(at.Add(30*24*time.Hour)) > time.Minute {
+		t.Errorf("idle cutoff %v, want 30 days ago", cutoff.value)
+	}
+
+	for _, want := range []struct{ target, details string }{
+		{"2", "reason=expired expired 2026-10-01T00:00:00Z"},
+		{"3", "reason=inactive no activity for 30 days"},
+	} {
+		event := events.next(t)
+		if event.Action != "user.suspend" || event.ActorEmail != accountExpiryActor || event.TargetID != want.target ||
+			event.Details != want.details {
+			t.Errorf("audited %+v, want user.suspend of %s with %q", event, want.target, want.details)
+		}
+	}
+}
+
+func TestAccountExpiryKeepsLastActiveAdmin(t *testing.T) {
+	s, mock, events := newTestAccountExpiry(t, 24*time.Hour)
+
+	first, second := testUser(1, "root@example.com"), testUser(2, "ops@example.com")
+	first.Role, second.Role = "admin", "admin"
+	idleUser := testUser(3, "idle@example.com")
+
+	mock.ExpectQuery("WHERE status = 'active' AND expires_at <=").WillReturnRows(userRows())
+	mock.ExpectQuery("GREATEST").WillReturnRows(userRows(first, second, idleUser))
+	// Both admins are idle: the first goes while another admin is left, the
+	// second stays
+	expectActiveAdmins(mock, 2)
+	expectSuspend(mock, 1, SuspendedInactive)
+	expectActiveAdmins(mock, 1)
+	expectSuspend(mock, 3, SuspendedInactive)
+
+	suspended, err := s.Run()
+	if err != nil || suspended != 2 {
+		t.Fatalf("Run = %d, %v; want 2 suspended", suspended, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"1", "3"} {
+		if event := events.next(t); event.TargetID != target {
+			t.Errorf("suspended %s, want %s", event.TargetID, target)
+		}
+	}
+}
+
+func TestAccountExpiryLeavesIdleUsersWithoutIdleDays(t *testing.T) {
+	s, mock, _ := newTestAccountExpiry(t, 0)
+
+	mock.ExpectQuery("WHERE status = 'active' AND expires_at <=").WillReturnRows(userRows())
+	if suspended, err := s.Run(); err != nil || suspended != 0 {
+		t.Fatalf("Run = %d, %v; want none suspended", suspended, err)
+	}
+	// No query for idle users at all
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountExpiryContinuesPastFailures(t *testing.T) {
+	s, mock, events := newTestAccountExpiry(t, 0)
+
+	a, b := testUser(2, "a@example.com"), testUser(3, "b@example.com")
+	past := time.Now().Add(-time.Hour)
+	a.ExpiresAt, b.ExpiresAt = &past, &past
+
+	mock.ExpectQuery("WHERE status = 'active' AND expires_at <=").WillReturnRows(userRows(a, b))
+	mock.ExpectExec("UPDATE users SET status").WithArgs(UserSuspended, SuspendedExpired, sqlmock.AnyArg(), 2).
+		WillReturnError(sqlmock.ErrCancelled)
+	expectSuspend(mock, 3, SuspendedExpired)
+
+	if suspended, err := s.Run(); err != nil || suspended != 1 {
+		t.Fatalf("Run = %d, %v; want 1 suspended", suspended, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if event := events.next(t); event.TargetID != "3" || !strings.HasPrefix(event.Details, "reason=expired") {
+		t.Errorf("audited %+v, want the suspension of user 3", event)
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APITokenPrefix starts every personal access token, so they can be told
+// apart from access tokens and found by secret scanners.
+const APITokenPrefix = "cs_pat_"
+
+// Scopes an API token can hold. Each endpoint open to tokens needs one of
+// them; see middleware.AuthMiddleware.
+const (
+	ScopeCredentialsRead  = "credentials:read"
+	ScopeCredentialsWrite = "credentials:write"
+	ScopeDocumentsRead    = "documents:read"
+	ScopeDocumentsWrite   = "documents:write"
+	ScopeServicesRead     = "services:read"
+	ScopeServicesWrite    = "services:write"
+)
+
+var apiTokenScopes = []string{ScopeCredentialsRead, ScopeCredentialsWrite, ScopeDocumentsRead, ScopeDocumentsWrite,
+	ScopeServicesRead, ScopeServicesWrite}
+
+var (
+	ErrInvalidAPIToken   = errors.New("invalid, expired or revoked API token")
+	ErrAPITokenNotFound  = errors.New("API token not found")
+	ErrInvalidTokenScope = errors.New("invalid token scope")
+	ErrAPITokenLifetime  = errors.New("API token lifetime is too long")
+)
+
+// APITokenService manages personal access tokens: long-lived, scoped
+// credentials for automation that act as the user who created them. A token
+// can only ever do what its user can; scopes and a folder narrow that down.
+type APITokenService struct {
+	tokenRepo  *repository.APITokenRepository
+	userRepo   *repository.UserRepository
+	folderRepo *repository.FolderRepository
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// NewAPITokenService gives tokens created without an expiry defaultTTL, and
+// refuses any longer than maxTTL.
+func NewAPITokenService(tokenRepo *repository.APITokenRepository, userRepo *repository.UserRepository,
+	folderRepo *repository.FolderRepository, defaultTTL, maxTTL time.Duration) *APITokenService {
+	return &APITokenService{
+		tokenRepo:  tokenRepo,
+		userRepo:   userRepo,
+		folderRepo: folderRepo,
+		defaultTTL: defaultTTL,
+		maxTTL:     maxTTL,
+	}
+}
+
+// Create issues a token for user. The secret is in the response only; just
+// its hash is stored.
+func (s *APITokenService) Create(user *models.User, req *models.CreateAPITokenRequest) (*models.CreateAPITokenResponse, error) {
+	scopes, err := s.checkScopes(user, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := s.defaultTTL
+	if req.ExpiresInDays > 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	if ttl > s.maxTTL {
+		return nil, fmt.Errorf("%w; tokens may last at most %d days", ErrAPITokenLifetime, int(s.maxTTL.Hours()/24))
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	token := &models.APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		Prefix:    secret[:len(APITokenPrefix)+6],
+		Scopes:    scopes,
+		FolderID:  req.FolderID,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	if err := s.tokenRepo.Create(token, hashRefreshToken(secret)); err != nil {
+		return nil, err
+	}
+	return &models.CreateAPITokenResponse{Token: secret, APIToken: *token}, nil
+}
+
+// Authenticate returns a presented token and its user, and records the use.
+func (s *APITokenService) Authenticate(secret, ip string) (*models.APIToken, *models.User, error) {
+	token, err := s.tokenRepo.FindByHash(hashRefreshToken(secret))
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.RevokedAt != nil || !time.Now().Before(token.ExpiresAt) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	user, err := s.userRepo.FindByID(token.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkAccount(user); err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.tokenRepo.Touch(token.ID, ip); err != nil {
+		return nil, nil, err
+	}
+	return token, user, nil
+}
+
+// List returns a user's tokens that still work.
+func (s *APITokenService) List(userID int) ([]models.APIToken, error) {
+	return s.tokenRepo.FindActiveByUser(userID)
+}
+
+func (s *APITokenService) Revoke(userID, tokenID int) error {
+	revoked, err := s.tokenRepo.Revoke(tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// checkScopes validates the requested scopes and folder. A token limited to
+// a folder only gets credential scopes, as nothing else lives in folders, and
+// only for a folder its user can read.
+func (s *APITokenService) checkScopes(user *models.User, req *models.CreateAPITokenRequest) ([]string, error) {
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !containsString(apiTokenScopes, scope) {
+			return nil, fmt.Errorf("%w %q; expected one of %s", ErrInvalidTokenScope, scope,
+				strings.Join(apiTokenScopes, ", "))
+		}
+		if req.FolderID != nil && !strings.HasPrefix(scope, "credentials:") {
+			return nil, fmt.Errorf("%w: a token limited to a folder can only have credential scopes",
+				ErrInvalidTokenScope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if req.FolderID == nil {
+		return scopes, nil
+	}
+	if _, err := s.folderRepo.FindByID(*req.FolderID); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: folder %d does not exist", ErrInvalidTokenScope, *req.FolderID)
+	} else if err != nil {
+		return nil, err
+	}
+	if user.Role == "admin" {
+		return scopes, nil
+	}
+	perm, err := s.folderRepo.GetPermission(*req.FolderID, user.UserGroup)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if perm == nil || !perm.CanRead {
+		return nil, fmt.Errorf("%w: you cannot read folder %d", ErrInvalidTokenScope, *req.FolderID)
+	}
+	return scopes, nil
+}
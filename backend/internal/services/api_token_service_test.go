@@ -0,0 +1,219 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestAPITokenService(t *testing.T) (*APITokenService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewAPITokenService(repository.NewAPITokenRepository(db), repository.NewUserRepository(db),
+		repository.NewFolderRepository(db), 30*24*time.Hour, 90*24*time.Hour), mock
+}
+
+var apiTokenColumns = []string{"id", "user_id", "name", "prefix", "scopes", "folder_id", "created_at", "expires_at",
+	"last_used_at", "last_used_ip", "revoked_at"}
+
+func apiTokenRows(userID int, scopes string, expiresAt time.Time, revokedAt *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows(apiTokenColumns).AddRow(7, userID, "ci", "cs_pat_abcdef", scopes, nil,
+		time.Now().Add(-time.Hour), expiresAt, nil, "", revokedAt)
+}
+
+func expectFolder(mock sqlmock.Sqlmock, folderID int, exists bool) {
+	q := mock.ExpectQuery("FROM folders WHERE id = \\$1").WithArgs(folderID)
+	if !exists {
+		q.WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}))
+		return
+	}
+	q.WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}).
+		AddRow(folderID, "ops", "", time.Now()))
+}
+
+func TestAPITokenCreate(t *testing.T) {
+	s, mock := newTestAPITokenService(t)
+	alice := testUser(1, "alice@example.com")
+
+	hash, expiresAt := &captureArg{}, &captureArg{}
+	mock.ExpectQuery("INSERT INTO api_tokens").
+		WithArgs(1, "ci", sqlmock.AnyArg(), hash, ScopeCredentialsRead+" "+ScopeServicesRead, nil, expiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	resp, err := s.Create(alice, &models.CreateAPITokenRequest{Name: "ci",
+		Scopes: []string{ScopeCredentialsRead, ScopeServicesRead, ScopeCredentialsRead}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Only the hash of the secret is stored; the prefix shown in listings is
+	// the start of the secret
+	if !strings.HasPrefix(resp.Token, APITokenPrefix) || hash.value != hashRefreshToken(resp.Token) {
+		t.Errorf("token %q stored with hash %v", resp.Token, hash.value)
+	}
+	if !strings.HasPrefix(resp.Token, resp.APIToken.Prefix) || len(resp.APIToken.Prefix) != len(APITokenPrefix)+6 {
+		t.Errorf("prefix %q of token %q", resp.APIToken.Prefix, resp.Token)
+	}
+	if resp.APIToken.ID != 7 || len(resp.APIToken.Scopes) != 2 {
+		t.Errorf("token %+v", resp.APIToken)
+	}
+	if expiry := time.Until(expiresAt.value.(time.Time)); expiry < 29*24*time.Hour || expiry > 30*24*time.Hour {
+		t.Errorf("default expiry in %s, want 30 days", expiry)
+	}
+
+	// A requested lifetime replaces the default, up to the maximum
+	mock.ExpectQuery("INSERT INTO api_tokens").WithArgs(1, "ci", sqlmock.AnyArg(), sqlmock.AnyArg(),
+		ScopeDocumentsRead, nil, expiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()))
+	if _, err := s.Create(alice, &models.CreateAPITokenRequest{Name: "ci", Scopes: []string{ScopeDocumentsRead},
+		ExpiresInDays: 90}); err != nil {
+		t.Fatalf("Create for 90 days: %v", err)
+	}
+	if expiry := time.Until(expiresAt.value.(time.Time)); expiry < 89*24*time.Hour || expiry > 90*24*time.Hour {
+		t.Errorf("expiry in %s, want 90 days", expiry)
+	}
+	if _, err := s.Create(alice, &models.CreateAPITokenRequest{Name: "ci", Scopes: []string{ScopeDocumentsRead},
+		ExpiresInDays: 91}); !errors.Is(err, ErrAPITokenLifetime) {
+		t.Errorf("Create for 91 days = %v, want ErrAPITokenLifetime", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	folder := 10
+	admin := testUser(2, "admin@example.com")
+	admin.Role = "admin"
+	tests := []struct {
+		name   string
+		user   *models.User
+		req    models.CreateAPITokenRequest
+		expect func(mock sqlmock.Sqlmock)
+		ok     bool
+	}{
+		{"unknown scope", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{"credentials:admin"}}, nil, false},
+		{"folder token with a document scope", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsRead, ScopeDocumentsRead}, FolderID: &folder},
+			nil, false},
+		{"missing folder", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsRead}, FolderID: &folder},
+			func(mock sqlmock.Sqlmock) { expectFolder(mock, folder, false) }, false},
+		{"folder not shared with the group", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsRead}, FolderID: &folder},
+			func(mock sqlmock.Sqlmock) {
+				expectFolder(mock, folder, true)
+				expectPermission(mock, folder, "junior", false, false)
+			}, false},
+		{"folder listed without read access", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsWrite}, FolderID: &folder},
+			func(mock sqlmock.Sqlmock) {
+				expectFolder(mock, folder, true)
+				expectPermission(mock, folder, "junior", true, false)
+			}, false},
+		{"readable folder", testUser(1, "alice@example.com"),
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsRead}, FolderID: &folder},
+			func(mock sqlmock.Sqlmock) {
+				expectFolder(mock, folder, true)
+				expectPermission(mock, folder, "junior", true, true)
+			}, true},
+		{"admin", admin,
+			models.CreateAPITokenRequest{Scopes: []string{ScopeCredentialsRead}, FolderID: &folder},
+			func(mock sqlmock.Sqlmock) { expectFolder(mock, folder, true) }, true},
+	}
+	for _, tt := range tests {
+		s, mock := newTestAPITokenService(t)
+		if tt.expect != nil {
+			tt.expect(mock)
+		}
+		if tt.ok {
+			mock.ExpectQuery("INSERT INTO api_tokens").WithArgs(tt.user.ID, "", sqlmock.AnyArg(), sqlmock.AnyArg(),
+				strings.Join(tt.req.Scopes, " "), folder, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+		}
+
+		_, err := s.Create(tt.user, &tt.req)
+		if tt.ok && err != nil {
+			t.Errorf("%s: Create = %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidTokenScope) {
+			t.Errorf("%s: Create = %v, want ErrInvalidTokenScope", tt.name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestAPITokenAuthenticate(t *testing.T) {
+	const secret = APITokenPrefix + "secret"
+	revokedAt := time.Now().Add(-time.Minute)
+	suspended := testUser(1, "alice@example.com")
+	suspended.Status = UserSuspended
+
+	s, mock := newTestAPITokenService(t)
+	mock.ExpectQuery("FROM api_tokens WHERE token_hash").WithArgs(hashRefreshToken(secret)).
+		WillReturnRows(sqlmock.NewRows(apiTokenColumns))
+	mock.ExpectQuery("FROM api_tokens WHERE token_hash").
+		WillReturnRows(apiTokenRows(1, ScopeCredentialsRead, time.Now().Add(time.Hour), &revokedAt))
+	mock.ExpectQuery("FROM api_tokens WHERE token_hash").
+		WillReturnRows(apiTokenRows(1, ScopeCredentialsRead, time.Now().Add(-time.Second), nil))
+	for _, name := range []string{"unknown", "revoked", "expired"} {
+		if _, _, err := s.Authenticate(secret, "192.0.2.1"); err != ErrInvalidAPIToken {
+			t.Errorf("Authenticate(%s) = %v, want ErrInvalidAPIToken", name, err)
+		}
+	}
+
+	// Tokens stop working with their user's account
+	mock.ExpectQuery("FROM api_tokens WHERE token_hash").
+		WillReturnRows(apiTokenRows(1, ScopeCredentialsRead, time.Now().Add(time.Hour), nil))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(1).WillReturnRows(userRows(suspended))
+	if _, _, err := s.Authenticate(secret, "192.0.2.1"); err != ErrAccountSuspended {
+		t.Errorf("Authenticate(suspended user) = %v, want ErrAccountSuspended", err)
+	}
+
+	mock.ExpectQuery("FROM api_tokens WHERE token_hash").
+		WillReturnRows(apiTokenRows(1, ScopeCredentialsRead+" "+ScopeCredentialsWrite, time.Now().Add(time.Hour), nil))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(1).WillReturnRows(userRows(testUser(1, "alice@example.com")))
+	mock.ExpectExec("UPDATE api_tokens SET last_used_at").WithArgs(sqlmock.AnyArg(), "192.0.2.1", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	token, user, err := s.Authenticate(secret, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.ID != 1 || len(token.Scopes) != 2 || token.Scopes[1] != ScopeCredentialsWrite {
+		t.Errorf("Authenticate = %+v, %+v", token, user)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPITokenRevoke(t *testing.T) {
+	s, mock := newTestAPITokenService(t)
+
+	mock.ExpectExec("UPDATE api_tokens SET revoked_at").WithArgs(sqlmock.AnyArg(), 7, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.Revoke(1, 7); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	// Someone else's token, or one already revoked, is not found
+	mock.ExpectExec("UPDATE api_tokens SET revoked_at").WithArgs(sqlmock.AnyArg(), 7, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.Revoke(2, 7); err != ErrAPITokenNotFound {
+		t.Errorf("Revoke(other user) = %v, want ErrAPITokenNotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
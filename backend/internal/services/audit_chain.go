@@ -0,0 +1,137 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The first chained event points at this instead of a previous hash.
+var auditGenesisHash = strings.Repeat("0", 64)
+
+const auditTimeLayout = "2006-01-02T15:04:05.000000"
+
+// auditEventHash hashes an event's contents together with its id and the hash
+// of the event before it.
+func auditEventHash(e *models.AuditEvent) string {
+	payload, _ := json.Marshal(struct {
+		ID         int64  `json:"id"`
+		OccurredAt string `json:"occurred_at"`
+		ActorID    *int   `json:"actor_id"`
+		ActorEmail string `json:"actor_email"`
+		// Left out when empty, so events from before service accounts still verify
+		ActorType  string `json:"actor_type,omitempty"`
+		Action     string `json:"action"`
+		TargetType string `json:"target_type"`
+		TargetID   string `json:"target_id"`
+		IPAddress  string `json:"ip_address"`
+		UserAgent  string `json:"user_agent"`
+		Outcome    string `json:"outcome"`
+		Details    string `json:"details"`
+		PrevHash   string `json:"prev_hash"`
+	}{
+		e.ID, e.OccurredAt.UTC().Format(auditTimeLayout), e.ActorID, e.ActorEmail, e.ActorType, e.Action, e.TargetType,
+		e.TargetID, e.IPAddress, e.UserAgent, e.Outcome, e.Details, e.PrevHash,
+	})
+	sum := sha256.Sum256(append([]byte("credstore-audit-v1\n"), payload...))
+	return hex.EncodeToString(sum[:])
+}
+
+var ErrAuditSignerMissing = errors.New("no audit signing key configured")
+
+// AuditSigner signs audit checkpoints with Ed25519. The key stays outside the
+// database, so someone who can only write to the database cannot forge one.
+//
+//	AUDIT_SIGNING_KEY   base64 Ed25519 seed (32 bytes) used for new checkpoints
+//	AUDIT_VERIFY_KEYS   comma separated base64 public keys of retired signing
+//	                    keys, still accepted when verifying
+//
+// Verification only needs public keys, so auditors can run it without
+// AUDIT_SIGNING_KEY.
+type AuditSigner struct {
+	keyID      string
+	privateKey ed25519.PrivateKey
+	publicKeys map[string]ed25519.PublicKey
+}
+
+func NewAuditSignerFromEnv() (*AuditSigner, error) {
+	signer := &AuditSigner{publicKeys: make(map[string]ed25519.PublicKey)}
+
+	if raw := os.Getenv("AUDIT_SIGNING_KEY"); raw != "" {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("AUDIT_SIGNING_KEY must be %d base64-encoded bytes", ed25519.SeedSize)
+		}
+		signer.privateKey = ed25519.NewKeyFromSeed(seed)
+		public := signer.privateKey.Public().(ed25519.PublicKey)
+		signer.keyID = auditKeyID(public)
+		signer.publicKeys[signer.keyID] = public
+	}
+
+	for _, raw := range strings.Split(os.Getenv("AUDIT_VERIFY_KEYS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		public, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("AUDIT_VERIFY_KEYS: %q is not a base64 Ed25519 public key", raw)
+		}
+		signer.publicKeys[auditKeyID(public)] = public
+	}
+	return signer, nil
+}
+
+func auditKeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *AuditSigner) CanSign() bool {
+	return s != nil && s.privateKey != nil
+}
+
+func (s *AuditSigner) KeyID() string {
+	return s.keyID
+}
+
+// PublicKey returns the base64 public key to hand to auditors.
+func (s *AuditSigner) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey))
+}
+
+func (s *AuditSigner) Sign(cp *models.AuditCheckpoint) error {
+	if !s.CanSign() {
+		return ErrAuditSignerMissing
+	}
+	cp.KeyID = s.keyID
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, checkpointPayload(cp)))
+	return nil
+}
+
+func (s *AuditSigner) Verify(cp *models.AuditCheckpoint) error {
+	var public ed25519.PublicKey
+	if s != nil {
+		public = s.publicKeys[cp.KeyID]
+	}
+	if public == nil {
+		return fmt.Errorf("signed with unknown key %s", cp.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil || !ed25519.Verify(public, checkpointPayload(cp), signature) {
+		return errors.New("signature is invalid")
+	}
+	return nil
+}
+
+func checkpointPayload(cp *models.AuditCheckpoint) []byte {
+	return []byte(fmt.Sprintf("credstore-audit-checkpoint-v1\n%d\n%s\n%s\n%s",
+		cp.EventID, cp.EventHash, cp.KeyID, cp.CreatedAt.UTC().Format(auditTimeLayout)))
+}
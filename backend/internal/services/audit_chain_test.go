@@ -0,0 +1,398 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var auditColumns = []string{"id", "occurred_at", "actor_id", "actor_email", "action", "target_type", "target_id",
+	"ip_address", "user_agent", "outcome", "details", "prev_hash", "hash", "actor_type"}
+
+// testChain returns n chained events with ids starting at firstID.
+func testChain(firstID int64, n int) []models.AuditEvent {
+	events := make([]models.AuditEvent, n)
+	prevHash := auditGenesisHash
+	actor := 3
+	for i := range events {
+		e := &events[i]
+		e.ID = firstID + int64(i)
+		e.OccurredAt = time.Date(2026, 3, 1, 12, 0, i, 1000, time.UTC)
+		e.ActorID = &actor
+		e.ActorEmail = "admin@example.com"
+		e.Action = "credential.reveal"
+		e.TargetType = "credential"
+		e.TargetID = "42"
+		e.Outcome = AuditSuccess
+		e.PrevHash = prevHash
+		e.Hash = auditEventHash(e)
+		prevHash = e.Hash
+	}
+	return events
+}
+
+func auditRows(events []models.AuditEvent) *sqlmock.Rows {
+	rows := sqlmock.NewRows(auditColumns)
+	for _, e := range events {
+		var actorID interface{}
+		if e.ActorID != nil {
+			actorID = int64(*e.ActorID)
+		}
+		rows.AddRow(e.ID, e.OccurredAt, actorID, e.ActorEmail, e.Action, e.TargetType, e.TargetID, e.IPAddress,
+			e.UserAgent, e.Outcome, e.Details, e.PrevHash, e.Hash, e.ActorType)
+	}
+	return rows
+}
+
+func testAuditSigner(t *testing.T) *AuditSigner {
+	t.Helper()
+	t.Setenv("AUDIT_SIGNING_KEY", base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize)))
+	t.Setenv("AUDIT_VERIFY_KEYS", "")
+	signer, err := NewAuditSignerFromEnv()
+	if err != nil {
+		t.Fatalf("NewAuditSignerFromEnv: %v", err)
+	}
+	return signer
+}
+
+// verifyChain runs Verify over events and checkpoints, answering checkpoint
+// lookups from events.
+func verifyChain(t *testing.T, signer *AuditSigner, events []models.AuditEvent, checkpoints []models.AuditCheckpoint) *models.AuditVerifyReport {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("FROM audit_events WHERE id > \\$1").WithArgs(0, auditVerifyBatchSize).WillReturnRows(auditRows(events))
+	if len(events) > 0 {
+		mock.ExpectQuery("FROM audit_events WHERE id > \\$1").WillReturnRows(sqlmock.NewRows(auditColumns))
+	}
+	cpRows := sqlmock.NewRows([]string{"id", "event_id", "event_hash", "key_id", "signature", "created_at"})
+	for _, cp := range checkpoints {
+		cpRows.AddRow(cp.ID, cp.EventID, cp.EventHash, cp.KeyID, cp.Signature, cp.CreatedAt)
+	}
+	mock.ExpectQuery("FROM audit_checkpoints").WillReturnRows(cpRows)
+	for _, cp := range checkpoints {
+		if signer.Verify(&cp) != nil {
+			continue
+		}
+		hashQuery := mock.ExpectQuery("SELECT COALESCE\\(hash, ''\\) FROM audit_events").WithArgs(cp.EventID)
+		found := false
+		for _, e := range events {
+			if e.ID == cp.EventID {
+				hashQuery.WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow(e.Hash))
+				found = true
+			}
+		}
+		if !found {
+			hashQuery.WillReturnError(sql.ErrNoRows)
+		}
+	}
+
+	report, err := NewAuditService(repository.NewAuditRepository(db), signer).Verify()
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func signedCheckpoint(t *testing.T, signer *AuditSigner, id int, event models.AuditEvent) models.AuditCheckpoint {
+	t.Helper()
+	cp := models.AuditCheckpoint{ID: id, EventID: event.ID, EventHash: event.Hash, CreatedAt: time.Now().UTC()}
+	if err := signer.Sign(&cp); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return cp
+}
+
+func expectProblem(t *testing.T, report *models.AuditVerifyReport, eventID int64, substr string) {
+	t.Helper()
+	if report.OK {
+		t.Fatalf("report is OK, want a problem with event %d", eventID)
+	}
+	for _, p := range report.Problems {
+		if p.EventID == eventID && strings.Contains(p.Problem, substr) {
+			return
+		}
+	}
+	t.Fatalf("no %q problem for event %d in %+v", substr, eventID, report.Problems)
+}
+
+func TestAuditVerifyIntactChain(t *testing.T) {
+	signer := testAuditSigner(t)
+	// Events recorded before the chain existed carry no hash
+	events := []models.AuditEvent{{ID: 1, OccurredAt: time.Now(), Action: "login", Outcome: AuditSuccess},
+		{ID: 2, OccurredAt: time.Now(), Action: "login", Outcome: AuditSuccess}}
+	events = append(events, testChain(3, 5)...)
+
+	report := verifyChain(t, signer, events, []models.AuditCheckpoint{signedCheckpoint(t, signer, 1, events[6])})
+	if !report.OK || report.Events != 7 || report.UnchainedEvents != 2 || report.LastEventID != 7 || report.Checkpoints != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestAuditVerifyDetectsModifiedEvent(t *testing.T) {
+	events := testChain(1, 4)
+	events[2].Details = "rewritten"
+
+	report := verifyChain(t, testAuditSigner(t), events, nil)
+	expectProblem(t, report, 3, "modified")
+	if report.ProblemCount != 1 {
+		t.Errorf("ProblemCount = %d, want 1", report.ProblemCount)
+	}
+}
+
+func TestAuditVerifyDetectsRemovedAndReorderedEvents(t *testing.T) {
+	events := testChain(1, 5)
+
+	removed := append(append([]models.AuditEvent(nil), events[:2]...), events[3:]...)
+	expectProblem(t, verifyChain(t, testAuditSigner(t), removed, nil), 4, "removed, inserted or reordered")
+
+	reordered := []models.AuditEvent{events[0], events[2], events[1], events[3], events[4]}
+	expectProblem(t, verifyChain(t, testAuditSigner(t), reordered, nil), 3, "removed, inserted or reordered")
+}
+
+func TestAuditVerifyDetectsRechainedEdit(t *testing.T) {
+	// Recomputing the edited event's hash breaks the link to the next event
+	events := testChain(1, 3)
+	events[1].Details = "rewritten"
+	events[1].Hash = auditEventHash(&events[1])
+
+	expectProblem(t, verifyChain(t, testAuditSigner(t), events, nil), 3, "removed, inserted or reordered")
+}
+
+func TestAuditVerifyDetectsUnchainedInsert(t *testing.T) {
+	events := testChain(1, 3)
+	events = append(events, models.AuditEvent{ID: 4, OccurredAt: time.Now(), Action: "forged", Outcome: AuditSuccess})
+
+	expectProblem(t, verifyChain(t, testAuditSigner(t), events, nil), 4, "not chained")
+}
+
+func TestAuditVerifyCheckpoints(t *testing.T) {
+	signer := testAuditSigner(t)
+	events := testChain(1, 5)
+
+	// Truncating the log back past a checkpoint
+	cp := signedCheckpoint(t, signer, 1, events[4])
+	expectProblem(t, verifyChain(t, signer, events[:3], []models.AuditCheckpoint{cp}), 5, "truncated")
+
+	// A whole-chain rewrite no longer matches the signed head
+	rewritten := testChain(1, 5)
+	rewritten[4].ActorEmail = "someone@example.com"
+	rewritten[4].Hash = auditEventHash(&rewritten[4])
+	expectProblem(t, verifyChain(t, signer, rewritten, []models.AuditCheckpoint{cp}), 5, "hash differs")
+
+	// Checkpoints forged without the signing key
+	forged := cp
+	forged.EventHash = rewritten[4].Hash
+	expectProblem(t, verifyChain(t, signer, rewritten, []models.AuditCheckpoint{forged}), 5, "signature is invalid")
+}
+
+func TestAuditAppendLinksToChainHead(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	head := testChain(1, 1)[0]
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_events").WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow(head.Hash))
+	mock.ExpectQuery("SELECT nextval").WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(2))
+	hash := &captureArg{}
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(int64(2), sqlmock.AnyArg(), nil, "", "user.delete", "user", "9", "", "", AuditSuccess, "",
+			head.Hash, hash, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	event := &models.AuditEvent{Action: "user.delete", TargetType: "user", TargetID: "9", Outcome: AuditSuccess}
+	if err := NewAuditService(repository.NewAuditRepository(db), nil).append(event); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if event.PrevHash != head.Hash || event.Hash != hash.value || event.Hash != auditEventHash(event) {
+		t.Fatalf("event not linked to the head: prev %s hash %s", event.PrevHash, event.Hash)
+	}
+}
+
+func TestAuditEventHash(t *testing.T) {
+	// Pinned: stored chains must keep verifying whatever the code turns into
+	base := testChain(1, 1)[0]
+	if base.Hash != "8c0a6379264071c8dfa4b6b1a3bb2471e306714bf1f2b0a7db3c99ec786f3e07" {
+		t.Fatalf("hash of the reference event changed to %s", base.Hash)
+	}
+
+	// The same instant in another zone, and the nanoseconds the database
+	// doesn't keep, hash alike
+	same := base
+	same.OccurredAt = base.OccurredAt.In(time.FixedZone("CET", 3600)).Add(999)
+	if auditEventHash(&same) != base.Hash {
+		t.Error("hash depends on the time zone or nanoseconds")
+	}
+
+	other := 4
+	changes := map[string]func(e *models.AuditEvent){
+		"id":          func(e *models.AuditEvent) { e.ID = 2 },
+		"occurred_at": func(e *models.AuditEvent) { e.OccurredAt = e.OccurredAt.Add(time.Microsecond) },
+		"actor_id":    func(e *models.AuditEvent) { e.ActorID = &other },
+		"no actor":    func(e *models.AuditEvent) { e.ActorID = nil },
+		"actor_email": func(e *models.AuditEvent) { e.ActorEmail = "mallory@example.com" },
+		"actor_type":  func(e *models.AuditEvent) { e.ActorType = "service_account" },
+		"action":      func(e *models.AuditEvent) { e.Action = "credential.list" },
+		"target_type": func(e *models.AuditEvent) { e.TargetType = "folder" },
+		"target_id":   func(e *models.AuditEvent) { e.TargetID = "43" },
+		"ip_address":  func(e *models.AuditEvent) { e.IPAddress = "192.0.2.1" },
+		"user_agent":  func(e *models.AuditEvent) { e.UserAgent = "curl/8.0" },
+		"outcome":     func(e *models.AuditEvent) { e.Outcome = AuditFailure },
+		"details":     func(e *models.AuditEvent) { e.Details = "field=password" },
+		"prev_hash":   func(e *models.AuditEvent) { e.PrevHash = strings.Repeat("1", 64) },
+	}
+	for name, change := range changes {
+		e := base
+		change(&e)
+		if auditEventHash(&e) == base.Hash {
+			t.Errorf("changing %s leaves the hash alone", name)
+		}
+	}
+}
+
+func TestAuditSignerKeys(t *testing.T) {
+	signer := testAuditSigner(t)
+	events := testChain(1, 2)
+	cp := signedCheckpoint(t, signer, 1, events[1])
+
+	// Auditors verify with the public key alone, also after the signing key
+	// was retired
+	t.Setenv("AUDIT_SIGNING_KEY", "")
+	t.Setenv("AUDIT_VERIFY_KEYS", " "+signer.PublicKey()+" ,")
+	verifier, err := NewAuditSignerFromEnv()
+	if err != nil {
+		t.Fatalf("NewAuditSignerFromEnv: %v", err)
+	}
+	if verifier.CanSign() {
+		t.Error("a signer without AUDIT_SIGNING_KEY can sign")
+	}
+	if err := verifier.Sign(&models.AuditCheckpoint{}); err != ErrAuditSignerMissing {
+		t.Errorf("Sign = %v, want ErrAuditSignerMissing", err)
+	}
+	if err := verifier.Verify(&cp); err != nil {
+		t.Errorf("Verify with the retired key: %v", err)
+	}
+	if report := verifyChain(t, verifier, events, []models.AuditCheckpoint{cp}); !report.OK {
+		t.Errorf("chain checkpointed with a retired key: %+v", report.Problems)
+	}
+
+	// Every signed field counts
+	for name, change := range map[string]func(cp *models.AuditCheckpoint){
+		"event":     func(cp *models.AuditCheckpoint) { cp.EventID++ },
+		"hash":      func(cp *models.AuditCheckpoint) { cp.EventHash = events[0].Hash },
+		"time":      func(cp *models.AuditCheckpoint) { cp.CreatedAt = cp.CreatedAt.Add(time.Second) },
+		"signature": func(cp *models.AuditCheckpoint) { cp.Signature = "not base64" },
+	} {
+		changed := cp
+		change(&changed)
+		if err := verifier.Verify(&changed); err == nil {
+			t.Errorf("checkpoint with another %s verifies", name)
+		}
+	}
+
+	// Keys nobody configured are refused
+	t.Setenv("AUDIT_SIGNING_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, ed25519.SeedSize)))
+	t.Setenv("AUDIT_VERIFY_KEYS", "")
+	other, err := NewAuditSignerFromEnv()
+	if err != nil {
+		t.Fatalf("NewAuditSignerFromEnv: %v", err)
+	}
+	if err := other.Verify(&cp); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("Verify with another key = %v, want an unknown key error", err)
+	}
+	if err := (*AuditSigner)(nil).Verify(&cp); err == nil {
+		t.Error("Verify without any keys succeeded")
+	}
+
+	for _, env := range []struct{ signing, verify string }{
+		{"c2hvcnQ=", ""},
+		{"not base64", ""},
+		{"", "c2hvcnQ="},
+		{"", signer.PublicKey() + ",not base64"},
+	} {
+		t.Setenv("AUDIT_SIGNING_KEY", env.signing)
+		t.Setenv("AUDIT_VERIFY_KEYS", env.verify)
+		if _, err := NewAuditSignerFromEnv(); err == nil {
+			t.Errorf("AUDIT_SIGNING_KEY=%q AUDIT_VERIFY_KEYS=%q accepted", env.signing, env.verify)
+		}
+	}
+}
+
+func TestAuditCheckpointSignsHead(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	signer := testAuditSigner(t)
+	s := NewAuditService(repository.NewAuditRepository(db), signer)
+	head := testChain(1, 5)[4]
+	cpColumns := []string{"id", "event_id", "event_hash", "key_id", "signature", "created_at"}
+
+	signature := &captureArg{}
+	mock.ExpectQuery("SELECT id, hash FROM audit_events").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash"}).AddRow(head.ID, head.Hash))
+	mock.ExpectQuery("FROM audit_checkpoints ORDER BY id DESC").
+		WillReturnRows(sqlmock.NewRows(cpColumns).AddRow(1, 3, "h", signer.KeyID(), "s", time.Now()))
+	mock.ExpectQuery("INSERT INTO audit_checkpoints").
+		WithArgs(head.ID, head.Hash, signer.KeyID(), signature, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	cp, err := s.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if cp.ID != 2 || cp.EventID != head.ID || cp.Signature != signature.value || signer.Verify(cp) != nil {
+		t.Errorf("checkpoint %+v does not sign the head", cp)
+	}
+
+	// Nothing new since the last checkpoint
+	mock.ExpectQuery("SELECT id, hash FROM audit_events").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash"}).AddRow(head.ID, head.Hash))
+	mock.ExpectQuery("FROM audit_checkpoints ORDER BY id DESC").
+		WillReturnRows(sqlmock.NewRows(cpColumns).AddRow(cp.ID, cp.EventID, cp.EventHash, cp.KeyID, cp.Signature, cp.CreatedAt))
+	if cp, err := s.Checkpoint(); cp != nil || err != nil {
+		t.Errorf("Checkpoint without new events = %+v, %v", cp, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAuditService(repository.NewAuditRepository(db), nil).Checkpoint(); err != ErrAuditSignerMissing {
+		t.Errorf("Checkpoint without a signing key = %v", err)
+	}
+}
+
+func TestAuditVerifyCapsReportedProblems(t *testing.T) {
+	events := testChain(1, maxReportedAuditIssues+20)
+	for i := range events {
+		events[i].Details = "rewritten"
+	}
+
+	report := verifyChain(t, testAuditSigner(t), events, nil)
+	if report.OK || report.ProblemCount != len(events) || len(report.Problems) != maxReportedAuditIssues {
+		t.Fatalf("%d problems counted, %d reported", report.ProblemCount, len(report.Problems))
+	}
+}
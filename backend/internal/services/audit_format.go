@@ -0,0 +1,100 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AuditFormatter renders an audit event as a single line for an external sink.
+type AuditFormatter func(event *models.AuditEvent) string
+
+// AuditFormatterByName returns the formatter for "json" or "cef".
+func AuditFormatterByName(name string) (AuditFormatter, error) {
+	switch name {
+	case "json":
+		return FormatAuditJSON, nil
+	case "cef":
+		return FormatAuditCEF, nil
+	}
+	return nil, fmt.Errorf("unknown audit format %q (expected json or cef)", name)
+}
+
+func FormatAuditJSON(event *models.AuditEvent) string {
+	line, _ := json.Marshal(event)
+	return string(line)
+}
+
+const (
+	cefVendor  = "CredStore"
+	cefProduct = "Credential Store"
+	cefVersion = "1.0"
+)
+
+// FormatAuditCEF renders an event in ArcSight Common Event Format.
+func FormatAuditCEF(event *models.AuditEvent) string {
+	header := []string{
+		"CEF:0",
+		cefHeaderEscaper.Replace(cefVendor),
+		cefHeaderEscaper.Replace(cefProduct),
+		cefHeaderEscaper.Replace(cefVersion),
+		cefHeaderEscaper.Replace(event.Action),
+		cefHeaderEscaper.Replace(event.Action + " " + event.Outcome),
+		strconv.Itoa(cefSeverity(event.Outcome)),
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(event.OccurredAt.UnixNano()/1e6, 10))
+	if event.ID != 0 {
+		add("externalId", strconv.FormatInt(event.ID, 10))
+	}
+	add("act", event.Action)
+	add("outcome", event.Outcome)
+	if event.ActorID != nil {
+		add("suid", strconv.Itoa(*event.ActorID))
+	}
+	add("suser", event.ActorEmail)
+	if event.ActorType != "" {
+		add("cs4Label", "actorType")
+		add("cs4", event.ActorType)
+	}
+	add("src", event.IPAddress)
+	add("requestClientApplication", event.UserAgent)
+	if event.TargetType != "" {
+		add("cs1Label", "targetType")
+		add("cs1", event.TargetType)
+	}
+	if event.TargetID != "" {
+		add("cs2Label", "targetId")
+		add("cs2", event.TargetID)
+	}
+	if event.Hash != "" {
+		add("cs3Label", "chainHash")
+		add("cs3", event.Hash)
+	}
+	add("msg", event.Details)
+
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+func cefSeverity(outcome string) int {
+	switch outcome {
+	case AuditDenied:
+		return 7
+	case AuditFailure:
+		return 5
+	}
+	return 3
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
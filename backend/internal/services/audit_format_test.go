@@ -0,0 +1,111 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"testing"
+	"time"
+)
+
+func testAuditEvent() *models.AuditEvent {
+	actor := 7
+	return &models.AuditEvent{
+		ID:         42,
+		OccurredAt: time.Date(2026, 10, 17, 12, 30, 45, 123456789, time.UTC),
+		ActorID:    &actor,
+		ActorEmail: "alice@example.com",
+		ActorType:  "user",
+		Action:     "credential.reveal",
+		TargetType: "credential",
+		TargetID:   "9",
+		IPAddress:  "192.0.2.1",
+		UserAgent:  "curl/8.0",
+		Outcome:    AuditDenied,
+		Details:    "field=password",
+		Hash:       "ab12",
+	}
+}
+
+func TestFormatAuditCEF(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func(*models.AuditEvent)
+		want  string
+	}{
+		{
+			"every field",
+			func(*models.AuditEvent) {},
+			`CEF:0|CredStore|Credential Store|1.0|credential.reveal|credential.reveal denied|7|` +
+				`rt=1792240245123 externalId=42 act=credential.reveal outcome=denied suid=7 suser=alice@example.com ` +
+				`cs4Label=actorType cs4=user src=192.0.2.1 requestClientApplication=curl/8.0 ` +
+				`cs1Label=targetType cs1=credential cs2Label=targetId cs2=9 cs3Label=chainHash cs3=ab12 msg=field\=password`,
+		},
+		{
+			"optional fields left out",
+			func(e *models.AuditEvent) {
+				*e = models.AuditEvent{OccurredAt: e.OccurredAt, Action: "auth.login", Outcome: AuditSuccess}
+			},
+			`CEF:0|CredStore|Credential Store|1.0|auth.login|auth.login success|3|rt=1792240245123 act=auth.login outcome=success`,
+		},
+		{
+			// Pipes and backslashes are escaped in the header, line breaks
+			// become spaces there
+			"header escaping",
+			func(e *models.AuditEvent) {
+				*e = models.AuditEvent{OccurredAt: e.OccurredAt, Action: "a|b\\c\nd", Outcome: AuditFailure}
+			},
+			`CEF:0|CredStore|Credential Store|1.0|a\|b\\c d|a\|b\\c d failure|5|rt=1792240245123 act=a|b\\c\nd outcome=failure`,
+		},
+		{
+			// Equals signs, backslashes and line breaks are escaped in the
+			// extension, so a value can't start a field of its own
+			"extension escaping",
+			func(e *models.AuditEvent) {
+				*e = models.AuditEvent{OccurredAt: e.OccurredAt, Action: "user.update", Outcome: AuditSuccess,
+					Details: "name=x act=forged\r\nC:\\path | y"}
+			},
+			`CEF:0|CredStore|Credential Store|1.0|user.update|user.update success|3|` +
+				`rt=1792240245123 act=user.update outcome=success msg=name\=x act\=forged\r\nC:\\path | y`,
+		},
+	}
+	for _, tt := range tests {
+		event := testAuditEvent()
+		tt.event(event)
+		if got := FormatAuditCEF(event); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAuditJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func(*models.AuditEvent)
+		want  string
+	}{
+		{
+			"every field",
+			func(*models.AuditEvent) {},
+			`{"id":42,"occurred_at":"2026-10-17T12:30:45.123456789Z","actor_id":7,"actor_email":"alice@example.com",` +
+				`"actor_type":"user","action":"credential.reveal","target_type":"credential","target_id":"9",` +
+				`"ip_address":"192.0.2.1","user_agent":"curl/8.0","outcome":"denied","details":"field=password","hash":"ab12"}`,
+		},
+		{
+			// One event stays on one line, and HTML-significant characters
+			// are escaped for viewers that render them
+			"escaping",
+			func(e *models.AuditEvent) {
+				*e = models.AuditEvent{OccurredAt: e.OccurredAt, Action: "user.update", Outcome: AuditSuccess,
+					Details: "line\nbreak \"quoted\" <b>\\ \u2028"}
+			},
+			`{"id":0,"occurred_at":"2026-10-17T12:30:45.123456789Z","actor_id":null,"action":"user.update",` +
+				`"outcome":"success","details":"line\nbreak \"quoted\" \u003cb\u003e\\ \u2028"}`,
+		},
+	}
+	for _, tt := range tests {
+		event := testAuditEvent()
+		tt.event(event)
+		if got := FormatAuditJSON(event); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+
+	auditVerifyBatchSize   = 1000
+	maxReportedAuditIssues = 100
+)
+
+// AuditService writes the audit trail as a hash chain: every event stores the
+// hash of the one before it, and the chain head is periodically signed as a
+// checkpoint. Events are also streamed to any configured sinks. Recording
+// never fails the request being audited; a write error is logged instead.
+type AuditService struct {
+	auditRepo *repository.AuditRepository
+	signer    *AuditSigner
+	streams   []*auditStream
+
+	checkpointMu sync.Mutex
+}
+
+func NewAuditService(auditRepo *repository.AuditRepository, signer *AuditSigner) *AuditService {
+	return &AuditService{auditRepo: auditRepo, signer: signer}
+}
+
+func (s *AuditService) Record(event *models.AuditEvent) {
+	if err := s.append(event); err != nil {
+		log.Printf("Failed to record audit event %s (%s): %v", event.Action, event.Outcome, err)
+	}
+	// Sinks get the event even if the database write failed, without a chain
+	// position in that case
+	s.publish(event)
+}
+
+// append links the event to the chain head. The chain is locked for the
+// duration, so concurrent events get consecutive positions.
+func (s *AuditService) append(event *models.AuditEvent) error {
+	tx, err := s.auditRepo.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.auditRepo.LockChain(tx); err != nil {
+		return err
+	}
+	prevHash, err := s.auditRepo.LastHash(tx)
+	if err != nil {
+		return err
+	}
+	if prevHash == "" {
+		prevHash = auditGenesisHash
+	}
+	id, err := s.auditRepo.NextID(tx)
+	if err != nil {
+		return err
+	}
+
+	event.ID = id
+	// Stored with microsecond precision, so hash exactly what will be read back
+	event.OccurredAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.PrevHash = prevHash
+	event.Hash = auditEventHash(event)
+
+	if err := s.auditRepo.Insert(tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *AuditService) Query(q *models.AuditQuery) ([]models.AuditEvent, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditQueryLimit
+	}
+	if q.Limit > maxAuditQueryLimit {
+		q.Limit = maxAuditQueryLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return s.auditRepo.Find(q)
+}
+
+// Checkpoint signs the current chain head. It returns nil when there is
+// nothing new since the last checkpoint.
+func (s *AuditService) Checkpoint() (*models.AuditCheckpoint, error) {
+	if !s.signer.CanSign() {
+		return nil, ErrAuditSignerMissing
+	}
+
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	eventID, eventHash, err := s.auditRepo.Head()
+	if err != nil || eventID == 0 {
+		return nil, err
+	}
+	last, err := s.auditRepo.LastCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if last != nil && last.EventID >= eventID {
+		return nil, nil
+	}
+
+	cp := &models.AuditCheckpoint{
+		EventID:   eventID,
+		EventHash: eventHash,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	if err := s.signer.Sign(cp); err != nil {
+		return nil, err
+	}
+	if err := s.auditRepo.CreateCheckpoint(cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// StartCheckpoints writes a checkpoint every interval in the background.
+func (s *AuditService) StartCheckpoints(interval time.Duration) {
+	if !s.signer.CanSign() {
+		log.Println("AUDIT_SIGNING_KEY is not set; audit checkpoints are disabled")
+		return
+	}
+	log.Printf("Signing audit checkpoints every %s with key %s (public key %s)",
+		interval, s.signer.KeyID(), s.signer.PublicKey())
+
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := s.Checkpoint(); err != nil {
+				log.Printf("Failed to write audit checkpoint: %v", err)
+			}
+		}
+	}()
+}
+
+// Verify walks the whole chain and every checkpoint. Removed, inserted,
+// edited or reordered events show up as problems, as does truncation back past
+// a checkpoint. Events recorded before the chain existed are only counted.
+func (s *AuditService) Verify() (*models.AuditVerifyReport, error) {
+	report := &models.AuditVerifyReport{Problems: []models.AuditChainProblem{}}
+	problem := func(eventID int64, checkpointID int, format string, args ...interface{}) {
+		report.ProblemCount++
+		if len(report.Problems) < maxReportedAuditIssues {
+			report.Problems = append(report.Problems, models.AuditChainProblem{
+				EventID:      eventID,
+				CheckpointID: checkpointID,
+				Problem:      fmt.Sprintf(format, args...),
+			})
+		}
+	}
+
+	prevHash := ""
+	var afterID int64
+	for {
+		batch, err := s.auditRepo.FindAfter(afterID, auditVerifyBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for i := range batch {
+			event := &batch[i]
+			afterID = event.ID
+			report.Events++
+			report.LastEventID = event.ID
+
+			if event.Hash == "" {
+				if prevHash == "" {
+					report.UnchainedEvents++
+				} else {
+					problem(event.ID, 0, "event is not chained; it was written outside the application")
+				}
+				continue
+			}
+
+			expectedPrev := prevHash
+			if expectedPrev == "" {
+				expectedPrev = auditGenesisHash
+			}
+			if event.PrevHash != expectedPrev {
+				problem(event.ID, 0, "previous hash does not match the preceding event; events were removed, inserted or reordered")
+			}
+			if auditEventHash(event) != event.Hash {
+				problem(event.ID, 0, "hash does not match the event; it was modified")
+			}
+			prevHash = event.Hash
+		}
+	}
+
+	checkpoints, err := s.auditRepo.FindCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	for i := range checkpoints {
+		cp := &checkpoints[i]
+		report.Checkpoints++
+		report.LastCheckpointID = cp.ID
+		report.LastCheckpointEvent = cp.EventID
+
+		if err := s.signer.Verify(cp); err != nil {
+			problem(cp.EventID, cp.ID, "checkpoint %s", err)
+			continue
+		}
+		hash, found, err := s.auditRepo.EventHash(cp.EventID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			problem(cp.EventID, cp.ID, "checkpointed event is missing; the log was truncated")
+		} else if hash != cp.EventHash {
+			problem(cp.EventID, cp.ID, "checkpointed event hash differs; the event was modified")
+		}
+	}
+
+	report.OK = report.ProblemCount == 0
+	return report, nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// AuditSink receives a copy of every audit event, in addition to the
+// database. Sinks are fed from a buffer by their own goroutine, so a slow or
+// unreachable sink never holds up a request.
+type AuditSink interface {
+	Write(event *models.AuditEvent) error
+}
+
+type auditStream struct {
+	name    string
+	sink    AuditSink
+	events  chan models.AuditEvent
+	dropped int64
+}
+
+// AddSink streams events to sink through a buffer of the given size. Events
+// arriving while the buffer is full are dropped and counted in the log.
+func (s *AuditService) AddSink(name string, sink AuditSink, buffer int) {
+	stream := &auditStream{
+		name:   name,
+		sink:   sink,
+		events: make(chan models.AuditEvent, buffer),
+	}
+	s.streams = append(s.streams, stream)
+	go stream.run()
+}
+
+func (s *AuditService) publish(event *models.AuditEvent) {
+	for _, stream := range s.streams {
+		select {
+		case stream.events <- *event:
+		default:
+			atomic.AddInt64(&stream.dropped, 1)
+		}
+	}
+}
+
+func (st *auditStream) run() {
+	for event := range st.events {
+		if dropped := atomic.SwapInt64(&st.dropped, 0); dropped > 0 {
+			log.Printf("Audit sink %s: buffer full, dropped %d events", st.name, dropped)
+		}
+		if err := st.sink.Write(&event); err != nil {
+			log.Printf("Audit sink %s: failed to write event %d (%s): %v", st.name, event.ID, event.Action, err)
+		}
+	}
+}
+
+// FileAuditSink appends one formatted event per line, rotating the file once
+// it reaches maxBytes: audit.log becomes audit.log.1, audit.log.1 becomes
+// audit.log.2 and so on, keeping at most maxBackups old files.
+type FileAuditSink struct {
+	path       string
+	format     AuditFormatter
+	maxBytes   int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func NewFileAuditSink(path string, format AuditFormatter, maxBytes int64, maxBackups int) (*FileAuditSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	sink := &FileAuditSink{path: path, format: format, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (f *FileAuditSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileAuditSink) Write(event *models.AuditEvent) error {
+	line := f.format(event) + "\n"
+
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			// Keep appending rather than lose events; the next write tries again
+			log.Printf("Audit file %s: failed to rotate: %v", f.path, err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.WriteString(line)
+	f.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups along. Backups that don't exist yet are skipped;
+// any other failure stops the rotation and is returned.
+func (f *FileAuditSink) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	if f.maxBackups < 1 {
+		return os.Remove(f.path)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lineFormat(event *models.AuditEvent) string {
+	return event.Details
+}
+
+func readAuditFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileAuditSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	sink, err := NewFileAuditSink(path, lineFormat, 10, 2)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink: %v", err)
+	}
+	for _, details := range []string{"first", "second", "third", "fourth"} {
+		if err := sink.Write(&models.AuditEvent{Details: details}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if got := readAuditFile(t, file); got != want {
+			t.Errorf("%s: %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept: %v", err)
+	}
+}
+
+func TestFileAuditSinkKeepsEventsWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	// A backup that can't be removed stops the rotation
+	if err := os.MkdirAll(filepath.Join(path+".1", "stuck"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewFileAuditSink(path, lineFormat, 10, 1)
+	if err != nil {
+		t.Fatalf("NewFileAuditSink: %v", err)
+	}
+	if err := sink.rotate(); err == nil {
+		t.Fatal("rotate ignored a backup it couldn't remove")
+	}
+
+	for _, details := range []string{"first", "second"} {
+		if err := sink.Write(&models.AuditEvent{Details: details}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if got := readAuditFile(t, path); !strings.HasSuffix(got, "first\nsecond\n") {
+		t.Fatalf("audit.log: %q, want both events", got)
+	}
+}
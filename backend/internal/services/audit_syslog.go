@@ -0,0 +1,157 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacilityAuthpriv = 10
+	syslogSeverityWarning  = 4
+	syslogSeverityNotice   = 5
+	syslogDialTimeout      = 5 * time.Second
+	syslogWriteTimeout     = 5 * time.Second
+)
+
+// SyslogAuditSink sends events as RFC 5424 messages to a collector at
+// udp://host:port, tcp://host:port or tls://host:port. Stream transports use
+// octet-counting framing (RFC 6587). The connection is opened on first use and
+// re-opened after a failed write.
+type SyslogAuditSink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	format    AuditFormatter
+	hostname  string
+	procID    string
+
+	conn net.Conn
+}
+
+// NewSyslogAuditSink parses the collector URL. caFile, if set, holds the PEM
+// certificates trusted for tls:// instead of the system roots.
+func NewSyslogAuditSink(rawURL string, format AuditFormatter, caFile string) (*SyslogAuditSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("syslog address %q must look like udp://host:514, tcp://host:601 or tls://host:6514", rawURL)
+	}
+
+	hostname, _ := os.Hostname()
+	sink := &SyslogAuditSink{
+		address:  u.Host,
+		format:   format,
+		hostname: syslogHeaderField(hostname, 255),
+		procID:   fmt.Sprint(os.Getpid()),
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		sink.network = u.Scheme
+	case "tls":
+		sink.network = "tcp"
+		sink.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+			sink.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport %q (expected udp, tcp or tls)", u.Scheme)
+	}
+	return sink, nil
+}
+
+func (s *SyslogAuditSink) Write(event *models.AuditEvent) error {
+	msg := s.message(event)
+
+	// One retry on a fresh connection covers a collector restart
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.dial(); err != nil {
+				continue
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogAuditSink) dial() error {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.network, s.address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// message builds "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG",
+// framed for the transport.
+func (s *SyslogAuditSink) message(event *models.AuditEvent) []byte {
+	severity := syslogSeverityNotice
+	if event.Outcome != AuditSuccess {
+		severity = syslogSeverityWarning
+	}
+
+	timestamp := event.OccurredAt
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s credstore %s %s - %s",
+		syslogFacilityAuthpriv*8+severity,
+		timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.procID,
+		syslogHeaderField(event.Action, 32),
+		s.format(event))
+
+	if s.network == "udp" {
+		return []byte(msg)
+	}
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+// syslogHeaderField makes a value safe for a header field: printable ASCII
+// without spaces, at most max characters, "-" when empty.
+func syslogHeaderField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bufio"
+	"credential-store/internal/models"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSyslogSink(network string) *SyslogAuditSink {
+	return &SyslogAuditSink{
+		network:  network,
+		format:   func(event *models.AuditEvent) string { return event.Details },
+		hostname: "vault-1",
+		procID:   "1234",
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	at := time.Date(2026, 10, 17, 14, 30, 45, 123456789, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		name    string
+		network string
+		event   models.AuditEvent
+		want    string
+	}{
+		{
+			"udp, one message per datagram",
+			"udp",
+			models.AuditEvent{OccurredAt: at, Action: "auth.login", Outcome: AuditSuccess, Details: "ok"},
+			"<85>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 auth.login - ok",
+		},
+		{
+			"failures are warnings",
+			"udp",
+			models.AuditEvent{OccurredAt: at, Action: "auth.login", Outcome: AuditFailure, Details: "bad password"},
+			"<84>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 auth.login - bad password",
+		},
+		{
+			"tcp, octet counted",
+			"tcp",
+			models.AuditEvent{OccurredAt: at, Action: "auth.login", Outcome: AuditDenied, Details: "x"},
+			"71 <84>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 auth.login - x",
+		},
+		{
+			// The count is of bytes, not characters
+			"tcp, multibyte body",
+			"tcp",
+			models.AuditEvent{OccurredAt: at, Action: "user.update", Outcome: AuditSuccess, Details: "name=Zoë"},
+			"80 <85>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 user.update - name=Zoë",
+		},
+		{
+			// MSGID is printable ASCII without spaces, at most 32 characters
+			"unsafe msgid",
+			"udp",
+			models.AuditEvent{OccurredAt: at, Action: "a b\tc" + strings.Repeat("x", 40), Outcome: AuditSuccess, Details: "-"},
+			"<85>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 a_b_c" + strings.Repeat("x", 27) + " - -",
+		},
+		{
+			"empty msgid",
+			"udp",
+			models.AuditEvent{OccurredAt: at, Outcome: AuditSuccess, Details: "none"},
+			"<85>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 - - none",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(testSyslogSink(tt.network).message(&tt.event)); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogHeaderField(t *testing.T) {
+	tests := []struct {
+		value string
+		max   int
+		want  string
+	}{
+		{"vault-1.example.com", 255, "vault-1.example.com"},
+		{"", 255, "-"},
+		{"two words", 255, "two_words"},
+		{"né", 255, "n_"},
+		{"abcdef", 4, "abcd"},
+	}
+	for _, tt := range tests {
+		if got := syslogHeaderField(tt.value, tt.max); got != tt.want {
+			t.Errorf("syslogHeaderField(%q, %d) = %q, want %q", tt.value, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogAuditSinkFramesOverTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var messages []string
+		for i := 0; i < 2; i++ {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				break
+			}
+			n, _ := strconv.Atoi(strings.TrimSuffix(length, " "))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				break
+			}
+			messages = append(messages, string(msg))
+		}
+		received <- messages
+	}()
+
+	sink, err := NewSyslogAuditSink("tcp://"+listener.Addr().String(), FormatAuditCEF, "")
+	if err != nil {
+		t.Fatalf("NewSyslogAuditSink: %v", err)
+	}
+	sink.hostname, sink.procID = "vault-1", "1234"
+	first := testAuditEvent()
+	// A line break in a message must not split it for the collector
+	second := &models.AuditEvent{OccurredAt: first.OccurredAt, Action: "user.update", Outcome: AuditSuccess,
+		Details: "two\nlines"}
+	for _, event := range []*models.AuditEvent{first, second} {
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	select {
+	case messages := <-received:
+		want := []string{
+			"<84>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 credential.reveal - " + FormatAuditCEF(first),
+			"<85>1 2026-10-17T12:30:45.123456Z vault-1 credstore 1234 user.update - " + FormatAuditCEF(second),
+		}
+		if len(messages) != 2 || messages[0] != want[0] || messages[1] != want[1] {
+			t.Fatalf("received %q, want %q", messages, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector received nothing")
+	}
+}
+
+func TestNewSyslogAuditSinkRejectsBadAddresses(t *testing.T) {
+	for _, address := range []string{"syslog.example.com:514", "udp://syslog.example.com", "http://syslog.example.com:514"} {
+		if _, err := NewSyslogAuditSink(address, FormatAuditCEF, ""); err == nil {
+			t.Errorf("NewSyslogAuditSink(%q) accepted", address)
+		}
+	}
+}
@@ -3,8 +3,9 @@ package services
 import (
 	"credential-store/internal/models"
 	"credential-store/internal/repository"
+	"database/sql"
 	"errors"
-	"os"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -12,15 +13,92 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidCredentials        = errors.New("invalid credentials")
+	ErrPhishingResistantRequired = errors.New("administrators must sign in with a security key or passkey")
+	ErrNoSecurityKey             = errors.New("register a security key or passkey first")
+	ErrExternalAccountConflict   = errors.New("an account with this email is managed by another identity provider")
+	ErrLocalAccountConflict      = errors.New("a local account with this email already exists; an administrator must remove it first")
+	ErrAccountSuspended          = errors.New("this account is suspended")
+	ErrAccountExpired            = errors.New("this account has expired")
+	ErrDirectoryUnavailable      = errors.New("the directory server is unavailable")
+)
+
+// dummyPasswordHash is checked against when there is no password to check.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("credential-store-no-such-user"), bcrypt.DefaultCost)
+
+// How a session was authenticated. Only WebAuthn ones are phishing-resistant:
+// the browser binds the signature to the site's origin.
+const (
+	AuthMethodPassword     = "password"
+	AuthMethodTOTP         = "totp"
+	AuthMethodRecoveryCode = "recovery_code"
+	AuthMethodSecurityKey  = "webauthn"
+	AuthMethodPasskey      = "passkey"
+	AuthMethodOIDC         = "oidc"
+)
+
+// AuthSourceLocal marks accounts that log in with a password kept here.
+const AuthSourceLocal = "local"
+
+// User statuses, and who suspended a user.
+const (
+	UserActive    = "active"
+	UserSuspended = "suspended"
+
+	SuspendedByAdmin     = "admin"
+	SuspendedByDirectory = "directory"
+	SuspendedExpired     = "expired"
+	SuspendedInactive    = "inactive"
+)
+
+// Authenticator checks passwords against an external directory. It returns
+// ErrInvalidCredentials for a wrong email or password, and
+// ErrDirectoryUnavailable when the directory can't be asked.
+type Authenticator interface {
+	// Source is the auth_source of the users it provisions
+	Source() string
+	Authenticate(email, password string) (*models.ExternalIdentity, error)
+}
+
 type AuthService struct {
-	userRepo *repository.UserRepository
+	userRepo      *repository.UserRepository
+	policyRepo    *repository.AuthPolicyRepository
+	webauthnRepo  *repository.WebAuthnRepository
+	authenticator Authenticator
+	passwords     *PasswordPolicy
+	historyRepo   *repository.PasswordHistoryRepository
+	signer        *TokenSigner
+	accessTTL     time.Duration
+	generations   *ttlCache[int, tokenGenerationEntry]
 }
 
-func NewAuthService(userRepo *repository.UserRepository) *AuthService {
-	return &AuthService{userRepo: userRepo}
+// NewAuthService issues access tokens valid for accessTTL; sessions extend
+// them with refresh tokens. Token generations are cached for generationTTL.
+// Passwords of users unknown here, or provisioned by it, are checked by
+// authenticator, which may be nil. New local passwords must satisfy
+// passwords. Access tokens are signed by signer.
+func NewAuthService(userRepo *repository.UserRepository, policyRepo *repository.AuthPolicyRepository,
+	webauthnRepo *repository.WebAuthnRepository, historyRepo *repository.PasswordHistoryRepository,
+	authenticator Authenticator, passwords *PasswordPolicy, signer *TokenSigner,
+	accessTTL, generationTTL time.Duration) *AuthService {
+	return &AuthService{
+		userRepo:      userRepo,
+		policyRepo:    policyRepo,
+		webauthnRepo:  webauthnRepo,
+		authenticator: authenticator,
+		passwords:     passwords,
+		historyRepo:   historyRepo,
+		signer:        signer,
+		accessTTL:     accessTTL,
+		generations:   newTokenGenerationCache(userRepo, generationTTL),
+	}
 }
 
 func (s *AuthService) Signup(req *models.SignupRequest) (*models.User, error) {
+	if err := s.checkPassword(nil, req.Password, req.Email); err != nil {
+		return nil, err
+	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
@@ -46,39 +124,183 @@ func (s *AuthService) Signup(req *models.SignupRequest) (*models.User, error) {
 	if err := s.userRepo.Create(user); err != nil {
 		return nil, err
 	}
+	if err := s.rememberPassword(user.ID, user.Password); err != nil {
+		return nil, err
+	}
 
 	return user, nil
 }
 
+// Login checks a user's password, here or with the external authenticator;
+// the caller starts the session. Directory users are provisioned on their
+// first login and updated on later ones; the change is returned as with
+// ProvisionExternalUser.
 func (s *AuthService) Login(req *models.LoginRequest) (*models.User, string, error) {
 	user, err := s.userRepo.FindByEmail(req.Email)
-	if err != nil {
-		return nil, "", errors.New("invalid credentials")
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return nil, "", errors.New("invalid credentials")
+	change := ""
+	if s.authenticator != nil && (user == nil || user.AuthSource == s.authenticator.Source()) {
+		identity, err := s.authenticator.Authenticate(req.Email, req.Password)
+		if err != nil {
+			return nil, "", err
+		}
+		if identity.UserGroup == "" {
+			return nil, "", ErrNoMappedGroup
+		}
+		if user, change, err = s.ProvisionExternalUser(identity); err != nil {
+			return nil, "", err
+		}
+	} else {
+		// Provisioned accounts have no password here; they log in through
+		// their identity provider
+		if user == nil || user.AuthSource != AuthSourceLocal || user.Password == "" {
+			// Spend as long as a real check, so the response time doesn't
+			// tell which emails have an account
+			bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+			return nil, "", ErrInvalidCredentials
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			return nil, "", ErrInvalidCredentials
+		}
 	}
 
-	token, err := s.GenerateToken(user)
-	if err != nil {
+	// Only reported once the password is known to be right
+	if err := checkAccount(user); err != nil {
+		return nil, "", err
+	}
+	return user, change, nil
+}
+
+// checkAccount refuses suspended users, and users whose account expired
+// before the expiry job got to suspend them.
+func checkAccount(user *models.User) error {
+	if user.Status != UserActive {
+		return ErrAccountSuspended
+	}
+	if user.ExpiresAt != nil && !time.Now().Before(*user.ExpiresAt) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+// ProvisionExternalUser returns the user an identity provider authenticated,
+// creating it on first login. A local account with the same email is never
+// taken over: the provider vouching for an email doesn't prove its user owns
+// the account here, which may be an admin's. The group, and with it the admin
+// role, follow the provider on every login; suspended users are left as they
+// are. The change made, if any, is returned as the audit action describing
+// it: "user.create" or "user.update".
+func (s *AuthService) ProvisionExternalUser(identity *models.ExternalIdentity) (*models.User, string, error) {
+	role := "user"
+	if identity.UserGroup == "admin" {
+		role = "admin"
+	}
+
+	user, err := s.userRepo.FindByExternalID(identity.Source, identity.ExternalID)
+	if err == sql.ErrNoRows {
+		user, err = s.userRepo.FindByEmail(identity.Email)
+		if err == sql.ErrNoRows {
+			user = &models.User{
+				Email:      identity.Email,
+				Role:       role,
+				UserGroup:  identity.UserGroup,
+				AuthSource: identity.Source,
+				ExternalID: identity.ExternalID,
+			}
+			if err := s.userRepo.Create(user); err != nil {
+				return nil, "", err
+			}
+			return user, "user.create", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if user.AuthSource == AuthSourceLocal {
+			return nil, "", ErrLocalAccountConflict
+		}
+		if user.AuthSource != identity.Source {
+			return nil, "", ErrExternalAccountConflict
+		}
+	} else if err != nil {
 		return nil, "", err
 	}
 
-	return user, token, nil
+	if user.Status != UserActive {
+		return user, "", nil
+	}
+	if user.Email == identity.Email && user.Role == role && user.UserGroup == identity.UserGroup &&
+		user.AuthSource == identity.Source && user.ExternalID == identity.ExternalID {
+		return user, "", nil
+	}
+	user.Email = identity.Email
+	user.Role = role
+	user.UserGroup = identity.UserGroup
+	user.AuthSource = identity.Source
+	user.ExternalID = identity.ExternalID
+	if err := s.userRepo.Update(user); err != nil {
+		return nil, "", err
+	}
+	s.generations.invalidate(user.ID)
+	return user, "user.update", nil
 }
 
-func (s *AuthService) GenerateToken(user *models.User) (string, error) {
+// GenerateToken issues a short-lived access token. sessionID ties it to a
+// the login session it is issued in.
+func (s *AuthService) GenerateToken(user *models.User, sessionID int) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":    user.ID,
 		"email":      user.Email,
 		"role":       user.Role,
 		"user_group": user.UserGroup,
-		"exp":        time.Now().Add(time.Hour * 1).Unix(), // 1 hour expiration for security
+		"gen":        user.TokenGeneration,
+		"exp":        time.Now().Add(s.accessTTL).Unix(),
+	}
+	if sessionID != 0 {
+		claims["sid"] = sessionID
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return s.signer.Sign(claims)
+}
+
+// ParseToken verifies an access token and returns its claims.
+func (s *AuthService) ParseToken(tokenString string) (jwt.MapClaims, error) {
+	return s.signer.Parse(tokenString)
+}
+
+// JWKS publishes the public keys that verify access tokens.
+func (s *AuthService) JWKS() []byte {
+	return s.signer.JWKS()
+}
+
+func (s *AuthService) AccessTokenTTL() time.Duration {
+	return s.accessTTL
+}
+
+// CheckToken rejects tokens of deleted users, tokens issued before the user
+// was last updated, suspended or changed their password, and tokens of
+// expired accounts.
+func (s *AuthService) CheckToken(userID, generation int) error {
+	entry, err := s.generations.get(userID)
+	if err != nil {
+		return err
+	}
+	if entry.deleted || entry.generation != generation {
+		return ErrTokenRevoked
+	}
+	if entry.status != UserActive {
+		return ErrAccountSuspended
+	}
+	if entry.expiresAt != nil && !time.Now().Before(*entry.expiresAt) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+func (s *AuthService) GetUser(id int) (*models.User, error) {
+	return s.userRepo.FindByID(id)
 }
 
 func (s *AuthService) GetAllUsers() ([]models.User, error) {
@@ -100,6 +322,9 @@ func (s *AuthService) UpdateUser(id string, req *models.UpdateUserRequest) (*mod
 		user.Email = req.Email
 	}
 	if req.Password != "" {
+		if err := s.checkPassword(user, req.Password, user.Email); err != nil {
+			return nil, err
+		}
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
 			return nil, err
@@ -116,6 +341,12 @@ func (s *AuthService) UpdateUser(id string, req *models.UpdateUserRequest) (*mod
 	if err := s.userRepo.Update(user); err != nil {
 		return nil, err
 	}
+	s.generations.invalidate(user.ID)
+	if req.Password != "" {
+		if err := s.rememberPassword(user.ID, user.Password); err != nil {
+			return nil, err
+		}
+	}
 
 	return user, nil
 }
@@ -125,7 +356,11 @@ func (s *AuthService) DeleteUser(id string) error {
 	if err != nil {
 		return err
 	}
-	return s.userRepo.Delete(userID)
+	if err := s.userRepo.Delete(userID); err != nil {
+		return err
+	}
+	s.generations.invalidate(userID)
+	return nil
 }
 
 func (s *AuthService) ChangePassword(userID int, currentPassword, newPassword string) error {
@@ -137,12 +372,215 @@ func (s *AuthService) ChangePassword(userID int, currentPassword, newPassword st
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
 		return errors.New("current password is incorrect")
 	}
+	return s.SetPassword(user, newPassword)
+}
+
+// CheckPassword returns a *PasswordPolicyError if password may not become
+// the user's new password.
+func (s *AuthService) CheckPassword(user *models.User, password string) error {
+	return s.checkPassword(user, password, user.Email)
+}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+// SetPassword replaces a user's password, if the policy allows it, and
+// invalidates their access tokens; the caller ends their sessions.
+func (s *AuthService) SetPassword(user *models.User, password string) error {
+	if err := s.checkPassword(user, password, user.Email); err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	return s.userRepo.UpdatePassword(userID, string(hashedPassword))
+	if err := s.userRepo.UpdatePassword(user.ID, string(hashedPassword)); err != nil {
+		return err
+	}
+	s.generations.invalidate(user.ID)
+	return s.rememberPassword(user.ID, string(hashedPassword))
+}
+
+func (s *AuthService) PasswordPolicy() models.PasswordPolicyInfo {
+	return s.passwords.Rules()
 }
 
+// checkPassword returns a *PasswordPolicyError if password may not become
+// user's new password; user is nil for a new account.
+func (s *AuthService) checkPassword(user *models.User, password string, userInputs ...string) error {
+	violations := s.passwords.Check(password, userInputs...)
+	if user != nil && len(violations) == 0 {
+		reused, err := s.passwordReused(user, password)
+		if err != nil {
+			return err
+		}
+		if reused {
+			violations = append(violations, models.PasswordViolation{
+				Code:    PasswordRecentlyUsed,
+				Message: fmt.Sprintf("must not be one of your last %d passwords", s.passwords.History()),
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// passwordReused reports whether password is the user's current one or one
+// of the others in their history.
+func (s *AuthService) passwordReused(user *models.User, password string) (bool, error) {
+	if s.passwords.History() == 0 {
+		return false, nil
+	}
+	hashes, err := s.historyRepo.FindRecent(user.ID, s.passwords.History())
+	if err != nil {
+		return false, err
+	}
+	// Users from before the history was kept only have the current one
+	if user.Password != "" && (len(hashes) == 0 || hashes[0] != user.Password) {
+		hashes = append([]string{user.Password}, hashes...)
+		if len(hashes) > s.passwords.History() {
+			hashes = hashes[:s.passwords.History()]
+		}
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *AuthService) rememberPassword(userID int, passwordHash string) error {
+	if s.passwords.History() == 0 {
+		return nil
+	}
+	return s.historyRepo.Add(userID, passwordHash, s.passwords.History())
+}
+
+// SetStatus suspends a user, for reason (one of the SuspendedBy constants),
+// or reactivates them. Suspending invalidates their access tokens; the caller
+// ends their sessions.
+func (s *AuthService) SetStatus(userID int, status, reason string) error {
+	if status == UserActive {
+		reason = ""
+	}
+	if err := s.userRepo.SetStatus(userID, status, reason, time.Now().UTC()); err != nil {
+		return err
+	}
+	s.generations.invalidate(userID)
+	return nil
+}
+
+// UpdateStatus suspends or reactivates a user on behalf of an admin. An
+// expired account can't be reactivated before its expiry date is moved.
+func (s *AuthService) UpdateStatus(userID int, status string) (*models.User, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if status == UserActive && user.ExpiresAt != nil && !time.Now().Before(*user.ExpiresAt) {
+		return nil, ErrAccountExpired
+	}
+	if user.Status == status && (status == UserActive || user.SuspendedReason == SuspendedByAdmin) {
+		return user, nil
+	}
+	if err := s.SetStatus(userID, status, SuspendedByAdmin); err != nil {
+		return nil, err
+	}
+	return s.userRepo.FindByID(userID)
+}
+
+// SetExpiry sets when a user's account stops working; nil means never. A
+// time already past stops it at once.
+func (s *AuthService) SetExpiry(userID int, expiresAt *time.Time) (*models.User, error) {
+	if expiresAt != nil {
+		// Stored without a zone
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+	if err := s.userRepo.SetExpiry(userID, expiresAt); err != nil {
+		return nil, err
+	}
+	s.generations.invalidate(userID)
+	return s.userRepo.FindByID(userID)
+}
+
+func (s *AuthService) Policy() (*models.AuthPolicy, error) {
+	return s.policyRepo.Get()
+}
+
+// UpdatePolicy changes the login policy on behalf of an admin. Requiring
+// phishing-resistant logins for admins is refused unless that admin has a
+// security key, so they can't lock themselves out. The other admins without
+// one are returned; they can no longer log in.
+func (s *AuthService) UpdatePolicy(actorID int, req *models.UpdateAuthPolicyRequest) (*models.AuthPolicy, []string, error) {
+	policy, err := s.policyRepo.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.AdminRequirePhishingResistant != nil {
+		policy.AdminRequirePhishingResistant = *req.AdminRequirePhishingResistant
+	}
+
+	var withoutKeys []string
+	if policy.AdminRequirePhishingResistant {
+		count, err := s.webauthnRepo.CountByUser(actorID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count == 0 {
+			return nil, nil, ErrNoSecurityKey
+		}
+
+		users, err := s.userRepo.FindAll()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, user := range users {
+			if user.Role != "admin" {
+				continue
+			}
+			count, err := s.webauthnRepo.CountByUser(user.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if count == 0 {
+				withoutKeys = append(withoutKeys, user.Email)
+			}
+		}
+	}
+
+	if err := s.policyRepo.Update(policy); err != nil {
+		return nil, nil, err
+	}
+	return policy, withoutKeys, nil
+}
+
+// RequiresPhishingResistant reports whether the user may only log in with a
+// security key or passkey.
+func (s *AuthService) RequiresPhishingResistant(user *models.User) (bool, error) {
+	if user.Role != "admin" {
+		return false, nil
+	}
+	policy, err := s.policyRepo.Get()
+	if err != nil {
+		return false, err
+	}
+	return policy.AdminRequirePhishingResistant, nil
+}
+
+// CheckAuthMethod rejects a login, or a session being refreshed, that the
+// current policy no longer accepts for the user.
+func (s *AuthService) CheckAuthMethod(user *models.User, method string) error {
+	if method == AuthMethodSecurityKey || method == AuthMethodPasskey {
+		return nil
+	}
+	required, err := s.RequiresPhishingResistant(user)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrPhishingResistantRequired
+	}
+	return nil
+}
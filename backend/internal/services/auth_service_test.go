@@ -0,0 +1,199 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testAuthService(t *testing.T, db *sql.DB) *AuthService {
+	t.Helper()
+	userRepo := repository.NewUserRepository(db)
+	return &AuthService{
+		userRepo:    userRepo,
+		policyRepo:  repository.NewAuthPolicyRepository(db),
+		signer:      testTokenSigner(t),
+		accessTTL:   15 * time.Minute,
+		generations: newTokenGenerationCache(userRepo, time.Minute),
+	}
+}
+
+func newTestAuthService(t *testing.T) (*AuthService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return testAuthService(t, db), mock
+}
+
+func expectExternalLookup(mock sqlmock.Sqlmock, identity *models.ExternalIdentity, byID, byEmail *models.User) {
+	q := mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WithArgs(identity.Source, identity.ExternalID)
+	if byID != nil {
+		q.WillReturnRows(userRows(byID))
+		return
+	}
+	q.WillReturnRows(userRows())
+	if byEmail != nil {
+		mock.ExpectQuery("FROM users WHERE email").WithArgs(identity.Email).WillReturnRows(userRows(byEmail))
+	} else {
+		mock.ExpectQuery("FROM users WHERE email").WithArgs(identity.Email).WillReturnRows(userRows())
+	}
+}
+
+func TestProvisionExternalUserCreatesUser(t *testing.T) {
+	s, mock := newTestAuthService(t)
+	identity := &models.ExternalIdentity{Source: AuthSourceOIDC, ExternalID: "sub-1", Email: "bob@example.com",
+		UserGroup: "admin"}
+
+	expectExternalLookup(mock, identity, nil, nil)
+	mock.ExpectQuery("INSERT INTO users").WithArgs("bob@example.com", "", "admin", "admin", AuthSourceOIDC, "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "status"}).AddRow(9, time.Now(), UserActive))
+
+	user, change, err := s.ProvisionExternalUser(identity)
+	if err != nil || user.ID != 9 || user.Role != "admin" || change != "user.create" {
+		t.Fatalf("ProvisionExternalUser = %+v, %q, %v", user, change, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionExternalUserRefusesLocalAccounts(t *testing.T) {
+	for _, role := range []string{"user", "admin"} {
+		s, mock := newTestAuthService(t)
+		local := testUser(3, "alice@example.com")
+		local.Role = role
+		local.Password = "$2a$10$hash"
+		identity := &models.ExternalIdentity{Source: AuthSourceOIDC, ExternalID: "sub-1", Email: local.Email,
+			UserGroup: "admin"}
+
+		// No update may follow: the account keeps its password and role
+		expectExternalLookup(mock, identity, nil, local)
+		if _, _, err := s.ProvisionExternalUser(identity); !errors.Is(err, ErrLocalAccountConflict) {
+			t.Errorf("%s: ProvisionExternalUser = %v, want ErrLocalAccountConflict", role, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", role, err)
+		}
+	}
+}
+
+func TestProvisionExternalUserRefusesOtherProviders(t *testing.T) {
+	s, mock := newTestAuthService(t)
+	ldapUser := testUser(3, "alice@example.com")
+	ldapUser.AuthSource, ldapUser.ExternalID = AuthSourceLDAP, "uid=alice"
+	identity := &models.ExternalIdentity{Source: AuthSourceOIDC, ExternalID: "sub-1", Email: ldapUser.Email,
+		UserGroup: "junior"}
+
+	expectExternalLookup(mock, identity, nil, ldapUser)
+	if _, _, err := s.ProvisionExternalUser(identity); !errors.Is(err, ErrExternalAccountConflict) {
+		t.Fatalf("ProvisionExternalUser = %v, want ErrExternalAccountConflict", err)
+	}
+}
+
+func TestProvisionExternalUserFollowsProvider(t *testing.T) {
+	s, mock := newTestAuthService(t)
+	existing := testUser(3, "alice@example.com")
+	existing.AuthSource, existing.ExternalID = AuthSourceOIDC, "sub-1"
+	identity := &models.ExternalIdentity{Source: AuthSourceOIDC, ExternalID: "sub-1", Email: existing.Email,
+		UserGroup: "junior"}
+
+	// Unchanged
+	expectExternalLookup(mock, identity, existing, nil)
+	if _, change, err := s.ProvisionExternalUser(identity); err != nil || change != "" {
+		t.Fatalf("ProvisionExternalUser(unchanged) = %q, %v", change, err)
+	}
+
+	// Promoted through the provider's groups
+	identity.UserGroup = "admin"
+	expectExternalLookup(mock, identity, existing, nil)
+	mock.ExpectQuery("UPDATE users SET email").
+		WithArgs(existing.Email, "", "admin", "admin", AuthSourceOIDC, "sub-1", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(2))
+	user, change, err := s.ProvisionExternalUser(identity)
+	if err != nil || change != "user.update" || user.Role != "admin" || user.TokenGeneration != 2 {
+		t.Fatalf("ProvisionExternalUser(promoted) = %+v, %q, %v", user, change, err)
+	}
+
+	// A provider account whose subject changed is matched by email again
+	identity.ExternalID = "sub-2"
+	expectExternalLookup(mock, identity, nil, existing)
+	mock.ExpectQuery("UPDATE users SET email").
+		WithArgs(existing.Email, "", "admin", "admin", AuthSourceOIDC, "sub-2", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(3))
+	if _, change, err := s.ProvisionExternalUser(identity); err != nil || change != "user.update" {
+		t.Fatalf("ProvisionExternalUser(new subject) = %q, %v", change, err)
+	}
+
+	// Suspended users are left alone
+	suspended := testUser(4, "carol@example.com")
+	suspended.AuthSource, suspended.ExternalID, suspended.Status = AuthSourceOIDC, "sub-4", UserSuspended
+	identity = &models.ExternalIdentity{Source: AuthSourceOIDC, ExternalID: "sub-4", Email: suspended.Email,
+		UserGroup: "admin"}
+	expectExternalLookup(mock, identity, suspended, nil)
+	if user, change, err := s.ProvisionExternalUser(identity); err != nil || change != "" || user.Role != "user" {
+		t.Fatalf("ProvisionExternalUser(suspended) = %+v, %q, %v", user, change, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginWithDirectory(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "engineering"),
+		ldapPerson("bob", "bob-secret", "staff"), ldapPerson("carol", "carol-secret", "engineering"))
+	s, mock := newTestAuthService(t)
+	s.authenticator = NewLDAPDirectory(testLDAPConfig(stub.URL()))
+
+	// First login provisions the directory user
+	mock.ExpectQuery("FROM users WHERE email").WithArgs("alice@example.com").WillReturnRows(userRows())
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WithArgs(AuthSourceLDAP, "alice-uuid").
+		WillReturnRows(userRows())
+	mock.ExpectQuery("FROM users WHERE email").WithArgs("alice@example.com").WillReturnRows(userRows())
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("alice@example.com", "", "user", "junior", AuthSourceLDAP, "alice-uuid").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "status"}).AddRow(9, time.Now(), UserActive))
+	user, change, err := s.Login(&models.LoginRequest{Email: "alice@example.com", Password: "alice-secret"})
+	if err != nil || user.ID != 9 || change != "user.create" {
+		t.Fatalf("Login = %+v, %q, %v", user, change, err)
+	}
+
+	// Users without a mapped group are refused after their password is checked
+	mock.ExpectQuery("FROM users WHERE email").WithArgs("bob@example.com").WillReturnRows(userRows())
+	if _, _, err := s.Login(&models.LoginRequest{Email: "bob@example.com", Password: "bob-secret"}); !errors.Is(err, ErrNoMappedGroup) {
+		t.Fatalf("Login(no mapped group) = %v, want ErrNoMappedGroup", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A local account keeps its own password; the directory isn't asked
+	binds := len(stub.Binds())
+	hash, err := bcrypt.GenerateFromPassword([]byte("local-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := testUser(3, "carol@example.com")
+	local.Password = string(hash)
+	for _, password := range []string{"carol-secret", "local-secret"} {
+		mock.ExpectQuery("FROM users WHERE email").WithArgs(local.Email).WillReturnRows(userRows(local))
+		user, _, err := s.Login(&models.LoginRequest{Email: local.Email, Password: password})
+		if password == "carol-secret" && !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Login(directory password) = %v, want ErrInvalidCredentials", err)
+		}
+		if password == "local-secret" && (err != nil || user.ID != 3) {
+			t.Errorf("Login(local password) = %+v, %v", user, err)
+		}
+	}
+	if got := len(stub.Binds()); got != binds {
+		t.Fatalf("%d binds for a local account", got-binds)
+	}
+}
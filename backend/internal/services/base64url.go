@@ -0,0 +1,7 @@
+package services
+
+import "encoding/base64"
+
+// base64URL is the unpadded URL-safe base64 of JOSE (RFC 7515), used in JSON
+// Web Keys and tokens, and of WebAuthn.
+var base64URL = base64.RawURLEncoding
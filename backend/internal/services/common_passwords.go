@@ -0,0 +1,27 @@
+package services
+
+// commonPasswords are the most used passwords from public breach corpora,
+// most common first. They rank dictionary matches in the strength estimate
+// and are always treated as breached.
+var commonPasswords = []string{
+	"123456", "password", "123456789", "12345678", "12345", "qwerty", "1234567", "111111", "1234567890", "123123",
+	"abc123", "1234", "password1", "iloveyou", "1q2w3e4r", "000000", "qwerty123", "zaq12wsx", "dragon", "sunshine",
+	"princess", "letmein", "654321", "monkey", "27653", "1qaz2wsx", "123321", "qwertyuiop", "superman", "asdfghjkl",
+	"football", "baseball", "welcome", "admin", "master", "shadow", "michael", "jennifer", "hunter", "trustno1",
+	"passw0rd", "starwars", "login", "freedom", "whatever", "qazwsx", "ninja", "mustang", "access", "batman",
+	"solo", "loveme", "696969", "charlie", "donald", "aa123456", "hello", "flower", "hottie", "lovely",
+	"121212", "666666", "987654321", "7777777", "555555", "112233", "123qwe", "1q2w3e", "google", "secret",
+	"computer", "michelle", "jordan", "tigger", "soccer", "harley", "ranger", "daniel", "thomas", "robert",
+	"jessica", "pepper", "buster", "killer", "george", "andrew", "joshua", "summer", "ashley", "hannah",
+	"maggie", "cheese", "banana", "orange", "purple", "matrix", "silver", "ginger", "cookie", "chelsea",
+	"liverpool", "arsenal", "pokemon", "naruto", "angel", "samsung", "apple", "internet", "qwe123", "asdasd",
+	"zxcvbnm", "asdf1234", "qwer1234", "abcd1234", "abcdef", "abc12345", "password123", "password12", "admin123",
+	"root", "toor", "changeme", "default", "guest", "test", "test123", "temp", "temp123", "letmein1",
+	"welcome1", "welcome123", "p@ssw0rd", "p@ssword", "pa$$word", "passw0rd1", "qwerty1", "iloveyou1", "princess1",
+	"monkey1", "dragon1", "sunshine1", "football1", "baseball1", "master1", "shadow1", "superman1", "1password",
+	"password!", "summer2024", "winter2024", "spring2024", "autumn2024", "summer2025", "winter2025", "company123",
+	"secret123", "administrator", "letmein123", "love", "god", "sex", "money", "family", "jesus", "blessed",
+	"forever", "friends", "hello123", "mypassword", "mypass", "pass", "pass123", "pass1234", "passwd", "qwertyui",
+	"asdfgh", "zxcvbn", "1qazxsw2", "q1w2e3r4", "q1w2e3r4t5", "1q2w3e4r5t", "11111111", "00000000", "88888888",
+	"12341234", "11223344", "123654", "147258369", "159753", "741852963", "123abc", "a123456", "ab123456",
+}
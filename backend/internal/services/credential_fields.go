@@ -0,0 +1,54 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	passwordField = "password"
+	usernameField = "username"
+	notesField    = "notes"
+)
+
+// credentialFields lists every credential column that can be encrypted. To make
+// a new column encryptable, add it here and to CredentialRepository.
+var credentialFields = []struct {
+	name  string
+	value func(*models.Credential) *string
+}{
+	{passwordField, func(c *models.Credential) *string { return &c.Password }},
+	{usernameField, func(c *models.Credential) *string { return &c.Username }},
+	{notesField, func(c *models.Credential) *string { return &c.Notes }},
+}
+
+const defaultEncryptedFields = "username,notes"
+
+// parseEncryptedFields reads ENCRYPTED_CREDENTIAL_FIELDS, a comma separated list
+// of fields to encrypt on top of the password, which is always encrypted.
+func parseEncryptedFields() (map[string]bool, error) {
+	raw := os.Getenv("ENCRYPTED_CREDENTIAL_FIELDS")
+	if raw == "" {
+		raw = defaultEncryptedFields
+	}
+
+	known := make(map[string]bool, len(credentialFields))
+	for _, field := range credentialFields {
+		known[field.name] = true
+	}
+
+	enabled := map[string]bool{passwordField: true}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("ENCRYPTED_CREDENTIAL_FIELDS: unknown field %q", name)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
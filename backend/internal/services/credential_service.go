@@ -3,93 +3,256 @@ package services
 import (
 	"credential-store/internal/models"
 	"credential-store/internal/repository"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 )
 
+var (
+	ErrIntegrity              = errors.New("credential integrity check failed")
+	ErrCredentialAccessDenied = errors.New("you don't have access to this credential")
+)
+
 type CredentialService struct {
-	credRepo   *repository.CredentialRepository
-	encryption *EncryptionService
+	credRepo        *repository.CredentialRepository
+	folderRepo      *repository.FolderRepository
+	encryption      *EncryptionService
+	folderKeys      *FolderKeyService
+	encryptedFields map[string]bool
+	// Also read what was written before per-record binding, whatever the
+	// EncryptionService allows; see withUnbound
+	allowUnbound bool
 }
 
-func NewCredentialService(credRepo *repository.CredentialRepository, encryption *EncryptionService) *CredentialService {
+func NewCredentialService(credRepo *repository.CredentialRepository, folderRepo *repository.FolderRepository,
+	encryption *EncryptionService, folderKeys *FolderKeyService) (*CredentialService, error) {
+	encryptedFields, err := parseEncryptedFields()
+	if err != nil {
+		return nil, err
+	}
+
 	return &CredentialService{
-		credRepo:   credRepo,
-		encryption: encryption,
+		credRepo:        credRepo,
+		folderRepo:      folderRepo,
+		encryption:      encryption,
+		folderKeys:      folderKeys,
+		encryptedFields: encryptedFields,
+	}, nil
+}
+
+// withUnbound returns a copy that reads unbound ciphertexts and plaintext
+// fields from before per-record binding, for moving them over.
+func (s *CredentialService) withUnbound() *CredentialService {
+	c := *s
+	c.allowUnbound = true
+	return &c
+}
+
+// acceptsUnbound reports whether values from before per-record binding may
+// still be read.
+func (s *CredentialService) acceptsUnbound() bool {
+	return s.allowUnbound || s.encryption.AllowsUnbound()
+}
+
+// credentialAAD ties a ciphertext to the row and column it was written for, so
+// copying it into another credential or field fails authentication.
+func credentialAAD(cred *models.Credential, field string) []byte {
+	folderID := 0
+	if cred.FolderID != nil {
+		folderID = *cred.FolderID
+	}
+	return []byte(fmt.Sprintf("credential:%d|folder:%d|field:%s", cred.ID, folderID, field))
+}
+
+// sealField encrypts with the folder's data key, or with the master key-ring
+// for credentials that are not in a folder.
+func (s *CredentialService) sealField(cred *models.Credential, field, plaintext string) (string, error) {
+	aad := credentialAAD(cred, field)
+	if cred.FolderID != nil {
+		return s.folderKeys.Encrypt(*cred.FolderID, plaintext, aad)
+	}
+	return s.encryption.EncryptWithAAD(plaintext, aad)
+}
+
+// openField also accepts key-ring ciphertexts written before per-folder keys
+// existed, and unbound ones from before per-record binding while those are
+// accepted; the re-wrap job moves both over. A ciphertext that fails
+// authentication, or is unbound when that is refused, is an ErrIntegrity.
+func (s *CredentialService) openField(cred *models.Credential, field, ciphertext string) (string, error) {
+	bound := IsBoundCiphertext(ciphertext)
+	if !bound && !s.acceptsUnbound() {
+		return "", ErrIntegrity
+	}
+
+	aad := credentialAAD(cred, field)
+	if !bound {
+		// Never authenticated against a record
+		aad = nil
+	}
+	var plaintext string
+	var err error
+	switch {
+	case !IsDataKeyCiphertext(ciphertext):
+		plaintext, err = s.encryption.DecryptWithAAD(ciphertext, aad)
+	case cred.FolderID == nil:
+		return "", ErrIntegrity
+	default:
+		plaintext, err = s.folderKeys.Decrypt(*cred.FolderID, ciphertext, aad)
+	}
+
+	if bound && errors.Is(err, ErrAuthenticationFailed) {
+		return "", ErrIntegrity
+	}
+	return plaintext, err
+}
+
+// sealValue encrypts a field if it is configured for encryption. Empty values
+// are stored as is.
+func (s *CredentialService) sealValue(cred *models.Credential, field, plaintext string) (string, error) {
+	if field != passwordField && (!s.encryptedFields[field] || plaintext == "") {
+		return plaintext, nil
+	}
+	return s.sealField(cred, field, plaintext)
+}
+
+// openValue decrypts a field. Passwords are always ciphertext; other fields
+// may still hold plaintext written before they were encrypted, which is told
+// apart by the bound ciphertext header that encrypted fields always carry.
+func (s *CredentialService) openValue(cred *models.Credential, field, value string) (string, error) {
+	if field == passwordField || IsBoundCiphertext(value) {
+		return s.openField(cred, field, value)
+	}
+	if !s.acceptsUnbound() && s.encryptedFields[field] && value != "" {
+		return "", ErrIntegrity
+	}
+	return value, nil
+}
+
+// fieldNeedsRewrap reports whether a stored value is not yet sealed the way
+// sealValue would seal it today.
+func (s *CredentialService) fieldNeedsRewrap(cred *models.Credential, field, value string) bool {
+	if field != passwordField && !IsBoundCiphertext(value) {
+		return s.encryptedFields[field] && value != ""
+	}
+	if !IsBoundCiphertext(value) {
+		return true
 	}
+	if cred.FolderID != nil {
+		return !IsDataKeyCiphertext(value)
+	}
+	return IsDataKeyCiphertext(value) || s.encryption.NeedsRewrap(value)
 }
 
-func (s *CredentialService) Create(userID int, req *models.CreateCredentialRequest) (*models.Credential, error) {
-	encryptedPassword, err := s.encryption.Encrypt(req.Password)
+// sealAll encrypts every configured field of a credential holding plaintext.
+func (s *CredentialService) sealAll(cred *models.Credential) error {
+	for _, field := range credentialFields {
+		value := field.value(cred)
+		sealed, err := s.sealValue(cred, field.name, *value)
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// openAll decrypts every field of a stored credential in place.
+func (s *CredentialService) openAll(cred *models.Credential) error {
+	stored := *cred
+	for _, field := range credentialFields {
+		value := field.value(cred)
+		plaintext, err := s.openValue(&stored, field.name, *value)
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+func (s *CredentialService) Create(userID int, req *models.CreateCredentialRequest) (*models.CredentialSummary, error) {
+	// The id is part of the AAD, so it has to be known before encrypting
+	id, err := s.credRepo.NextID()
 	if err != nil {
-		log.Printf("Encryption error: %v", err)
+		log.Printf("Database error: %v", err)
 		return nil, err
 	}
 
-	cred := &models.Credential{
+	cred := models.Credential{
+		ID:          id,
 		UserID:      userID,
 		FolderID:    req.FolderID,
 		ServiceName: req.ServiceName,
 		Username:    req.Username,
-		Password:    encryptedPassword,
+		Password:    req.Password,
 		Notes:       req.Notes,
 	}
 
-	if err := s.credRepo.Create(cred); err != nil {
-		log.Printf("Database error: %v", err)
+	if err := s.sealAll(&cred); err != nil {
+		log.Printf("Encryption error: %v", err)
 		return nil, err
 	}
 
-	decryptedPassword, _ := s.encryption.Decrypt(cred.Password)
-	cred.Password = decryptedPassword
+	if err := s.credRepo.Create(&cred); err != nil {
+		log.Printf("Database error: %v", err)
+		return nil, err
+	}
 
-	return cred, nil
+	summary := cred.Summary()
+	return &summary, nil
 }
 
-func (s *CredentialService) GetAll(userID int, isAdmin bool, userGroup string) ([]models.Credential, error) {
-	var credentials []models.Credential
-	var err error
-
-	if isAdmin {
-		credentials, err = s.credRepo.FindAll()
-	} else {
-		// Get credentials based on folder permissions for user group
-		credentials, err = s.credRepo.FindByUserGroup(userGroup)
-	}
-
+// GetAll lists the credentials the caller can read, without their secrets;
+// see Reveal.
+func (s *CredentialService) GetAll(isAdmin bool, userGroup string) ([]models.CredentialSummary, error) {
+	credentials, err := s.credRepo.FindAll()
 	if err != nil {
 		return nil, err
 	}
 
+	// Most credentials share a handful of folders; look each up once
+	readable := make(map[int]bool)
+	summaries := make([]models.CredentialSummary, 0, len(credentials))
 	for i := range credentials {
-		decrypted, err := s.encryption.Decrypt(credentials[i].Password)
-		if err == nil {
-			credentials[i].Password = decrypted
+		cred := &credentials[i]
+		allowed, known := true, true
+		if cred.FolderID != nil {
+			allowed, known = readable[*cred.FolderID]
+		}
+		if !known {
+			if allowed, err = s.canRead(cred, isAdmin, userGroup); err != nil {
+				return nil, err
+			}
+			readable[*cred.FolderID] = allowed
+		}
+		if allowed {
+			summaries = append(summaries, cred.Summary())
 		}
 	}
 
-	return credentials, nil
+	return summaries, nil
 }
 
-func (s *CredentialService) GetByID(id, userID int, isAdmin bool) (*models.Credential, error) {
+func (s *CredentialService) GetByID(id int, isAdmin bool, userGroup string) (*models.CredentialSummary, error) {
 	cred, err := s.credRepo.FindByID(id)
 	if err != nil {
 		return nil, err
 	}
 
-	if !isAdmin && cred.UserID != userID {
-		return nil, errors.New("unauthorized")
+	allowed, err := s.canRead(cred, isAdmin, userGroup)
+	if err != nil {
+		return nil, err
 	}
-
-	decrypted, err := s.encryption.Decrypt(cred.Password)
-	if err == nil {
-		cred.Password = decrypted
+	if !allowed {
+		return nil, ErrCredentialAccessDenied
 	}
 
-	return cred, nil
+	summary := cred.Summary()
+	return &summary, nil
 }
 
-func (s *CredentialService) Update(id, userID int, isAdmin bool, req *models.UpdateCredentialRequest) (*models.Credential, error) {
+func (s *CredentialService) Update(id, userID int, isAdmin bool, req *models.UpdateCredentialRequest) (*models.CredentialSummary, error) {
 	cred, err := s.credRepo.FindByID(id)
 	if err != nil {
 		return nil, err
@@ -99,34 +262,131 @@ func (s *CredentialService) Update(id, userID int, isAdmin bool, req *models.Upd
 		return nil, errors.New("unauthorized")
 	}
 
+	// Re-encrypt everything: moving folders changes both the data key and the
+	// AAD, and fields may have been switched on for encryption since
+	plain := *cred
+	replaced := map[string]bool{
+		passwordField: req.Password != "",
+		usernameField: req.Username != "",
+		notesField:    req.Notes != "",
+	}
+	for _, field := range credentialFields {
+		if replaced[field.name] {
+			continue
+		}
+		value := field.value(&plain)
+		plaintext, err := s.openValue(cred, field.name, *value)
+		if err != nil {
+			return nil, err
+		}
+		*value = plaintext
+	}
+
 	if req.FolderID != nil {
-		cred.FolderID = req.FolderID
+		plain.FolderID = req.FolderID
 	}
 	if req.ServiceName != "" {
-		cred.ServiceName = req.ServiceName
+		plain.ServiceName = req.ServiceName
 	}
 	if req.Username != "" {
-		cred.Username = req.Username
+		plain.Username = req.Username
 	}
 	if req.Password != "" {
-		encryptedPassword, err := s.encryption.Encrypt(req.Password)
-		if err != nil {
-			return nil, err
-		}
-		cred.Password = encryptedPassword
+		plain.Password = req.Password
 	}
 	if req.Notes != "" {
-		cred.Notes = req.Notes
+		plain.Notes = req.Notes
+	}
+
+	updated := plain
+	if err := s.sealAll(&updated); err != nil {
+		return nil, err
 	}
 
-	if err := s.credRepo.Update(cred); err != nil {
+	if err := s.credRepo.Update(&updated); err != nil {
 		return nil, err
 	}
 
-	decrypted, _ := s.encryption.Decrypt(cred.Password)
-	cred.Password = decrypted
+	summary := updated.Summary()
+	return &summary, nil
+}
+
+// Reveal decrypts a single field for a user who can read the credential, and
+// records that they did. Nothing is returned if the reveal can't be recorded. Service accounts pass their id with a userID of 0.
+func (s *CredentialService) Reveal(id, userID, serviceAccountID int, isAdmin bool, userGroup, field, ipAddress string) (*models.RevealCredentialResponse, error) {
+	cred, err := s.credRepo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
 
-	return cred, nil
+	allowed, err := s.canRead(cred, isAdmin, userGroup)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrCredentialAccessDenied
+	}
+
+	var stored *string
+	for _, f := range credentialFields {
+		if f.name == field {
+			stored = f.value(cred)
+		}
+	}
+	if stored == nil {
+		return nil, fmt.Errorf("unknown credential field %q", field)
+	}
+
+	plaintext, err := s.openValue(cred, field, *stored)
+	if errors.Is(err, ErrIntegrity) {
+		log.Printf("Integrity check failed for credential %d field %s", cred.ID, field)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reveal := &models.CredentialReveal{
+		CredentialID:     cred.ID,
+		UserID:           userID,
+		ServiceAccountID: serviceAccountID,
+		Field:            field,
+		IPAddress:        ipAddress,
+	}
+	if err := s.credRepo.RecordReveal(reveal); err != nil {
+		return nil, err
+	}
+
+	return &models.RevealCredentialResponse{CredentialID: cred.ID, Field: field, Value: plaintext}, nil
+}
+
+// FolderOf returns the folder a credential is in, nil if none.
+func (s *CredentialService) FolderOf(id int) (*int, error) {
+	cred, err := s.credRepo.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return cred.FolderID, nil
+}
+
+func (s *CredentialService) GetReveals(id int) ([]models.CredentialReveal, error) {
+	return s.credRepo.FindReveals(id)
+}
+
+// canRead decides who sees a credential, for listing, getting and revealing
+// alike: credentials outside folders are visible to everyone, the rest to
+// groups with read access to the folder.
+func (s *CredentialService) canRead(cred *models.Credential, isAdmin bool, userGroup string) (bool, error) {
+	if isAdmin || cred.FolderID == nil {
+		return true, nil
+	}
+	perm, err := s.folderRepo.GetPermission(*cred.FolderID, userGroup)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return perm.CanRead, nil
 }
 
 func (s *CredentialService) Delete(id, userID int, isAdmin bool) error {
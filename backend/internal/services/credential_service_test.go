@@ -0,0 +1,313 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestCredentialService(t *testing.T) (*CredentialService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &CredentialService{
+		credRepo:        repository.NewCredentialRepository(db),
+		folderRepo:      repository.NewFolderRepository(db),
+		encryption:      newTestEncryption(t, 1, 1),
+		encryptedFields: map[string]bool{passwordField: true},
+	}, mock
+}
+
+var credentialColumns = []string{"id", "user_id", "folder_id", "service_name", "username", "password", "notes",
+	"created_at", "updated_at"}
+
+// credentialRows has a credential per entry of folders, with id i+1 and the
+// given folder id, or none for 0.
+func credentialRows(folders ...int) *sqlmock.Rows {
+	rows := sqlmock.NewRows(credentialColumns)
+	for i, folder := range folders {
+		var folderID interface{}
+		if folder != 0 {
+			folderID = folder
+		}
+		rows.AddRow(i+1, 1, folderID, "service", "", "v1+aad:x", "", time.Now(), time.Now())
+	}
+	return rows
+}
+
+// expectPermission answers a permission lookup for the folder and group;
+// groups that aren't listed on the folder at all have no row.
+func expectPermission(mock sqlmock.Sqlmock, folderID int, group string, listed, canRead bool) {
+	q := mock.ExpectQuery("FROM folder_permissions WHERE folder_id").WithArgs(folderID, group)
+	if !listed {
+		q.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	q.WillReturnRows(sqlmock.NewRows([]string{"id", "folder_id", "user_group", "can_read", "can_write", "can_delete"}).
+		AddRow(1, folderID, group, canRead, false, false))
+}
+
+func TestCredentialListVisibility(t *testing.T) {
+	s, mock := newTestCredentialService(t)
+
+	// Folder 10 is readable, 20 is listed without read access, 30 not at all;
+	// each is looked up once
+	mock.ExpectQuery("FROM credentials ORDER BY").WillReturnRows(credentialRows(0, 10, 20, 10, 30, 20))
+	expectPermission(mock, 10, "staff", true, true)
+	expectPermission(mock, 20, "staff", true, false)
+	expectPermission(mock, 30, "staff", false, false)
+	listed, err := s.GetAll(false, "staff")
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	var ids []int
+	for _, cred := range listed {
+		ids = append(ids, cred.ID)
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 4 {
+		t.Fatalf("GetAll listed %v, want [1 2 4]", ids)
+	}
+
+	// Admins see everything without lookups
+	mock.ExpectQuery("FROM credentials ORDER BY").WillReturnRows(credentialRows(0, 10, 20))
+	if listed, err := s.GetAll(true, "admins"); err != nil || len(listed) != 3 {
+		t.Fatalf("GetAll(admin) = %d credentials, %v; want 3", len(listed), err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialGetAndRevealFollowListing(t *testing.T) {
+	tests := []struct {
+		name    string
+		folder  int
+		listed  bool
+		canRead bool
+		want    error
+	}{
+		{"outside folders", 0, false, false, nil},
+		{"readable folder", 10, true, true, nil},
+		{"folder without read access", 10, true, false, ErrCredentialAccessDenied},
+		{"folder of other groups", 10, false, false, ErrCredentialAccessDenied},
+	}
+	for _, tt := range tests {
+		s, mock := newTestCredentialService(t)
+		mock.ExpectQuery("FROM credentials WHERE id").WithArgs(1).WillReturnRows(credentialRows(tt.folder))
+		if tt.folder != 0 {
+			expectPermission(mock, tt.folder, "staff", tt.listed, tt.canRead)
+		}
+		if _, err := s.GetByID(1, false, "staff"); !errors.Is(err, tt.want) {
+			t.Errorf("%s: GetByID = %v, want %v", tt.name, err, tt.want)
+		}
+
+		if tt.want != nil {
+			mock.ExpectQuery("FROM credentials WHERE id").WithArgs(1).WillReturnRows(credentialRows(tt.folder))
+			expectPermission(mock, tt.folder, "staff", tt.listed, tt.canRead)
+			if _, err := s.Reveal(1, 2, 0, false, "staff", passwordField, "192.0.2.1"); !errors.Is(err, tt.want) {
+				t.Errorf("%s: Reveal = %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestCredentialCiphertextCopiedElsewhereFails(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	s := &CredentialService{encryption: encryption, encryptedFields: map[string]bool{passwordField: true, notesField: true}}
+
+	alice := &models.Credential{ID: 1, UserID: 1}
+	bob := &models.Credential{ID: 2, UserID: 2}
+	ct, err := s.sealValue(alice, passwordField, "hunter2")
+	if err != nil {
+		t.Fatalf("sealValue: %v", err)
+	}
+	if pt, err := s.openValue(alice, passwordField, ct); err != nil || pt != "hunter2" {
+		t.Fatalf("openValue = %q, %v", pt, err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		cred  *models.Credential
+		field string
+	}{
+		{"another row", bob, passwordField},
+		{"another field", alice, notesField},
+		{"another row and field", bob, notesField},
+	} {
+		if pt, err := s.openValue(tc.cred, tc.field, ct); !errors.Is(err, ErrIntegrity) {
+			t.Errorf("%s: openValue = %q, %v; want ErrIntegrity", tc.name, pt, err)
+		}
+	}
+}
+
+func TestCredentialUnboundCiphertextRefused(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	s := &CredentialService{encryption: encryption, encryptedFields: map[string]bool{passwordField: true, notesField: true}}
+	cred := &models.Credential{ID: 1, UserID: 1}
+
+	legacy, _ := encryption.Encrypt("hunter2")
+	if _, err := s.openValue(cred, passwordField, legacy); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("openValue(unbound) = %v, want ErrIntegrity", err)
+	}
+	// Nor may an encrypted field fall back to reading it as plaintext
+	if _, err := s.openValue(cred, notesField, "written before encryption"); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("openValue(plaintext notes) = %v, want ErrIntegrity", err)
+	}
+
+	// The re-wrap reads them to move them over
+	if pt, err := s.withUnbound().openValue(cred, passwordField, legacy); err != nil || pt != "hunter2" {
+		t.Fatalf("withUnbound().openValue = %q, %v", pt, err)
+	}
+	encryption.AllowUnbound(true)
+	if pt, err := s.openValue(cred, passwordField, legacy); err != nil || pt != "hunter2" {
+		t.Fatalf("openValue(unbound) allowed = %q, %v", pt, err)
+	}
+}
+
+func TestParseEncryptedFields(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    []string
+		invalid bool
+	}{
+		{"", []string{passwordField, usernameField, notesField}, false},
+		{"notes", []string{passwordField, notesField}, false},
+		{" username , notes ,", []string{passwordField, usernameField, notesField}, false},
+		// The password is encrypted whatever the setting
+		{"none", []string{passwordField}, false},
+		{"notes,custom", nil, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("ENCRYPTED_CREDENTIAL_FIELDS", tt.env)
+		got, err := parseEncryptedFields()
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%q: accepted", tt.env)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("%q: %v, %v; want %v", tt.env, got, err, tt.want)
+			continue
+		}
+		for _, field := range tt.want {
+			if !got[field] {
+				t.Errorf("%q: %s not encrypted", tt.env, field)
+			}
+		}
+	}
+}
+
+func TestCredentialCreateEncryptsConfiguredFields(t *testing.T) {
+	s, mock := newTestCredentialService(t)
+	s.encryptedFields = map[string]bool{passwordField: true, notesField: true}
+
+	username, password, notes := &captureArg{}, &captureArg{}, &captureArg{}
+	mock.ExpectQuery("SELECT nextval").WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(9))
+	mock.ExpectQuery("INSERT INTO credentials").WithArgs(9, 1, nil, "db", username, password, notes).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(time.Now(), time.Now()))
+	summary, err := s.Create(1, &models.CreateCredentialRequest{ServiceName: "db", Username: "admin",
+		Password: "hunter2", Notes: "recovery code 1234-5678"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Usernames aren't configured for encryption here; notes and the
+	// password are sealed to their field of credential 9
+	if username.value != "admin" {
+		t.Errorf("username stored as %v, want it in the clear", username.value)
+	}
+	stored := &models.Credential{ID: 9, UserID: 1}
+	for field, arg := range map[string]*captureArg{passwordField: password, notesField: notes} {
+		ct, _ := arg.value.(string)
+		if !IsBoundCiphertext(ct) {
+			t.Errorf("%s stored as %q, want a bound ciphertext", field, ct)
+		}
+		if pt, err := s.openValue(stored, field, ct); err != nil {
+			t.Errorf("%s doesn't open: %v", field, err)
+		} else if field == notesField && pt != "recovery code 1234-5678" {
+			t.Errorf("notes open to %q", pt)
+		}
+	}
+	if summary.ID != 9 {
+		t.Errorf("summary %+v", summary)
+	}
+
+	// Empty optional fields stay empty rather than becoming ciphertexts
+	mock.ExpectQuery("SELECT nextval").WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(10))
+	mock.ExpectQuery("INSERT INTO credentials").WithArgs(10, 1, nil, "db", "admin", password, "").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(time.Now(), time.Now()))
+	if _, err := s.Create(1, &models.CreateCredentialRequest{ServiceName: "db", Username: "admin", Password: "x"}); err != nil {
+		t.Fatalf("Create without notes: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedCredentialRows returns cred sealed the way Create stores it.
+func storedCredentialRows(t *testing.T, s *CredentialService, cred models.Credential) *sqlmock.Rows {
+	t.Helper()
+	if err := s.sealAll(&cred); err != nil {
+		t.Fatalf("sealAll: %v", err)
+	}
+	return sqlmock.NewRows(credentialColumns).AddRow(cred.ID, cred.UserID, cred.FolderID, cred.ServiceName,
+		cred.Username, cred.Password, cred.Notes, time.Now(), time.Now())
+}
+
+func TestCredentialRevealIsRecorded(t *testing.T) {
+	s, mock := newTestCredentialService(t)
+	s.encryptedFields = map[string]bool{passwordField: true, usernameField: true, notesField: true}
+	cred := models.Credential{ID: 1, UserID: 1, ServiceName: "db", Username: "admin", Password: "hunter2",
+		Notes: "connection string"}
+	revealRow := sqlmock.NewRows([]string{"id", "user_email", "service_account_name", "revealed_at"})
+
+	tests := []struct {
+		name             string
+		userID, saID     int
+		field, plaintext string
+	}{
+		{"user reveals the password", 2, 0, passwordField, "hunter2"},
+		{"user reveals the notes", 2, 0, notesField, "connection string"},
+		{"service account reveals the username", 0, 5, usernameField, "admin"},
+	}
+	for _, tt := range tests {
+		mock.ExpectQuery("FROM credentials WHERE id").WithArgs(1).WillReturnRows(storedCredentialRows(t, s, cred))
+		mock.ExpectQuery("INSERT INTO credential_reveals").WithArgs(1, tt.userID, tt.saID, tt.field, "192.0.2.1").
+			WillReturnRows(revealRow.AddRow(1, "", "", time.Now()))
+		revealed, err := s.Reveal(1, tt.userID, tt.saID, false, "staff", tt.field, "192.0.2.1")
+		if err != nil || revealed.Value != tt.plaintext || revealed.Field != tt.field {
+			t.Errorf("%s: Reveal = %+v, %v; want %q", tt.name, revealed, err, tt.plaintext)
+		}
+	}
+
+	// Nothing is revealed that isn't recorded
+	mock.ExpectQuery("FROM credentials WHERE id").WithArgs(1).WillReturnRows(storedCredentialRows(t, s, cred))
+	mock.ExpectQuery("INSERT INTO credential_reveals").WillReturnError(sql.ErrConnDone)
+	if revealed, err := s.Reveal(1, 2, 0, false, "staff", passwordField, "192.0.2.1"); revealed != nil || err == nil {
+		t.Errorf("Reveal without a record = %+v, %v; want an error", revealed, err)
+	}
+
+	// Neither are unknown fields, nor is their reveal recorded
+	mock.ExpectQuery("FROM credentials WHERE id").WithArgs(1).WillReturnRows(storedCredentialRows(t, s, cred))
+	if revealed, err := s.Reveal(1, 2, 0, false, "staff", "service_name", "192.0.2.1"); revealed != nil || err == nil {
+		t.Errorf("Reveal(service_name) = %+v, %v; want an error", revealed, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
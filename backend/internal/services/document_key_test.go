@@ -0,0 +1,37 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDocumentKeyBoundToDocument(t *testing.T) {
+	s := newTestEncryption(t, 1, 1)
+	dataKey, _ := NewDataKey()
+
+	wrapped, err := s.WrapKeyWithAAD(dataKey, DocumentKeyAAD(7))
+	if err != nil {
+		t.Fatalf("WrapKeyWithAAD: %v", err)
+	}
+	if !IsBoundCiphertext(wrapped) {
+		t.Fatal("wrapped document key is not marked as bound")
+	}
+	if key, err := s.UnwrapKeyWithAAD(wrapped, DocumentKeyAAD(7)); err != nil || !bytes.Equal(key, dataKey) {
+		t.Fatalf("UnwrapKeyWithAAD = %x, %v", key, err)
+	}
+	if _, err := s.UnwrapKeyWithAAD(wrapped, DocumentKeyAAD(8)); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("key moved to another document: %v, want ErrAuthenticationFailed", err)
+	}
+
+	// Keys wrapped before binding are refused unless allowed, which
+	// ENCRYPTION_REQUIRE_AAD=false does until a clean re-wrap
+	legacy, _ := s.WrapKey(dataKey)
+	if _, err := s.UnwrapKeyWithAAD(legacy, DocumentKeyAAD(7)); !errors.Is(err, ErrUnboundCiphertext) {
+		t.Fatalf("UnwrapKeyWithAAD(unbound) = %v, want ErrUnboundCiphertext", err)
+	}
+	s.AllowUnbound(true)
+	if key, err := s.UnwrapKeyWithAAD(legacy, DocumentKeyAAD(7)); err != nil || !bytes.Equal(key, dataKey) {
+		t.Fatalf("UnwrapKeyWithAAD(unbound) allowed = %x, %v", key, err)
+	}
+}
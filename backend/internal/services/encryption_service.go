@@ -7,71 +7,434 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// Ciphertexts written before key versioning carry no header and were sealed
+// with the original ENCRYPTION_KEY, which is treated as version 1.
+const legacyKeyVersion = 1
+
+var (
+	ErrUnknownKeyVersion    = errors.New("unknown encryption key version")
+	ErrAuthenticationFailed = errors.New("ciphertext authentication failed")
+	ErrSealed               = errors.New("vault is sealed")
+	ErrUnboundCiphertext    = errors.New("ciphertext is not bound to its record")
+)
+
+// EncryptionService holds the master key-ring. A sealed service has no keys in
+// memory and refuses to encrypt or decrypt until it is unsealed.
 type EncryptionService struct {
-	key []byte
+	mu            sync.RWMutex
+	keys          map[int][]byte
+	activeVersion int
+	allowUnbound  bool
+}
+
+func NewEncryptionService(provider KeyProvider) (*EncryptionService, error) {
+	ring, err := provider.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ring.Keys[ring.Active]; !ok {
+		return nil, errors.New("active key version is missing from the key-ring")
+	}
+
+	return &EncryptionService{keys: ring.Keys, activeVersion: ring.Active}, nil
+}
+
+// NewSealedEncryptionService starts without any key material; see Unseal.
+func NewSealedEncryptionService() *EncryptionService {
+	return &EncryptionService{}
+}
+
+func (s *EncryptionService) IsSealed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys == nil
+}
+
+// Unseal installs a key-ring, replacing (and wiping) any existing one.
+func (s *EncryptionService) Unseal(ring *KeyRing) error {
+	if _, ok := ring.Keys[ring.Active]; !ok {
+		return errors.New("active key version is missing from the key-ring")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wipeKeys()
+	s.keys = ring.Keys
+	s.activeVersion = ring.Active
+	return nil
 }
 
-func NewEncryptionService() *EncryptionService {
-	keyStr := os.Getenv("ENCRYPTION_KEY")
-	if keyStr == "" {
-		keyStr = "default-key-change-in-production"
+// Seal wipes the key-ring from memory.
+func (s *EncryptionService) Seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wipeKeys()
+	s.keys = nil
+	s.activeVersion = 0
+}
+
+func (s *EncryptionService) wipeKeys() {
+	for _, key := range s.keys {
+		wipe(key)
+	}
+}
+
+// ActiveKey returns a copy of the active key and its version.
+func (s *EncryptionService) ActiveKey() ([]byte, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.keys == nil {
+		return nil, 0, ErrSealed
+	}
+	return append([]byte(nil), s.keys[s.activeVersion]...), s.activeVersion, nil
+}
+
+// KeyRing returns a copy of the whole key-ring.
+func (s *EncryptionService) KeyRing() (*KeyRing, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.keys == nil {
+		return nil, ErrSealed
+	}
+	ring := &KeyRing{Keys: make(map[int][]byte, len(s.keys)), Active: s.activeVersion}
+	for version, key := range s.keys {
+		ring.Keys[version] = append([]byte(nil), key...)
 	}
-	
-	// Hash the key to ensure it's exactly 32 bytes for AES-256
+	return ring, nil
+}
+
+// Hash the key to ensure it's exactly 32 bytes for AES-256
+func deriveKey(keyStr string) []byte {
 	hash := sha256.Sum256([]byte(keyStr))
-	return &EncryptionService{key: hash[:]}
+	return hash[:]
+}
+
+func (s *EncryptionService) ActiveVersion() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeVersion
+}
+
+// HasVersion reports whether the key-ring holds a key with the given version.
+func (s *EncryptionService) HasVersion(version int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.keys[version]
+	return ok
+}
+
+// MaxVersion returns the highest version in the key-ring.
+func (s *EncryptionService) MaxVersion() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	max := 0
+	for version := range s.keys {
+		if version > max {
+			max = version
+		}
+	}
+	return max
 }
 
 func (s *EncryptionService) Encrypt(plaintext string) (string, error) {
-	block, err := aes.NewCipher(s.key)
+	return s.EncryptWithAAD(plaintext, nil)
+}
+
+func (s *EncryptionService) Decrypt(ciphertext string) (string, error) {
+	return s.DecryptWithAAD(ciphertext, nil)
+}
+
+// EncryptWithAAD seals plaintext under the active key-ring version and
+// authenticates it against aad, which must be supplied again to decrypt.
+func (s *EncryptionService) EncryptWithAAD(plaintext string, aad []byte) (string, error) {
+	return s.encryptBytes([]byte(plaintext), aad)
+}
+
+// AllowUnbound sets whether the WithAAD methods still open ciphertexts
+// written before per-record binding, which carry no aad to check. That is off
+// by default, so a ciphertext can't be pasted into another record by dropping
+// its binding; turn it on while the re-wrap job moves old rows over.
+func (s *EncryptionService) AllowUnbound(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowUnbound = allow
+}
+
+func (s *EncryptionService) AllowsUnbound() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allowUnbound
+}
+
+// checkBound refuses an unbound ciphertext where aad is expected, unless
+// AllowUnbound is on. Malformed ciphertexts are left for decryption to
+// report.
+func (s *EncryptionService) checkBound(ciphertext string, aad []byte) error {
+	env, err := parseCiphertext(ciphertext)
+	if err != nil || env.bound || aad == nil || s.AllowsUnbound() {
+		return nil
+	}
+	return ErrUnboundCiphertext
+}
+
+// DecryptWithAAD opens a key-ring ciphertext bound to aad. An unbound one is
+// an ErrUnboundCiphertext unless AllowUnbound is on.
+func (s *EncryptionService) DecryptWithAAD(ciphertext string, aad []byte) (string, error) {
+	if err := s.checkBound(ciphertext, aad); err != nil {
+		return "", err
+	}
+	plaintext, err := s.decryptBytes(ciphertext, aad)
 	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
 
-	gcm, err := cipher.NewGCM(block)
+// WrapKey seals a data encryption key under the active key-ring version.
+func (s *EncryptionService) WrapKey(dataKey []byte) (string, error) {
+	return s.encryptBytes(dataKey, nil)
+}
+
+func (s *EncryptionService) UnwrapKey(wrapped string) ([]byte, error) {
+	return s.decryptBytes(wrapped, nil)
+}
+
+// WrapKeyWithAAD seals a data encryption key and binds it to aad, typically
+// the record whose contents the key protects.
+func (s *EncryptionService) WrapKeyWithAAD(dataKey, aad []byte) (string, error) {
+	return s.encryptBytes(dataKey, aad)
+}
+
+// UnwrapKeyWithAAD opens a wrapped key. As with DecryptWithAAD, an unbound
+// key is refused unless AllowUnbound is on.
+func (s *EncryptionService) UnwrapKeyWithAAD(wrapped string, aad []byte) ([]byte, error) {
+	if err := s.checkBound(wrapped, aad); err != nil {
+		return nil, err
+	}
+	return s.decryptBytes(wrapped, aad)
+}
+
+// NewDataKey returns a fresh random AES-256 data encryption key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncryptWithDataKey seals plaintext under a data key instead of the key-ring.
+// The result carries a "dk" header so it is never mistaken for a key-ring
+// ciphertext.
+func (s *EncryptionService) EncryptWithDataKey(dataKey []byte, plaintext string, aad []byte) (string, error) {
+	sealed, err := seal(dataKey, []byte(plaintext), aad)
+	if err != nil {
+		return "", err
+	}
+	return formatCiphertext(dataKeyHeader, aad != nil, sealed), nil
+}
+
+func (s *EncryptionService) DecryptWithDataKey(dataKey []byte, ciphertext string, aad []byte) (string, error) {
+	env, err := parseCiphertext(ciphertext)
 	if err != nil {
 		return "", err
 	}
+	if !env.dataKey {
+		return "", errors.New("ciphertext is not sealed with a data key")
+	}
+	if err := s.checkBound(ciphertext, aad); err != nil {
+		return "", err
+	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	plaintext, err := env.open(dataKey, aad)
+	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+// IsDataKeyCiphertext reports whether the ciphertext was sealed with a data key.
+func IsDataKeyCiphertext(ciphertext string) bool {
+	env, err := parseCiphertext(ciphertext)
+	return err == nil && env.dataKey
 }
 
-func (s *EncryptionService) Decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+// IsBoundCiphertext reports whether the ciphertext is authenticated against
+// additional data.
+func IsBoundCiphertext(ciphertext string) bool {
+	env, err := parseCiphertext(ciphertext)
+	return err == nil && env.bound
+}
+
+// KeyVersion reports which key-ring version sealed the given ciphertext.
+func (s *EncryptionService) KeyVersion(ciphertext string) (int, error) {
+	env, err := parseCiphertext(ciphertext)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
+	if env.dataKey {
+		return 0, errors.New("ciphertext is sealed with a data key")
+	}
+	return env.version, nil
+}
 
-	block, err := aes.NewCipher(s.key)
+// NeedsRewrap reports whether the ciphertext was sealed with a key-ring key
+// other than the active one.
+func (s *EncryptionService) NeedsRewrap(ciphertext string) bool {
+	env, err := parseCiphertext(ciphertext)
+	return err == nil && !env.dataKey && env.version != s.ActiveVersion()
+}
+
+func (s *EncryptionService) encryptBytes(plaintext, aad []byte) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.keys == nil {
+		return "", ErrSealed
+	}
+	version := s.activeVersion
+	sealed, err := seal(s.keys[version], plaintext, aad)
 	if err != nil {
 		return "", err
 	}
+	return formatCiphertext(fmt.Sprintf("v%d", version), aad != nil, sealed), nil
+}
+
+// decryptBytes opens a key-ring ciphertext, bound or not. The re-wrap job and
+// the key migration read rows from before per-record binding with it.
+func (s *EncryptionService) decryptBytes(ciphertext string, aad []byte) ([]byte, error) {
+	env, err := parseCiphertext(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if env.dataKey {
+		return nil, errors.New("ciphertext is sealed with a data key")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.keys == nil {
+		return nil, ErrSealed
+	}
+	key, ok := s.keys[env.version]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+	return env.open(key, aad)
+}
+
+const (
+	dataKeyHeader = "dk"
+	boundSuffix   = "+aad"
+)
+
+type envelope struct {
+	dataKey bool
+	version int
+	bound   bool
+	payload string
+}
+
+func formatCiphertext(header string, bound bool, sealed []byte) string {
+	if bound {
+		header += boundSuffix
+	}
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// parseCiphertext splits a "<header>:<base64>" ciphertext, where the header is
+// either "v<version>" for the key-ring or "dk" for a data key, followed by
+// "+aad" when the ciphertext is bound to additional data. Values without a
+// header are legacy ciphertexts sealed with the version 1 key; base64 never
+// contains ':' so the two forms can't be confused.
+func parseCiphertext(ciphertext string) (envelope, error) {
+	header, payload, found := strings.Cut(ciphertext, ":")
+	if !found {
+		return envelope{version: legacyKeyVersion, payload: ciphertext}, nil
+	}
+
+	env := envelope{payload: payload}
+	header, env.bound = strings.CutSuffix(header, boundSuffix)
+
+	if header == dataKeyHeader {
+		env.dataKey = true
+		return env, nil
+	}
+	if !strings.HasPrefix(header, "v") {
+		return envelope{}, errors.New("malformed ciphertext header")
+	}
+	version, err := strconv.Atoi(header[1:])
+	if err != nil || version < 1 {
+		return envelope{}, errors.New("malformed ciphertext header")
+	}
+	env.version = version
+	return env, nil
+}
+
+// open decrypts the payload; aad is ignored for unbound ciphertexts.
+func (e envelope) open(key, aad []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(e.payload)
+	if err != nil {
+		return nil, err
+	}
+	if !e.bound {
+		aad = nil
+	}
+	return open(key, data, aad)
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, data, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(data) < nonceSize {
-		return "", errors.New("ciphertext too short")
+		return nil, errors.New("ciphertext too short")
 	}
 
 	nonce, ciphertextBytes := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, aad)
 	if err != nil {
-		return "", err
+		return nil, ErrAuthenticationFailed
 	}
-
-	return string(plaintext), nil
+	return plaintext, nil
 }
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testRing(active int, versions ...int) *KeyRing {
+	ring := &KeyRing{Keys: make(map[int][]byte), Active: active}
+	for _, v := range versions {
+		ring.Keys[v] = deriveKey(strings.Repeat("k", v))
+	}
+	return ring
+}
+
+func newTestEncryption(t *testing.T, active int, versions ...int) *EncryptionService {
+	t.Helper()
+	s := NewSealedEncryptionService()
+	if err := s.Unseal(testRing(active, versions...)); err != nil {
+		t.Fatalf("Unseal: %v", err)
+	}
+	return s
+}
+
+func TestEncryptRoundTripWritesVersionHeader(t *testing.T) {
+	s := newTestEncryption(t, 2, 1, 2)
+
+	ct, err := s.Encrypt("hunter2")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if !strings.HasPrefix(ct, "v2:") {
+		t.Fatalf("ciphertext %q lacks the active version header", ct)
+	}
+	if v, err := s.KeyVersion(ct); err != nil || v != 2 {
+		t.Fatalf("KeyVersion = %d, %v; want 2", v, err)
+	}
+
+	pt, err := s.Decrypt(ct)
+	if err != nil || pt != "hunter2" {
+		t.Fatalf("Decrypt = %q, %v", pt, err)
+	}
+}
+
+func TestDecryptOlderVersionAfterRotation(t *testing.T) {
+	old := newTestEncryption(t, 1, 1)
+	ct, err := old.Encrypt("before rotation")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	rotated := newTestEncryption(t, 2, 1, 2)
+	if !rotated.NeedsRewrap(ct) {
+		t.Error("NeedsRewrap = false for a version 1 ciphertext with version 2 active")
+	}
+	if pt, err := rotated.Decrypt(ct); err != nil || pt != "before rotation" {
+		t.Fatalf("Decrypt = %q, %v", pt, err)
+	}
+
+	retired := newTestEncryption(t, 2, 2)
+	if _, err := retired.Decrypt(ct); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Fatalf("Decrypt with version 1 dropped = %v, want ErrUnknownKeyVersion", err)
+	}
+}
+
+func TestDecryptLegacyHeaderlessCiphertext(t *testing.T) {
+	s := newTestEncryption(t, 2, 1, 2)
+
+	sealed, err := seal(s.keys[legacyKeyVersion], []byte("legacy"), nil)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	ct := base64.StdEncoding.EncodeToString(sealed)
+
+	if v, err := s.KeyVersion(ct); err != nil || v != legacyKeyVersion {
+		t.Fatalf("KeyVersion = %d, %v; want %d", v, err, legacyKeyVersion)
+	}
+	if pt, err := s.Decrypt(ct); err != nil || pt != "legacy" {
+		t.Fatalf("Decrypt = %q, %v", pt, err)
+	}
+}
+
+func TestDecryptRejectsTamperedCiphertext(t *testing.T) {
+	s := newTestEncryption(t, 1, 1)
+	ct, err := s.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	header, payload, _ := strings.Cut(ct, ":")
+	data, _ := base64.StdEncoding.DecodeString(payload)
+	data[len(data)-1] ^= 0x01
+	tampered := header + ":" + base64.StdEncoding.EncodeToString(data)
+
+	if _, err := s.Decrypt(tampered); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Decrypt(tampered) = %v, want ErrAuthenticationFailed", err)
+	}
+	if _, err := s.Decrypt("v1:" + base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Fatal("Decrypt accepted a truncated ciphertext")
+	}
+	for _, malformed := range []string{"x1:AAAA", "v0:AAAA", "v-1:AAAA", "vX:AAAA"} {
+		if _, err := s.Decrypt(malformed); err == nil {
+			t.Errorf("Decrypt(%q) accepted a malformed header", malformed)
+		}
+	}
+}
+
+func TestAADBindsCiphertextToRecord(t *testing.T) {
+	s := newTestEncryption(t, 1, 1)
+
+	ct, err := s.EncryptWithAAD("secret", []byte("credential:1:password"))
+	if err != nil {
+		t.Fatalf("EncryptWithAAD: %v", err)
+	}
+	if !IsBoundCiphertext(ct) || !strings.HasPrefix(ct, "v1+aad:") {
+		t.Fatalf("ciphertext %q is not marked as bound", ct)
+	}
+
+	if pt, err := s.DecryptWithAAD(ct, []byte("credential:1:password")); err != nil || pt != "secret" {
+		t.Fatalf("DecryptWithAAD = %q, %v", pt, err)
+	}
+	for _, aad := range [][]byte{[]byte("credential:2:password"), []byte("credential:1:notes"), nil} {
+		if _, err := s.DecryptWithAAD(ct, aad); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("DecryptWithAAD(%q) = %v, want ErrAuthenticationFailed", aad, err)
+		}
+	}
+
+	// Stripping the "+aad" marker must not turn a bound ciphertext into an
+	// unbound one that opens without its record.
+	stripped := strings.Replace(ct, "+aad", "", 1)
+	if _, err := s.DecryptWithAAD(stripped, nil); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("DecryptWithAAD(stripped) = %v, want ErrAuthenticationFailed", err)
+	}
+}
+
+func TestDataKeyCiphertexts(t *testing.T) {
+	s := newTestEncryption(t, 1, 1)
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey: %v", err)
+	}
+
+	wrapped, err := s.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	unwrapped, err := s.UnwrapKey(wrapped)
+	if err != nil || string(unwrapped) != string(dataKey) {
+		t.Fatalf("UnwrapKey = %x, %v", unwrapped, err)
+	}
+
+	ct, err := s.EncryptWithDataKey(dataKey, "folder secret", []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptWithDataKey: %v", err)
+	}
+	if !IsDataKeyCiphertext(ct) {
+		t.Fatalf("ciphertext %q is not marked as a data-key ciphertext", ct)
+	}
+	if pt, err := s.DecryptWithDataKey(dataKey, ct, []byte("aad")); err != nil || pt != "folder secret" {
+		t.Fatalf("DecryptWithDataKey = %q, %v", pt, err)
+	}
+
+	otherKey, _ := NewDataKey()
+	if _, err := s.DecryptWithDataKey(otherKey, ct, []byte("aad")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("DecryptWithDataKey(wrong key) = %v, want ErrAuthenticationFailed", err)
+	}
+	if _, err := s.Decrypt(ct); err == nil {
+		t.Error("key-ring Decrypt accepted a data-key ciphertext")
+	}
+	ringCT, _ := s.Encrypt("ring secret")
+	if _, err := s.DecryptWithDataKey(dataKey, ringCT, nil); err == nil {
+		t.Error("DecryptWithDataKey accepted a key-ring ciphertext")
+	}
+}
+
+func TestSealedServiceRefusesWork(t *testing.T) {
+	s := newTestEncryption(t, 1, 1)
+	ct, _ := s.Encrypt("secret")
+	key := s.keys[1]
+
+	s.Seal()
+	if !s.IsSealed() {
+		t.Fatal("IsSealed = false after Seal")
+	}
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("Seal left key material in memory")
+		}
+	}
+	if _, err := s.Encrypt("x"); !errors.Is(err, ErrSealed) {
+		t.Errorf("Encrypt = %v, want ErrSealed", err)
+	}
+	if _, err := s.Decrypt(ct); !errors.Is(err, ErrSealed) {
+		t.Errorf("Decrypt = %v, want ErrSealed", err)
+	}
+	if _, _, err := s.ActiveKey(); !errors.Is(err, ErrSealed) {
+		t.Errorf("ActiveKey = %v, want ErrSealed", err)
+	}
+}
+
+func TestUnsealRequiresActiveKey(t *testing.T) {
+	s := NewSealedEncryptionService()
+	if err := s.Unseal(testRing(3, 1, 2)); err == nil {
+		t.Fatal("Unseal accepted a ring without its active version")
+	}
+	if !s.IsSealed() {
+		t.Fatal("a failed Unseal left the service unsealed")
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"credential-store/internal/repository"
+	"sync"
+)
+
+// FolderKeyService hands out the per-folder data encryption keys. Keys are
+// stored wrapped by the master key-ring and cached unwrapped in memory.
+type FolderKeyService struct {
+	folderRepo *repository.FolderRepository
+	encryption *EncryptionService
+
+	mu    sync.RWMutex
+	cache map[int][]byte
+}
+
+func NewFolderKeyService(folderRepo *repository.FolderRepository, encryption *EncryptionService) *FolderKeyService {
+	return &FolderKeyService{
+		folderRepo: folderRepo,
+		encryption: encryption,
+		cache:      make(map[int][]byte),
+	}
+}
+
+// NewWrappedKey generates a data key for a folder that is about to be created.
+func (s *FolderKeyService) NewWrappedKey() (string, error) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		return "", err
+	}
+	return s.encryption.WrapKey(dataKey)
+}
+
+// KeyFor returns a copy of the folder's data key, generating one for folders
+// created before per-folder keys existed. The cached key may be wiped by
+// Forget or Purge at any time, so callers get their own copy and should wipe
+// it when done.
+func (s *FolderKeyService) KeyFor(folderID int) ([]byte, error) {
+	if s.encryption.IsSealed() {
+		return nil, ErrSealed
+	}
+
+	s.mu.RLock()
+	key, ok := s.cache[folderID]
+	if ok {
+		key = append([]byte(nil), key...)
+	}
+	s.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	wrapped, err := s.folderRepo.GetWrappedKey(folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrapped == "" {
+		newWrapped, err := s.NewWrappedKey()
+		if err != nil {
+			return nil, err
+		}
+		stored, err := s.folderRepo.SetWrappedKeyIfEmpty(folderID, newWrapped)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			wrapped = newWrapped
+		} else if wrapped, err = s.folderRepo.GetWrappedKey(folderID); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err = s.encryption.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.encryption.IsSealed() {
+		// Sealed (and purged) while unwrapping; don't repopulate the cache
+		wipe(key)
+		return nil, ErrSealed
+	}
+	if cached, ok := s.cache[folderID]; ok {
+		// Another caller unwrapped it first; keep a single cached copy
+		wipe(key)
+		key = cached
+	} else {
+		s.cache[folderID] = key
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (s *FolderKeyService) Encrypt(folderID int, plaintext string, aad []byte) (string, error) {
+	key, err := s.KeyFor(folderID)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(key)
+	return s.encryption.EncryptWithDataKey(key, plaintext, aad)
+}
+
+func (s *FolderKeyService) Decrypt(folderID int, ciphertext string, aad []byte) (string, error) {
+	key, err := s.KeyFor(folderID)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(key)
+	return s.encryption.DecryptWithDataKey(key, ciphertext, aad)
+}
+
+// Forget drops a folder's cached key, wiping the key material.
+func (s *FolderKeyService) Forget(folderID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.cache[folderID]; ok {
+		wipe(key)
+		delete(s.cache, folderID)
+	}
+}
+
+// Purge wipes every cached key, e.g. when the vault is sealed.
+func (s *FolderKeyService) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for folderID, key := range s.cache {
+		wipe(key)
+		delete(s.cache, folderID)
+	}
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
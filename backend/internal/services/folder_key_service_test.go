@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/repository"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// folderKeysWithStoredKey returns a FolderKeyService whose folder 1 has
+// dataKey stored wrapped in the database, for one lookup.
+func folderKeysWithStoredKey(t *testing.T, encryption *EncryptionService, dataKey []byte) *FolderKeyService {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	wrapped, err := encryption.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	mock.ExpectQuery("SELECT COALESCE\\(wrapped_key").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"wrapped_key"}).AddRow(wrapped))
+	return NewFolderKeyService(repository.NewFolderRepository(db), encryption)
+}
+
+func TestFolderKeyCopiesSurvivePurge(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	folderKeys := NewFolderKeyService(nil, encryption)
+	dataKey, _ := NewDataKey()
+	folderKeys.cache[7] = append([]byte(nil), dataKey...)
+
+	key, err := folderKeys.KeyFor(7)
+	if err != nil {
+		t.Fatalf("KeyFor: %v", err)
+	}
+	folderKeys.Purge()
+	if !bytes.Equal(key, dataKey) {
+		t.Fatal("Purge wiped a key a caller was still using")
+	}
+
+	folderKeys.cache[7] = append([]byte(nil), dataKey...)
+	key, _ = folderKeys.KeyFor(7)
+	key[0] ^= 0xff
+	if !bytes.Equal(folderKeys.cache[7], dataKey) {
+		t.Fatal("modifying the returned key changed the cached key")
+	}
+}
+
+func TestFolderKeyEncryptDuringPurge(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	dataKey, _ := NewDataKey()
+
+	for i := 0; i < 50; i++ {
+		folderKeys := folderKeysWithStoredKey(t, encryption, dataKey)
+		folderKeys.cache[1] = append([]byte(nil), dataKey...)
+
+		var wg sync.WaitGroup
+		var ct string
+		var err error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ct, err = folderKeys.Encrypt(1, "secret", nil)
+		}()
+		go func() {
+			defer wg.Done()
+			folderKeys.Purge()
+		}()
+		wg.Wait()
+
+		// Whatever Encrypt sealed must be under the real key, never under
+		// one that was zeroed half-way through.
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if pt, err := encryption.DecryptWithDataKey(dataKey, ct, nil); err != nil || pt != "secret" {
+			t.Fatalf("ciphertext sealed during Purge doesn't open with the folder key: %q, %v", pt, err)
+		}
+	}
+}
+
+func TestFolderKeyUnwrapsAndCachesStoredKey(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	dataKey, _ := NewDataKey()
+	folderKeys := folderKeysWithStoredKey(t, encryption, dataKey)
+
+	for i := 0; i < 2; i++ {
+		key, err := folderKeys.KeyFor(1)
+		if err != nil {
+			t.Fatalf("KeyFor: %v", err)
+		}
+		if !bytes.Equal(key, dataKey) {
+			t.Fatal("KeyFor returned the wrong key")
+		}
+	}
+
+	folderKeys.Forget(1)
+	if _, ok := folderKeys.cache[1]; ok {
+		t.Fatal("Forget left the key cached")
+	}
+}
+
+func TestFolderKeyForRefusesWhenSealed(t *testing.T) {
+	encryption := newTestEncryption(t, 1, 1)
+	folderKeys := NewFolderKeyService(nil, encryption)
+	folderKeys.cache[1] = bytes.Repeat([]byte{1}, 32)
+
+	encryption.Seal()
+	if _, err := folderKeys.KeyFor(1); err != ErrSealed {
+		t.Fatalf("KeyFor = %v, want ErrSealed", err)
+	}
+	if _, err := folderKeys.Encrypt(1, "x", nil); err == nil || !strings.Contains(err.Error(), "sealed") {
+		t.Fatalf("Encrypt = %v, want ErrSealed", err)
+	}
+}
@@ -7,16 +7,26 @@ import (
 
 type FolderService struct {
 	folderRepo *repository.FolderRepository
+	folderKeys *FolderKeyService
 }
 
-func NewFolderService(folderRepo *repository.FolderRepository) *FolderService {
-	return &FolderService{folderRepo: folderRepo}
+func NewFolderService(folderRepo *repository.FolderRepository, folderKeys *FolderKeyService) *FolderService {
+	return &FolderService{
+		folderRepo: folderRepo,
+		folderKeys: folderKeys,
+	}
 }
 
 func (s *FolderService) Create(req *models.CreateFolderRequest) (*models.Folder, error) {
+	wrappedKey, err := s.folderKeys.NewWrappedKey()
+	if err != nil {
+		return nil, err
+	}
+
 	folder := &models.Folder{
 		Name:        req.Name,
 		Description: req.Description,
+		WrappedKey:  wrappedKey,
 	}
 
 	if err := s.folderRepo.Create(folder); err != nil {
@@ -95,6 +105,12 @@ func (s *FolderService) CheckPermission(folderID int, userGroup, role, action st
 	}
 }
 
+// Delete crypto-shreds the folder: its data key is destroyed along with the
+// credentials sealed under it. Other folders' keys are unaffected.
 func (s *FolderService) Delete(folderID int) error {
-	return s.folderRepo.Delete(folderID)
+	if err := s.folderRepo.Delete(folderID); err != nil {
+		return err
+	}
+	s.folderKeys.Forget(folderID)
+	return nil
 }
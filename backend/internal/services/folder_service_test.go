@@ -0,0 +1,183 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestFolderService(t *testing.T) (*FolderService, *FolderKeyService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	folderRepo := repository.NewFolderRepository(db)
+	folderKeys := NewFolderKeyService(folderRepo, newTestEncryption(t, 1, 1))
+	return NewFolderService(folderRepo, folderKeys), folderKeys, mock
+}
+
+func TestFolderCreateStoresOwnWrappedKey(t *testing.T) {
+	s, folderKeys, mock := newTestFolderService(t)
+
+	wrapped := make([]*captureArg, 2)
+	for i := range wrapped {
+		wrapped[i] = &captureArg{}
+		mock.ExpectQuery("INSERT INTO folders").WithArgs("Production", "", wrapped[i]).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(i+1, time.Now()))
+		if _, err := s.Create(&models.CreateFolderRequest{Name: "Production"}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each folder gets a fresh key, stored wrapped by the master key
+	keys := make([][]byte, 2)
+	for i, w := range wrapped {
+		stored, _ := w.value.(string)
+		key, err := folderKeys.encryption.UnwrapKey(stored)
+		if err != nil {
+			t.Fatalf("stored key %q doesn't unwrap: %v", stored, err)
+		}
+		if bytes.Contains([]byte(stored), key) {
+			t.Fatal("the data key is stored in the clear")
+		}
+		keys[i] = key
+	}
+	if bytes.Equal(keys[0], keys[1]) {
+		t.Fatal("two folders share a data key")
+	}
+}
+
+func TestFolderKeysAreIsolated(t *testing.T) {
+	_, folderKeys, _ := newTestFolderService(t)
+	production, _ := NewDataKey()
+	development, _ := NewDataKey()
+	folderKeys.cache[1] = production
+	folderKeys.cache[2] = development
+
+	ct, err := folderKeys.Encrypt(1, "prod-db-password", []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if pt, err := folderKeys.Decrypt(1, ct, []byte("aad")); err != nil || pt != "prod-db-password" {
+		t.Fatalf("Decrypt = %q, %v", pt, err)
+	}
+	if _, err := folderKeys.Decrypt(2, ct, []byte("aad")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("another folder's key opened the ciphertext: %v", err)
+	}
+	// Nor does the master key-ring open it directly
+	if _, err := folderKeys.encryption.Decrypt(ct); err == nil {
+		t.Fatal("the master key opened a folder ciphertext")
+	}
+}
+
+func TestFolderKeyGeneratedForOlderFolders(t *testing.T) {
+	_, folderKeys, mock := newTestFolderService(t)
+
+	// Folder 1 predates per-folder keys: one is made and stored
+	stored := &captureArg{}
+	mock.ExpectQuery("SELECT COALESCE\\(wrapped_key").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"wrapped_key"}).AddRow(""))
+	mock.ExpectExec("UPDATE folders SET wrapped_key = \\$1 WHERE id = \\$2 AND wrapped_key IS NULL").
+		WithArgs(stored, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	key, err := folderKeys.KeyFor(1)
+	if err != nil {
+		t.Fatalf("KeyFor: %v", err)
+	}
+	if unwrapped, err := folderKeys.encryption.UnwrapKey(stored.value.(string)); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("stored key %x, %v; handed out %x", unwrapped, err, key)
+	}
+
+	// For folder 2 another request stored a key first: that one is used
+	theirs, _ := NewDataKey()
+	theirsWrapped, _ := folderKeys.encryption.WrapKey(theirs)
+	mock.ExpectQuery("SELECT COALESCE\\(wrapped_key").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"wrapped_key"}).AddRow(""))
+	mock.ExpectExec("UPDATE folders SET wrapped_key").WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE\\(wrapped_key").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"wrapped_key"}).AddRow(theirsWrapped))
+	if key, err := folderKeys.KeyFor(2); err != nil || !bytes.Equal(key, theirs) {
+		t.Fatalf("KeyFor(2) = %x, %v; want the key stored first", key, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFolderDeleteShredsKey(t *testing.T) {
+	s, folderKeys, mock := newTestFolderService(t)
+	doomed, _ := NewDataKey()
+	kept, _ := NewDataKey()
+	folderKeys.cache[1] = doomed
+	folderKeys.cache[2] = append([]byte(nil), kept...)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM credentials WHERE folder_id").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM folders WHERE id").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := s.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := folderKeys.cache[1]; ok || !bytes.Equal(doomed, make([]byte, len(doomed))) {
+		t.Fatal("the deleted folder's key is still in memory")
+	}
+	if !bytes.Equal(folderKeys.cache[2], kept) {
+		t.Fatal("deleting a folder touched another folder's key")
+	}
+}
+
+func TestFolderCheckPermission(t *testing.T) {
+	s, _, mock := newTestFolderService(t)
+	permissionRows := func(canRead, canWrite, canDelete bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "folder_id", "user_group", "can_read", "can_write", "can_delete"}).
+			AddRow(1, 10, "staff", canRead, canWrite, canDelete)
+	}
+
+	tests := []struct {
+		name   string
+		role   string
+		rows   *sqlmock.Rows
+		action string
+		want   bool
+	}{
+		{"admin without a permission row", "admin", nil, "delete", true},
+		{"read allowed", "user", permissionRows(true, false, false), "read", true},
+		{"write refused", "user", permissionRows(true, false, false), "write", false},
+		{"write allowed", "user", permissionRows(true, true, false), "write", true},
+		{"delete allowed", "user", permissionRows(false, false, true), "delete", true},
+		{"delete refused", "user", permissionRows(true, true, false), "delete", false},
+		{"unknown action", "user", permissionRows(true, true, true), "share", false},
+	}
+	for _, tt := range tests {
+		if tt.rows != nil {
+			mock.ExpectQuery("FROM folder_permissions WHERE folder_id").WithArgs(10, "staff").WillReturnRows(tt.rows)
+		}
+		if got, err := s.CheckPermission(10, "staff", tt.role, tt.action); err != nil || got != tt.want {
+			t.Errorf("%s: CheckPermission = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// A group the folder isn't shared with gets nothing
+	mock.ExpectQuery("FROM folder_permissions WHERE folder_id").WithArgs(10, "guests").WillReturnError(sql.ErrNoRows)
+	if got, err := s.CheckPermission(10, "guests", "user", "read"); got || err == nil {
+		t.Errorf("CheckPermission(unshared) = %v, %v; want refused", got, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNoMappedGroup = errors.New("your account is not assigned to a group here")
+
+// GroupMapping gives members of an identity provider group a user_group here.
+type GroupMapping struct {
+	External  string
+	UserGroup string
+}
+
+// parseGroupMappings reads comma separated "external=user_group" pairs. The
+// last "=" splits a pair, so external names may contain one.
+func parseGroupMappings(raw string) ([]GroupMapping, error) {
+	var mappings []GroupMapping
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("%q is not external-group=user_group", entry)
+		}
+		mappings = append(mappings, GroupMapping{
+			External:  strings.TrimSpace(entry[:i]),
+			UserGroup: strings.TrimSpace(entry[i+1:]),
+		})
+	}
+	return mappings, nil
+}
+
+// mapGroup returns the user_group of the first mapping whose external group
+// the user is in, or def.
+func mapGroup(mappings []GroupMapping, groups map[string]bool, def string) string {
+	for _, mapping := range mappings {
+		if groups[mapping.External] {
+			return mapping.UserGroup
+		}
+	}
+	return def
+}
@@ -25,6 +25,7 @@ func (s *GroupService) Create(req *models.CreateGroupRequest) (*models.Group, er
 	group := &models.Group{
 		Name:        req.Name,
 		Description: req.Description,
+		RequireMFA:  req.RequireMFA,
 	}
 
 	if err := s.groupRepo.Create(group); err != nil {
@@ -63,6 +64,9 @@ func (s *GroupService) Update(id string, req *models.UpdateGroupRequest) (*model
 	if req.Description != "" {
 		group.Description = req.Description
 	}
+	if req.RequireMFA != nil {
+		group.RequireMFA = *req.RequireMFA
+	}
 
 	if err := s.groupRepo.Update(group); err != nil {
 		return nil, err
@@ -93,6 +97,14 @@ func (s *GroupService) Delete(id string) error {
 		return errors.New("cannot delete group with existing users")
 	}
 
+	count, err = s.groupRepo.CountServiceAccounts(group.Name)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("cannot delete group with existing service accounts")
+	}
+
 	// Clean up folder permissions for this group
 	if err := s.groupRepo.DeleteFolderPermissions(group.Name); err != nil {
 		return err
@@ -0,0 +1,567 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// KeyMigrationStats counts the records of one kind seen by a migration or
+// verification pass.
+type KeyMigrationStats struct {
+	Total     int
+	Scanned   int
+	Rewritten int
+	Skipped   int
+	Failed    int
+}
+
+type KeyMigrationReport struct {
+	Folders     KeyMigrationStats
+	Credentials KeyMigrationStats
+	Documents   KeyMigrationStats
+	MFASecrets  KeyMigrationStats
+}
+
+func (r *KeyMigrationReport) Failed() int {
+	return r.Folders.Failed + r.Credentials.Failed + r.Documents.Failed + r.MFASecrets.Failed
+}
+
+type KeyMigrationOptions struct {
+	BatchSize int
+	DryRun    bool
+	// Progress is called after every batch with the stage name and its counts
+	Progress func(stage string, stats KeyMigrationStats)
+}
+
+// KeyMigrationService moves everything sealed under a compromised key-ring onto
+// a new key while the server is stopped. Unlike the online re-wrap job it also
+// replaces every folder data key, since the old master key exposes those too:
+// each folder is re-encrypted in one transaction together with its
+// credentials. Credentials outside folders and document keys are rewritten in
+// batches, as are TOTP secrets. Records already sealed under the new key are skipped, so an
+// interrupted run can simply be started again.
+//
+// Document contents are not rewritten; their data keys are re-wrapped.
+type KeyMigrationService struct {
+	repo            *repository.KeyMigrationRepository
+	oldEncryption   *EncryptionService
+	newEncryption   *EncryptionService
+	encryptedFields map[string]bool
+}
+
+func NewKeyMigrationService(repo *repository.KeyMigrationRepository, oldEncryption, newEncryption *EncryptionService) (*KeyMigrationService, error) {
+	if oldEncryption.HasVersion(newEncryption.ActiveVersion()) {
+		return nil, fmt.Errorf("new key version %d is already used by the current key-ring", newEncryption.ActiveVersion())
+	}
+
+	encryptedFields, err := parseEncryptedFields()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyMigrationService{
+		repo:            repo,
+		oldEncryption:   oldEncryption,
+		newEncryption:   newEncryption,
+		encryptedFields: encryptedFields,
+	}, nil
+}
+
+// credentialsUnder returns a CredentialService sealing with the given key-ring
+// and a fixed set of folder keys, bypassing the database.
+func (s *KeyMigrationService) credentialsUnder(encryption *EncryptionService, folderKeys map[int][]byte, strict bool) *CredentialService {
+	return &CredentialService{
+		encryption:      encryption,
+		folderKeys:      &FolderKeyService{encryption: encryption, cache: folderKeys},
+		encryptedFields: s.encryptedFields,
+		allowUnbound:    !strict,
+	}
+}
+
+// Run re-encrypts everything. In a dry run every change is computed and then
+// rolled back.
+func (s *KeyMigrationService) Run(opts KeyMigrationOptions) (*KeyMigrationReport, error) {
+	report := &KeyMigrationReport{}
+	var err error
+	report.Folders.Total, report.Credentials.Total, report.Documents.Total, report.MFASecrets.Total, err = s.repo.Totals()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.migrateFolders(opts, report); err != nil {
+		return report, err
+	}
+	if err := s.migrateCredentials(opts, &report.Credentials); err != nil {
+		return report, err
+	}
+	if err := s.migrateDocuments(opts, &report.Documents); err != nil {
+		return report, err
+	}
+	if err := s.migrateMFASecrets(opts, &report.MFASecrets); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// finishBatch commits a batch, or rolls it back in a dry run.
+func finishBatch(tx *sql.Tx, opts KeyMigrationOptions) error {
+	if opts.DryRun {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+func (s *KeyMigrationService) migrateFolders(opts KeyMigrationOptions, report *KeyMigrationReport) error {
+	lastID := 0
+	for {
+		tx, err := s.repo.Begin()
+		if err != nil {
+			return err
+		}
+		folders, err := s.repo.FindFolderKeysAfter(tx, lastID, opts.BatchSize)
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if len(folders) == 0 {
+			return nil
+		}
+
+		for _, folder := range folders {
+			lastID = folder.ID
+			report.Folders.Scanned++
+			if folder.WrappedKey != "" && !s.newEncryption.NeedsRewrap(folder.WrappedKey) {
+				count, err := s.countFolderCredentials(folder.ID)
+				if err != nil {
+					return err
+				}
+				report.Folders.Skipped++
+				report.Credentials.Scanned += count
+				report.Credentials.Skipped += count
+				continue
+			}
+
+			count, err := s.migrateFolder(opts, folder)
+			report.Credentials.Scanned += count
+			if err != nil {
+				log.Printf("Folder %d: %v", folder.ID, err)
+				report.Folders.Failed++
+				report.Credentials.Failed += count
+				continue
+			}
+			report.Folders.Rewritten++
+			report.Credentials.Rewritten += count
+		}
+		if opts.Progress != nil {
+			opts.Progress("folders", report.Folders)
+		}
+	}
+}
+
+func (s *KeyMigrationService) countFolderCredentials(folderID int) (int, error) {
+	tx, err := s.repo.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return s.repo.CountFolderCredentials(tx, folderID)
+}
+
+// migrateFolder gives the folder a fresh data key and re-encrypts its
+// credentials under it, returning how many credentials the folder holds.
+func (s *KeyMigrationService) migrateFolder(opts KeyMigrationOptions, folder models.WrappedKey) (int, error) {
+	// A folder without a key has no data-key ciphertexts; a random key makes
+	// any that turn up fail authentication
+	var oldKey []byte
+	var err error
+	if folder.WrappedKey != "" {
+		oldKey, err = s.oldEncryption.UnwrapKey(folder.WrappedKey)
+	} else {
+		oldKey, err = NewDataKey()
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer wipe(oldKey)
+
+	newKey, err := NewDataKey()
+	if err != nil {
+		return 0, err
+	}
+	defer wipe(newKey)
+
+	oldCreds := s.credentialsUnder(s.oldEncryption, map[int][]byte{folder.ID: oldKey}, false)
+	newCreds := s.credentialsUnder(s.newEncryption, map[int][]byte{folder.ID: newKey}, false)
+
+	tx, err := s.repo.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	credentials, err := s.repo.FindFolderCredentials(tx, folder.ID)
+	if err != nil {
+		return 0, err
+	}
+	count := len(credentials)
+	for i := range credentials {
+		cred := &credentials[i]
+		if err := oldCreds.openAll(cred); err != nil {
+			return count, fmt.Errorf("cannot decrypt credential %d: %w", cred.ID, err)
+		}
+		if err := newCreds.sealAll(cred); err != nil {
+			return count, fmt.Errorf("cannot encrypt credential %d: %w", cred.ID, err)
+		}
+		if err := s.repo.UpdateSealedFields(tx, cred); err != nil {
+			return count, err
+		}
+	}
+
+	wrapped, err := s.newEncryption.WrapKey(newKey)
+	if err != nil {
+		return count, err
+	}
+	if err := s.repo.SetFolderKey(tx, folder.ID, wrapped); err != nil {
+		return count, err
+	}
+
+	return count, finishBatch(tx, opts)
+}
+
+// migrateCredentials handles credentials outside folders, which are sealed
+// directly under the key-ring.
+func (s *KeyMigrationService) migrateCredentials(opts KeyMigrationOptions, stats *KeyMigrationStats) error {
+	oldCreds := s.credentialsUnder(s.oldEncryption, map[int][]byte{}, false)
+	newCreds := s.credentialsUnder(s.newEncryption, map[int][]byte{}, false)
+
+	lastID := 0
+	for {
+		tx, err := s.repo.Begin()
+		if err != nil {
+			return err
+		}
+		batch, err := s.repo.FindCredentialsAfter(tx, lastID, opts.BatchSize, true)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(batch) == 0 {
+			return tx.Rollback()
+		}
+
+		for i := range batch {
+			cred := &batch[i]
+			lastID = cred.ID
+			stats.Scanned++
+
+			needsRewrite := false
+			for _, field := range credentialFields {
+				if newCreds.fieldNeedsRewrap(cred, field.name, *field.value(cred)) {
+					needsRewrite = true
+					break
+				}
+			}
+			if !needsRewrite {
+				stats.Skipped++
+				continue
+			}
+
+			if err := oldCreds.openAll(cred); err != nil {
+				log.Printf("Credential %d: cannot decrypt: %v", cred.ID, err)
+				stats.Failed++
+				continue
+			}
+			if err := newCreds.sealAll(cred); err != nil {
+				log.Printf("Credential %d: cannot encrypt: %v", cred.ID, err)
+				stats.Failed++
+				continue
+			}
+			if err := s.repo.UpdateSealedFields(tx, cred); err != nil {
+				tx.Rollback()
+				return err
+			}
+			stats.Rewritten++
+		}
+
+		if err := finishBatch(tx, opts); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress("credentials", *stats)
+		}
+	}
+}
+
+func (s *KeyMigrationService) migrateDocuments(opts KeyMigrationOptions, stats *KeyMigrationStats) error {
+	lastID := 0
+	for {
+		tx, err := s.repo.Begin()
+		if err != nil {
+			return err
+		}
+		batch, err := s.repo.FindDocumentKeysAfter(tx, lastID, opts.BatchSize)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(batch) == 0 {
+			return tx.Rollback()
+		}
+
+		for _, doc := range batch {
+			lastID = doc.ID
+			stats.Scanned++
+			if !s.newEncryption.NeedsRewrap(doc.WrappedKey) && IsBoundCiphertext(doc.WrappedKey) {
+				stats.Skipped++
+				continue
+			}
+
+			// Keys already under the new key only need binding to the document
+			from := s.oldEncryption
+			if !s.newEncryption.NeedsRewrap(doc.WrappedKey) {
+				from = s.newEncryption
+			}
+			aad := DocumentKeyAAD(doc.ID)
+			dataKey, err := from.decryptBytes(doc.WrappedKey, aad)
+			if err != nil {
+				log.Printf("Document %d: cannot unwrap key: %v", doc.ID, err)
+				stats.Failed++
+				continue
+			}
+			wrapped, err := s.newEncryption.WrapKeyWithAAD(dataKey, aad)
+			wipe(dataKey)
+			if err != nil {
+				log.Printf("Document %d: cannot wrap key: %v", doc.ID, err)
+				stats.Failed++
+				continue
+			}
+			if err := s.repo.SetDocumentKey(tx, doc.ID, wrapped); err != nil {
+				tx.Rollback()
+				return err
+			}
+			stats.Rewritten++
+		}
+
+		if err := finishBatch(tx, opts); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress("documents", *stats)
+		}
+	}
+}
+
+func (s *KeyMigrationService) migrateMFASecrets(opts KeyMigrationOptions, stats *KeyMigrationStats) error {
+	lastID := 0
+	for {
+		tx, err := s.repo.Begin()
+		if err != nil {
+			return err
+		}
+		batch, err := s.repo.FindMFASecretsAfter(tx, lastID, opts.BatchSize)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(batch) == 0 {
+			return tx.Rollback()
+		}
+
+		for _, mfa := range batch {
+			lastID = mfa.ID
+			stats.Scanned++
+			if !s.newEncryption.NeedsRewrap(mfa.WrappedKey) && IsBoundCiphertext(mfa.WrappedKey) {
+				stats.Skipped++
+				continue
+			}
+
+			// Secrets already under the new key only need binding to the user
+			from := s.oldEncryption
+			if !s.newEncryption.NeedsRewrap(mfa.WrappedKey) {
+				from = s.newEncryption
+			}
+			secret, err := from.decryptBytes(mfa.WrappedKey, totpSecretAAD(mfa.ID))
+			if err != nil {
+				log.Printf("TOTP secret of user %d: cannot decrypt: %v", mfa.ID, err)
+				stats.Failed++
+				continue
+			}
+			sealed, err := s.newEncryption.EncryptWithAAD(string(secret), totpSecretAAD(mfa.ID))
+			if err != nil {
+				log.Printf("TOTP secret of user %d: cannot encrypt: %v", mfa.ID, err)
+				stats.Failed++
+				continue
+			}
+			if err := s.repo.SetMFASecret(tx, mfa.ID, sealed); err != nil {
+				tx.Rollback()
+				return err
+			}
+			stats.Rewritten++
+		}
+
+		if err := finishBatch(tx, opts); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress("mfa secrets", *stats)
+		}
+	}
+}
+
+// Verify checks that every folder key, credential field, document key and
+// TOTP secret opens under the new key alone. Before a migration, verifyOld
+// checks the same against the current key-ring, so a dry run also finds
+// records that a real run would fail on.
+func (s *KeyMigrationService) Verify(opts KeyMigrationOptions, verifyOld bool) (*KeyMigrationReport, error) {
+	encryption, strict := s.newEncryption, true
+	if verifyOld {
+		// Legacy ciphertexts are still acceptable before the migration
+		encryption, strict = s.oldEncryption, false
+	}
+
+	report := &KeyMigrationReport{}
+	var err error
+	report.Folders.Total, report.Credentials.Total, report.Documents.Total, report.MFASecrets.Total, err = s.repo.Totals()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.repo.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Verification never writes
+	defer tx.Rollback()
+
+	folderKeys := make(map[int][]byte)
+	defer func() {
+		for _, key := range folderKeys {
+			wipe(key)
+		}
+	}()
+	err = walkWrappedKeys(opts.BatchSize, func(afterID, limit int) ([]models.WrappedKey, error) {
+		return s.repo.FindFolderKeysAfter(tx, afterID, limit)
+	}, func(folder models.WrappedKey) {
+		report.Folders.Scanned++
+		if folder.WrappedKey == "" {
+			if strict {
+				log.Printf("Folder %d: no data key", folder.ID)
+				report.Folders.Failed++
+			}
+			return
+		}
+		key, err := encryption.UnwrapKey(folder.WrappedKey)
+		if err != nil {
+			log.Printf("Folder %d: cannot unwrap key: %v", folder.ID, err)
+			report.Folders.Failed++
+			return
+		}
+		folderKeys[folder.ID] = key
+	})
+	if err != nil {
+		return report, err
+	}
+	if opts.Progress != nil {
+		opts.Progress("verify folders", report.Folders)
+	}
+
+	credentials := s.credentialsUnder(encryption, folderKeys, strict)
+	lastID := 0
+	for {
+		batch, err := s.repo.FindCredentialsAfter(tx, lastID, opts.BatchSize, false)
+		if err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			cred := &batch[i]
+			lastID = cred.ID
+			report.Credentials.Scanned++
+			if cred.FolderID != nil && folderKeys[*cred.FolderID] == nil {
+				// Unusable folder key, already reported; only key-ring
+				// ciphertexts can still open
+				key, err := NewDataKey()
+				if err != nil {
+					return report, err
+				}
+				folderKeys[*cred.FolderID] = key
+			}
+			if err := credentials.openAll(cred); err != nil {
+				log.Printf("Credential %d: %v", cred.ID, err)
+				report.Credentials.Failed++
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress("verify credentials", report.Credentials)
+		}
+	}
+
+	err = walkWrappedKeys(opts.BatchSize, func(afterID, limit int) ([]models.WrappedKey, error) {
+		return s.repo.FindDocumentKeysAfter(tx, afterID, limit)
+	}, func(doc models.WrappedKey) {
+		report.Documents.Scanned++
+		if strict && !IsBoundCiphertext(doc.WrappedKey) {
+			log.Printf("Document %d: data key is not bound to the document", doc.ID)
+			report.Documents.Failed++
+			return
+		}
+		key, err := encryption.decryptBytes(doc.WrappedKey, DocumentKeyAAD(doc.ID))
+		if err != nil {
+			log.Printf("Document %d: cannot unwrap key: %v", doc.ID, err)
+			report.Documents.Failed++
+			return
+		}
+		wipe(key)
+	})
+	if err != nil {
+		return report, err
+	}
+	if opts.Progress != nil {
+		opts.Progress("verify documents", report.Documents)
+	}
+
+	err = walkWrappedKeys(opts.BatchSize, func(afterID, limit int) ([]models.WrappedKey, error) {
+		return s.repo.FindMFASecretsAfter(tx, afterID, limit)
+	}, func(mfa models.WrappedKey) {
+		report.MFASecrets.Scanned++
+		if strict && !IsBoundCiphertext(mfa.WrappedKey) {
+			log.Printf("TOTP secret of user %d: not bound to the user", mfa.ID)
+			report.MFASecrets.Failed++
+			return
+		}
+		if _, err := encryption.decryptBytes(mfa.WrappedKey, totpSecretAAD(mfa.ID)); err != nil {
+			log.Printf("TOTP secret of user %d: %v", mfa.ID, err)
+			report.MFASecrets.Failed++
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	if opts.Progress != nil {
+		opts.Progress("verify mfa secrets", report.MFASecrets)
+	}
+
+	return report, nil
+}
+
+func walkWrappedKeys(batchSize int, find func(afterID, limit int) ([]models.WrappedKey, error), visit func(models.WrappedKey)) error {
+	lastID := 0
+	for {
+		batch, err := find(lastID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, key := range batch {
+			lastID = key.ID
+			visit(key)
+		}
+	}
+}
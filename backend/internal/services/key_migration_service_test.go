@@ -0,0 +1,345 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// keyMigrationFixture is a database sealed under key version 1: folder 10
+// holding credential 1, unfiled credentials 2 and 3, of which 3 is already
+// under version 2, document 20 and the TOTP secret of user 30.
+type keyMigrationFixture struct {
+	folderKey, documentKey []byte
+	folderWrapped          string
+	documentWrapped        string
+	mfaSecret              string
+	credentials            []models.Credential
+}
+
+func newTestKeyMigration(t *testing.T) (*KeyMigrationService, sqlmock.Sqlmock) {
+	t.Helper()
+	t.Setenv("ENCRYPTED_CREDENTIAL_FIELDS", "")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewKeyMigrationService(repository.NewKeyMigrationRepository(db), newTestEncryption(t, 1, 1),
+		newTestEncryption(t, 2, 2))
+	if err != nil {
+		t.Fatalf("NewKeyMigrationService: %v", err)
+	}
+	return s, mock
+}
+
+func newKeyMigrationFixture(t *testing.T, s *KeyMigrationService) *keyMigrationFixture {
+	t.Helper()
+	f := &keyMigrationFixture{folderKey: bytes.Repeat([]byte{1}, 32), documentKey: bytes.Repeat([]byte{2}, 32)}
+	var err error
+	if f.folderWrapped, err = s.oldEncryption.WrapKey(f.folderKey); err != nil {
+		t.Fatal(err)
+	}
+	if f.documentWrapped, err = s.oldEncryption.WrapKeyWithAAD(f.documentKey, DocumentKeyAAD(20)); err != nil {
+		t.Fatal(err)
+	}
+	if f.mfaSecret, err = s.oldEncryption.EncryptWithAAD(testTOTPSecret, totpSecretAAD(30)); err != nil {
+		t.Fatal(err)
+	}
+
+	folderID := 10
+	f.credentials = []models.Credential{
+		{ID: 1, UserID: 1, FolderID: &folderID, ServiceName: "db", Username: "admin", Password: "hunter2", Notes: "primary"},
+		{ID: 2, UserID: 1, ServiceName: "mail", Username: "alice", Password: "correct horse"},
+		{ID: 3, UserID: 1, ServiceName: "wiki", Password: "already migrated"},
+	}
+	old := s.credentialsUnder(s.oldEncryption, map[int][]byte{folderID: f.folderKey}, true)
+	migrated := s.credentialsUnder(s.newEncryption, nil, true)
+	for i := range f.credentials {
+		sealer := old
+		if f.credentials[i].ID == 3 {
+			sealer = migrated
+		}
+		if err := sealer.sealAll(&f.credentials[i]); err != nil {
+			t.Fatalf("sealAll: %v", err)
+		}
+	}
+	return f
+}
+
+func wrappedKeyRows(id int, wrapped string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "wrapped_key"})
+	if wrapped != "" {
+		rows.AddRow(id, wrapped)
+	}
+	return rows
+}
+
+func migrationCredentialRows(creds ...models.Credential) *sqlmock.Rows {
+	rows := sqlmock.NewRows(credentialColumns)
+	for _, cred := range creds {
+		var folderID interface{}
+		if cred.FolderID != nil {
+			folderID = *cred.FolderID
+		}
+		rows.AddRow(cred.ID, cred.UserID, folderID, cred.ServiceName, cred.Username, cred.Password, cred.Notes,
+			time.Now(), time.Now())
+	}
+	return rows
+}
+
+// migrationWrites holds what a run stores.
+type migrationWrites struct {
+	folderKey, documentKey, mfaSecret *captureArg
+	credentials                       map[int][3]*captureArg
+}
+
+// expectMigration answers a Run over the fixture with a batch size of 10; a
+// dry run rolls back where a real one commits.
+func expectMigration(mock sqlmock.Sqlmock, f *keyMigrationFixture, dryRun bool) *migrationWrites {
+	finish := func() {
+		if dryRun {
+			mock.ExpectRollback()
+		} else {
+			mock.ExpectCommit()
+		}
+	}
+	w := &migrationWrites{folderKey: &captureArg{}, documentKey: &captureArg{}, mfaSecret: &captureArg{},
+		credentials: make(map[int][3]*captureArg)}
+	expectCredentialUpdate := func(id int) {
+		fields := [3]*captureArg{{}, {}, {}}
+		w.credentials[id] = fields
+		mock.ExpectExec("UPDATE credentials SET").WithArgs(fields[0], fields[1], fields[2], id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	mock.ExpectQuery("COUNT\\(\\*\\) FROM folders").
+		WillReturnRows(sqlmock.NewRows([]string{"f", "c", "d", "m"}).AddRow(1, 3, 1, 1))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM folders WHERE id >").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(10, f.folderWrapped))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM credentials WHERE folder_id").WithArgs(10).
+		WillReturnRows(migrationCredentialRows(f.credentials[0]))
+	expectCredentialUpdate(1)
+	mock.ExpectExec("UPDATE folders SET wrapped_key").WithArgs(w.folderKey, 10).WillReturnResult(sqlmock.NewResult(0, 1))
+	finish()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM folders WHERE id >").WithArgs(10, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(0, 10, true).
+		WillReturnRows(migrationCredentialRows(f.credentials[1:]...))
+	expectCredentialUpdate(2)
+	finish()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(3, 10, true).WillReturnRows(migrationCredentialRows())
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM documents WHERE").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(20, f.documentWrapped))
+	mock.ExpectExec("UPDATE documents SET wrapped_key").WithArgs(w.documentKey, 20).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	finish()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM documents WHERE").WithArgs(20, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM user_mfa").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(30, f.mfaSecret))
+	mock.ExpectExec("UPDATE user_mfa SET totp_secret").WithArgs(w.mfaSecret, 30).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	finish()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM user_mfa").WithArgs(30, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectRollback()
+	return w
+}
+
+// stored returns the fixture's credentials as a run left them.
+func (w *migrationWrites) stored(f *keyMigrationFixture) []models.Credential {
+	creds := append([]models.Credential(nil), f.credentials...)
+	for i := range creds {
+		if fields, ok := w.credentials[creds[i].ID]; ok {
+			creds[i].Username = fields[0].value.(string)
+			creds[i].Password = fields[1].value.(string)
+			creds[i].Notes = fields[2].value.(string)
+		}
+	}
+	return creds
+}
+
+// expectVerify answers a verification pass over the given records.
+func expectVerify(mock sqlmock.Sqlmock, folderWrapped string, creds []models.Credential, documentWrapped, mfaSecret string) {
+	mock.ExpectQuery("COUNT\\(\\*\\) FROM folders").
+		WillReturnRows(sqlmock.NewRows([]string{"f", "c", "d", "m"}).AddRow(1, len(creds), 1, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM folders WHERE id >").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(10, folderWrapped))
+	mock.ExpectQuery("FROM folders WHERE id >").WithArgs(10, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(0, 10, false).
+		WillReturnRows(migrationCredentialRows(creds...))
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(creds[len(creds)-1].ID, 10, false).
+		WillReturnRows(migrationCredentialRows())
+	mock.ExpectQuery("FROM documents WHERE").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(20, documentWrapped))
+	mock.ExpectQuery("FROM documents WHERE").WithArgs(20, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectQuery("FROM user_mfa").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(30, mfaSecret))
+	mock.ExpectQuery("FROM user_mfa").WithArgs(30, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectRollback()
+}
+
+func TestKeyMigrationRefusesUsedVersion(t *testing.T) {
+	t.Setenv("ENCRYPTED_CREDENTIAL_FIELDS", "")
+	repo := repository.NewKeyMigrationRepository(nil)
+	if _, err := NewKeyMigrationService(repo, newTestEncryption(t, 2, 1, 2), newTestEncryption(t, 1, 1)); err == nil {
+		t.Fatal("a new key reusing an existing version was accepted")
+	}
+}
+
+func TestKeyMigrationRun(t *testing.T) {
+	s, mock := newTestKeyMigration(t)
+	f := newKeyMigrationFixture(t, s)
+	w := expectMigration(mock, f, false)
+
+	report, err := s.Run(KeyMigrationOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	want := KeyMigrationReport{
+		Folders:     KeyMigrationStats{Total: 1, Scanned: 1, Rewritten: 1},
+		Credentials: KeyMigrationStats{Total: 3, Scanned: 3, Rewritten: 2, Skipped: 1},
+		Documents:   KeyMigrationStats{Total: 1, Scanned: 1, Rewritten: 1},
+		MFASecrets:  KeyMigrationStats{Total: 1, Scanned: 1, Rewritten: 1},
+	}
+	if *report != want {
+		t.Errorf("report %+v, want %+v", *report, want)
+	}
+
+	// The folder gets a fresh data key, which the old key-ring can't open
+	folderWrapped := w.folderKey.value.(string)
+	if _, err := s.oldEncryption.UnwrapKey(folderWrapped); err == nil {
+		t.Error("new folder key opens under the old key-ring")
+	}
+	folderKey, err := s.newEncryption.UnwrapKey(folderWrapped)
+	if err != nil {
+		t.Fatalf("new folder key: %v", err)
+	}
+	if bytes.Equal(folderKey, f.folderKey) {
+		t.Error("folder data key was re-wrapped, not replaced")
+	}
+
+	migrated := s.credentialsUnder(s.newEncryption, map[int][]byte{10: folderKey}, true)
+	for i, cred := range w.stored(f) {
+		if err := migrated.openAll(&cred); err != nil {
+			t.Errorf("credential %d: %v", cred.ID, err)
+			continue
+		}
+		if i == 0 && (cred.Username != "admin" || cred.Password != "hunter2" || cred.Notes != "primary") {
+			t.Errorf("credential 1 opens to %+v", cred)
+		}
+	}
+	if key, err := s.newEncryption.decryptBytes(w.documentKey.value.(string), DocumentKeyAAD(20)); err != nil ||
+		!bytes.Equal(key, f.documentKey) {
+		t.Errorf("document key: %v", err)
+	}
+	if secret, err := s.newEncryption.decryptBytes(w.mfaSecret.value.(string), totpSecretAAD(30)); err != nil ||
+		string(secret) != testTOTPSecret {
+		t.Errorf("TOTP secret: %v", err)
+	}
+
+	// Everything opens under the new key alone afterwards
+	expectVerify(mock, folderWrapped, w.stored(f), w.documentKey.value.(string), w.mfaSecret.value.(string))
+	report, err = s.Verify(KeyMigrationOptions{BatchSize: 10}, false)
+	if err != nil || report.Failed() != 0 {
+		t.Fatalf("Verify after the run: %+v, %v", report, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyMigrationDryRunWritesNothing(t *testing.T) {
+	s, mock := newTestKeyMigration(t)
+	f := newKeyMigrationFixture(t, s)
+	expectMigration(mock, f, true)
+
+	// Every batch is rolled back
+	report, err := s.Run(KeyMigrationOptions{BatchSize: 10, DryRun: true})
+	if err != nil || report.Failed() != 0 {
+		t.Fatalf("Run: %+v, %v", report, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The current key-ring opens everything not yet migrated, the new key
+	// none of it
+	unmigrated := f.credentials[:2]
+	expectVerify(mock, f.folderWrapped, unmigrated, f.documentWrapped, f.mfaSecret)
+	if report, err := s.Verify(KeyMigrationOptions{BatchSize: 10}, true); err != nil || report.Failed() != 0 {
+		t.Errorf("Verify under the current key-ring: %+v, %v", report, err)
+	}
+	expectVerify(mock, f.folderWrapped, unmigrated, f.documentWrapped, f.mfaSecret)
+	report, err = s.Verify(KeyMigrationOptions{BatchSize: 10}, false)
+	if err != nil {
+		t.Fatalf("Verify under the new key: %v", err)
+	}
+	if report.Folders.Failed != 1 || report.Credentials.Failed != 2 || report.Documents.Failed != 1 ||
+		report.MFASecrets.Failed != 1 {
+		t.Errorf("Verify under the new key: %+v", report)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyMigrationCountsUnreadableRecords(t *testing.T) {
+	s, mock := newTestKeyMigration(t)
+	f := newKeyMigrationFixture(t, s)
+
+	// Credential 4 holds a copy of credential 2's password, bound to credential 2
+	copied := f.credentials[1]
+	copied.ID = 4
+	fields := [3]*captureArg{{}, {}, {}}
+	mock.ExpectQuery("COUNT\\(\\*\\) FROM folders").
+		WillReturnRows(sqlmock.NewRows([]string{"f", "c", "d", "m"}).AddRow(0, 2, 0, 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM folders WHERE id >").WithArgs(0, 10).WillReturnRows(wrappedKeyRows(0, ""))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(0, 10, true).
+		WillReturnRows(migrationCredentialRows(f.credentials[1], copied))
+	mock.ExpectExec("UPDATE credentials SET").WithArgs(fields[0], fields[1], fields[2], 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM credentials WHERE id >").WithArgs(4, 10, true).WillReturnRows(migrationCredentialRows())
+	mock.ExpectRollback()
+	for _, table := range []string{"FROM documents WHERE", "FROM user_mfa"} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(table).WithArgs(0, 10).WillReturnRows(wrappedKeyRows(0, ""))
+		mock.ExpectRollback()
+	}
+
+	// The rest of the batch is still migrated
+	report, err := s.Run(KeyMigrationOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if report.Credentials != (KeyMigrationStats{Total: 2, Scanned: 2, Rewritten: 1, Failed: 1}) || report.Failed() != 1 {
+		t.Errorf("report %+v", *report)
+	}
+}
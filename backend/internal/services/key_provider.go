@@ -0,0 +1,347 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyRing is a set of 32-byte master keys by version. New writes use Active.
+type KeyRing struct {
+	Keys   map[int][]byte
+	Active int
+}
+
+// KeyProvider supplies the master key-ring to EncryptionService.
+type KeyProvider interface {
+	LoadKeys() (*KeyRing, error)
+}
+
+// Keys that ship in this repository and must never protect real data.
+var wellKnownKeys = map[string]bool{
+	"default-key-change-in-production": true,
+	"12345678901234567890123456789012": true,
+}
+
+// NewKeyProviderFromEnv picks a provider based on ENCRYPTION_KEY_PROVIDER
+// ("env", "file" or "kms"; default "env").
+func NewKeyProviderFromEnv() (KeyProvider, error) {
+	switch os.Getenv("ENCRYPTION_KEY_PROVIDER") {
+	case "", "env":
+		return &EnvKeyProvider{DevMode: IsDevMode()}, nil
+	case "file":
+		path := os.Getenv("ENCRYPTION_KEY_FILE")
+		if path == "" {
+			return nil, errors.New("ENCRYPTION_KEY_FILE is required for the file key provider")
+		}
+		return &FileKeyProvider{Path: path, DevMode: IsDevMode()}, nil
+	case "kms":
+		return NewKMSKeyProviderFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown ENCRYPTION_KEY_PROVIDER %q", os.Getenv("ENCRYPTION_KEY_PROVIDER"))
+	}
+}
+
+// IsDevMode reports whether DEV_MODE=true, which relaxes startup checks that
+// would otherwise refuse insecure configuration.
+func IsDevMode() bool {
+	return os.Getenv("DEV_MODE") == "true"
+}
+
+// EnvKeyProvider reads the key-ring from the environment:
+//
+//	ENCRYPTION_KEY          active key used for all new writes
+//	ENCRYPTION_KEY_VERSION  version number of the active key (default 1)
+//	ENCRYPTION_OLD_KEYS     retired keys still accepted for decryption,
+//	                        as comma separated "version:key" pairs
+type EnvKeyProvider struct {
+	DevMode bool
+}
+
+func (p *EnvKeyProvider) LoadKeys() (*KeyRing, error) {
+	keyStr := os.Getenv("ENCRYPTION_KEY")
+	if keyStr == "" {
+		if !p.DevMode {
+			return nil, errors.New("ENCRYPTION_KEY is not set")
+		}
+		keyStr = "default-key-change-in-production"
+	}
+	if err := checkWellKnownKey(keyStr, p.DevMode); err != nil {
+		return nil, err
+	}
+
+	activeVersion := legacyKeyVersion
+	if v := os.Getenv("ENCRYPTION_KEY_VERSION"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			return nil, errors.New("ENCRYPTION_KEY_VERSION must be a positive integer")
+		}
+		activeVersion = parsed
+	}
+
+	ring := &KeyRing{
+		Keys:   map[int][]byte{activeVersion: deriveKey(keyStr)},
+		Active: activeVersion,
+	}
+	for _, entry := range strings.Split(os.Getenv("ENCRYPTION_OLD_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		version, secret, err := parseVersionedEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_OLD_KEYS: %w", err)
+		}
+		if version == activeVersion {
+			return nil, errors.New("ENCRYPTION_OLD_KEYS must not reuse the active key version")
+		}
+		ring.Keys[version] = deriveKey(secret)
+	}
+
+	return ring, nil
+}
+
+// StaticKeyProvider is a single-key ring built from a secret held by the
+// caller, e.g. the replacement key handed to credstore-admin reencrypt.
+type StaticKeyProvider struct {
+	Secret  string
+	Version int
+	DevMode bool
+}
+
+func (p *StaticKeyProvider) LoadKeys() (*KeyRing, error) {
+	if p.Secret == "" {
+		return nil, errors.New("key is empty")
+	}
+	if p.Version < 1 {
+		return nil, errors.New("key versions must be positive integers")
+	}
+	if err := checkWellKnownKey(p.Secret, p.DevMode); err != nil {
+		return nil, err
+	}
+	return &KeyRing{Keys: map[int][]byte{p.Version: deriveKey(p.Secret)}, Active: p.Version}, nil
+}
+
+// FileKeyProvider reads "version:key" lines from a file; blank lines and lines
+// starting with '#' are ignored. The highest version is active unless
+// ENCRYPTION_KEY_VERSION says otherwise.
+type FileKeyProvider struct {
+	Path    string
+	DevMode bool
+}
+
+func (p *FileKeyProvider) LoadKeys() (*KeyRing, error) {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ring := &KeyRing{Keys: make(map[int][]byte)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		version, secret, err := parseVersionedEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p.Path, lineNo, err)
+		}
+		if _, dup := ring.Keys[version]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key version %d", p.Path, lineNo, version)
+		}
+		if err := checkWellKnownKey(secret, p.DevMode); err != nil {
+			return nil, err
+		}
+		ring.Keys[version] = deriveKey(secret)
+		if version > ring.Active {
+			ring.Active = version
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ring.Keys) == 0 {
+		return nil, fmt.Errorf("%s contains no keys", p.Path)
+	}
+	if err := selectActiveVersion(ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// KMSKeyProvider keeps only wrapped master keys in configuration and asks a
+// KMS to unwrap them at startup. It speaks the AWS KMS JSON protocol's Decrypt
+// call, which local stand-ins such as local-kms also implement. Requests are
+// not SigV4 signed, so this is meant for a KMS on a trusted local network.
+type KMSKeyProvider struct {
+	Endpoint    string
+	KeyID       string
+	WrappedKeys map[int]string
+	Client      *http.Client
+}
+
+// NewKMSKeyProviderFromEnv configures the provider from KMS_ENDPOINT,
+// KMS_KEY_ID and ENCRYPTION_WRAPPED_KEYS, a comma separated list of
+// "version:base64 ciphertext blob" pairs.
+func NewKMSKeyProviderFromEnv() (*KMSKeyProvider, error) {
+	endpoint := os.Getenv("KMS_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("KMS_ENDPOINT is required for the kms key provider")
+	}
+
+	wrapped := make(map[int]string)
+	for _, entry := range strings.Split(os.Getenv("ENCRYPTION_WRAPPED_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		version, blob, err := parseVersionedEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_WRAPPED_KEYS: %w", err)
+		}
+		wrapped[version] = blob
+	}
+	if len(wrapped) == 0 {
+		return nil, errors.New("ENCRYPTION_WRAPPED_KEYS is required for the kms key provider")
+	}
+
+	return &KMSKeyProvider{
+		Endpoint:    endpoint,
+		KeyID:       os.Getenv("KMS_KEY_ID"),
+		WrappedKeys: wrapped,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *KMSKeyProvider) LoadKeys() (*KeyRing, error) {
+	ring := &KeyRing{Keys: make(map[int][]byte)}
+	for version, blob := range p.WrappedKeys {
+		key, err := p.decrypt(blob)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping key version %d: %w", version, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key version %d is %d bytes, want 32", version, len(key))
+		}
+		ring.Keys[version] = key
+		if version > ring.Active {
+			ring.Active = version
+		}
+	}
+	if err := selectActiveVersion(ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+type kmsDecryptRequest struct {
+	KeyId          string `json:"KeyId,omitempty"`
+	CiphertextBlob string `json:"CiphertextBlob"`
+}
+
+type kmsDecryptResponse struct {
+	KeyId     string `json:"KeyId"`
+	Plaintext string `json:"Plaintext"`
+}
+
+type kmsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (p *KMSKeyProvider) decrypt(blob string) ([]byte, error) {
+	body, err := json.Marshal(kmsDecryptRequest{KeyId: p.KeyID, CiphertextBlob: blob})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr kmsError
+		if json.Unmarshal(data, &kmsErr) == nil && kmsErr.Type != "" {
+			return nil, fmt.Errorf("kms: %s: %s", kmsErr.Type, kmsErr.Message)
+		}
+		return nil, fmt.Errorf("kms: unexpected status %s", resp.Status)
+	}
+
+	var decrypted kmsDecryptResponse
+	if err := json.Unmarshal(data, &decrypted); err != nil {
+		return nil, fmt.Errorf("kms: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(decrypted.Plaintext)
+}
+
+func parseVersionedEntry(entry string) (int, string, error) {
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.New("entries must look like \"version:value\"")
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || version < 1 {
+		return 0, "", errors.New("key versions must be positive integers")
+	}
+	return version, strings.TrimSpace(parts[1]), nil
+}
+
+// selectActiveVersion applies ENCRYPTION_KEY_VERSION to a ring whose active
+// version otherwise defaults to its highest.
+func selectActiveVersion(ring *KeyRing) error {
+	v := os.Getenv("ENCRYPTION_KEY_VERSION")
+	if v == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return errors.New("ENCRYPTION_KEY_VERSION must be a positive integer")
+	}
+	if _, ok := ring.Keys[version]; !ok {
+		return fmt.Errorf("ENCRYPTION_KEY_VERSION %d is not in the key-ring", version)
+	}
+	ring.Active = version
+	return nil
+}
+
+func checkWellKnownKey(secret string, devMode bool) error {
+	if !wellKnownKeys[secret] {
+		return nil
+	}
+	if !devMode {
+		return errors.New("refusing to start with a well-known example encryption key; set a real key or DEV_MODE=true")
+	}
+	log.Println("WARNING: using a well-known example encryption key (DEV_MODE)")
+	return nil
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeKMS answers Decrypt calls by looking the blob up in keys.
+func fakeKMS(t *testing.T, keyID string, keys map[string][]byte) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" {
+			t.Errorf("X-Amz-Target = %q", r.Header.Get("X-Amz-Target"))
+		}
+		var req kmsDecryptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		if req.KeyId != keyID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(kmsError{Type: "AccessDeniedException", Message: "not authorized for key"})
+			return
+		}
+		key, ok := keys[req.CiphertextBlob]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(kmsError{Type: "InvalidCiphertextException", Message: "bad blob"})
+			return
+		}
+		json.NewEncoder(w).Encode(kmsDecryptResponse{KeyId: keyID, Plaintext: base64.StdEncoding.EncodeToString(key)})
+	}))
+}
+
+func TestKMSKeyProviderUnwrapsKeys(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY_VERSION", "")
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	server := fakeKMS(t, "alias/credstore", map[string][]byte{"blob-1": k1, "blob-2": k2})
+	defer server.Close()
+
+	p := &KMSKeyProvider{
+		Endpoint:    server.URL,
+		KeyID:       "alias/credstore",
+		WrappedKeys: map[int]string{1: "blob-1", 2: "blob-2"},
+	}
+	ring, err := p.LoadKeys()
+	if err != nil {
+		t.Fatalf("LoadKeys: %v", err)
+	}
+	if ring.Active != 2 {
+		t.Errorf("Active = %d, want 2", ring.Active)
+	}
+	if !bytes.Equal(ring.Keys[1], k1) || !bytes.Equal(ring.Keys[2], k2) {
+		t.Errorf("unwrapped keys don't match")
+	}
+
+	t.Setenv("ENCRYPTION_KEY_VERSION", "1")
+	if ring, err = p.LoadKeys(); err != nil || ring.Active != 1 {
+		t.Fatalf("LoadKeys with ENCRYPTION_KEY_VERSION=1: active %v, %v", ring, err)
+	}
+}
+
+func TestKMSKeyProviderAuthFailure(t *testing.T) {
+	server := fakeKMS(t, "alias/credstore", map[string][]byte{"blob-1": bytes.Repeat([]byte{1}, 32)})
+	defer server.Close()
+
+	p := &KMSKeyProvider{Endpoint: server.URL, KeyID: "alias/other", WrappedKeys: map[int]string{1: "blob-1"}}
+	_, err := p.LoadKeys()
+	if err == nil || !strings.Contains(err.Error(), "AccessDeniedException") {
+		t.Fatalf("LoadKeys = %v, want AccessDeniedException", err)
+	}
+}
+
+func TestKMSKeyProviderMalformedResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"not json", http.StatusOK, "<html>gateway</html>"},
+		{"plaintext not base64", http.StatusOK, `{"KeyId":"k","Plaintext":"***"}`},
+		{"short key", http.StatusOK, `{"KeyId":"k","Plaintext":"` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}`},
+		{"error without type", http.StatusInternalServerError, "oops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			p := &KMSKeyProvider{Endpoint: server.URL, WrappedKeys: map[int]string{1: "blob"}}
+			if ring, err := p.LoadKeys(); err == nil {
+				t.Fatalf("LoadKeys accepted a malformed response: %v", ring)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const rewrapBatchSize = 100
+
+var ErrRewrapInProgress = errors.New("a re-wrap job is already running")
+
+type RewrapStatus struct {
+	Running       bool       `json:"running"`
+	ActiveVersion int        `json:"active_version"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	FolderKeys    int        `json:"folder_keys_rewrapped"`
+	DocumentKeys  int        `json:"document_keys_rewrapped"`
+	MFASecrets    int        `json:"mfa_secrets_rewrapped"`
+	Scanned       int        `json:"scanned"`
+	Rewrapped     int        `json:"rewrapped"`
+	Skipped       int        `json:"skipped"`
+	Failed        int        `json:"failed"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// KeyRotationService re-wraps folder and document keys under the active
+// key-ring version, document keys bound to their document, and re-encrypts
+// credential fields that are not sealed the way new writes would be: encrypted
+// if configured, bound to their record, folder credentials under their folder
+// key and the rest under the active key-ring version. It doubles as the
+// one-time migration for rows written before any of those existed, and runs
+// in the background while the server keeps serving requests. Document contents
+// never need rewriting, only the keys wrapping them. TOTP secrets are
+// re-encrypted like credential fields. Unbound ciphertexts are read even when
+// the EncryptionService refuses them elsewhere, and a pass that leaves none
+// behind stops accepting them.
+type KeyRotationService struct {
+	credRepo    *repository.CredentialRepository
+	folderRepo  *repository.FolderRepository
+	docRepo     *repository.DocumentRepository
+	mfaRepo     *repository.MFARepository
+	encryption  *EncryptionService
+	credService *CredentialService
+
+	mu     sync.Mutex
+	status RewrapStatus
+}
+
+func NewKeyRotationService(credRepo *repository.CredentialRepository, folderRepo *repository.FolderRepository,
+	docRepo *repository.DocumentRepository, mfaRepo *repository.MFARepository, encryption *EncryptionService,
+	credService *CredentialService) *KeyRotationService {
+	return &KeyRotationService{
+		credRepo:    credRepo,
+		folderRepo:  folderRepo,
+		docRepo:     docRepo,
+		mfaRepo:     mfaRepo,
+		encryption:  encryption,
+		credService: credService,
+	}
+}
+
+// Start launches a re-wrap pass in the background.
+func (s *KeyRotationService) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status.Running {
+		return ErrRewrapInProgress
+	}
+	if s.encryption.IsSealed() {
+		return ErrSealed
+	}
+
+	now := time.Now()
+	s.status = RewrapStatus{
+		Running:       true,
+		ActiveVersion: s.encryption.ActiveVersion(),
+		StartedAt:     &now,
+	}
+
+	go s.run()
+	return nil
+}
+
+func (s *KeyRotationService) Status() RewrapStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status
+	if !status.Running {
+		status.ActiveVersion = s.encryption.ActiveVersion()
+	}
+	return status
+}
+
+func (s *KeyRotationService) run() {
+	folderKeys, err := s.rewrapKeys(s.folderRepo.FindWrappedKeys, s.folderRepo.ReplaceWrappedKey, nil)
+	s.mu.Lock()
+	s.status.FolderKeys = folderKeys
+	s.mu.Unlock()
+	if err != nil {
+		s.finish(err)
+		return
+	}
+
+	documentKeys, err := s.rewrapKeys(s.docRepo.FindWrappedKeys, s.docRepo.ReplaceWrappedKey, DocumentKeyAAD)
+	s.mu.Lock()
+	s.status.DocumentKeys = documentKeys
+	s.mu.Unlock()
+	if err != nil {
+		s.finish(err)
+		return
+	}
+
+	mfaSecrets, err := s.rewrapMFASecrets()
+	s.mu.Lock()
+	s.status.MFASecrets = mfaSecrets
+	s.mu.Unlock()
+	if err != nil {
+		s.finish(err)
+		return
+	}
+
+	lastID := 0
+	for {
+		batch, err := s.credRepo.FindBatchAfter(lastID, rewrapBatchSize)
+		if err != nil {
+			s.finish(err)
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, cred := range batch {
+			lastID = cred.ID
+			s.record(s.rewrapCredential(&cred))
+		}
+	}
+	s.finish(nil)
+}
+
+type rewrapOutcome int
+
+const (
+	rewrapSkipped rewrapOutcome = iota
+	rewrapDone
+	rewrapFailed
+)
+
+// rewrapKeys re-wraps data keys, given how to list them, how to swap one and,
+// for keys bound to their record, the additional data to bind them to. It
+// returns how many were changed.
+func (s *KeyRotationService) rewrapKeys(find func() (map[int]string, error),
+	replace func(id int, oldKey, newKey string) (bool, error), aadFor func(id int) []byte) (int, error) {
+	wrappedKeys, err := find()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for id, wrapped := range wrappedKeys {
+		var aad []byte
+		if aadFor != nil {
+			aad = aadFor(id)
+		}
+		if !s.encryption.NeedsRewrap(wrapped) && (aad == nil || IsBoundCiphertext(wrapped)) {
+			continue
+		}
+
+		dataKey, err := s.encryption.decryptBytes(wrapped, aad)
+		if err != nil {
+			return count, err
+		}
+		rewrapped, err := s.encryption.WrapKeyWithAAD(dataKey, aad)
+		wipe(dataKey)
+		if err != nil {
+			return count, err
+		}
+
+		changed, err := replace(id, wrapped, rewrapped)
+		if err != nil {
+			return count, err
+		}
+		if changed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *KeyRotationService) rewrapMFASecrets() (int, error) {
+	secrets, err := s.mfaRepo.FindSecrets()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for userID, sealed := range secrets {
+		if !s.encryption.NeedsRewrap(sealed) && IsBoundCiphertext(sealed) {
+			continue
+		}
+
+		secret, err := s.encryption.decryptBytes(sealed, totpSecretAAD(userID))
+		if err != nil {
+			return count, err
+		}
+		resealed, err := s.encryption.EncryptWithAAD(string(secret), totpSecretAAD(userID))
+		if err != nil {
+			return count, err
+		}
+
+		changed, err := s.mfaRepo.ReplaceSecret(userID, sealed, resealed)
+		if err != nil {
+			return count, err
+		}
+		if changed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *KeyRotationService) rewrapCredential(cred *models.Credential) rewrapOutcome {
+	needsRewrap := false
+	for _, field := range credentialFields {
+		if s.credService.fieldNeedsRewrap(cred, field.name, *field.value(cred)) {
+			needsRewrap = true
+			break
+		}
+	}
+	if !needsRewrap {
+		return rewrapSkipped
+	}
+
+	rewrapped := *cred
+	if err := s.credService.withUnbound().openAll(&rewrapped); err != nil {
+		log.Printf("Re-wrap: cannot decrypt credential %d: %v", cred.ID, err)
+		return rewrapFailed
+	}
+	if err := s.credService.sealAll(&rewrapped); err != nil {
+		log.Printf("Re-wrap: cannot encrypt credential %d: %v", cred.ID, err)
+		return rewrapFailed
+	}
+
+	changed, err := s.credRepo.ReplaceSealedFields(cred, &rewrapped)
+	if err != nil {
+		log.Printf("Re-wrap: cannot update credential %d: %v", cred.ID, err)
+		return rewrapFailed
+	}
+	if !changed {
+		// A concurrent update already rewrote the row
+		return rewrapSkipped
+	}
+	return rewrapDone
+}
+
+func (s *KeyRotationService) record(outcome rewrapOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Scanned++
+	switch outcome {
+	case rewrapDone:
+		s.status.Rewrapped++
+	case rewrapFailed:
+		s.status.Failed++
+	default:
+		s.status.Skipped++
+	}
+}
+
+func (s *KeyRotationService) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.status.Running = false
+	s.status.FinishedAt = &now
+	if err != nil {
+		s.status.LastError = err.Error()
+		log.Printf("Re-wrap aborted: %v", err)
+		return
+	}
+	log.Printf("Re-wrap finished: %d scanned, %d rewrapped, %d failed",
+		s.status.Scanned, s.status.Rewrapped, s.status.Failed)
+	// Nothing unbound is left to read, so stop accepting it
+	if s.status.Failed == 0 && s.encryption.AllowsUnbound() {
+		s.encryption.AllowUnbound(false)
+		log.Println("Every ciphertext is bound to its record now; refusing unbound ones from here on")
+	}
+}
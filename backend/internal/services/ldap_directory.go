@@ -0,0 +1,304 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// AuthSourceLDAP marks users provisioned from the LDAP directory.
+const AuthSourceLDAP = "ldap"
+
+const ldapPageSize = 500
+
+// LDAPConfig describes the directory and how its users map to ours.
+type LDAPConfig struct {
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// The service account used to search the directory
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user by email; every %s is replaced by the escaped
+	// email, or by * to list all users
+	UserFilter     string
+	EmailAttribute string
+	// IDAttribute is the user's stable id, such as entryUUID or objectGUID;
+	// the DN is used if the entry has none
+	IDAttribute string
+	// Groups come from GroupAttribute on the user (memberOf), or, with
+	// GroupFilter set, from a search under GroupBaseDN where %s is the
+	// escaped user DN. They are matched by CN.
+	GroupAttribute string
+	GroupBaseDN    string
+	GroupFilter    string
+	GroupMappings  []GroupMapping
+	// DefaultGroup is for users no mapping matches; empty refuses them
+	DefaultGroup string
+	Timeout      time.Duration
+}
+
+// NewLDAPConfigFromEnv reads the LDAP_* settings. It returns nil when LDAP_URL
+// is unset, which turns LDAP off.
+//
+//	LDAP_URL                 ldap://host:389 or ldaps://host:636
+//	LDAP_START_TLS=true      upgrade an ldap:// connection with StartTLS
+//	LDAP_CA_FILE             PEM bundle to verify the server with
+//	LDAP_BIND_DN             service account for searches
+//	LDAP_BIND_PASSWORD       its password
+//	LDAP_BASE_DN             where users are searched
+//	LDAP_USER_FILTER         default (&(objectClass=person)(mail=%s))
+//	LDAP_EMAIL_ATTRIBUTE     default mail
+//	LDAP_ID_ATTRIBUTE        default entryUUID (objectGUID for Active Directory)
+//	LDAP_GROUP_ATTRIBUTE     default memberOf
+//	LDAP_GROUP_FILTER        e.g. (&(objectClass=groupOfNames)(member=%s)), instead of memberOf
+//	LDAP_GROUP_BASE_DN       where groups are searched (default LDAP_BASE_DN)
+//	LDAP_GROUP_MAPPING       comma separated "group-cn=user_group" pairs
+//	LDAP_DEFAULT_GROUP       group for users no mapping matches (default: refuse them)
+func NewLDAPConfigFromEnv() (*LDAPConfig, error) {
+	rawURL := os.Getenv("LDAP_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+	baseDN := os.Getenv("LDAP_BASE_DN")
+	if baseDN == "" {
+		return nil, errors.New("LDAP_BASE_DN is required when LDAP_URL is set")
+	}
+
+	mappings, err := parseGroupMappings(os.Getenv("LDAP_GROUP_MAPPING"))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP_GROUP_MAPPING: %w", err)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("LDAP_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("LDAP_CA_FILE: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &LDAPConfig{
+		URL:            rawURL,
+		StartTLS:       os.Getenv("LDAP_START_TLS") == "true",
+		TLSConfig:      tlsConfig,
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         baseDN,
+		UserFilter:     envOr("LDAP_USER_FILTER", "(&(objectClass=person)(mail=%s))"),
+		EmailAttribute: envOr("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		IDAttribute:    envOr("LDAP_ID_ATTRIBUTE", "entryUUID"),
+		GroupAttribute: envOr("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupBaseDN:    envOr("LDAP_GROUP_BASE_DN", baseDN),
+		GroupFilter:    os.Getenv("LDAP_GROUP_FILTER"),
+		GroupMappings:  mappings,
+		DefaultGroup:   os.Getenv("LDAP_DEFAULT_GROUP"),
+		Timeout:        10 * time.Second,
+	}, nil
+}
+
+// LDAPDirectory checks passwords by binding as the user, and lists the
+// directory's users for the sync job. Every call uses its own connection.
+type LDAPDirectory struct {
+	cfg *LDAPConfig
+}
+
+func NewLDAPDirectory(cfg *LDAPConfig) *LDAPDirectory {
+	return &LDAPDirectory{cfg: cfg}
+}
+
+func (d *LDAPDirectory) Source() string {
+	return AuthSourceLDAP
+}
+
+// Authenticate finds the user by email with the service account, then binds
+// as them with the password. Users without a mapped group come back with an
+// empty UserGroup.
+func (d *LDAPDirectory) Authenticate(email, password string) (*models.ExternalIdentity, error) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.Search(d.userSearch(ldap.EscapeFilter(email), 2))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, ldapFailure("user search", err)
+	}
+	if len(result.Entries) != 1 {
+		if len(result.Entries) > 1 {
+			log.Printf("LDAP: %d entries match %s; refusing the login", len(result.Entries), email)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, ldapFailure("user bind", err)
+	}
+
+	// Group searches may need the service account's rights
+	if d.cfg.GroupFilter != "" {
+		if err := d.bindService(conn); err != nil {
+			return nil, err
+		}
+	}
+	return d.identity(conn, entry)
+}
+
+// Users lists every user the filter matches, for the sync job.
+func (d *LDAPDirectory) Users() ([]models.ExternalIdentity, error) {
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.SearchWithPaging(d.userSearch("*", 0), ldapPageSize)
+	if err != nil {
+		return nil, ldapFailure("user listing", err)
+	}
+
+	identities := make([]models.ExternalIdentity, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		identity, err := d.identity(conn, entry)
+		if err != nil {
+			return nil, err
+		}
+		if identity.Email == "" {
+			continue
+		}
+		identities = append(identities, *identity)
+	}
+	return identities, nil
+}
+
+func (d *LDAPDirectory) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(d.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: d.cfg.Timeout}),
+		ldap.DialWithTLSConfig(d.cfg.TLSConfig))
+	if err != nil {
+		return nil, ldapFailure("connect", err)
+	}
+	conn.SetTimeout(d.cfg.Timeout)
+
+	if d.cfg.StartTLS {
+		if err := conn.StartTLS(d.cfg.TLSConfig); err != nil {
+			conn.Close()
+			return nil, ldapFailure("StartTLS", err)
+		}
+	}
+	if err := d.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *LDAPDirectory) bindService(conn *ldap.Conn) error {
+	var err error
+	if d.cfg.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(d.cfg.BindDN, d.cfg.BindPassword)
+	}
+	if err != nil {
+		return ldapFailure("service account bind", err)
+	}
+	return nil
+}
+
+func (d *LDAPDirectory) userSearch(value string, sizeLimit int) *ldap.SearchRequest {
+	attributes := []string{d.cfg.EmailAttribute, d.cfg.IDAttribute}
+	if d.cfg.GroupFilter == "" {
+		attributes = append(attributes, d.cfg.GroupAttribute)
+	}
+	return ldap.NewSearchRequest(d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		sizeLimit, int(d.cfg.Timeout.Seconds()), false,
+		strings.ReplaceAll(d.cfg.UserFilter, "%s", value), attributes, nil)
+}
+
+func (d *LDAPDirectory) identity(conn *ldap.Conn, entry *ldap.Entry) (*models.ExternalIdentity, error) {
+	var groupDNs []string
+	if d.cfg.GroupFilter == "" {
+		groupDNs = entry.GetAttributeValues(d.cfg.GroupAttribute)
+	} else {
+		filter := strings.ReplaceAll(d.cfg.GroupFilter, "%s", ldap.EscapeFilter(entry.DN))
+		result, err := conn.SearchWithPaging(ldap.NewSearchRequest(d.cfg.GroupBaseDN, ldap.ScopeWholeSubtree,
+			ldap.NeverDerefAliases, 0, int(d.cfg.Timeout.Seconds()), false, filter, []string{"cn"}, nil), ldapPageSize)
+		if err != nil {
+			return nil, ldapFailure("group search", err)
+		}
+		for _, group := range result.Entries {
+			groupDNs = append(groupDNs, group.DN)
+		}
+	}
+
+	groups := make(map[string]bool, len(groupDNs))
+	for _, dn := range groupDNs {
+		if cn := firstRDNValue(dn); cn != "" {
+			groups[cn] = true
+		}
+	}
+
+	return &models.ExternalIdentity{
+		Source:     AuthSourceLDAP,
+		ExternalID: ldapEntryID(entry, d.cfg.IDAttribute),
+		Email:      entry.GetAttributeValue(d.cfg.EmailAttribute),
+		UserGroup:  mapGroup(d.cfg.GroupMappings, groups, d.cfg.DefaultGroup),
+	}, nil
+}
+
+// ldapEntryID reads the stable id attribute. Binary ids such as AD's
+// objectGUID are hex encoded.
+func ldapEntryID(entry *ldap.Entry, attribute string) string {
+	raw := entry.GetRawAttributeValue(attribute)
+	if len(raw) == 0 {
+		return entry.DN
+	}
+	if utf8.Valid(raw) && !strings.ContainsRune(string(raw), 0) {
+		return string(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+func firstRDNValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// ldapFailure logs what went wrong talking to the directory; callers only
+// learn that it is unavailable.
+func ldapFailure(stage string, err error) error {
+	log.Printf("LDAP %s failed: %v", stage, err)
+	return ErrDirectoryUnavailable
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testLDAPServiceDN = "cn=vault,ou=services,dc=example,dc=com"
+	testLDAPPeople    = "ou=people,dc=example,dc=com"
+	testLDAPGroups    = "ou=groups,dc=example,dc=com"
+)
+
+type stubLDAPEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// stubLDAPDirectory is an LDAP server with just enough of the protocol for
+// LDAPDirectory: simple binds, searches with equality, presence, and, or and
+// not filters, and unbind. Like real servers, it accepts a bind with an empty
+// password as an unauthenticated one, and like a locked down one, it only
+// answers searches from the service account.
+type stubLDAPDirectory struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries []stubLDAPEntry
+	binds   []string
+}
+
+func newStubLDAPDirectory(t *testing.T, entries ...stubLDAPEntry) *stubLDAPDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &stubLDAPDirectory{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return d
+}
+
+func (d *stubLDAPDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+// Binds lists the DNs successfully bound as, in order.
+func (d *stubLDAPDirectory) Binds() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func (d *stubLDAPDirectory) setEntries(entries ...stubLDAPEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = entries
+}
+
+func (d *stubLDAPDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	boundAs := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			code := d.bind(dn, op.Children[2].Data.String())
+			if code == ldap.LDAPResultSuccess {
+				boundAs = dn
+			}
+			writeLDAPResult(conn, messageID, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			if boundAs != testLDAPServiceDN {
+				writeLDAPResult(conn, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			d.search(conn, messageID, op)
+		default:
+			return
+		}
+	}
+}
+
+func (d *stubLDAPDirectory) bind(dn, password string) uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if password == "" {
+		d.binds = append(d.binds, "")
+		return ldap.LDAPResultSuccess
+	}
+	if dn == testLDAPServiceDN && password == "service-secret" {
+		d.binds = append(d.binds, dn)
+		return ldap.LDAPResultSuccess
+	}
+	for _, entry := range d.entries {
+		if entry.dn == dn && entry.password != "" && entry.password == password {
+			d.binds = append(d.binds, dn)
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *stubLDAPDirectory) search(w io.Writer, messageID interface{}, op *ber.Packet) {
+	base := strings.ToLower(op.Children[0].Value.(string))
+	sizeLimit := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+
+	d.mu.Lock()
+	entries := d.entries
+	d.mu.Unlock()
+
+	sent := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(strings.ToLower(entry.dn), base) || !matchLDAPFilter(filter, entry) {
+			continue
+		}
+		if sizeLimit > 0 && int64(sent) == sizeLimit {
+			writeLDAPResult(w, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded)
+			return
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "dn"))
+		attributes := ber.NewSequence("attributes")
+		for name, values := range entry.attrs {
+			attribute := ber.NewSequence("attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+		writeLDAPMessage(w, messageID, result)
+		sent++
+	}
+	writeLDAPResult(w, messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+}
+
+func matchLDAPFilter(filter *ber.Packet, entry stubLDAPEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchLDAPFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchLDAPFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchLDAPFilter(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		want := filter.Children[1].Data.String()
+		for _, value := range stubLDAPAttribute(entry, filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(stubLDAPAttribute(entry, filter.Data.String())) > 0
+	}
+	return false
+}
+
+func stubLDAPAttribute(entry stubLDAPEntry, name string) []string {
+	for attribute, values := range entry.attrs {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func writeLDAPResult(w io.Writer, messageID interface{}, tag ber.Tag, code uint16) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnostic"))
+	writeLDAPMessage(w, messageID, result)
+}
+
+func writeLDAPMessage(w io.Writer, messageID interface{}, op *ber.Packet) {
+	message := ber.NewSequence("message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "id"))
+	message.AppendChild(op)
+	w.Write(message.Bytes())
+}
+
+func ldapPerson(uid, password string, groups ...string) stubLDAPEntry {
+	memberOf := make([]string, len(groups))
+	for i, group := range groups {
+		memberOf[i] = "cn=" + group + "," + testLDAPGroups
+	}
+	return stubLDAPEntry{
+		dn:       "uid=" + uid + "," + testLDAPPeople,
+		password: password,
+		attrs: map[string][]string{
+			"objectClass": {"person"},
+			"mail":        {uid + "@example.com"},
+			"entryUUID":   {uid + "-uuid"},
+			"memberOf":    memberOf,
+		},
+	}
+}
+
+func ldapGroup(cn string, members ...string) stubLDAPEntry {
+	dns := make([]string, len(members))
+	for i, uid := range members {
+		dns[i] = "uid=" + uid + "," + testLDAPPeople
+	}
+	return stubLDAPEntry{
+		dn:    "cn=" + cn + "," + testLDAPGroups,
+		attrs: map[string][]string{"objectClass": {"groupOfNames"}, "cn": {cn}, "member": dns},
+	}
+}
+
+func testLDAPConfig(url string) *LDAPConfig {
+	return &LDAPConfig{
+		URL:            url,
+		BindDN:         testLDAPServiceDN,
+		BindPassword:   "service-secret",
+		BaseDN:         testLDAPPeople,
+		UserFilter:     "(&(objectClass=person)(mail=%s))",
+		EmailAttribute: "mail",
+		IDAttribute:    "entryUUID",
+		GroupAttribute: "memberOf",
+		GroupBaseDN:    testLDAPGroups,
+		GroupMappings: []GroupMapping{
+			{External: "vault-admins", UserGroup: "admin"},
+			{External: "engineering", UserGroup: "junior"},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestLDAPAuthenticateBindsAsUser(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "engineering", "staff"))
+	d := NewLDAPDirectory(testLDAPConfig(stub.URL()))
+
+	identity, err := d.Authenticate("alice@example.com", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	want := models.ExternalIdentity{Source: AuthSourceLDAP, ExternalID: "alice-uuid", Email: "alice@example.com",
+		UserGroup: "junior"}
+	if *identity != want {
+		t.Fatalf("Authenticate = %+v, want %+v", identity, want)
+	}
+	binds := stub.Binds()
+	if len(binds) != 2 || binds[0] != testLDAPServiceDN || binds[1] != "uid=alice,"+testLDAPPeople {
+		t.Fatalf("binds = %q, want the service account then the user", binds)
+	}
+}
+
+func TestLDAPAuthenticateRefusals(t *testing.T) {
+	twin := ldapPerson("bob", "bob-secret")
+	twin.dn = "uid=bob2," + testLDAPPeople
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "engineering"), ldapPerson("bob", "bob-secret"),
+		twin)
+	d := NewLDAPDirectory(testLDAPConfig(stub.URL()))
+
+	cases := []struct{ name, email, password string }{
+		{"wrong password", "alice@example.com", "guess"},
+		{"unknown email", "mallory@example.com", "alice-secret"},
+		{"filter injection", "*", "alice-secret"},
+		{"email on two entries", "bob@example.com", "bob-secret"},
+	}
+	for _, tc := range cases {
+		if _, err := d.Authenticate(tc.email, tc.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: Authenticate = %v, want ErrInvalidCredentials", tc.name, err)
+		}
+	}
+}
+
+func TestLDAPAuthenticateRefusesEmptyPassword(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "engineering"))
+	d := NewLDAPDirectory(testLDAPConfig(stub.URL()))
+
+	// The stub, like real servers, would take it as an unauthenticated bind
+	if _, err := d.Authenticate("alice@example.com", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate(empty password) = %v, want ErrInvalidCredentials", err)
+	}
+	if binds := stub.Binds(); len(binds) != 0 {
+		t.Fatalf("binds = %q, want the directory left alone", binds)
+	}
+}
+
+func TestLDAPAuthenticateGroupSearch(t *testing.T) {
+	stub := newStubLDAPDirectory(t,
+		ldapPerson("alice", "alice-secret"),
+		ldapGroup("staff", "alice"),
+		ldapGroup("vault-admins", "bob", "alice"),
+		ldapGroup("engineering", "bob"))
+	cfg := testLDAPConfig(stub.URL())
+	cfg.GroupFilter = "(&(objectClass=groupOfNames)(member=%s))"
+	d := NewLDAPDirectory(cfg)
+
+	identity, err := d.Authenticate("alice@example.com", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.UserGroup != "admin" {
+		t.Fatalf("UserGroup = %q, want admin", identity.UserGroup)
+	}
+	// The stub only lets the service account search
+	binds := stub.Binds()
+	if len(binds) != 3 || binds[2] != testLDAPServiceDN {
+		t.Fatalf("binds = %q, want the service account again for the group search", binds)
+	}
+}
+
+func TestLDAPAuthenticateGroupMapping(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "staff"))
+	cfg := testLDAPConfig(stub.URL())
+	d := NewLDAPDirectory(cfg)
+
+	identity, err := d.Authenticate("alice@example.com", "alice-secret")
+	if err != nil || identity.UserGroup != "" {
+		t.Fatalf("Authenticate = %+v, %v; want no group", identity, err)
+	}
+	cfg.DefaultGroup = "readonly"
+	identity, err = d.Authenticate("alice@example.com", "alice-secret")
+	if err != nil || identity.UserGroup != "readonly" {
+		t.Fatalf("Authenticate = %+v, %v; want the default group", identity, err)
+	}
+}
+
+func TestLDAPDirectoryUnavailable(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "alice-secret", "engineering"))
+	cfg := testLDAPConfig(stub.URL())
+	cfg.BindPassword = "rotated"
+	if _, err := NewLDAPDirectory(cfg).Authenticate("alice@example.com", "alice-secret"); !errors.Is(err, ErrDirectoryUnavailable) {
+		t.Errorf("Authenticate(bad service account) = %v, want ErrDirectoryUnavailable", err)
+	}
+
+	stub.listener.Close()
+	if _, err := NewLDAPDirectory(testLDAPConfig(stub.URL())).Users(); !errors.Is(err, ErrDirectoryUnavailable) {
+		t.Errorf("Users(server down) = %v, want ErrDirectoryUnavailable", err)
+	}
+}
+
+func TestLDAPUsers(t *testing.T) {
+	noMail := ldapPerson("printer", "")
+	delete(noMail.attrs, "mail")
+	binaryID := ldapPerson("carol", "", "vault-admins")
+	binaryID.attrs["entryUUID"] = []string{"\x01\x00\xff"}
+	noID := ldapPerson("dave", "")
+	delete(noID.attrs, "entryUUID")
+
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "", "engineering"), noMail, binaryID, noID,
+		ldapGroup("engineering", "alice"))
+	users, err := NewLDAPDirectory(testLDAPConfig(stub.URL())).Users()
+	if err != nil {
+		t.Fatalf("Users: %v", err)
+	}
+
+	want := []models.ExternalIdentity{
+		{Source: AuthSourceLDAP, ExternalID: "alice-uuid", Email: "alice@example.com", UserGroup: "junior"},
+		{Source: AuthSourceLDAP, ExternalID: "0100ff", Email: "carol@example.com", UserGroup: "admin"},
+		{Source: AuthSourceLDAP, ExternalID: "uid=dave," + testLDAPPeople, Email: "dave@example.com"},
+	}
+	if len(users) != len(want) {
+		t.Fatalf("Users = %+v, want %+v", users, want)
+	}
+	for i := range want {
+		if users[i] != want[i] {
+			t.Errorf("Users[%d] = %+v, want %+v", i, users[i], want[i])
+		}
+	}
+}
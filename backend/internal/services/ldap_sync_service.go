@@ -0,0 +1,230 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// directorySyncActor is recorded as the actor of the sync job's changes.
+const directorySyncActor = "directory-sync"
+
+var (
+	ErrDirectorySyncInProgress = errors.New("a directory sync is already running")
+	ErrDirectoryEmpty          = errors.New("the directory returned no users; refusing to suspend everyone")
+)
+
+type DirectorySyncReport struct {
+	Running        bool       `json:"running"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	DirectoryUsers int        `json:"directory_users"`
+	GroupsCreated  int        `json:"groups_created"`
+	Updated        int        `json:"updated"`
+	Reactivated    int        `json:"reactivated"`
+	Suspended      int        `json:"suspended"`
+	Failed         int        `json:"failed"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// LDAPSyncService brings LDAP users that have logged in here up to date with
+// the directory: their group and role follow their directory groups, users
+// that left the directory or every mapped group are suspended and logged out,
+// and users it suspended that come back are reactivated. Users suspended for
+// other reasons stay suspended. Groups the mapping
+// refers to are created in the groups table. Users are still only created by
+// their first login.
+type LDAPSyncService struct {
+	directory      *LDAPDirectory
+	userRepo       *repository.UserRepository
+	groupRepo      *repository.GroupRepository
+	authService    *AuthService
+	sessionService *SessionService
+	auditService   *AuditService
+
+	mu     sync.Mutex
+	status DirectorySyncReport
+}
+
+func NewLDAPSyncService(directory *LDAPDirectory, userRepo *repository.UserRepository,
+	groupRepo *repository.GroupRepository, authService *AuthService, sessionService *SessionService,
+	auditService *AuditService) *LDAPSyncService {
+	return &LDAPSyncService{
+		directory:      directory,
+		userRepo:       userRepo,
+		groupRepo:      groupRepo,
+		authService:    authService,
+		sessionService: sessionService,
+		auditService:   auditService,
+	}
+}
+
+// Status reports the running or last finished sync.
+func (s *LDAPSyncService) Status() DirectorySyncReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Sync runs one pass and returns its report.
+func (s *LDAPSyncService) Sync() (DirectorySyncReport, error) {
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		return DirectorySyncReport{}, ErrDirectorySyncInProgress
+	}
+	now := time.Now()
+	s.status = DirectorySyncReport{Running: true, StartedAt: &now}
+	s.mu.Unlock()
+
+	err := s.sync()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	s.status.Running = false
+	s.status.FinishedAt = &finished
+	outcome := AuditSuccess
+	if err != nil {
+		s.status.LastError = err.Error()
+		outcome = AuditFailure
+	}
+	s.record("directory.sync", "", "", outcome, s.summary(err))
+	return s.status, err
+}
+
+// StartSync runs a sync every interval in the background.
+func (s *LDAPSyncService) StartSync(interval time.Duration) {
+	log.Printf("Syncing LDAP users and groups every %s", interval)
+
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := s.Sync(); err != nil && !errors.Is(err, ErrDirectorySyncInProgress) {
+				log.Printf("Directory sync failed: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *LDAPSyncService) sync() error {
+	identities, err := s.directory.Users()
+	if err != nil {
+		return err
+	}
+	// An empty answer is far more likely a broken filter or permissions
+	// than a directory that really lost everyone
+	if len(identities) == 0 {
+		return ErrDirectoryEmpty
+	}
+	s.update(func(r *DirectorySyncReport) { r.DirectoryUsers = len(identities) })
+
+	byID := make(map[string]*models.ExternalIdentity, len(identities))
+	for i := range identities {
+		byID[identities[i].ExternalID] = &identities[i]
+		if group := identities[i].UserGroup; group != "" {
+			if err := s.ensureGroup(group); err != nil {
+				return err
+			}
+		}
+	}
+
+	users, err := s.userRepo.FindBySource(AuthSourceLDAP)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if err := s.syncUser(&users[i], byID[users[i].ExternalID]); err != nil {
+			log.Printf("Directory sync failed for user %d: %v", users[i].ID, err)
+			s.update(func(r *DirectorySyncReport) { r.Failed++ })
+		}
+	}
+	return nil
+}
+
+func (s *LDAPSyncService) syncUser(user *models.User, identity *models.ExternalIdentity) error {
+	if identity == nil || identity.UserGroup == "" {
+		if user.Status != UserActive {
+			return nil
+		}
+		if err := s.authService.SetStatus(user.ID, UserSuspended, SuspendedByDirectory); err != nil {
+			return err
+		}
+		if _, err := s.sessionService.RevokeAll(user.ID, SessionSuspended); err != nil {
+			return err
+		}
+		details := "removed from the directory"
+		if identity != nil {
+			details = "no mapped group"
+		}
+		s.record("user.suspend", "user", strconv.Itoa(user.ID), AuditSuccess, details)
+		s.update(func(r *DirectorySyncReport) { r.Suspended++ })
+		return nil
+	}
+
+	if user.Status != UserActive {
+		if user.SuspendedReason != SuspendedByDirectory {
+			return nil
+		}
+		if err := s.authService.SetStatus(user.ID, UserActive, ""); err != nil {
+			return err
+		}
+		s.record("user.reactivate", "user", strconv.Itoa(user.ID), AuditSuccess, "back in the directory")
+		s.update(func(r *DirectorySyncReport) { r.Reactivated++ })
+	}
+
+	updated, change, err := s.authService.ProvisionExternalUser(identity)
+	if err != nil {
+		return err
+	}
+	if change != "" {
+		s.record(change, "user", strconv.Itoa(updated.ID), AuditSuccess, "user_group="+updated.UserGroup)
+		s.update(func(r *DirectorySyncReport) { r.Updated++ })
+	}
+	return nil
+}
+
+func (s *LDAPSyncService) ensureGroup(name string) error {
+	_, err := s.groupRepo.FindByName(name)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	group := &models.Group{Name: name, Description: "Created by the LDAP directory sync"}
+	if err := s.groupRepo.Create(group); err != nil {
+		return err
+	}
+	s.record("group.create", "group", strconv.Itoa(group.ID), AuditSuccess, name)
+	s.update(func(r *DirectorySyncReport) { r.GroupsCreated++ })
+	return nil
+}
+
+func (s *LDAPSyncService) update(fn func(*DirectorySyncReport)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.status)
+}
+
+func (s *LDAPSyncService) summary(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("directory_users=%d groups_created=%d updated=%d reactivated=%d suspended=%d failed=%d",
+		s.status.DirectoryUsers, s.status.GroupsCreated, s.status.Updated, s.status.Reactivated,
+		s.status.Suspended, s.status.Failed)
+}
+
+func (s *LDAPSyncService) record(action, targetType, targetID, outcome, details string) {
+	s.auditService.Record(&models.AuditEvent{
+		ActorEmail: directorySyncActor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Outcome:    outcome,
+		Details:    details,
+	})
+}
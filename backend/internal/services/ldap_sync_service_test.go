@@ -0,0 +1,193 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// auditRecorder is an audit sink handing events to the test.
+type auditRecorder chan models.AuditEvent
+
+func (r auditRecorder) Write(event *models.AuditEvent) error {
+	r <- *event
+	return nil
+}
+
+func (r auditRecorder) next(t *testing.T) models.AuditEvent {
+	t.Helper()
+	select {
+	case event := <-r:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit event")
+		return models.AuditEvent{}
+	}
+}
+
+func newTestLDAPSync(t *testing.T, stub *stubLDAPDirectory) (*LDAPSyncService, sqlmock.Sqlmock, auditRecorder) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// The chain itself is covered elsewhere; the events are read from a sink
+	auditDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { auditDB.Close() })
+
+	auth := testAuthService(t, db)
+	sessions := NewSessionService(repository.NewSessionRepository(db), auth.userRepo, auth, time.Hour, 24*time.Hour, time.Minute)
+	audit := NewAuditService(repository.NewAuditRepository(auditDB), nil)
+	events := make(auditRecorder, 32)
+	audit.AddSink("test", events, 32)
+
+	return NewLDAPSyncService(NewLDAPDirectory(testLDAPConfig(stub.URL())), auth.userRepo,
+		repository.NewGroupRepository(db), auth, sessions, audit), mock, events
+}
+
+func ldapUser(id int, uid, group, status, reason string) *models.User {
+	user := testUser(id, uid+"@example.com")
+	user.UserGroup, user.AuthSource, user.ExternalID = group, AuthSourceLDAP, uid+"-uuid"
+	user.Status, user.SuspendedReason = status, reason
+	return user
+}
+
+func expectGroup(mock sqlmock.Sqlmock, name string, exists bool) {
+	q := mock.ExpectQuery("FROM groups WHERE name").WithArgs(name)
+	if exists {
+		q.WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "require_mfa", "created_at"}).
+			AddRow(1, name, "", false, time.Now()))
+		return
+	}
+	q.WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO groups").WithArgs(name, sqlmock.AnyArg(), false).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+}
+
+func expectSetStatus(mock sqlmock.Sqlmock, userID int, status, reason string) {
+	mock.ExpectExec("UPDATE users SET status").WithArgs(status, reason, sqlmock.AnyArg(), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestLDAPSync(t *testing.T) {
+	stub := newStubLDAPDirectory(t,
+		ldapPerson("alice", "", "engineering"),
+		ldapPerson("bob", "", "vault-admins"),
+		ldapPerson("carol", "", "staff"),
+		ldapPerson("erin", "", "engineering"))
+	s, mock, events := newTestLDAPSync(t, stub)
+
+	alice := ldapUser(1, "alice", "junior", UserActive, "")
+	bob := ldapUser(2, "bob", "junior", UserSuspended, SuspendedByDirectory)
+	carol := ldapUser(3, "carol", "junior", UserActive, "")
+	dave := ldapUser(4, "dave", "junior", UserActive, "")
+	erin := ldapUser(5, "erin", "junior", UserSuspended, SuspendedByAdmin)
+
+	expectGroup(mock, "junior", true)
+	expectGroup(mock, "admin", false)
+	expectGroup(mock, "junior", true)
+	mock.ExpectQuery("WHERE auth_source = \\$1 ORDER BY id").WithArgs(AuthSourceLDAP).
+		WillReturnRows(userRows(alice, bob, carol, dave, erin))
+
+	// alice is up to date
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WithArgs(AuthSourceLDAP, "alice-uuid").
+		WillReturnRows(userRows(alice))
+	// bob is back, and now an admin
+	expectSetStatus(mock, 2, UserActive, "")
+	reactivated := *bob
+	reactivated.Status, reactivated.SuspendedReason = UserActive, ""
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WithArgs(AuthSourceLDAP, "bob-uuid").
+		WillReturnRows(userRows(&reactivated))
+	mock.ExpectQuery("UPDATE users SET email").
+		WithArgs("bob@example.com", "", "admin", "admin", AuthSourceLDAP, "bob-uuid", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(1))
+	// carol has no mapped group any more, dave left
+	for _, id := range []int{3, 4} {
+		expectSetStatus(mock, id, UserSuspended, SuspendedByDirectory)
+		mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionSuspended, id).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+	}
+	// erin was suspended by an admin and stays suspended
+
+	report, err := s.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if report.Running || report.DirectoryUsers != 4 || report.GroupsCreated != 1 || report.Updated != 1 ||
+		report.Reactivated != 1 || report.Suspended != 2 || report.Failed != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	want := []models.AuditEvent{
+		{Action: "group.create", TargetType: "group", TargetID: "7", Details: "admin"},
+		{Action: "user.reactivate", TargetType: "user", TargetID: "2", Details: "back in the directory"},
+		{Action: "user.update", TargetType: "user", TargetID: "2", Details: "user_group=admin"},
+		{Action: "user.suspend", TargetType: "user", TargetID: "3", Details: "no mapped group"},
+		{Action: "user.suspend", TargetType: "user", TargetID: "4", Details: "removed from the directory"},
+		{Action: "directory.sync", Details: "directory_users=4 groups_created=1 updated=1 reactivated=1 suspended=2 failed=0"},
+	}
+	for _, w := range want {
+		got := events.next(t)
+		if got.ActorEmail != directorySyncActor || got.Action != w.Action || got.TargetType != w.TargetType ||
+			got.TargetID != w.TargetID || got.Details != w.Details || got.Outcome != AuditSuccess {
+			t.Errorf("audit event %+v, want %+v", got, w)
+		}
+	}
+}
+
+func TestLDAPSyncRefusesEmptyDirectory(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapGroup("engineering"))
+	s, mock, events := newTestLDAPSync(t, stub)
+
+	// No expectations: not a single user may be suspended
+	if _, err := s.Sync(); !errors.Is(err, ErrDirectoryEmpty) {
+		t.Fatalf("Sync = %v, want ErrDirectoryEmpty", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Status(); status.Running || status.LastError != ErrDirectoryEmpty.Error() {
+		t.Fatalf("Status = %+v", status)
+	}
+	if event := events.next(t); event.Action != "directory.sync" || event.Outcome != AuditFailure {
+		t.Fatalf("audit event %+v, want a failed directory.sync", event)
+	}
+
+	stub.listener.Close()
+	if _, err := s.Sync(); !errors.Is(err, ErrDirectoryUnavailable) {
+		t.Fatalf("Sync(server down) = %v, want ErrDirectoryUnavailable", err)
+	}
+}
+
+func TestLDAPSyncCountsFailedUsers(t *testing.T) {
+	stub := newStubLDAPDirectory(t, ldapPerson("alice", "", "engineering"))
+	s, mock, _ := newTestLDAPSync(t, stub)
+
+	expectGroup(mock, "junior", true)
+	mock.ExpectQuery("WHERE auth_source = \\$1 ORDER BY id").
+		WillReturnRows(userRows(ldapUser(1, "alice", "junior", UserActive, ""), ldapUser(2, "bob", "junior", UserActive, "")))
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WillReturnError(errors.New("connection reset"))
+	// One user failing doesn't stop the others
+	expectSetStatus(mock, 2, UserSuspended, SuspendedByDirectory)
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	report, err := s.Sync()
+	if err != nil || report.Failed != 1 || report.Suspended != 1 {
+		t.Fatalf("Sync = %+v, %v", report, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
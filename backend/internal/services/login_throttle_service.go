@@ -0,0 +1,245 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// What failed logins are counted against.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+var ErrLoginThrottled = errors.New("too many failed login attempts, try again later")
+
+// LoginThrottlePolicy configures LoginThrottleService. A threshold of 0
+// turns throttling off for that scope.
+type LoginThrottlePolicy struct {
+	// Failures in a row that lock an account or IP out for LockoutDuration
+	AccountThreshold int
+	IPThreshold      int
+	LockoutDuration  time.Duration
+	// After n failures the next attempt has to wait BackoffBase * 2^(n-1),
+	// at most BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Failures are forgotten after this long without another one
+	Window time.Duration
+}
+
+// LoginThrottleService slows down password guessing. Every failed login
+// makes the next attempt for the same account and from the same IP wait
+// exponentially longer, and enough failures lock either out for a while.
+// Attempts are counted when they start, so guesses sent at once wait their
+// turn like the others.
+// Accounts are tracked by the email tried, so an email that doesn't exist
+// behaves exactly like one that does.
+type LoginThrottleService struct {
+	throttleRepo *repository.LoginThrottleRepository
+	userRepo     *repository.UserRepository
+	policy       LoginThrottlePolicy
+}
+
+func NewLoginThrottleService(throttleRepo *repository.LoginThrottleRepository, userRepo *repository.UserRepository,
+	policy LoginThrottlePolicy) *LoginThrottleService {
+	return &LoginThrottleService{throttleRepo: throttleRepo, userRepo: userRepo, policy: policy}
+}
+
+// LoginAttempt is a login reserved by Attempt. It counts as a failure until
+// Release or Succeed take it back.
+type LoginAttempt struct {
+	keys []throttleKey
+	// The failures of each key, this attempt included
+	failures []int
+}
+
+// Attempt reserves a login for email from ip. When the login has to wait, it
+// returns how long and the scope holding it back, and reserves nothing.
+// Otherwise the attempt is counted as a failure up front, in the transaction
+// that read the count, so concurrent guesses can't all go ahead before any of
+// them is counted.
+func (s *LoginThrottleService) Attempt(email, ip string) (*LoginAttempt, time.Duration, string, error) {
+	keys := s.keys(email, ip)
+	if len(keys) == 0 {
+		return &LoginAttempt{}, 0, "", nil
+	}
+	tx, err := s.throttleRepo.Begin()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer tx.Rollback()
+
+	// Rows are always locked account first, so concurrent attempts can't
+	// deadlock
+	now := time.Now().UTC()
+	var wait time.Duration
+	var scope string
+	for _, k := range keys {
+		t, err := s.throttleRepo.Reserve(tx, k.scope, k.key, now)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if d := s.waitFor(t, now); d > wait {
+			wait, scope = d, k.scope
+		}
+	}
+	if wait > 0 {
+		return nil, wait, scope, nil
+	}
+
+	attempt := &LoginAttempt{keys: keys}
+	for _, k := range keys {
+		t, err := s.throttleRepo.RecordFailure(tx, k.scope, k.key, now, now.Add(-s.policy.Window))
+		if err != nil {
+			return nil, 0, "", err
+		}
+		attempt.failures = append(attempt.failures, t.Failures)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, "", err
+	}
+	return attempt, 0, "", nil
+}
+
+// Fail settles an attempt as failed and returns the scopes it locked out.
+func (s *LoginThrottleService) Fail(attempt *LoginAttempt) ([]string, error) {
+	until := time.Now().UTC().Add(s.policy.LockoutDuration)
+	var locked []string
+	for i, k := range attempt.keys {
+		// Every threshold failures in a row earn another lockout
+		if attempt.failures[i]%k.threshold != 0 {
+			continue
+		}
+		if err := s.throttleRepo.Lock(k.scope, k.key, until); err != nil {
+			return locked, err
+		}
+		locked = append(locked, k.scope)
+	}
+	return locked, nil
+}
+
+// Release takes back an attempt that didn't fail, say because the password
+// was right, without forgetting earlier failures.
+func (s *LoginThrottleService) Release(attempt *LoginAttempt) error {
+	for _, k := range attempt.keys {
+		if err := s.throttleRepo.Refund(k.scope, k.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeed forgets an account's failures once its login succeeded. Those from
+// the IP stay, so logging in to one account doesn't buy more guesses at
+// others; only the attempt itself is taken back.
+func (s *LoginThrottleService) Succeed(attempt *LoginAttempt) error {
+	for _, k := range attempt.keys {
+		var err error
+		if k.scope == ThrottleAccount {
+			_, err = s.throttleRepo.Delete(k.scope, k.key)
+		} else {
+			err = s.throttleRepo.Refund(k.scope, k.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlock lifts a user's lockout and forgets their failures. It reports
+// whether there was anything to forget.
+func (s *LoginThrottleService) Unlock(userID int) (bool, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return false, err
+	}
+	return s.throttleRepo.Delete(ThrottleAccount, throttleAccountKey(user.Email))
+}
+
+// LockedOut returns when the lockout of each locked out user ends, by user id.
+func (s *LoginThrottleService) LockedOut(users []models.User) (map[int]time.Time, error) {
+	locked, err := s.throttleRepo.FindLocked(ThrottleAccount, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	byUser := make(map[int]time.Time)
+	for _, user := range users {
+		if until, ok := locked[throttleAccountKey(user.Email)]; ok {
+			byUser[user.ID] = until
+		}
+	}
+	return byUser, nil
+}
+
+// StartCleanup drops forgotten failures every interval in the background.
+func (s *LoginThrottleService) StartCleanup(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			now := time.Now().UTC()
+			if _, err := s.throttleRepo.DeleteStale(now.Add(-s.policy.Window), now); err != nil {
+				log.Printf("Failed to clean up login throttles: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *LoginThrottleService) waitFor(t *models.LoginThrottle, now time.Time) time.Duration {
+	// A lockout runs its course even when it outlasts the window
+	var wait time.Duration
+	if t.LockedUntil != nil && t.LockedUntil.After(now) {
+		wait = t.LockedUntil.Sub(now)
+	}
+	if t.LastFailureAt.Before(now.Add(-s.policy.Window)) {
+		return wait
+	}
+	if d := t.LastFailureAt.Add(s.backoff(t.Failures)).Sub(now); d > wait {
+		wait = d
+	}
+	return wait
+}
+
+func (s *LoginThrottleService) backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := s.policy.BackoffBase
+	for i := 1; i < failures && delay < s.policy.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > s.policy.BackoffMax {
+		delay = s.policy.BackoffMax
+	}
+	return delay
+}
+
+type throttleKey struct {
+	scope     string
+	key       string
+	threshold int
+}
+
+func (s *LoginThrottleService) keys(email, ip string) []throttleKey {
+	var keys []throttleKey
+	// A passkey login has no account to count against until it succeeded
+	if s.policy.AccountThreshold > 0 && email != "" {
+		keys = append(keys, throttleKey{ThrottleAccount, throttleAccountKey(email), s.policy.AccountThreshold})
+	}
+	if s.policy.IPThreshold > 0 && ip != "" {
+		keys = append(keys, throttleKey{ThrottleIP, ip, s.policy.IPThreshold})
+	}
+	return keys
+}
+
+func throttleAccountKey(email string) string {
+	key := strings.ToLower(strings.TrimSpace(email))
+	if len(key) > 255 {
+		key = key[:255]
+	}
+	return key
+}
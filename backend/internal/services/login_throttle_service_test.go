@@ -0,0 +1,304 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testThrottleColumns = []string{"scope", "key", "failures", "last_failure_at", "locked_until"}
+
+func throttleRows(scope, key string, failures int, lastFailureAt time.Time, lockedUntil *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows(testThrottleColumns).AddRow(scope, key, failures, lastFailureAt, lockedUntil)
+}
+
+func testThrottlePolicy() LoginThrottlePolicy {
+	return LoginThrottlePolicy{
+		AccountThreshold: 5,
+		IPThreshold:      20,
+		LockoutDuration:  15 * time.Minute,
+		BackoffBase:      time.Second,
+		BackoffMax:       time.Minute,
+		Window:           time.Hour,
+	}
+}
+
+func newTestLoginThrottle(t *testing.T, policy LoginThrottlePolicy) (*LoginThrottleService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewLoginThrottleService(repository.NewLoginThrottleRepository(db), repository.NewUserRepository(db), policy), mock
+}
+
+// near reports whether got is want, give or take the time a test takes.
+func near(got, want time.Duration) bool {
+	return got <= want && got > want-5*time.Second
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	s := &LoginThrottleService{policy: testThrottlePolicy()}
+	for failures, want := range map[int]time.Duration{
+		0: 0, 1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 6: 32 * time.Second,
+		7: time.Minute, 1000: time.Minute,
+	} {
+		if got := s.backoff(failures); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+
+	now := time.Now().UTC()
+	lockedUntil := now.Add(10 * time.Minute)
+	expired := now.Add(-time.Minute)
+	cases := []struct {
+		name     string
+		throttle models.LoginThrottle
+		want     time.Duration
+	}{
+		{"backing off", models.LoginThrottle{Failures: 6, LastFailureAt: now.Add(-2 * time.Second)}, 30 * time.Second},
+		{"backoff over", models.LoginThrottle{Failures: 3, LastFailureAt: now.Add(-time.Minute)}, 0},
+		{"locked out", models.LoginThrottle{Failures: 5, LastFailureAt: now, LockedUntil: &lockedUntil}, 10 * time.Minute},
+		{"outside the window", models.LoginThrottle{Failures: 4, LastFailureAt: now.Add(-2 * time.Hour)}, 0},
+		{"lockout outlasting the window", models.LoginThrottle{Failures: 5, LastFailureAt: now.Add(-2 * time.Hour), LockedUntil: &lockedUntil}, 10 * time.Minute},
+		{"lockout over", models.LoginThrottle{Failures: 5, LastFailureAt: now.Add(-2 * time.Hour), LockedUntil: &expired}, 0},
+	}
+	for _, tc := range cases {
+		if got := s.waitFor(&tc.throttle, now); got != tc.want {
+			t.Errorf("%s: waitFor = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func expectReserve(mock sqlmock.Sqlmock, scope, key string, rows *sqlmock.Rows) {
+	mock.ExpectQuery("INSERT INTO login_throttles .* VALUES \\(\\$1, \\$2, 0, \\$3\\)").WithArgs(scope, key, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+func expectCountFailure(mock sqlmock.Sqlmock, scope, key string, failures int) (recordedAt, resetBefore *captureArg) {
+	recordedAt, resetBefore = &captureArg{}, &captureArg{}
+	mock.ExpectQuery("INSERT INTO login_throttles .* VALUES \\(\\$1, \\$2, 1, \\$3\\)").
+		WithArgs(scope, key, recordedAt, resetBefore).
+		WillReturnRows(throttleRows(scope, key, failures, time.Now().UTC(), nil))
+	return recordedAt, resetBefore
+}
+
+// reserveAttempt reserves an attempt counted as the given failures of each key.
+func reserveAttempt(t *testing.T, s *LoginThrottleService, mock sqlmock.Sqlmock, email, ip string, failures ...int) *LoginAttempt {
+	t.Helper()
+	now := time.Now().UTC()
+	keys := s.keys(email, ip)
+	mock.ExpectBegin()
+	for i, k := range keys {
+		expectReserve(mock, k.scope, k.key, throttleRows(k.scope, k.key, failures[i]-1, now.Add(-time.Hour), nil))
+	}
+	for i, k := range keys {
+		expectCountFailure(mock, k.scope, k.key, failures[i])
+	}
+	mock.ExpectCommit()
+	a, wait, _, err := s.Attempt(email, ip)
+	if err != nil || wait != 0 {
+		t.Fatalf("Attempt = %s, %v", wait, err)
+	}
+	return a
+}
+
+func TestLoginThrottleAttempt(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+	now := time.Now().UTC()
+	lockedUntil := now.Add(10 * time.Minute)
+
+	// Emails are tracked case and space insensitively; whether the account
+	// exists is never looked up. A throttled attempt counts nothing.
+	mock.ExpectBegin()
+	expectReserve(mock, ThrottleAccount, "alice@example.com", throttleRows(ThrottleAccount, "alice@example.com", 3, now, nil))
+	expectReserve(mock, ThrottleIP, "192.0.2.1", throttleRows(ThrottleIP, "192.0.2.1", 20, now, &lockedUntil))
+	mock.ExpectRollback()
+	a, wait, scope, err := s.Attempt(" Alice@Example.com", "192.0.2.1")
+	if err != nil || a != nil || !near(wait, 10*time.Minute) || scope != ThrottleIP {
+		t.Fatalf("Attempt = %v, %s, %q, %v; want the IP lockout", a, wait, scope, err)
+	}
+
+	mock.ExpectBegin()
+	expectReserve(mock, ThrottleAccount, "alice@example.com", throttleRows(ThrottleAccount, "alice@example.com", 3, now, nil))
+	expectReserve(mock, ThrottleIP, "198.51.100.7", throttleRows(ThrottleIP, "198.51.100.7", 0, now, nil))
+	mock.ExpectRollback()
+	if _, wait, scope, err = s.Attempt("alice@example.com", "198.51.100.7"); err != nil || !near(wait, 4*time.Second) ||
+		scope != ThrottleAccount {
+		t.Fatalf("Attempt = %s, %q, %v; want the account backoff", wait, scope, err)
+	}
+
+	// An attempt that may go ahead is counted as failed before it is answered,
+	// in the transaction holding the rows, so a concurrent one waits its turn
+	mock.ExpectBegin()
+	expectReserve(mock, ThrottleAccount, "bob@example.com", throttleRows(ThrottleAccount, "bob@example.com", 0, now, nil))
+	expectReserve(mock, ThrottleIP, "198.51.100.7", throttleRows(ThrottleIP, "198.51.100.7", 2, now.Add(-time.Minute), nil))
+	recordedAt, resetBefore := expectCountFailure(mock, ThrottleAccount, "bob@example.com", 1)
+	expectCountFailure(mock, ThrottleIP, "198.51.100.7", 3)
+	mock.ExpectCommit()
+	if a, wait, scope, err := s.Attempt("bob@example.com", "198.51.100.7"); err != nil || a == nil || wait != 0 || scope != "" {
+		t.Fatalf("Attempt = %v, %s, %q, %v; want no wait", a, wait, scope, err)
+	}
+	// Failures older than the window start the count over
+	if at, before := recordedAt.value.(time.Time), resetBefore.value.(time.Time); at.Sub(before) != time.Hour {
+		t.Fatalf("failures forgotten before %s, %s before the failure; want the window", before, at.Sub(before))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleFailLocksOut(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+
+	expectLock := func(scope, key string) *captureArg {
+		until := &captureArg{}
+		mock.ExpectExec("UPDATE login_throttles SET locked_until").WithArgs(until, scope, key).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		return until
+	}
+
+	a := reserveAttempt(t, s, mock, "Alice@example.com", "192.0.2.1", 4, 19)
+	if locked, err := s.Fail(a); err != nil || len(locked) != 0 {
+		t.Fatalf("Fail = %v, %v; want no lockout", locked, err)
+	}
+
+	// The threshold locks out both the account and the IP
+	a = reserveAttempt(t, s, mock, "alice@example.com", "192.0.2.1", 5, 20)
+	accountUntil := expectLock(ThrottleAccount, "alice@example.com")
+	expectLock(ThrottleIP, "192.0.2.1")
+	locked, err := s.Fail(a)
+	if err != nil || len(locked) != 2 || locked[0] != ThrottleAccount || locked[1] != ThrottleIP {
+		t.Fatalf("Fail = %v, %v; want both locked out", locked, err)
+	}
+	if until := accountUntil.value.(time.Time); !near(time.Until(until), 15*time.Minute) {
+		t.Fatalf("locked until %s, want in 15 minutes", until)
+	}
+
+	// After the lockout, every further threshold failures earn another
+	a = reserveAttempt(t, s, mock, "alice@example.com", "192.0.2.1", 9, 21)
+	if locked, err := s.Fail(a); err != nil || len(locked) != 0 {
+		t.Fatalf("Fail = %v, %v; want no lockout", locked, err)
+	}
+	a = reserveAttempt(t, s, mock, "alice@example.com", "192.0.2.1", 10, 22)
+	expectLock(ThrottleAccount, "alice@example.com")
+	if locked, err := s.Fail(a); err != nil || len(locked) != 1 || locked[0] != ThrottleAccount {
+		t.Fatalf("Fail = %v, %v; want the account locked out again", locked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleDisabledScopes(t *testing.T) {
+	policy := testThrottlePolicy()
+	policy.AccountThreshold = 0
+	s, mock := newTestLoginThrottle(t, policy)
+
+	a := reserveAttempt(t, s, mock, "alice@example.com", "192.0.2.1", 1)
+	if len(a.keys) != 1 || a.keys[0].scope != ThrottleIP {
+		t.Fatalf("attempt counted against %+v, want the IP only", a.keys)
+	}
+	// Without a client IP, and the account scope off, nothing is tracked
+	a, wait, _, err := s.Attempt("alice@example.com", "")
+	if err != nil || wait != 0 {
+		t.Fatalf("Attempt = %s, %v", wait, err)
+	}
+	if locked, err := s.Fail(a); err != nil || len(locked) != 0 {
+		t.Fatalf("Fail = %v, %v", locked, err)
+	}
+	if err := s.Succeed(a); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottlePasskeyCountsAgainstIP(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+
+	// A passkey login names no account until it succeeded
+	a := reserveAttempt(t, s, mock, "", "192.0.2.1", 4)
+	if len(a.keys) != 1 || a.keys[0].scope != ThrottleIP {
+		t.Fatalf("attempt counted against %+v, want the IP only", a.keys)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleReleaseAndSucceed(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+
+	// A released attempt is taken back, earlier failures are kept
+	a := reserveAttempt(t, s, mock, "ALICE@example.com ", "192.0.2.1", 3, 7)
+	mock.ExpectExec("UPDATE login_throttles SET failures = GREATEST").WithArgs(ThrottleAccount, "alice@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login_throttles SET failures = GREATEST").WithArgs(ThrottleIP, "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.Release(a); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// Success forgets the account's failures, but only takes the attempt back
+	// from the IP's
+	a = reserveAttempt(t, s, mock, "alice@example.com", "192.0.2.1", 3, 7)
+	mock.ExpectExec("DELETE FROM login_throttles").WithArgs(ThrottleAccount, "alice@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login_throttles SET failures = GREATEST").WithArgs(ThrottleIP, "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.Succeed(a); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleUnlock(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+	alice := testUser(1, "Alice@example.com")
+
+	for _, affected := range []int64{1, 0} {
+		mock.ExpectQuery("WHERE id = \\$1").WithArgs(1).WillReturnRows(userRows(alice))
+		mock.ExpectExec("DELETE FROM login_throttles").WithArgs(ThrottleAccount, "alice@example.com").
+			WillReturnResult(sqlmock.NewResult(0, affected))
+		if unlocked, err := s.Unlock(1); err != nil || unlocked != (affected == 1) {
+			t.Errorf("Unlock = %v, %v; want %v", unlocked, err, affected == 1)
+		}
+	}
+
+	mock.ExpectQuery("WHERE id = \\$1").WithArgs(2).WillReturnRows(userRows())
+	if _, err := s.Unlock(2); err != sql.ErrNoRows {
+		t.Errorf("Unlock(unknown user) = %v, want sql.ErrNoRows", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottleLockedOut(t *testing.T) {
+	s, mock := newTestLoginThrottle(t, testThrottlePolicy())
+	until := time.Now().Add(5 * time.Minute).UTC().Truncate(time.Second)
+
+	// Lockouts of emails without an account are not reported
+	mock.ExpectQuery("SELECT key, locked_until FROM login_throttles").WithArgs(ThrottleAccount, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "locked_until"}).
+			AddRow("alice@example.com", until).AddRow("mallory@example.com", until))
+	locked, err := s.LockedOut([]models.User{*testUser(1, "Alice@example.com"), *testUser(2, "bob@example.com")})
+	if err != nil {
+		t.Fatalf("LockedOut: %v", err)
+	}
+	if len(locked) != 1 || !locked[1].Equal(until) {
+		t.Fatalf("LockedOut = %v, want user 1 until %s", locked, until)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
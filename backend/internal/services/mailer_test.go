@@ -0,0 +1,287 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type smtpMessage struct {
+	auth string
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpSink is an SMTP server that keeps what it is sent, like the Mailpit or
+// MailHog sinks used in development. It offers the given extensions after
+// EHLO, but implements only AUTH PLAIN.
+type smtpSink struct {
+	listener   net.Listener
+	extensions []string
+
+	mu          sync.Mutex
+	connections int
+	messages    []smtpMessage
+}
+
+func newSMTPSink(t *testing.T, extensions ...string) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{listener: listener, extensions: extensions}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+// config is for an SMTPMailer sending through the sink. The host is
+// localhost, the only one PlainAuth sends a password to in the clear.
+func (s *smtpSink) config(security string) *SMTPConfig {
+	return &SMTPConfig{
+		Host:     "localhost",
+		Port:     s.listener.Addr().(*net.TCPAddr).Port,
+		From:     &mail.Address{Name: "Credential Store", Address: "vault@example.com"},
+		Security: security,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func (s *smtpSink) received() (int, []smtpMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections, append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+	var msg smtpMessage
+	tp.PrintfLine("220 sink.example ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			lines := append([]string{"sink.example"}, s.extensions...)
+			for i, ext := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, ext)
+			}
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(initial)
+			if mechanism != "PLAIN" || err != nil {
+				tp.PrintfLine("504 unsupported")
+				continue
+			}
+			msg.auth = string(decoded)
+			tp.PrintfLine("235 accepted")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			if msg.data, err = readSMTPData(tp); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = smtpMessage{}
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// readSMTPData reads a message as sent, undoing only the dot stuffing;
+// textproto's dot reader would also turn CRLF into LF.
+func readSMTPData(tp *textproto.Conn) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := tp.R.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" {
+			return data, nil
+		}
+		data = append(data, strings.TrimPrefix(line, ".")...)
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	sink := newSMTPSink(t, "AUTH PLAIN")
+	cfg := sink.config(SMTPPlain)
+	cfg.Username, cfg.Password = "vault", "smtp-secret"
+
+	subject := "Réinitialisez votre mot de passe"
+	body := "Bonjour Zoë,\n\n" +
+		"https://vault.example.com/reset-password#token=" + strings.Repeat("a=b", 40) + "\n" +
+		".a line starting with a dot\n"
+	if err := NewSMTPMailer(cfg).Send("Zoë <zoe@example.com>", subject, body); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	_, messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(messages))
+	}
+	sent := messages[0]
+	if sent.auth != "\x00vault\x00smtp-secret" || sent.from != "vault@example.com" ||
+		len(sent.to) != 1 || sent.to[0] != "zoe@example.com" {
+		t.Fatalf("envelope auth %q from %q to %q", sent.auth, sent.from, sent.to)
+	}
+	for _, b := range sent.data {
+		if b >= 0x80 {
+			t.Fatal("message is not 7 bit clean")
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(sent.data))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err != nil || *from != *cfg.From {
+		t.Errorf("From %q", msg.Header.Get("From"))
+	}
+	if to, err := mail.ParseAddress(msg.Header.Get("To")); err != nil || to.Name != "Zoë" || to.Address != "zoe@example.com" {
+		t.Errorf("To %q", msg.Header.Get("To"))
+	}
+	if got, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || got != subject {
+		t.Errorf("Subject %q decodes to %q", msg.Header.Get("Subject"), got)
+	}
+	if date, err := msg.Header.Date(); err != nil || time.Since(date) > time.Minute {
+		t.Errorf("Date %q", msg.Header.Get("Date"))
+	}
+	if id := msg.Header.Get("Message-ID"); !regexp.MustCompile(`^<[0-9a-f]{32}@example\.com>$`).MatchString(id) {
+		t.Errorf("Message-ID %q", id)
+	}
+	for name, want := range map[string]string{
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+
+	raw, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if strings.ContainsAny(line, "\r\n") {
+			t.Errorf("bare line break in %q", line)
+		}
+		if len(line) > 76 {
+			t.Errorf("line of %d characters: %q", len(line), line)
+		}
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(body, "\n", "\r\n"); string(decoded) != want {
+		t.Errorf("body %q, want %q", decoded, want)
+	}
+}
+
+func TestSMTPMailerRefusesHeaderInjection(t *testing.T) {
+	sink := newSMTPSink(t)
+	mailer := NewSMTPMailer(sink.config(SMTPPlain))
+
+	if err := mailer.Send("zoe@example.com", "Hello\r\nBcc: mallory@example.com", "body"); err == nil {
+		t.Error("Send accepted a subject with a line break")
+	}
+	if err := mailer.Send("zoe@example.com\r\nBcc: mallory@example.com", "Hello", "body"); err == nil {
+		t.Error("Send accepted a recipient with a line break")
+	}
+	if connections, _ := sink.received(); connections != 0 {
+		t.Errorf("%d connections to the server, want none", connections)
+	}
+}
+
+func TestSMTPMailerRequiresStartTLS(t *testing.T) {
+	sink := newSMTPSink(t, "AUTH PLAIN")
+	cfg := sink.config(SMTPStartTLS)
+	cfg.Username, cfg.Password = "vault", "smtp-secret"
+
+	// A server, or a man in the middle, not offering STARTTLS doesn't get the
+	// password or the message in the clear
+	err := NewSMTPMailer(cfg).Send("zoe@example.com", "Hello", "body")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("Send = %v, want a STARTTLS error", err)
+	}
+	if connections, messages := sink.received(); connections != 1 || len(messages) != 0 {
+		t.Fatalf("%d connections, %d messages; want 1 and none", connections, len(messages))
+	}
+}
+
+func TestNewSMTPConfigFromEnv(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	if cfg, err := NewSMTPConfigFromEnv(); cfg != nil || err != nil {
+		t.Fatalf("NewSMTPConfigFromEnv without SMTP_HOST = %+v, %v", cfg, err)
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_FROM", "Credential Store <vault@example.com>")
+	for security, port := range map[string]int{"": 587, SMTPStartTLS: 587, SMTPTLS: 465, SMTPPlain: 587} {
+		t.Setenv("SMTP_TLS", security)
+		cfg, err := NewSMTPConfigFromEnv()
+		if err != nil || cfg.Port != port || cfg.From.Address != "vault@example.com" {
+			t.Errorf("SMTP_TLS=%q: %+v, %v; want port %d", security, cfg, err, port)
+		}
+	}
+
+	t.Setenv("SMTP_TLS", "ssl")
+	if _, err := NewSMTPConfigFromEnv(); err == nil {
+		t.Error("unknown SMTP_TLS accepted")
+	}
+	t.Setenv("SMTP_TLS", "")
+	t.Setenv("SMTP_FROM", "not an address")
+	if _, err := NewSMTPConfigFromEnv(); err == nil {
+		t.Error("invalid SMTP_FROM accepted")
+	}
+}
@@ -0,0 +1,563 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidMFACode       = errors.New("invalid authentication code")
+	ErrInvalidMFAChallenge  = errors.New("invalid or expired login challenge; sign in again")
+	ErrMFAAlreadyEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled        = errors.New("two-factor authentication is not enabled")
+	ErrMFARequiredByGroup   = errors.New("your group requires two-factor authentication")
+	ErrMFAEnrollmentMissing = errors.New("start enrollment first")
+	ErrMFASetupNotAllowed   = errors.New("a second factor is already set up; sign in with it")
+)
+
+const (
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+// MFAService handles TOTP second factors: enrollment, which only takes effect
+// once the user proves their app works with a first code, the second login
+// step, and single-use recovery codes for a lost device. A registered WebAuthn
+// credential also counts as a second factor; WebAuthnService completes the
+// same challenges.
+//
+// Passing the password yields a challenge token rather than a session. It is
+// signed with a key derived from JWT_SECRET, so it is never accepted as an
+// access token, lives for five minutes and allows five wrong codes. That
+// count is per process; the login throttle, in the database, counts wrong
+// codes per account and IP across challenges, restarts and replicas.
+type MFAService struct {
+	mfaRepo      *repository.MFARepository
+	webauthnRepo *repository.WebAuthnRepository
+	groupRepo    *repository.GroupRepository
+	userRepo     *repository.UserRepository
+	authService  *AuthService
+	encryption   *EncryptionService
+	issuer       string
+
+	mu       sync.Mutex
+	attempts map[string]*challengeAttempts
+}
+
+type challengeAttempts struct {
+	failures  int
+	used      bool
+	expiresAt time.Time
+}
+
+func NewMFAService(mfaRepo *repository.MFARepository, webauthnRepo *repository.WebAuthnRepository,
+	groupRepo *repository.GroupRepository, userRepo *repository.UserRepository, authService *AuthService,
+	encryption *EncryptionService, issuer string) *MFAService {
+	return &MFAService{
+		mfaRepo:      mfaRepo,
+		webauthnRepo: webauthnRepo,
+		groupRepo:    groupRepo,
+		userRepo:     userRepo,
+		authService:  authService,
+		encryption:   encryption,
+		issuer:       issuer,
+		attempts:     make(map[string]*challengeAttempts),
+	}
+}
+
+// Challenge decides whether a user who just passed the password check needs a
+// second step. It returns nil if they can have a session straight away, and
+// ErrPhishingResistantRequired for an admin who must use a security key but
+// has none.
+func (s *MFAService) Challenge(user *models.User) (*models.MFAChallenge, error) {
+	mfa, err := s.mfaRepo.FindByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	totpEnabled := mfa != nil && mfa.Enabled
+
+	securityKeys, err := s.webauthnRepo.CountByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	phishingResistant, err := s.authService.RequiresPhishingResistant(user)
+	if err != nil {
+		return nil, err
+	}
+	required, err := s.groupRepo.RequiresMFA(user.UserGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	switch {
+	case phishingResistant && securityKeys == 0:
+		return nil, ErrPhishingResistantRequired
+	case phishingResistant:
+		methods = []string{AuthMethodSecurityKey}
+	default:
+		if totpEnabled {
+			methods = append(methods, AuthMethodTOTP, AuthMethodRecoveryCode)
+		}
+		if securityKeys > 0 {
+			methods = append(methods, AuthMethodSecurityKey)
+		}
+	}
+	if len(methods) == 0 && !required {
+		return nil, nil
+	}
+
+	token, err := s.newChallengeToken(user.ID, len(methods) == 0)
+	if err != nil {
+		return nil, err
+	}
+	return &models.MFAChallenge{
+		MFARequired:      true,
+		MFASetupRequired: len(methods) == 0,
+		Methods:          methods,
+		ChallengeToken:   token,
+		ExpiresIn:        int(mfaChallengeTTL.Seconds()),
+	}, nil
+}
+
+// SetupWithChallenge starts enrollment for a user whose group requires MFA but
+// who has none yet, in the middle of logging in. Only a password proves who
+// the caller is at that point, so it is refused unless the challenge was
+// issued for setup and the user still has no second factor; otherwise
+// enrolling would let a password alone replace one.
+func (s *MFAService) SetupWithChallenge(challengeToken string) (*models.TOTPEnrollment, error) {
+	challenge, err := s.parseChallenge(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSetupAllowed(challenge); err != nil {
+		return nil, err
+	}
+	user, err := s.userRepo.FindByID(challenge.userID)
+	if err != nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return s.BeginEnrollment(user)
+}
+
+// ChallengedUser returns the user a challenge token was issued to, for
+// counting second factor attempts against their account.
+func (s *MFAService) ChallengedUser(challengeToken string) (*models.User, error) {
+	challenge, err := s.parseChallenge(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userRepo.FindByID(challenge.userID)
+	if err != nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return user, nil
+}
+
+// VerifyChallenge completes a login with a TOTP code or a recovery code. If
+// the code confirmed a pending enrollment started with SetupWithChallenge, MFA
+// is enabled and the new recovery codes are returned.
+func (s *MFAService) VerifyChallenge(req *models.MFAVerifyRequest) (*models.User, []string, error) {
+	challenge, err := s.parseChallenge(req.ChallengeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	userID, jti := challenge.userID, challenge.jti
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, nil, ErrInvalidMFAChallenge
+	}
+	if err := s.authService.CheckAuthMethod(user, AuthMethodTOTP); err != nil {
+		return nil, nil, err
+	}
+
+	mfa, err := s.mfaRepo.FindByUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var recoveryCodes []string
+	switch {
+	case req.RecoveryCode != "":
+		if mfa == nil || !mfa.Enabled {
+			err = ErrInvalidMFACode
+		} else {
+			err = s.useRecoveryCode(userID, req.RecoveryCode)
+		}
+	case mfa == nil:
+		err = ErrMFAEnrollmentMissing
+	case mfa.Enabled:
+		err = s.checkTOTP(mfa, req.Code)
+	default:
+		if err = s.checkSetupAllowed(challenge); err == nil {
+			recoveryCodes, err = s.enable(mfa, req.Code)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			s.recordFailure(jti)
+		}
+		return nil, nil, err
+	}
+
+	s.markUsed(jti)
+	return user, recoveryCodes, nil
+}
+
+func (s *MFAService) Status(user *models.User) (*models.MFAStatus, error) {
+	status := &models.MFAStatus{}
+	var err error
+	if status.Required, err = s.groupRepo.RequiresMFA(user.UserGroup); err != nil {
+		return nil, err
+	}
+
+	if status.SecurityKeys, err = s.webauthnRepo.CountByUser(user.ID); err != nil {
+		return nil, err
+	}
+
+	mfa, err := s.mfaRepo.FindByUser(user.ID)
+	if err != nil || mfa == nil || !mfa.Enabled {
+		return status, err
+	}
+	status.Enabled = true
+	status.EnabledAt = mfa.EnabledAt
+
+	codes, err := s.mfaRepo.FindUnusedRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	status.RecoveryCodesRemaining = len(codes)
+	return status, nil
+}
+
+// BeginEnrollment generates a new secret. It does nothing until confirmed
+// with Enable, and replaces any earlier unconfirmed secret.
+func (s *MFAService) BeginEnrollment(user *models.User) (*models.TOTPEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.encryption.EncryptWithAAD(secret, totpSecretAAD(user.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := s.mfaRepo.SavePending(user.ID, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return &models.TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totpProvisioningURI(s.issuer, user.Email, secret),
+	}, nil
+}
+
+// Enable confirms a pending enrollment with a code from the app and returns
+// the recovery codes, which are shown only this once.
+func (s *MFAService) Enable(userID int, code string) ([]string, error) {
+	mfa, err := s.mfaRepo.FindByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa == nil {
+		return nil, ErrMFAEnrollmentMissing
+	}
+	if mfa.Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	return s.enable(mfa, code)
+}
+
+// Disable turns TOTP off after checking a current code. Members of groups
+// that require MFA can only do so if they have a security key.
+func (s *MFAService) Disable(user *models.User, code string) error {
+	if err := s.checkCanRemoveFactor(user); err != nil {
+		return err
+	}
+
+	mfa, err := s.mfaRepo.FindByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if mfa == nil || !mfa.Enabled {
+		return ErrMFANotEnabled
+	}
+	if err := s.checkTOTP(mfa, code); err != nil {
+		return err
+	}
+	return s.mfaRepo.Delete(user.ID)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current
+// code.
+func (s *MFAService) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	mfa, err := s.mfaRepo.FindByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa == nil || !mfa.Enabled {
+		return nil, ErrMFANotEnabled
+	}
+	if err := s.checkTOTP(mfa, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Reset removes all of a user's second factors, TOTP and security keys, for
+// an admin helping someone who lost both their device and their recovery
+// codes.
+func (s *MFAService) Reset(userID int) error {
+	if err := s.webauthnRepo.DeleteAllForUser(userID); err != nil {
+		return err
+	}
+	return s.mfaRepo.Delete(userID)
+}
+
+// checkCanRemoveFactor refuses to remove a user's only second factor when
+// their group requires one.
+func (s *MFAService) checkCanRemoveFactor(user *models.User) error {
+	required, err := s.groupRepo.RequiresMFA(user.UserGroup)
+	if err != nil || !required {
+		return err
+	}
+
+	factors, err := s.webauthnRepo.CountByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	mfa, err := s.mfaRepo.FindByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if mfa != nil && mfa.Enabled {
+		factors++
+	}
+	if factors <= 1 {
+		return ErrMFARequiredByGroup
+	}
+	return nil
+}
+
+// checkSetupAllowed lets a login challenge enroll TOTP only if it was issued
+// to a user with no second factor, and they still have none.
+func (s *MFAService) checkSetupAllowed(challenge *mfaChallenge) error {
+	if !challenge.setup {
+		return ErrMFASetupNotAllowed
+	}
+	mfa, err := s.mfaRepo.FindByUser(challenge.userID)
+	if err != nil {
+		return err
+	}
+	if mfa != nil && mfa.Enabled {
+		return ErrMFASetupNotAllowed
+	}
+	securityKeys, err := s.webauthnRepo.CountByUser(challenge.userID)
+	if err != nil {
+		return err
+	}
+	if securityKeys > 0 {
+		return ErrMFASetupNotAllowed
+	}
+	return nil
+}
+
+func (s *MFAService) enable(mfa *models.UserMFA, code string) ([]string, error) {
+	if err := s.checkTOTP(mfa, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.Enable(mfa.UserID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// checkTOTP accepts each code at most once.
+func (s *MFAService) checkTOTP(mfa *models.UserMFA, code string) error {
+	secret, err := s.encryption.DecryptWithAAD(mfa.TOTPSecret, totpSecretAAD(mfa.UserID))
+	if err != nil {
+		return err
+	}
+
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok || step <= mfa.LastUsedStep {
+		return ErrInvalidMFACode
+	}
+	fresh, err := s.mfaRepo.UseStep(mfa.UserID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (s *MFAService) useRecoveryCode(userID int, code string) error {
+	code = normalizeRecoveryCode(code)
+	codes, err := s.mfaRepo.FindUnusedRecoveryCodes(userID)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(candidate.CodeHash), []byte(code)) != nil {
+			continue
+		}
+		used, err := s.mfaRepo.UseRecoveryCode(candidate.ID)
+		if err != nil {
+			return err
+		}
+		if !used {
+			break
+		}
+		return nil
+	}
+	return ErrInvalidMFACode
+}
+
+// mfaChallenge is a parsed login challenge. setup is set when the user had no
+// second factor and may enroll one to finish logging in.
+type mfaChallenge struct {
+	userID int
+	jti    string
+	setup  bool
+}
+
+func (s *MFAService) newChallengeToken(userID int, setup bool) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"purpose": "mfa",
+		"jti":     fmt.Sprintf("%x", jti),
+		"exp":     time.Now().Add(mfaChallengeTTL).Unix(),
+	}
+	if setup {
+		claims["setup"] = true
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(mfaChallengeKey())
+}
+
+// parseChallenge validates a challenge token that is not yet used up.
+func (s *MFAService) parseChallenge(tokenString string) (*mfaChallenge, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return mfaChallengeKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidMFAChallenge
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	userID, _ := claims["user_id"].(float64)
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	setup, _ := claims["setup"].(bool)
+	if claims["purpose"] != "mfa" || userID == 0 || jti == "" {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, a := range s.attempts {
+		if now.After(a.expiresAt) {
+			delete(s.attempts, id)
+		}
+	}
+	a := s.attempts[jti]
+	if a == nil {
+		a = &challengeAttempts{expiresAt: time.Unix(int64(exp), 0)}
+		s.attempts[jti] = a
+	}
+	if a.used || a.failures >= mfaChallengeMaxAttempts {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return &mfaChallenge{userID: int(userID), jti: jti, setup: setup}, nil
+}
+
+func (s *MFAService) recordFailure(jti string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.attempts[jti]; a != nil {
+		a.failures++
+	}
+}
+
+func (s *MFAService) markUsed(jti string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.attempts[jti]; a != nil {
+		a.used = true
+	}
+}
+
+// mfaChallengeKey keeps challenge tokens apart from the WebAuthn and single
+// sign-on flow tokens, whose keys are derived from JWT_SECRET as well. Access
+// tokens are signed with the TokenSigner's keys, so none of these verify as one.
+func mfaChallengeKey() []byte {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte("mfa-challenge"))
+	return mac.Sum(nil)
+}
+
+func totpSecretAAD(userID int) []byte {
+	return []byte(fmt.Sprintf("user_mfa:%d:totp_secret", userID))
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns codes like "k4xq2-mv7pa" and their bcrypt hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))[:10]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestMFAService(t *testing.T) (*MFAService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	auth := testAuthService(t, db)
+	return NewMFAService(repository.NewMFARepository(db), repository.NewWebAuthnRepository(db),
+		repository.NewGroupRepository(db), auth.userRepo, auth, newTestEncryption(t, 1, 1), "Credential Store"), mock
+}
+
+// enrolledTOTP returns a user's enabled TOTP factor and its raw key.
+func enrolledTOTP(t *testing.T, s *MFAService, userID int, lastUsedStep int64) (*models.UserMFA, []byte) {
+	t.Helper()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.encryption.EncryptWithAAD(secret, totpSecretAAD(userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	return &models.UserMFA{UserID: userID, TOTPSecret: sealed, Enabled: true, LastUsedStep: lastUsedStep}, key
+}
+
+func TestCheckTOTPRejectsReplay(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	step := totpStep(time.Now())
+	mfa, key := enrolledTOTP(t, s, 3, step-5)
+	code := totpCode(key, step)
+
+	mock.ExpectExec("UPDATE user_mfa SET last_used_step").WithArgs(step, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.checkTOTP(mfa, code); err != nil {
+		t.Fatalf("checkTOTP: %v", err)
+	}
+
+	// The same code, or an older one still inside the skew window, is refused
+	// once its step was used, without asking the database
+	mfa.LastUsedStep = step
+	if err := s.checkTOTP(mfa, code); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("checkTOTP(replayed) = %v, want ErrInvalidMFACode", err)
+	}
+	if err := s.checkTOTP(mfa, totpCode(key, step-1)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("checkTOTP(older step) = %v, want ErrInvalidMFACode", err)
+	}
+
+	// A concurrent login that used the step first wins
+	mfa.LastUsedStep = step - 5
+	mock.ExpectExec("UPDATE user_mfa SET last_used_step").WithArgs(step, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.checkTOTP(mfa, code); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("checkTOTP(raced) = %v, want ErrInvalidMFACode", err)
+	}
+
+	if err := s.checkTOTP(mfa, totpCode(key, step+3)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("checkTOTP(future code) = %v, want ErrInvalidMFACode", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckTOTPSecretBoundToUser(t *testing.T) {
+	s, _ := newTestMFAService(t)
+	mfa, key := enrolledTOTP(t, s, 3, 0)
+
+	// A secret copied onto another user's row doesn't decrypt
+	mfa.UserID = 4
+	if err := s.checkTOTP(mfa, totpCode(key, totpStep(time.Now()))); err == nil {
+		t.Fatal("checkTOTP accepted a secret moved to another user")
+	}
+}
+
+var mfaColumns = []string{"user_id", "totp_secret", "enabled", "enabled_at", "last_used_step"}
+
+// expectFactors answers the lookups of a user's TOTP factor, which may be
+// nil, and security key count.
+func expectFactors(mock sqlmock.Sqlmock, userID int, mfa *models.UserMFA, securityKeys int) {
+	rows := sqlmock.NewRows(mfaColumns)
+	if mfa != nil {
+		rows.AddRow(mfa.UserID, mfa.TOTPSecret, mfa.Enabled, mfa.EnabledAt, mfa.LastUsedStep)
+	}
+	mock.ExpectQuery("FROM user_mfa WHERE user_id").WithArgs(userID).WillReturnRows(rows)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM webauthn_credentials").WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(securityKeys))
+}
+
+// challengeFor runs the password login's MFA step for a member of a group
+// that requires MFA.
+func challengeFor(t *testing.T, s *MFAService, mock sqlmock.Sqlmock, user *models.User, mfa *models.UserMFA, securityKeys int) *models.MFAChallenge {
+	t.Helper()
+	expectFactors(mock, user.ID, mfa, securityKeys)
+	mock.ExpectQuery("SELECT require_mfa FROM groups").WithArgs(user.UserGroup).
+		WillReturnRows(sqlmock.NewRows([]string{"require_mfa"}).AddRow(true))
+	challenge, err := s.Challenge(user)
+	if err != nil || challenge == nil {
+		t.Fatalf("Challenge = %+v, %v", challenge, err)
+	}
+	return challenge
+}
+
+func TestMFASetupDuringLoginWithoutFactors(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	user := testUser(3, "alice@example.com")
+
+	challenge := challengeFor(t, s, mock, user, nil, 0)
+	if !challenge.MFASetupRequired || len(challenge.Methods) != 0 {
+		t.Fatalf("challenge = %+v, want setup required", challenge)
+	}
+
+	expectFactors(mock, 3, nil, 0)
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(user))
+	sealed := &captureArg{}
+	mock.ExpectExec("INSERT INTO user_mfa").WithArgs(3, sealed).WillReturnResult(sqlmock.NewResult(0, 1))
+	enrollment, err := s.SetupWithChallenge(challenge.ChallengeToken)
+	if err != nil {
+		t.Fatalf("SetupWithChallenge: %v", err)
+	}
+
+	// The first code enables TOTP and finishes the login
+	pending := &models.UserMFA{UserID: 3, TOTPSecret: sealed.value.(string), LastUsedStep: 0}
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := totpStep(time.Now())
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(user))
+	mock.ExpectQuery("FROM user_mfa WHERE user_id").WithArgs(3).WillReturnRows(sqlmock.NewRows(mfaColumns).
+		AddRow(3, pending.TOTPSecret, false, nil, 0))
+	expectFactors(mock, 3, pending, 0)
+	mock.ExpectExec("UPDATE user_mfa SET last_used_step").WithArgs(step, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_mfa SET enabled = TRUE").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM mfa_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec("INSERT INTO mfa_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	got, codes, err := s.VerifyChallenge(&models.MFAVerifyRequest{ChallengeToken: challenge.ChallengeToken,
+		Code: totpCode(key, step)})
+	if err != nil || got.ID != 3 || len(codes) != recoveryCodeCount {
+		t.Fatalf("VerifyChallenge = %v, %d codes, %v", got, len(codes), err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFASetupRefusedWhenUserHasFactor(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	user := testUser(3, "alice@example.com")
+	totp, _ := enrolledTOTP(t, s, 3, 0)
+
+	cases := []struct {
+		name         string
+		mfa          *models.UserMFA
+		securityKeys int
+	}{
+		{"totp", totp, 0},
+		{"security key", nil, 1},
+		{"both", totp, 2},
+	}
+	for _, tc := range cases {
+		challenge := challengeFor(t, s, mock, user, tc.mfa, tc.securityKeys)
+		if challenge.MFASetupRequired {
+			t.Fatalf("%s: challenge asks for setup", tc.name)
+		}
+
+		// Only a password got the caller here, which must not be enough to
+		// swap in a TOTP secret of their own
+		if _, err := s.SetupWithChallenge(challenge.ChallengeToken); !errors.Is(err, ErrMFASetupNotAllowed) {
+			t.Errorf("%s: SetupWithChallenge = %v, want ErrMFASetupNotAllowed", tc.name, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFASetupRefusedAfterFactorAdded(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	user := testUser(3, "alice@example.com")
+
+	// A security key registered after the setup challenge was issued
+	challenge := challengeFor(t, s, mock, user, nil, 0)
+	expectFactors(mock, 3, nil, 1)
+	if _, err := s.SetupWithChallenge(challenge.ChallengeToken); !errors.Is(err, ErrMFASetupNotAllowed) {
+		t.Errorf("SetupWithChallenge = %v, want ErrMFASetupNotAllowed", err)
+	}
+
+	// TOTP enabled since then
+	challenge = challengeFor(t, s, mock, user, nil, 0)
+	totp, _ := enrolledTOTP(t, s, 3, 0)
+	mock.ExpectQuery("FROM user_mfa WHERE user_id").WithArgs(3).WillReturnRows(sqlmock.NewRows(mfaColumns).
+		AddRow(3, totp.TOTPSecret, true, time.Now(), 0))
+	if _, err := s.SetupWithChallenge(challenge.ChallengeToken); !errors.Is(err, ErrMFASetupNotAllowed) {
+		t.Errorf("SetupWithChallenge = %v, want ErrMFASetupNotAllowed", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFAVerifyDoesNotEnableWithoutSetupChallenge(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	user := testUser(3, "alice@example.com")
+
+	// A user with only a security key, and a TOTP secret left pending by an
+	// enrollment they never finished, or one an attacker planted
+	challenge := challengeFor(t, s, mock, user, nil, 1)
+	pending, key := enrolledTOTP(t, s, 3, 0)
+	pending.Enabled = false
+
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(user))
+	mock.ExpectQuery("FROM user_mfa WHERE user_id").WithArgs(3).WillReturnRows(sqlmock.NewRows(mfaColumns).
+		AddRow(3, pending.TOTPSecret, false, nil, 0))
+	_, _, err := s.VerifyChallenge(&models.MFAVerifyRequest{ChallengeToken: challenge.ChallengeToken,
+		Code: totpCode(key, totpStep(time.Now()))})
+	if !errors.Is(err, ErrMFASetupNotAllowed) {
+		t.Fatalf("VerifyChallenge = %v, want ErrMFASetupNotAllowed", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMFAChallengeTokenRejectsForgedSetupClaim(t *testing.T) {
+	s, _ := newTestMFAService(t)
+	token, err := s.newChallengeToken(3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flipping the claim breaks the signature
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), `"purpose"`, `"setup":true,"purpose"`, 1))
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := s.parseChallenge(strings.Join(parts, ".")); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("parseChallenge(forged) = %v, want ErrInvalidMFAChallenge", err)
+	}
+
+	challenge, err := s.parseChallenge(token)
+	if err != nil || challenge.userID != 3 || challenge.setup {
+		t.Fatalf("parseChallenge = %+v, %v", challenge, err)
+	}
+}
+
+func TestMFAChallengedUser(t *testing.T) {
+	s, mock := newTestMFAService(t)
+	user := testUser(3, "alice@example.com")
+	challenge := challengeFor(t, s, mock, user, nil, 1)
+
+	// Looking the user up doesn't use up an attempt of the challenge
+	for i := 0; i < mfaChallengeMaxAttempts+1; i++ {
+		mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(user))
+		if got, err := s.ChallengedUser(challenge.ChallengeToken); err != nil || got.Email != user.Email {
+			t.Fatalf("ChallengedUser = %v, %v", got, err)
+		}
+	}
+
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows())
+	if _, err := s.ChallengedUser(challenge.ChallengeToken); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("ChallengedUser(deleted user) = %v, want ErrInvalidMFAChallenge", err)
+	}
+	if _, err := s.ChallengedUser("not-a-token"); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("ChallengedUser(garbage) = %v, want ErrInvalidMFAChallenge", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
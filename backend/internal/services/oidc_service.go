@@ -0,0 +1,523 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrOIDCFlow       = errors.New("invalid or expired single sign-on request; start again")
+	ErrOIDCFailed     = errors.New("single sign-on failed")
+	ErrOIDCUnverified = errors.New("the identity provider has not verified your email address")
+)
+
+// AuthSourceOIDC marks users provisioned through OpenID Connect.
+const AuthSourceOIDC = "oidc"
+
+const (
+	oidcFlowTTL       = 10 * time.Minute
+	oidcJWKSMinReload = time.Minute
+)
+
+// OIDCConfig describes the identity provider and how its users map to ours.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the frontend page the provider sends the browser back
+	// to; it must be registered with the provider
+	RedirectURL string
+	Scopes      []string
+	// Name is shown on the login button
+	Name        string
+	GroupsClaim string
+	// The first mapping whose claim the user has wins; users without any get
+	// DefaultGroup, or are refused if it is empty
+	GroupMappings []GroupMapping
+	DefaultGroup  string
+	// RequireVerifiedEmail refuses ID tokens without email_verified=true
+	RequireVerifiedEmail bool
+	Client               *http.Client
+}
+
+// NewOIDCConfigFromEnv reads the OIDC_* settings. It returns nil when
+// OIDC_ISSUER is unset, which turns single sign-on off.
+//
+//	OIDC_ISSUER             provider URL, as in its discovery document
+//	OIDC_CLIENT_ID          client registered with the provider
+//	OIDC_CLIENT_SECRET      its secret, if it is a confidential client
+//	OIDC_REDIRECT_URL       frontend callback page (default http://localhost:5173/login/oidc)
+//	OIDC_SCOPES             extra scopes besides openid (default "email profile")
+//	OIDC_PROVIDER_NAME      shown on the login button (default "Single Sign-On")
+//	OIDC_GROUPS_CLAIM       claim listing the user's groups (default "groups")
+//	OIDC_GROUP_MAPPING      comma separated "claim-value=user_group" pairs
+//	OIDC_DEFAULT_GROUP      group for users no mapping matches (default: refuse them)
+//	OIDC_ALLOW_UNVERIFIED_EMAIL=true  accept emails the provider has not verified
+func NewOIDCConfigFromEnv() (*OIDCConfig, error) {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	mappings, err := parseGroupMappings(os.Getenv("OIDC_GROUP_MAPPING"))
+	if err != nil {
+		return nil, fmt.Errorf("OIDC_GROUP_MAPPING: %w", err)
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range strings.Fields(envOr("OIDC_SCOPES", "email profile")) {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return &OIDCConfig{
+		Issuer:               issuer,
+		ClientID:             clientID,
+		ClientSecret:         os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:          envOr("OIDC_REDIRECT_URL", "http://localhost:5173/login/oidc"),
+		Scopes:               scopes,
+		Name:                 envOr("OIDC_PROVIDER_NAME", "Single Sign-On"),
+		GroupsClaim:          envOr("OIDC_GROUPS_CLAIM", "groups"),
+		GroupMappings:        mappings,
+		DefaultGroup:         os.Getenv("OIDC_DEFAULT_GROUP"),
+		RequireVerifiedEmail: os.Getenv("OIDC_ALLOW_UNVERIFIED_EMAIL") != "true",
+		Client:               &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// OIDCService logs users in with the OpenID Connect authorization code flow
+// and PKCE. The browser is sent to the provider with a fresh state, nonce and
+// code challenge; their secrets travel back to the frontend in a flow token
+// signed with a key derived from JWT_SECRET, which must accompany the code.
+// The code is exchanged from here, and the ID token's signature (from the
+// provider's JWKS), issuer, audience, expiry and nonce are checked before its
+// claims are trusted.
+type OIDCService struct {
+	cfg         *OIDCConfig
+	authService *AuthService
+
+	mu         sync.Mutex
+	discovery  *oidcDiscovery
+	keys       map[string]interface{}
+	keysLoaded time.Time
+	used       map[string]time.Time
+}
+
+func NewOIDCService(cfg *OIDCConfig, authService *AuthService) *OIDCService {
+	return &OIDCService{
+		cfg:         cfg,
+		authService: authService,
+		used:        make(map[string]time.Time),
+	}
+}
+
+type oidcDiscovery struct {
+	Issuer                 string   `json:"issuer"`
+	AuthorizationEndpoint  string   `json:"authorization_endpoint"`
+	TokenEndpoint          string   `json:"token_endpoint"`
+	JWKSURI                string   `json:"jwks_uri"`
+	TokenEndpointAuthModes []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcFlowClaims struct {
+	Purpose  string `json:"purpose"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func (s *OIDCService) Name() string {
+	return s.cfg.Name
+}
+
+// Begin returns the provider URL to send the browser to, and the flow token
+// the frontend keeps until the provider redirects back.
+func (s *OIDCService) Begin() (*models.OIDCBeginResponse, error) {
+	discovery, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		b, err := randomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		secrets[i] = base64URL.EncodeToString(b)
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	claims := oidcFlowClaims{
+		Purpose:  "oidc",
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcFlowTTL)),
+		},
+	}
+	flowToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(oidcFlowKey())
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.cfg.ClientID},
+		"redirect_uri":          {s.cfg.RedirectURL},
+		"scope":                 {strings.Join(s.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64URL.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return nil, oidcFailure("authorization endpoint", err)
+	}
+	query := authURL.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	authURL.RawQuery = query.Encode()
+
+	return &models.OIDCBeginResponse{
+		AuthorizationURL: authURL.String(),
+		FlowToken:        flowToken,
+		ExpiresIn:        int(oidcFlowTTL.Seconds()),
+	}, nil
+}
+
+// Complete redeems the code the provider redirected back with and returns
+// the user its ID token identifies, provisioning them on first login. The
+// account change, if any, is returned as with ProvisionExternalUser.
+func (s *OIDCService) Complete(req *models.OIDCCallbackRequest) (*models.User, string, error) {
+	flow, err := s.parseFlow(req.FlowToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if !hmac.Equal([]byte(flow.State), []byte(req.State)) {
+		return nil, "", ErrOIDCFlow
+	}
+	if !s.markFlowUsed(flow) {
+		return nil, "", ErrOIDCFlow
+	}
+
+	rawIDToken, err := s.exchangeCode(req.Code, flow.Verifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := s.verifyIDToken(rawIDToken, flow.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	identity, err := s.identity(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	user, change, err := s.authService.ProvisionExternalUser(identity)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkAccount(user); err != nil {
+		return nil, "", err
+	}
+	return user, change, nil
+}
+
+// identity maps verified ID token claims to a user and group.
+func (s *OIDCService) identity(claims jwt.MapClaims) (*models.ExternalIdentity, error) {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if subject == "" || email == "" {
+		return nil, oidcFailure("ID token", errors.New("sub or email claim missing"))
+	}
+	if s.cfg.RequireVerifiedEmail && !claimTrue(claims["email_verified"]) {
+		return nil, ErrOIDCUnverified
+	}
+
+	groups := make(map[string]bool)
+	switch value := claims[s.cfg.GroupsClaim].(type) {
+	case string:
+		groups[value] = true
+	case []interface{}:
+		for _, item := range value {
+			if name, ok := item.(string); ok {
+				groups[name] = true
+			}
+		}
+	}
+	userGroup := mapGroup(s.cfg.GroupMappings, groups, s.cfg.DefaultGroup)
+	if userGroup == "" {
+		return nil, ErrNoMappedGroup
+	}
+
+	return &models.ExternalIdentity{
+		Source:     AuthSourceOIDC,
+		ExternalID: subject,
+		Email:      email,
+		UserGroup:  userGroup,
+	}, nil
+}
+
+func (s *OIDCService) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := s.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	// client_secret_basic is the default; use client_secret_post only for
+	// providers that don't offer basic
+	useBasic := s.cfg.ClientSecret != ""
+	if useBasic && len(discovery.TokenEndpointAuthModes) > 0 && !containsString(discovery.TokenEndpointAuthModes, "client_secret_basic") {
+		useBasic = false
+		form.Set("client_secret", s.cfg.ClientSecret)
+	}
+	if !useBasic {
+		form.Set("client_id", s.cfg.ClientID)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	if useBasic {
+		httpReq.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	status, err := s.doJSON(httpReq, &tokens)
+	if err != nil {
+		return "", oidcFailure("token exchange", err)
+	}
+	if status != http.StatusOK || tokens.IDToken == "" {
+		return "", oidcFailure("token exchange", fmt.Errorf("status %d %s", status, tokens.Error))
+	}
+	return tokens.IDToken, nil
+}
+
+func (s *OIDCService) verifyIDToken(raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.signingKey(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, oidcFailure("ID token", err)
+	}
+
+	// With several audiences, the token must have been issued to us
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != s.cfg.ClientID {
+			return nil, oidcFailure("ID token", errors.New("authorized party mismatch"))
+		}
+	}
+	got, _ := claims["nonce"].(string)
+	if !hmac.Equal([]byte(got), []byte(nonce)) {
+		return nil, oidcFailure("ID token", errors.New("nonce mismatch"))
+	}
+	return claims, nil
+}
+
+// signingKey finds a provider key by id, reloading the JWKS when the id is
+// new, as providers rotate keys.
+func (s *OIDCService) signingKey(kid string) (interface{}, error) {
+	s.mu.Lock()
+	keys, loaded := s.keys, s.keysLoaded
+	s.mu.Unlock()
+
+	if key := pickJWK(keys, kid); key != nil {
+		return key, nil
+	}
+	if time.Since(loaded) < oidcJWKSMinReload {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	discovery, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set jwkSet
+	status, err := s.doJSON(httpReq, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("JWKS: status %d", status)
+	}
+	keys = set.publicKeys()
+
+	s.mu.Lock()
+	s.keys, s.keysLoaded = keys, time.Now()
+	s.mu.Unlock()
+
+	if key := pickJWK(keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// discover fetches the provider's metadata once; failures are retried on the
+// next login.
+func (s *OIDCService) discover() (*oidcDiscovery, error) {
+	s.mu.Lock()
+	discovery := s.discovery
+	s.mu.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	httpReq, err := http.NewRequest(http.MethodGet, s.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery = &oidcDiscovery{}
+	status, err := s.doJSON(httpReq, discovery)
+	if err != nil {
+		return nil, oidcFailure("discovery", err)
+	}
+	if status != http.StatusOK {
+		return nil, oidcFailure("discovery", fmt.Errorf("status %d", status))
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != s.cfg.Issuer {
+		return nil, oidcFailure("discovery", fmt.Errorf("issuer %q does not match OIDC_ISSUER", discovery.Issuer))
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, oidcFailure("discovery", errors.New("endpoints missing"))
+	}
+
+	s.mu.Lock()
+	s.discovery = discovery
+	s.mu.Unlock()
+	return discovery, nil
+}
+
+func (s *OIDCService) doJSON(req *http.Request, out interface{}) (int, error) {
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, out); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *OIDCService) parseFlow(tokenString string) (*oidcFlowClaims, error) {
+	claims := &oidcFlowClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return oidcFlowKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid || claims.Purpose != "oidc" || claims.ExpiresAt == nil {
+		return nil, ErrOIDCFlow
+	}
+	return claims, nil
+}
+
+// markFlowUsed returns false for a flow that was already completed, so a
+// code can't be replayed through it.
+func (s *OIDCService) markFlowUsed(flow *oidcFlowClaims) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for state, expiresAt := range s.used {
+		if now.After(expiresAt) {
+			delete(s.used, state)
+		}
+	}
+	if _, done := s.used[flow.State]; done {
+		return false
+	}
+	s.used[flow.State] = flow.ExpiresAt.Time
+	return true
+}
+
+// oidcFailure logs why a login failed; the client only learns that it did.
+func oidcFailure(stage string, err error) error {
+	log.Printf("OIDC %s failed: %v", stage, err)
+	return ErrOIDCFailed
+}
+
+func oidcFlowKey() []byte {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte("oidc-flow"))
+	return mac.Sum(nil)
+}
+
+// claimTrue accepts true and "true"; some providers send booleans as strings.
+func claimTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,397 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testOIDCClientID = "credential-store"
+
+// mockOIDCProvider is an identity provider with discovery, a JWKS and a
+// token endpoint that checks PKCE like a real one. idToken shapes the claims
+// of the ID token it issues for the pending login.
+type mockOIDCProvider struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	issuer    string
+	code      string
+	challenge string
+	nonce     string
+	idToken   func(claims jwt.MapClaims)
+	signWith  *rsa.PrivateKey
+	exchanges int
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{newJWK(&key.PublicKey, "RS256", "key-1")}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	p.issuer = p.URL
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exchanges++
+
+	fail := func(reason string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": reason})
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testOIDCClientID || secret != "client-secret" {
+		fail("invalid_client")
+		return
+	}
+	r.ParseForm()
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != p.code ||
+		r.PostForm.Get("redirect_uri") != "https://vault.example.com/login/oidc" ||
+		base64URL.EncodeToString(verifier[:]) != p.challenge {
+		fail("invalid_grant")
+		return
+	}
+	p.code = "" // codes work once
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"aud":            testOIDCClientID,
+		"sub":            "sub-1",
+		"email":          "bob@example.com",
+		"email_verified": true,
+		"nonce":          p.nonce,
+		"groups":         []string{"staff", "vault-admins"},
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+	if p.idToken != nil {
+		p.idToken(claims)
+	}
+	signWith := p.key
+	if p.signWith != nil {
+		signWith = p.signWith
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(signWith)
+	if err != nil {
+		p.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// authorize plays the user logging in at the provider: it takes the request
+// the browser was sent with and returns the callback the frontend gets.
+func (p *mockOIDCProvider) authorize(begin *models.OIDCBeginResponse) *models.OIDCCallbackRequest {
+	p.t.Helper()
+	u, err := url.Parse(begin.AuthorizationURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != testOIDCClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid email profile" {
+		p.t.Fatalf("authorization request %s", u)
+	}
+
+	code, _ := randomBytes(16)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.code = base64URL.EncodeToString(code)
+	p.challenge = q.Get("code_challenge")
+	p.nonce = q.Get("nonce")
+	return &models.OIDCCallbackRequest{FlowToken: begin.FlowToken, State: q.Get("state"), Code: p.code}
+}
+
+func newTestOIDCService(t *testing.T, p *mockOIDCProvider) (*OIDCService, sqlmock.Sqlmock) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	auth, mock := newTestAuthService(t)
+	return NewOIDCService(&OIDCConfig{
+		Issuer:       p.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://vault.example.com/login/oidc",
+		Scopes:       []string{"openid", "email", "profile"},
+		GroupsClaim:  "groups",
+		GroupMappings: []GroupMapping{
+			{External: "vault-admins", UserGroup: "admin"},
+			{External: "staff", UserGroup: "junior"},
+		},
+		RequireVerifiedEmail: true,
+		Client:               p.Client(),
+	}, auth), mock
+}
+
+// login runs a whole single sign-on login.
+func login(t *testing.T, s *OIDCService, p *mockOIDCProvider) (*models.User, string, error) {
+	t.Helper()
+	begin, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	return s.Complete(p.authorize(begin))
+}
+
+func expectNewOIDCUser(mock sqlmock.Sqlmock, email, group string) {
+	role := "user"
+	if group == "admin" {
+		role = "admin"
+	}
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WithArgs(AuthSourceOIDC, "sub-1").
+		WillReturnRows(userRows())
+	mock.ExpectQuery("FROM users WHERE email").WithArgs(email).WillReturnRows(userRows())
+	mock.ExpectQuery("INSERT INTO users").WithArgs(email, "", role, group, AuthSourceOIDC, "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "status"}).AddRow(9, time.Now(), UserActive))
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, mock := newTestOIDCService(t, p)
+
+	expectNewOIDCUser(mock, "bob@example.com", "admin")
+	user, change, err := login(t, s, p)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if user.ID != 9 || user.Role != "admin" || user.AuthSource != AuthSourceOIDC || change != "user.create" {
+		t.Fatalf("login = %+v, %q", user, change)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCFlowTokenChecks(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, mock := newTestOIDCService(t, p)
+
+	begin, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := p.authorize(begin)
+
+	wrongState := *callback
+	wrongState.State = "attacker-state"
+	if _, _, err := s.Complete(&wrongState); !errors.Is(err, ErrOIDCFlow) {
+		t.Errorf("Complete(wrong state) = %v, want ErrOIDCFlow", err)
+	}
+	forged := *callback
+	forged.FlowToken = begin.FlowToken[:len(begin.FlowToken)-2] + "xx"
+	if _, _, err := s.Complete(&forged); !errors.Is(err, ErrOIDCFlow) {
+		t.Errorf("Complete(forged flow token) = %v, want ErrOIDCFlow", err)
+	}
+
+	expectNewOIDCUser(mock, "bob@example.com", "admin")
+	if _, _, err := s.Complete(callback); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if _, _, err := s.Complete(callback); !errors.Is(err, ErrOIDCFlow) {
+		t.Errorf("Complete(replayed) = %v, want ErrOIDCFlow", err)
+	}
+	if p.exchanges != 1 {
+		t.Errorf("%d code exchanges, want 1", p.exchanges)
+	}
+}
+
+func TestOIDCCodeExchangeUsesPKCE(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, _ := newTestOIDCService(t, p)
+
+	// A code issued for one login can't be redeemed through another: that
+	// flow token carries a different verifier, which the provider refuses
+	victim, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen := p.authorize(victim)
+	attacker, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(attacker.AuthorizationURL)
+	req := &models.OIDCCallbackRequest{FlowToken: attacker.FlowToken, State: u.Query().Get("state"), Code: stolen.Code}
+	if _, _, err := s.Complete(req); !errors.Is(err, ErrOIDCFailed) {
+		t.Fatalf("Complete(code for another verifier) = %v, want ErrOIDCFailed", err)
+	}
+	if p.exchanges != 1 {
+		t.Errorf("%d code exchanges, want 1", p.exchanges)
+	}
+}
+
+func TestOIDCIDTokenChecks(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]func(p *mockOIDCProvider, claims jwt.MapClaims){
+		"nonce mismatch": func(p *mockOIDCProvider, c jwt.MapClaims) { c["nonce"] = "replayed-nonce" },
+		"no nonce":       func(p *mockOIDCProvider, c jwt.MapClaims) { delete(c, "nonce") },
+		"other audience": func(p *mockOIDCProvider, c jwt.MapClaims) { c["aud"] = "another-client" },
+		"several audiences, no azp": func(p *mockOIDCProvider, c jwt.MapClaims) {
+			c["aud"] = []string{testOIDCClientID, "another-client"}
+		},
+		"several audiences, other azp": func(p *mockOIDCProvider, c jwt.MapClaims) {
+			c["aud"] = []string{testOIDCClientID, "another-client"}
+			c["azp"] = "another-client"
+		},
+		"other issuer":         func(p *mockOIDCProvider, c jwt.MapClaims) { c["iss"] = "https://evil.example" },
+		"expired":              func(p *mockOIDCProvider, c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":            func(p *mockOIDCProvider, c jwt.MapClaims) { delete(c, "exp") },
+		"issued in the future": func(p *mockOIDCProvider, c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+		"unknown key":          func(p *mockOIDCProvider, c jwt.MapClaims) { p.signWith = otherKey },
+		"no email":             func(p *mockOIDCProvider, c jwt.MapClaims) { delete(c, "email") },
+	}
+	for name, mutate := range cases {
+		p := newMockOIDCProvider(t)
+		s, mock := newTestOIDCService(t, p)
+		p.idToken = func(claims jwt.MapClaims) { mutate(p, claims) }
+		if _, _, err := login(t, s, p); !errors.Is(err, ErrOIDCFailed) {
+			t.Errorf("%s: login = %v, want ErrOIDCFailed", name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// An ID token for several audiences is fine when it names us as azp
+	p := newMockOIDCProvider(t)
+	s, mock := newTestOIDCService(t, p)
+	p.idToken = func(c jwt.MapClaims) {
+		c["aud"] = []string{testOIDCClientID, "another-client"}
+		c["azp"] = testOIDCClientID
+	}
+	expectNewOIDCUser(mock, "bob@example.com", "admin")
+	if _, _, err := login(t, s, p); err != nil {
+		t.Errorf("login(azp is us) = %v", err)
+	}
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, mock := newTestOIDCService(t, p)
+	p.idToken = func(c jwt.MapClaims) { c["email_verified"] = false }
+	if _, _, err := login(t, s, p); !errors.Is(err, ErrOIDCUnverified) {
+		t.Fatalf("login = %v, want ErrOIDCUnverified", err)
+	}
+
+	// Some providers send the flag as a string
+	p.idToken = func(c jwt.MapClaims) { c["email_verified"] = "true" }
+	expectNewOIDCUser(mock, "bob@example.com", "admin")
+	if _, _, err := login(t, s, p); err != nil {
+		t.Fatalf("login(string flag) = %v", err)
+	}
+}
+
+func TestOIDCGroupMapping(t *testing.T) {
+	cases := []struct {
+		name   string
+		groups interface{}
+		def    string
+		want   string
+	}{
+		{"first mapping wins", []string{"staff", "vault-admins"}, "", "admin"},
+		{"later mapping", []string{"contractors", "staff"}, "", "junior"},
+		{"single string claim", "staff", "", "junior"},
+		{"default group", []string{"contractors"}, "readonly", "readonly"},
+		{"no claim, default group", nil, "readonly", "readonly"},
+		{"no mapped group", []string{"contractors"}, "", ""},
+	}
+	for _, tc := range cases {
+		p := newMockOIDCProvider(t)
+		s, mock := newTestOIDCService(t, p)
+		s.cfg.DefaultGroup = tc.def
+		p.idToken = func(c jwt.MapClaims) {
+			if tc.groups == nil {
+				delete(c, "groups")
+			} else {
+				c["groups"] = tc.groups
+			}
+		}
+
+		if tc.want == "" {
+			if _, _, err := login(t, s, p); !errors.Is(err, ErrNoMappedGroup) {
+				t.Errorf("%s: login = %v, want ErrNoMappedGroup", tc.name, err)
+			}
+			continue
+		}
+		expectNewOIDCUser(mock, "bob@example.com", tc.want)
+		user, _, err := login(t, s, p)
+		if err != nil || user.UserGroup != tc.want {
+			t.Errorf("%s: login = %+v, %v; want group %s", tc.name, user, err, tc.want)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestOIDCRefusesLocalAccountTakeover(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, mock := newTestOIDCService(t, p)
+
+	admin := testUser(1, "bob@example.com")
+	admin.Role, admin.UserGroup, admin.Password = "admin", "admin", "$2a$10$hash"
+	mock.ExpectQuery("WHERE auth_source = \\$1 AND external_id = \\$2").WillReturnRows(userRows())
+	mock.ExpectQuery("FROM users WHERE email").WithArgs("bob@example.com").WillReturnRows(userRows(admin))
+	if _, _, err := login(t, s, p); !errors.Is(err, ErrLocalAccountConflict) {
+		t.Fatalf("login = %v, want ErrLocalAccountConflict", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCDiscoveryChecksIssuer(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s, _ := newTestOIDCService(t, p)
+	p.issuer = "https://evil.example"
+	if _, err := s.Begin(); !errors.Is(err, ErrOIDCFailed) {
+		t.Fatalf("Begin = %v, want ErrOIDCFailed", err)
+	}
+
+	// A failed discovery is retried on the next login
+	p.issuer = p.URL
+	if _, err := s.Begin(); err != nil {
+		t.Fatalf("Begin after the provider recovered: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bufio"
+	"credential-store/internal/models"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Codes of password policy violations.
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordCharacterClasses = "character_classes"
+	PasswordTooWeak          = "too_weak"
+	PasswordBreached         = "breached"
+	PasswordRecentlyUsed     = "recently_used"
+)
+
+// bcrypt refuses longer passwords.
+const passwordMaxBytes = 72
+
+// PasswordPolicyError lists every rule a new password breaks.
+type PasswordPolicyError struct {
+	Violations []models.PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// PasswordRules configures PasswordPolicy; zero turns a rule off.
+type PasswordRules struct {
+	MinLength int
+	// Of lowercase, uppercase, digits and symbols
+	MinCharacterClasses int
+	// zxcvbn-style score from 0 to 4
+	MinStrength int
+	// New passwords may not be any of the user's last History passwords
+	History int
+}
+
+// PasswordPolicy checks new passwords. Passwords on the breached list, or
+// among the common passwords built in, are refused regardless of the rules.
+type PasswordPolicy struct {
+	rules      PasswordRules
+	dictionary map[string]int
+	breached   map[[sha1.Size]byte]bool
+}
+
+// NewPasswordPolicy loads the breached password list from breachedListFile,
+// if set: one password per line, or the SHA-1 of one in hex, optionally
+// followed by ":count" as in the Have I Been Pwned downloads.
+func NewPasswordPolicy(rules PasswordRules, breachedListFile string) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{
+		rules:      rules,
+		dictionary: make(map[string]int, len(commonPasswords)),
+		breached:   make(map[[sha1.Size]byte]bool),
+	}
+	for i, password := range commonPasswords {
+		p.dictionary[password] = i + 1
+		p.breached[sha1.Sum([]byte(password))] = true
+	}
+	if breachedListFile == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(breachedListFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if hash, ok := parseSHA1Line(line); ok {
+			p.breached[hash] = true
+		} else {
+			p.breached[sha1.Sum([]byte(line))] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", breachedListFile, err)
+	}
+	return p, nil
+}
+
+// Rules describes the policy to users choosing a password.
+func (p *PasswordPolicy) Rules() models.PasswordPolicyInfo {
+	return models.PasswordPolicyInfo{
+		MinLength:           p.rules.MinLength,
+		MaxBytes:            passwordMaxBytes,
+		MinCharacterClasses: p.rules.MinCharacterClasses,
+		MinStrength:         p.rules.MinStrength,
+		History:             p.rules.History,
+	}
+}
+
+// History is how many of a user's recent passwords may not be reused.
+func (p *PasswordPolicy) History() int {
+	return p.rules.History
+}
+
+// Check returns the rules password breaks, leaving out reuse, which takes the
+// user's history. userInputs are details of the user, like the email, that
+// make a password easier to guess.
+func (p *PasswordPolicy) Check(password string, userInputs ...string) []models.PasswordViolation {
+	var violations []models.PasswordViolation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, models.PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len([]rune(password)) < p.rules.MinLength {
+		add(PasswordTooShort, "must be at least %d characters long", p.rules.MinLength)
+	}
+	if len(password) > passwordMaxBytes {
+		add(PasswordTooLong, "must be at most %d bytes long", passwordMaxBytes)
+		return violations
+	}
+	if classes := characterClasses(password); classes < p.rules.MinCharacterClasses {
+		add(PasswordCharacterClasses,
+			"must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.rules.MinCharacterClasses)
+	}
+	if p.breached[sha1.Sum([]byte(password))] {
+		add(PasswordBreached, "appears in a list of breached passwords")
+	} else if p.rules.MinStrength > 0 {
+		if score := passwordStrength(password, p.dictionary, userInputs); score < p.rules.MinStrength {
+			add(PasswordTooWeak, "is too easy to guess (strength %d of 4, at least %d needed); "+
+				"use more words or characters and avoid common patterns", score, p.rules.MinStrength)
+		}
+	}
+	return violations
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+func parseSHA1Line(line string) ([sha1.Size]byte, bool) {
+	var hash [sha1.Size]byte
+	if i := strings.IndexByte(line, ':'); i == 2*sha1.Size {
+		line = line[:i]
+	}
+	if len(line) != 2*sha1.Size {
+		return hash, false
+	}
+	if _, err := hex.Decode(hash[:], []byte(line)); err != nil {
+		return hash, false
+	}
+	return hash, true
+}
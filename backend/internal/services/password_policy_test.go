@@ -0,0 +1,170 @@
+package services
+
+import (
+	"credential-store/internal/repository"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func violationCodes(t *testing.T, p *PasswordPolicy, password string, userInputs ...string) []string {
+	t.Helper()
+	var codes []string
+	for _, v := range p.Check(password, userInputs...) {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	p, err := NewPasswordPolicy(PasswordRules{MinLength: 12, MinCharacterClasses: 3, MinStrength: 3}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"strong", "kX9#mQ2$vL7!pR4w", nil},
+		{"long passphrase", "Correct horse battery staple", nil},
+		{"short", "kX9#mQ2$vL", []string{PasswordTooShort}},
+		// Length counts characters, not bytes
+		{"multibyte", "Zoë-ünïcødé-9", nil},
+		{"two classes", "correct horse battery staple", []string{PasswordCharacterClasses}},
+		{"digits only", "839201746592", []string{PasswordCharacterClasses}},
+		{"weak", "Password1234", []string{PasswordTooWeak}},
+		{"common", "password1", []string{PasswordTooShort, PasswordCharacterClasses, PasswordBreached}},
+		{"over bcrypt's limit", strings.Repeat("kX9#", 18) + "!", []string{PasswordTooLong}},
+		{"empty", "", []string{PasswordTooShort, PasswordCharacterClasses, PasswordTooWeak}},
+	}
+	for _, tt := range tests {
+		if got := violationCodes(t, p, tt.password); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: Check(%q) = %v, want %v", tt.name, tt.password, got, tt.want)
+		}
+	}
+
+	// The user's own details make a password weak
+	if got := violationCodes(t, p, "AliceSmith1990"); got != nil {
+		t.Errorf("Check(name and year) = %v, want none", got)
+	}
+	if got := violationCodes(t, p, "AliceSmith1990", "alice.smith@example.com"); len(got) != 1 || got[0] != PasswordTooWeak {
+		t.Errorf("Check(own name and year) = %v, want too_weak", got)
+	}
+}
+
+func TestPasswordPolicyRulesOff(t *testing.T) {
+	p, err := NewPasswordPolicy(PasswordRules{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := violationCodes(t, p, "x"); got != nil {
+		t.Errorf("Check without rules = %v, want none", got)
+	}
+	// Common passwords are refused even so
+	if got := violationCodes(t, p, "letmein"); len(got) != 1 || got[0] != PasswordBreached {
+		t.Errorf("Check(letmein) = %v, want breached", got)
+	}
+}
+
+func TestPasswordPolicyBreachedList(t *testing.T) {
+	sum := sha1.Sum([]byte("Tr0ub4dor&3"))
+	list := "plain-text-leak\n\n" +
+		strings.ToUpper(hex.EncodeToString(sum[:])) + ":1234\n"
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPasswordPolicy(PasswordRules{}, path)
+	if err != nil {
+		t.Fatalf("NewPasswordPolicy: %v", err)
+	}
+
+	for password, breached := range map[string]bool{
+		"plain-text-leak": true,
+		"Tr0ub4dor&3":     true,
+		"tr0ub4dor&3":     false,
+		"123456":          true,
+	} {
+		got := violationCodes(t, p, password)
+		if (len(got) == 1 && got[0] == PasswordBreached) != breached {
+			t.Errorf("Check(%q) = %v, want breached %v", password, got, breached)
+		}
+	}
+
+	if _, err := NewPasswordPolicy(PasswordRules{}, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("NewPasswordPolicy accepted a missing list")
+	}
+}
+
+func TestPasswordHistoryReuse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := testAuthService(t, db)
+	s.historyRepo = repository.NewPasswordHistoryRepository(db)
+	if s.passwords, err = NewPasswordPolicy(PasswordRules{History: 3}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	current, older, oldest, dropped := hash("current-secret"), hash("older-secret"), hash("oldest-secret"),
+		hash("dropped-secret")
+
+	user := testUser(1, "alice@example.com")
+	user.Password = current
+	tests := []struct {
+		name     string
+		history  []string
+		password string
+		reused   bool
+	}{
+		{"current password", []string{current, older, oldest}, "current-secret", true},
+		{"in the history", []string{current, older, oldest}, "oldest-secret", true},
+		{"new", []string{current, older, oldest}, "brand-new-secret", false},
+		// From before the history was kept: only the current one is known, and
+		// the history never grows past History
+		{"no history yet", nil, "current-secret", true},
+		{"current pushes the oldest out", []string{older, oldest, dropped}, "dropped-secret", false},
+		{"current added to the front", []string{older, oldest, dropped}, "current-secret", true},
+	}
+	for _, tt := range tests {
+		rows := sqlmock.NewRows([]string{"password_hash"})
+		for _, h := range tt.history {
+			rows.AddRow(h)
+		}
+		mock.ExpectQuery("SELECT password_hash FROM password_history").WithArgs(1, 3).WillReturnRows(rows)
+
+		err := s.checkPassword(user, tt.password)
+		var policyErr *PasswordPolicyError
+		gotReused := errors.As(err, &policyErr) && len(policyErr.Violations) == 1 &&
+			policyErr.Violations[0].Code == PasswordRecentlyUsed
+		if gotReused != tt.reused || (err != nil && !gotReused) {
+			t.Errorf("%s: checkPassword = %v, want reused %v", tt.name, err, tt.reused)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new account has no history to look up
+	if err := s.checkPassword(nil, "current-secret"); err != nil {
+		t.Errorf("checkPassword(new account) = %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// What a password token lets its holder do.
+const (
+	PasswordTokenInvite = "invite"
+	PasswordTokenReset  = "reset"
+)
+
+var (
+	ErrMailNotConfigured = errors.New("email is not configured on this server")
+	ErrMailDelivery      = errors.New("the email could not be sent")
+	ErrUserExists        = errors.New("a user with this email already exists")
+	ErrNotInvited        = errors.New("only users who have not set a password yet can be invited again")
+	ErrInvalidResetToken = errors.New("this link is invalid or has expired")
+)
+
+// PasswordResetService emails users single-use links to set their password:
+// invitations for accounts an admin created without one, and password
+// resets the users ask for themselves. Links carry a random token kept only
+// as a hash; requesting a new one of the same kind retires the older ones.
+type PasswordResetService struct {
+	tokenRepo   *repository.PasswordTokenRepository
+	userRepo    *repository.UserRepository
+	authService *AuthService
+	mailer      Mailer
+	appURL      string
+	inviteTTL   time.Duration
+	resetTTL    time.Duration
+}
+
+// NewPasswordResetService links to the frontend at appURL. mailer may be nil,
+// which turns invitations and resets off.
+func NewPasswordResetService(tokenRepo *repository.PasswordTokenRepository, userRepo *repository.UserRepository,
+	authService *AuthService, mailer Mailer, appURL string, inviteTTL, resetTTL time.Duration) *PasswordResetService {
+	return &PasswordResetService{
+		tokenRepo:   tokenRepo,
+		userRepo:    userRepo,
+		authService: authService,
+		mailer:      mailer,
+		appURL:      strings.TrimRight(appURL, "/"),
+		inviteTTL:   inviteTTL,
+		resetTTL:    resetTTL,
+	}
+}
+
+// Invite creates a user without a password and emails them a link to set
+// one. If the email can't be sent the user stays, and the error wraps
+// ErrMailDelivery; the invitation can be sent again.
+func (s *PasswordResetService) Invite(req *models.InviteUserRequest) (*models.User, error) {
+	if s.mailer == nil {
+		return nil, ErrMailNotConfigured
+	}
+	if _, err := s.userRepo.FindByEmail(req.Email); err == nil {
+		return nil, ErrUserExists
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	role := req.Role
+	if role == "" {
+		role = "user"
+	}
+	userGroup := req.UserGroup
+	if userGroup == "" {
+		userGroup = "junior"
+	}
+	user := &models.User{
+		Email:     req.Email,
+		Role:      role,
+		UserGroup: userGroup,
+	}
+	if err := s.userRepo.Create(user); err != nil {
+		return nil, err
+	}
+	user.AuthSource = AuthSourceLocal
+	return user, s.sendInvite(user)
+}
+
+// ResendInvite emails a new invitation to a user who hasn't set a password.
+func (s *PasswordResetService) ResendInvite(userID int) (*models.User, error) {
+	if s.mailer == nil {
+		return nil, ErrMailNotConfigured
+	}
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.AuthSource != AuthSourceLocal || user.Password != "" || checkAccount(user) != nil {
+		return nil, ErrNotInvited
+	}
+	return user, s.sendInvite(user)
+}
+
+// RequestReset emails a password reset link to email in the background, if
+// it belongs to an active local account. The caller learns nothing either
+// way, so it can't be used to find out who has an account.
+func (s *PasswordResetService) RequestReset(email string) error {
+	if s.mailer == nil {
+		return ErrMailNotConfigured
+	}
+	go func() {
+		if err := s.sendReset(email); err != nil {
+			log.Printf("Failed to send a password reset email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Verify returns what an unused token is for, and for whom.
+func (s *PasswordResetService) Verify(token string) (*models.PasswordToken, error) {
+	t, _, err := s.lookup(token)
+	return t, err
+}
+
+// Reset sets the password of the token's user and uses the token up, along
+// with every other link the user was sent. The caller ends their sessions.
+func (s *PasswordResetService) Reset(token, password string) (*models.User, *models.PasswordToken, error) {
+	t, user, err := s.lookup(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A password the policy refuses doesn't use the link up
+	if err := s.authService.CheckPassword(user, password); err != nil {
+		return nil, t, err
+	}
+	used, err := s.tokenRepo.Use(t.ID, time.Now().UTC())
+	if err != nil {
+		return nil, t, err
+	}
+	if !used {
+		return nil, t, ErrInvalidResetToken
+	}
+	if err := s.authService.SetPassword(user, password); err != nil {
+		return nil, t, err
+	}
+	if err := s.tokenRepo.DeleteForUser(user.ID, ""); err != nil {
+		log.Printf("Failed to delete the password links of user %d: %v", user.ID, err)
+	}
+	return user, t, nil
+}
+
+// StartCleanup drops used and expired tokens every interval in the
+// background.
+func (s *PasswordResetService) StartCleanup(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := s.tokenRepo.DeleteStale(time.Now().UTC()); err != nil {
+				log.Printf("Failed to clean up password links: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *PasswordResetService) lookup(token string) (*models.PasswordToken, *models.User, error) {
+	t, err := s.tokenRepo.FindByHash(hashRefreshToken(token))
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.UsedAt != nil || !time.Now().Before(t.ExpiresAt) {
+		return nil, nil, ErrInvalidResetToken
+	}
+	user, err := s.userRepo.FindByID(t.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Accounts suspended, expired, or handed to an identity provider, since
+	// the link was sent
+	if checkAccount(user) != nil || user.AuthSource != AuthSourceLocal {
+		return nil, nil, ErrInvalidResetToken
+	}
+	return t, user, nil
+}
+
+func (s *PasswordResetService) sendInvite(user *models.User) error {
+	link, err := s.issue(user, PasswordTokenInvite, s.inviteTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("You have been invited to Credential Store as %s.\n\n"+
+		"Choose your password here to get started:\n\n%s\n\n"+
+		"The link works once and expires in %s.\n", user.Email, link, humanDuration(s.inviteTTL))
+	if err := s.mailer.Send(user.Email, "You're invited to Credential Store", body); err != nil {
+		return fmt.Errorf("%w: %v", ErrMailDelivery, err)
+	}
+	return nil
+}
+
+func (s *PasswordResetService) sendReset(email string) error {
+	user, err := s.userRepo.FindByEmail(email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Provisioned users change their password with their identity provider
+	if checkAccount(user) != nil || user.AuthSource != AuthSourceLocal {
+		return nil
+	}
+
+	link, err := s.issue(user, PasswordTokenReset, s.resetTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Someone asked to reset the Credential Store password of %s.\n\n"+
+		"Choose a new password here:\n\n%s\n\n"+
+		"The link works once and expires in %s. If you didn't ask for it, ignore this email; "+
+		"your password stays as it is.\n", user.Email, link, humanDuration(s.resetTTL))
+	return s.mailer.Send(user.Email, "Reset your Credential Store password", body)
+}
+
+// issue retires the user's older links for purpose and returns a new one.
+func (s *PasswordResetService) issue(user *models.User, purpose string, ttl time.Duration) (string, error) {
+	if err := s.tokenRepo.DeleteForUser(user.ID, purpose); err != nil {
+		return "", err
+	}
+	secret, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	token := &models.PasswordToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	if err := s.tokenRepo.Create(token, hashRefreshToken(secret)); err != nil {
+		return "", err
+	}
+	// In the fragment, so it stays out of server logs and Referer headers
+	return s.appURL + "/reset-password#token=" + secret, nil
+}
+
+func humanDuration(d time.Duration) string {
+	n, unit := int64(d/time.Minute), "minute"
+	switch {
+	case d%(24*time.Hour) == 0:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d%time.Hour == 0:
+		n, unit = int64(d/time.Hour), "hour"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/repository"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestPasswordReset(t *testing.T, mailer Mailer) (*PasswordResetService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	auth := testAuthService(t, db)
+	return NewPasswordResetService(repository.NewPasswordTokenRepository(db), auth.userRepo, auth, mailer,
+		"https://vault.example.com/", 72*time.Hour, time.Hour), mock
+}
+
+func TestPasswordResetSendsNothingForUnknownEmail(t *testing.T) {
+	sink := newSMTPSink(t)
+	s, mock := newTestPasswordReset(t, NewSMTPMailer(sink.config(SMTPPlain)))
+
+	provisioned := testUser(2, "bob@example.com")
+	provisioned.AuthSource, provisioned.ExternalID = AuthSourceOIDC, "sub-2"
+	suspended := testUser(3, "carol@example.com")
+	suspended.Status = UserSuspended
+
+	mock.ExpectQuery("FROM users WHERE email").WithArgs("mallory@example.com").WillReturnRows(userRows())
+	mock.ExpectQuery("FROM users WHERE email").WithArgs(provisioned.Email).WillReturnRows(userRows(provisioned))
+	mock.ExpectQuery("FROM users WHERE email").WithArgs(suspended.Email).WillReturnRows(userRows(suspended))
+	// No link may be issued either
+	for _, email := range []string{"mallory@example.com", provisioned.Email, suspended.Email} {
+		if err := s.sendReset(email); err != nil {
+			t.Errorf("sendReset(%s) = %v", email, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if connections, _ := sink.received(); connections != 0 {
+		t.Fatalf("%d connections to the mail server, want none", connections)
+	}
+}
+
+func TestPasswordResetSendsLink(t *testing.T) {
+	sink := newSMTPSink(t)
+	s, mock := newTestPasswordReset(t, NewSMTPMailer(sink.config(SMTPPlain)))
+	alice := testUser(1, "alice@example.com")
+
+	hash := &captureArg{}
+	mock.ExpectQuery("FROM users WHERE email").WithArgs(alice.Email).WillReturnRows(userRows(alice))
+	mock.ExpectExec("DELETE FROM password_tokens").WithArgs(1, PasswordTokenReset).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO password_tokens").WithArgs(1, PasswordTokenReset, hash, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+	if err := s.sendReset(alice.Email); err != nil {
+		t.Fatalf("sendReset: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages := sink.received()
+	if len(messages) != 1 || messages[0].to[0] != alice.Email {
+		t.Fatalf("sent %+v, want one message to %s", messages, alice.Email)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(messages[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link carries the token whose hash was stored
+	const prefix = "https://vault.example.com/reset-password#token="
+	start := strings.Index(string(body), prefix)
+	if start < 0 {
+		t.Fatalf("no link in %q", body)
+	}
+	token := strings.Fields(string(body[start+len(prefix):]))[0]
+	if hashRefreshToken(token) != hash.value {
+		t.Fatalf("link token %q does not match the stored hash", token)
+	}
+	if !strings.Contains(string(body), "expires in 1 hour") {
+		t.Errorf("body %q does not say when the link expires", body)
+	}
+}
+
+func TestPasswordResetWithoutMailer(t *testing.T) {
+	s, mock := newTestPasswordReset(t, nil)
+	if err := s.RequestReset("alice@example.com"); err != ErrMailNotConfigured {
+		t.Fatalf("RequestReset = %v, want ErrMailNotConfigured", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
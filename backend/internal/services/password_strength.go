@@ -0,0 +1,239 @@
+package services
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// passwordStrength scores a password from 0 (guessable in under a thousand
+// tries) to 4 (over ten billion), in the manner of zxcvbn: the password is
+// split into the pieces an attacker would most cheaply guess (common
+// passwords and the user's own details, also reversed or in leetspeak,
+// repeats, sequences, keyboard runs, years and dates) with random
+// characters filling the gaps, and the guesses for the cheapest split are
+// counted.
+func passwordStrength(password string, dictionary map[string]int, userInputs []string) int {
+	guesses := passwordGuesses(password, dictionary, userInputs)
+	switch {
+	case guesses < 1e3+5:
+		return 0
+	case guesses < 1e6+5:
+		return 1
+	case guesses < 1e8+5:
+		return 2
+	case guesses < 1e10+5:
+		return 3
+	}
+	return 4
+}
+
+func passwordGuesses(password string, dictionary map[string]int, userInputs []string) float64 {
+	runes := []rune(password)
+	n := len(runes)
+	if n == 0 {
+		return 1
+	}
+
+	// The user's own details are the first thing to try
+	inputs := make(map[string]int)
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		inputs[input] = 1
+		for _, part := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len([]rune(part)) >= 3 {
+				inputs[part] = 1
+			}
+		}
+	}
+
+	// best[i] is the cheapest way found to guess the first i characters, as
+	// the product of its pieces' guesses; pieces[i] counts them. Guessing k
+	// pieces also means guessing their order, k! ways.
+	best := make([]float64, n+1)
+	pieces := make([]int, n+1)
+	best[0] = 1
+	for i := 1; i <= n; i++ {
+		best[i] = math.Inf(1)
+		for j := 0; j < i; j++ {
+			product := best[j] * segmentGuesses(runes[j:i], dictionary, inputs)
+			if product*factorial(pieces[j]+1) < best[i]*factorial(pieces[i]) {
+				best[i], pieces[i] = product, pieces[j]+1
+			}
+		}
+	}
+	return best[n] * factorial(pieces[n])
+}
+
+// segmentGuesses estimates the guesses for one piece of a password: the
+// cheapest of the patterns it matches, or brute force.
+func segmentGuesses(segment []rune, dictionary, inputs map[string]int) float64 {
+	guesses := bruteForceGuesses(segment)
+	if len(segment) == 1 {
+		return guesses
+	}
+	for _, g := range []float64{
+		dictionaryGuesses(segment, dictionary, inputs),
+		repeatGuesses(segment),
+		sequenceGuesses(segment),
+		keyboardGuesses(segment),
+		dateGuesses(segment),
+	} {
+		if g > 0 && g < guesses {
+			guesses = g
+		}
+	}
+	// Even the most obvious multi-character piece takes a few tries
+	return math.Max(guesses, 50)
+}
+
+func bruteForceGuesses(segment []rune) float64 {
+	return math.Pow(10, float64(len(segment)))
+}
+
+var leetSubstitutions = strings.NewReplacer("4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i",
+	"!", "i", "|", "l", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z")
+
+func dictionaryGuesses(segment []rune, dictionary, inputs map[string]int) float64 {
+	word := string(segment)
+	lower := strings.ToLower(word)
+	lookup := func(candidate string) int {
+		if rank, ok := inputs[candidate]; ok {
+			return rank
+		}
+		return dictionary[candidate]
+	}
+
+	var guesses float64
+	consider := func(candidate string, multiplier float64) {
+		if rank := lookup(candidate); rank > 0 {
+			if g := float64(rank) * multiplier; guesses == 0 || g < guesses {
+				guesses = g
+			}
+		}
+	}
+	variations := capitalizationVariations(word)
+	consider(lower, variations)
+	consider(reverseString(lower), variations*2)
+	if unleet := leetSubstitutions.Replace(lower); unleet != lower {
+		consider(unleet, variations*2)
+		consider(reverseString(unleet), variations*4)
+	}
+	return guesses
+}
+
+// capitalizationVariations is how many ways of capitalising a word an
+// attacker tries before this one.
+func capitalizationVariations(word string) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0:
+		return 2
+	case upper == 1 && unicode.IsUpper([]rune(word)[0]):
+		return 2
+	}
+	return math.Pow(2, float64(upper))
+}
+
+func repeatGuesses(segment []rune) float64 {
+	n := len(segment)
+	for size := 1; size <= n/2; size++ {
+		if n%size != 0 {
+			continue
+		}
+		unit := string(segment[:size])
+		if strings.Repeat(unit, n/size) == string(segment) {
+			return bruteForceGuesses(segment[:size]) * float64(n/size)
+		}
+	}
+	return 0
+}
+
+func sequenceGuesses(segment []rune) float64 {
+	if len(segment) < 3 {
+		return 0
+	}
+	delta := segment[1] - segment[0]
+	if delta != 1 && delta != -1 {
+		return 0
+	}
+	for i := 2; i < len(segment); i++ {
+		if segment[i]-segment[i-1] != delta {
+			return 0
+		}
+	}
+	base := 26.0
+	switch first := unicode.ToLower(segment[0]); {
+	case strings.ContainsRune("az019", first):
+		base = 4
+	case unicode.IsDigit(first):
+		base = 10
+	}
+	if delta < 0 {
+		base *= 2
+	}
+	return base * float64(len(segment))
+}
+
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./", "~!@#$%^&*()_+",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p", "qazwsxedcrfvtgbyhnujmikolp"}
+
+func keyboardGuesses(segment []rune) float64 {
+	if len(segment) < 3 {
+		return 0
+	}
+	lower := strings.ToLower(string(segment))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) || strings.Contains(reverseString(row), lower) {
+			return 40 * float64(len(segment)) * capitalizationVariations(string(segment))
+		}
+	}
+	return 0
+}
+
+// dateGuesses matches years from 1900 to 2099, and dates written with six or
+// eight digits.
+func dateGuesses(segment []rune) float64 {
+	for _, r := range segment {
+		if !unicode.IsDigit(r) {
+			return 0
+		}
+	}
+	s := string(segment)
+	switch len(s) {
+	case 4:
+		if s[:2] == "19" || s[:2] == "20" {
+			return 200
+		}
+	case 6, 8:
+		return 365 * 200
+	}
+	return 0
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
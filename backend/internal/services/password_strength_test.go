@@ -0,0 +1,51 @@
+package services
+
+import "testing"
+
+func TestPasswordStrength(t *testing.T) {
+	p, err := NewPasswordPolicy(PasswordRules{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := []string{"alice.smith@example.com"}
+
+	tests := []struct {
+		password string
+		inputs   []string
+		want     int
+	}{
+		{"", nil, 0},
+		// Common passwords, also capitalized, reversed or in leetspeak
+		{"password", nil, 0},
+		{"Password1", nil, 0},
+		{"P@ssw0rd", nil, 0},
+		{"drowssap", nil, 0},
+		{"monkeydragon", nil, 1},
+		// Repeats, sequences, keyboard runs and dates
+		{"aaaaaaaaaaaa", nil, 0},
+		{"abcabcabcabc", nil, 1},
+		{"abcdefghij", nil, 0},
+		{"zyxwvuts", nil, 0},
+		{"qwertyuiop", nil, 0},
+		{"asdfghjkl;", nil, 0},
+		{"19901231", nil, 1},
+		// Random characters count by length
+		{"xk7fq", nil, 1},
+		{"xk7fq2nb", nil, 2},
+		{"mushroom42", nil, 3},
+		{"Tr0ub4dor&3", nil, 4},
+		{"kX9#mQ2$vL7!pR4w", nil, 4},
+		{"correct horse battery staple", nil, 4},
+		// The user's own details are guessed first, whole or in parts
+		{"Alice.Smith", nil, 4},
+		{"Alice.Smith", user, 1},
+		{"alicesmith", user, 1},
+		{"htimsecila", user, 1},
+		{"alice2026", user, 1},
+	}
+	for _, tt := range tests {
+		if got := passwordStrength(tt.password, p.dictionary, tt.inputs); got != tt.want {
+			t.Errorf("passwordStrength(%q, %q) = %d, want %d", tt.password, tt.inputs, got, tt.want)
+		}
+	}
+}
@@ -80,6 +80,18 @@ func (s *S3Service) Download(key string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Open streams a file from S3; the caller must close the returned body
+func (s *S3Service) Open(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from S3: %w", err)
+	}
+	return out.Body, nil
+}
+
 // Delete deletes a file from S3
 func (s *S3Service) Delete(key string) error {
 	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
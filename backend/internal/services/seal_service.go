@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrSealNotInitialized     = errors.New("vault has not been initialized")
+	ErrSealAlreadyInitialized = errors.New("vault is already initialized")
+	ErrInvalidShare           = errors.New("invalid unseal share")
+	ErrUnsealFailed           = errors.New("unseal shares do not reconstruct the master key; progress has been reset")
+)
+
+// SealService splits the master key into Shamir shares and rebuilds it from
+// shares submitted by key holders. Only a check value derived from the key is
+// persisted, never the key itself.
+type SealService struct {
+	sealRepo   *repository.SealRepository
+	encryption *EncryptionService
+	folderKeys *FolderKeyService
+
+	mu      sync.Mutex
+	pending [][]byte
+}
+
+func NewSealService(sealRepo *repository.SealRepository, encryption *EncryptionService, folderKeys *FolderKeyService) *SealService {
+	return &SealService{
+		sealRepo:   sealRepo,
+		encryption: encryption,
+		folderKeys: folderKeys,
+	}
+}
+
+func (s *SealService) Status() (*models.SealStatus, error) {
+	cfg, err := s.sealRepo.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(cfg), nil
+}
+
+func (s *SealService) status(cfg *models.SealConfig) *models.SealStatus {
+	status := &models.SealStatus{
+		Sealed:   s.encryption.IsSealed(),
+		Progress: len(s.pending),
+	}
+	if cfg != nil {
+		status.Initialized = true
+		status.Shares = cfg.SecretShares
+		status.Threshold = cfg.SecretThreshold
+	}
+	return status
+}
+
+// Init splits the master key-ring into shares. A running server splits its
+// whole key-ring, so data encrypted under any version stays readable once it
+// is restarted in sealed mode; a sealed, never-initialized server generates a
+// fresh key. The shares are returned once and never stored.
+func (s *SealService) Init(req *models.InitSealRequest) (*models.InitSealResponse, error) {
+	if req.SecretThreshold > req.SecretShares {
+		return nil, errors.New("secret_threshold must not exceed secret_shares")
+	}
+	if req.SecretThreshold < 2 && req.SecretShares > 1 {
+		return nil, errors.New("secret_threshold must be at least 2 when there are several shares")
+	}
+
+	existing, err := s.sealRepo.Get()
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrSealAlreadyInitialized
+	}
+
+	ring, err := s.encryption.KeyRing()
+	if errors.Is(err, ErrSealed) {
+		key, err := NewDataKey()
+		if err != nil {
+			return nil, err
+		}
+		ring = &KeyRing{Keys: map[int][]byte{legacyKeyVersion: key}, Active: legacyKeyVersion}
+	} else if err != nil {
+		return nil, err
+	}
+	defer wipeKeyRing(ring)
+
+	secret, err := marshalKeyRing(ring)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+
+	shares, err := SplitSecret(secret, req.SecretShares, req.SecretThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &models.SealConfig{
+		SecretShares:    req.SecretShares,
+		SecretThreshold: req.SecretThreshold,
+		KeyVersion:      ring.Active,
+		KeyCheck:        keyCheck(secret),
+	}
+	created, err := s.sealRepo.Create(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrSealAlreadyInitialized
+	}
+
+	resp := &models.InitSealResponse{KeyVersion: ring.Active}
+	for _, share := range shares {
+		resp.Shares = append(resp.Shares, base64.StdEncoding.EncodeToString(share))
+		wipe(share)
+	}
+	log.Printf("Vault initialized with %d shares, threshold %d", req.SecretShares, req.SecretThreshold)
+	return resp, nil
+}
+
+// SubmitShare records one unseal share and unseals the vault once the
+// threshold is reached.
+func (s *SealService) SubmitShare(encoded string) (*models.SealStatus, error) {
+	cfg, err := s.sealRepo.Get()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, ErrSealNotInitialized
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.encryption.IsSealed() {
+		return s.status(cfg), nil
+	}
+
+	share, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(share) < 2 {
+		return nil, ErrInvalidShare
+	}
+	for _, p := range s.pending {
+		if p[0] == share[0] {
+			if bytes.Equal(p, share) {
+				// Resubmitting the same share doesn't count twice
+				return s.status(cfg), nil
+			}
+			return nil, ErrInvalidShare
+		}
+	}
+	s.pending = append(s.pending, share)
+
+	if len(s.pending) < cfg.SecretThreshold {
+		return s.status(cfg), nil
+	}
+
+	secret, err := CombineShares(s.pending)
+	s.resetPending()
+	if err != nil {
+		return nil, ErrUnsealFailed
+	}
+	defer wipe(secret)
+	if !hmac.Equal([]byte(keyCheck(secret)), []byte(cfg.KeyCheck)) {
+		log.Println("Unseal attempt failed: reconstructed key does not match")
+		return nil, ErrUnsealFailed
+	}
+
+	ring, err := unmarshalKeyRing(secret, cfg.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.encryption.Unseal(ring); err != nil {
+		wipeKeyRing(ring)
+		return nil, err
+	}
+	log.Println("Vault unsealed")
+	return s.status(cfg), nil
+}
+
+// ResetProgress discards shares submitted so far.
+func (s *SealService) ResetProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetPending()
+}
+
+// Seal immediately wipes all key material from memory.
+func (s *SealService) Seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resetPending()
+	s.encryption.Seal()
+	s.folderKeys.Purge()
+	log.Println("Vault sealed")
+}
+
+func (s *SealService) resetPending() {
+	for _, share := range s.pending {
+		wipe(share)
+	}
+	s.pending = nil
+}
+
+func keyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("credential-store seal check"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A split key-ring starts with keyRingMagic, then the active version and each
+// version followed by its key, all versions as big-endian uint32. Seals
+// initialized before whole key-rings were split hold a single bare key, whose
+// version is the one recorded in the seal config.
+var keyRingMagic = []byte("KR1")
+
+const masterKeySize = 32
+
+func marshalKeyRing(ring *KeyRing) ([]byte, error) {
+	versions := make([]int, 0, len(ring.Keys))
+	for version, key := range ring.Keys {
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("key version %d is %d bytes, want %d", version, len(key), masterKeySize)
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	buf := make([]byte, 0, len(keyRingMagic)+4+len(versions)*(4+masterKeySize))
+	buf = append(buf, keyRingMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(ring.Active))
+	for _, version := range versions {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(version))
+		buf = append(buf, ring.Keys[version]...)
+	}
+	return buf, nil
+}
+
+func unmarshalKeyRing(secret []byte, legacyVersion int) (*KeyRing, error) {
+	if len(secret) == masterKeySize {
+		key := append([]byte(nil), secret...)
+		return &KeyRing{Keys: map[int][]byte{legacyVersion: key}, Active: legacyVersion}, nil
+	}
+
+	malformed := errors.New("unseal shares do not hold a valid key-ring")
+	if !bytes.HasPrefix(secret, keyRingMagic) {
+		return nil, malformed
+	}
+	data := secret[len(keyRingMagic):]
+	if len(data) < 4 || (len(data)-4)%(4+masterKeySize) != 0 {
+		return nil, malformed
+	}
+
+	ring := &KeyRing{Keys: make(map[int][]byte), Active: int(binary.BigEndian.Uint32(data))}
+	for data = data[4:]; len(data) > 0; data = data[4+masterKeySize:] {
+		version := int(binary.BigEndian.Uint32(data))
+		ring.Keys[version] = append([]byte(nil), data[4:4+masterKeySize]...)
+	}
+	if _, ok := ring.Keys[ring.Active]; !ok {
+		wipeKeyRing(ring)
+		return nil, malformed
+	}
+	return ring, nil
+}
+
+func wipeKeyRing(ring *KeyRing) {
+	for _, key := range ring.Keys {
+		wipe(key)
+	}
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// captureArg matches any argument and remembers it.
+type captureArg struct{ value driver.Value }
+
+func (a *captureArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+var sealColumns = []string{"secret_shares", "secret_threshold", "key_version", "key_check", "created_at"}
+
+func newTestSealService(t *testing.T, encryption *EncryptionService) (*SealService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewSealService(repository.NewSealRepository(db), encryption, NewFolderKeyService(nil, encryption)), mock
+}
+
+// initSeal initializes the seal of a running service and returns the shares
+// and the stored config.
+func initSeal(t *testing.T, encryption *EncryptionService, shares, threshold int) ([]string, *models.SealConfig) {
+	t.Helper()
+	seal, mock := newTestSealService(t, encryption)
+
+	check := &captureArg{}
+	mock.ExpectQuery("SELECT (.+) FROM seal_config").WillReturnRows(sqlmock.NewRows(sealColumns))
+	mock.ExpectQuery("INSERT INTO seal_config").
+		WithArgs(shares, threshold, sqlmock.AnyArg(), check).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+
+	resp, err := seal.Init(&models.InitSealRequest{SecretShares: shares, SecretThreshold: threshold})
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Shares, &models.SealConfig{
+		SecretShares:    shares,
+		SecretThreshold: threshold,
+		KeyVersion:      resp.KeyVersion,
+		KeyCheck:        check.value.(string),
+	}
+}
+
+// unseal submits shares to a freshly started, sealed service.
+func unseal(t *testing.T, cfg *models.SealConfig, shares []string) (*EncryptionService, error) {
+	t.Helper()
+	encryption := NewSealedEncryptionService()
+	seal, mock := newTestSealService(t, encryption)
+
+	var err error
+	for _, share := range shares {
+		mock.ExpectQuery("SELECT (.+) FROM seal_config").WillReturnRows(sqlmock.NewRows(sealColumns).
+			AddRow(cfg.SecretShares, cfg.SecretThreshold, cfg.KeyVersion, cfg.KeyCheck, time.Now()))
+		if _, err = seal.SubmitShare(share); err != nil {
+			break
+		}
+	}
+	return encryption, err
+}
+
+func TestSealRestoresWholeKeyRing(t *testing.T) {
+	running := newTestEncryption(t, 2, 1, 2)
+	oldCT, _ := newTestEncryption(t, 1, 1).Encrypt("under version 1")
+	newCT, _ := running.Encrypt("under version 2")
+
+	shares, cfg := initSeal(t, running, 5, 3)
+	if cfg.KeyVersion != 2 {
+		t.Fatalf("KeyVersion = %d, want 2", cfg.KeyVersion)
+	}
+
+	restored, err := unseal(t, cfg, []string{shares[4], shares[0], shares[2]})
+	if err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	if restored.IsSealed() || restored.ActiveVersion() != 2 {
+		t.Fatalf("unsealed service: sealed=%v active=%d", restored.IsSealed(), restored.ActiveVersion())
+	}
+	for ct, want := range map[string]string{oldCT: "under version 1", newCT: "under version 2"} {
+		if pt, err := restored.Decrypt(ct); err != nil || pt != want {
+			t.Errorf("Decrypt after unseal = %q, %v; want %q", pt, err, want)
+		}
+	}
+}
+
+func TestSealNeedsThresholdShares(t *testing.T) {
+	shares, cfg := initSeal(t, newTestEncryption(t, 1, 1), 5, 3)
+
+	restored, err := unseal(t, cfg, shares[:2])
+	if err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	if !restored.IsSealed() {
+		t.Fatal("two of three shares unsealed the vault")
+	}
+}
+
+func TestSealRejectsCorruptedShares(t *testing.T) {
+	shares, cfg := initSeal(t, newTestEncryption(t, 1, 1), 3, 2)
+
+	raw, _ := base64.StdEncoding.DecodeString(shares[1])
+	raw[5] ^= 0x01
+	corrupted := base64.StdEncoding.EncodeToString(raw)
+
+	if _, err := unseal(t, cfg, []string{shares[0], corrupted}); !errors.Is(err, ErrUnsealFailed) {
+		t.Fatalf("SubmitShare(corrupted) = %v, want ErrUnsealFailed", err)
+	}
+	if _, err := unseal(t, cfg, []string{shares[0], "not base64!"}); !errors.Is(err, ErrInvalidShare) {
+		t.Fatalf("SubmitShare(garbage) = %v, want ErrInvalidShare", err)
+	}
+
+	// Resubmitting a share doesn't count towards the threshold
+	restored, err := unseal(t, cfg, []string{shares[0], shares[0]})
+	if err != nil || !restored.IsSealed() {
+		t.Fatalf("duplicate share: sealed=%v, %v", restored.IsSealed(), err)
+	}
+}
+
+func TestSealUnsealsLegacySingleKeyShares(t *testing.T) {
+	key := deriveKey("legacy seal key")
+	raw, err := SplitSecret(key, 3, 2)
+	if err != nil {
+		t.Fatalf("SplitSecret: %v", err)
+	}
+	cfg := &models.SealConfig{SecretShares: 3, SecretThreshold: 2, KeyVersion: 4, KeyCheck: keyCheck(key)}
+
+	restored, err := unseal(t, cfg, []string{
+		base64.StdEncoding.EncodeToString(raw[0]),
+		base64.StdEncoding.EncodeToString(raw[2]),
+	})
+	if err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	if restored.ActiveVersion() != 4 || !restored.HasVersion(4) {
+		t.Fatalf("legacy shares restored active version %d", restored.ActiveVersion())
+	}
+}
+
+func TestKeyRingEncodingRejectsMalformedSecrets(t *testing.T) {
+	ring := testRing(2, 1, 2)
+	secret, err := marshalKeyRing(ring)
+	if err != nil {
+		t.Fatalf("marshalKeyRing: %v", err)
+	}
+
+	decoded, err := unmarshalKeyRing(secret, 1)
+	if err != nil || decoded.Active != 2 || len(decoded.Keys) != 2 {
+		t.Fatalf("unmarshalKeyRing = %+v, %v", decoded, err)
+	}
+
+	for name, bad := range map[string][]byte{
+		"truncated":      secret[:len(secret)-1],
+		"no magic":       append([]byte("XX1"), secret[3:]...),
+		"missing active": mustMarshal(t, &KeyRing{Keys: map[int][]byte{1: deriveKey("a")}, Active: 1})[:7],
+	} {
+		if _, err := unmarshalKeyRing(bad, 1); err == nil {
+			t.Errorf("%s: unmarshalKeyRing accepted a malformed secret", name)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, ring *KeyRing) []byte {
+	t.Helper()
+	secret, err := marshalKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
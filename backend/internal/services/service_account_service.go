@@ -0,0 +1,262 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ServiceAccountKeyPrefix starts every service account API key.
+const ServiceAccountKeyPrefix = "cs_sak_"
+
+// ActorTypeServiceAccount marks audit events whose actor is a service
+// account rather than a user.
+const ActorTypeServiceAccount = "service_account"
+
+const (
+	ServiceAccountKey         = "api_key"
+	ServiceAccountCertificate = "certificate"
+)
+
+var (
+	ErrServiceAccountNotFound           = errors.New("service account not found")
+	ErrServiceAccountCredentialNotFound = errors.New("service account credential not found")
+	ErrServiceAccountExists             = errors.New("a service account with this name already exists")
+	ErrUnknownGroup                     = errors.New("group does not exist")
+	ErrInvalidServiceAccountCredential  = errors.New("invalid, expired or revoked service account credential")
+	ErrServiceAccountDisabled           = errors.New("this service account is disabled")
+	ErrInvalidCertificate               = errors.New("invalid certificate")
+	ErrCertificateAlreadyPinned         = errors.New("this certificate is already pinned")
+)
+
+// ServiceAccountService manages machine identities. A service account has
+// its group's folder permissions, is never an admin and cannot log in; it
+// authenticates with an API key or a pinned client certificate.
+type ServiceAccountService struct {
+	accountRepo *repository.ServiceAccountRepository
+	groupRepo   *repository.GroupRepository
+}
+
+func NewServiceAccountService(accountRepo *repository.ServiceAccountRepository,
+	groupRepo *repository.GroupRepository) *ServiceAccountService {
+	return &ServiceAccountService{accountRepo: accountRepo, groupRepo: groupRepo}
+}
+
+func (s *ServiceAccountService) Create(req *models.CreateServiceAccountRequest) (*models.ServiceAccount, error) {
+	if err := s.checkGroup(req.UserGroup); err != nil {
+		return nil, err
+	}
+	if _, err := s.accountRepo.FindByName(req.Name); err == nil {
+		return nil, ErrServiceAccountExists
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	account := &models.ServiceAccount{Name: req.Name, Description: req.Description, UserGroup: req.UserGroup}
+	if err := s.accountRepo.Create(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *ServiceAccountService) List() ([]models.ServiceAccount, error) {
+	return s.accountRepo.FindAll()
+}
+
+func (s *ServiceAccountService) Get(id int) (*models.ServiceAccount, error) {
+	account, err := s.accountRepo.FindByID(id)
+	if err == sql.ErrNoRows {
+		return nil, ErrServiceAccountNotFound
+	}
+	return account, err
+}
+
+func (s *ServiceAccountService) Update(id int, req *models.UpdateServiceAccountRequest) (*models.ServiceAccount, error) {
+	account, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if req.Description != nil {
+		account.Description = *req.Description
+	}
+	if req.UserGroup != "" {
+		if err := s.checkGroup(req.UserGroup); err != nil {
+			return nil, err
+		}
+		account.UserGroup = req.UserGroup
+	}
+	if req.Disabled != nil {
+		account.Disabled = *req.Disabled
+	}
+	if err := s.accountRepo.Update(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Delete removes the account and its credentials.
+func (s *ServiceAccountService) Delete(id int) error {
+	if err := s.accountRepo.Delete(id); err == sql.ErrNoRows {
+		return ErrServiceAccountNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Credentials lists an account's keys and certificates that still work.
+func (s *ServiceAccountService) Credentials(id int) ([]models.ServiceAccountCredential, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+	return s.accountRepo.FindActiveCredentials(id)
+}
+
+// CreateKey issues an API key. The key is in the response only; just its
+// fingerprint is stored.
+func (s *ServiceAccountService) CreateKey(id int, req *models.CreateServiceAccountKeyRequest) (*models.CreateServiceAccountKeyResponse, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	key := ServiceAccountKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	cred := &models.ServiceAccountCredential{
+		ServiceAccountID: id,
+		Kind:             ServiceAccountKey,
+		Name:             req.Name,
+		Fingerprint:      hashRefreshToken(key),
+		Prefix:           key[:len(ServiceAccountKeyPrefix)+6],
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().UTC().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		cred.ExpiresAt = &expires
+	}
+	if err := s.accountRepo.CreateCredential(cred); err != nil {
+		return nil, err
+	}
+	return &models.CreateServiceAccountKeyResponse{Key: key, Credential: *cred}, nil
+}
+
+// AddCertificate pins a client certificate to the account. It stops working
+// when the certificate expires.
+func (s *ServiceAccountService) AddCertificate(id int, req *models.AddServiceAccountCertificateRequest) (*models.ServiceAccountCredential, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(strings.TrimSpace(req.Certificate)))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: expected a PEM encoded CERTIFICATE block", ErrInvalidCertificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	if !time.Now().Before(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: it expired on %s", ErrInvalidCertificate, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	fingerprint := certificateFingerprint(cert)
+	if _, err := s.accountRepo.FindCredentialByFingerprint(ServiceAccountCertificate, fingerprint); err == nil {
+		return nil, ErrCertificateAlreadyPinned
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	expires := cert.NotAfter.UTC()
+	subject := cert.Subject.String()
+	if len(subject) > 255 {
+		subject = subject[:255]
+	}
+	cred := &models.ServiceAccountCredential{
+		ServiceAccountID: id,
+		Kind:             ServiceAccountCertificate,
+		Name:             req.Name,
+		Fingerprint:      fingerprint,
+		Subject:          subject,
+		ExpiresAt:        &expires,
+	}
+	if err := s.accountRepo.CreateCredential(cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (s *ServiceAccountService) RevokeCredential(id, credentialID int) error {
+	revoked, err := s.accountRepo.RevokeCredential(credentialID, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrServiceAccountCredentialNotFound
+	}
+	return nil
+}
+
+// AuthenticateKey returns the account an API key belongs to, and records
+// the use.
+func (s *ServiceAccountService) AuthenticateKey(key, ip string) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	return s.authenticate(ServiceAccountKey, hashRefreshToken(key), ip)
+}
+
+// AuthenticateCertificate returns the account a client certificate is
+// pinned to, and records the use. The TLS handshake has already proven the
+// client holds the certificate's private key.
+func (s *ServiceAccountService) AuthenticateCertificate(cert *x509.Certificate, ip string) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	return s.authenticate(ServiceAccountCertificate, certificateFingerprint(cert), ip)
+}
+
+func (s *ServiceAccountService) authenticate(kind, fingerprint, ip string) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	cred, err := s.accountRepo.FindCredentialByFingerprint(kind, fingerprint)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidServiceAccountCredential
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if cred.RevokedAt != nil || (cred.ExpiresAt != nil && !time.Now().Before(*cred.ExpiresAt)) {
+		return nil, nil, ErrInvalidServiceAccountCredential
+	}
+
+	account, err := s.accountRepo.FindByID(cred.ServiceAccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if account.Disabled {
+		return nil, nil, ErrServiceAccountDisabled
+	}
+
+	if err := s.accountRepo.TouchCredential(cred.ID, ip); err != nil {
+		return nil, nil, err
+	}
+	return account, cred, nil
+}
+
+func (s *ServiceAccountService) checkGroup(name string) error {
+	if _, err := s.groupRepo.FindByName(name); err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrUnknownGroup, name)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestServiceAccountService(t *testing.T) (*ServiceAccountService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewServiceAccountService(repository.NewServiceAccountRepository(db), repository.NewGroupRepository(db)), mock
+}
+
+var (
+	serviceAccountColumns           = []string{"id", "name", "description", "user_group", "disabled", "created_at"}
+	serviceAccountCredentialColumns = []string{"id", "service_account_id", "kind", "name", "fingerprint", "prefix",
+		"subject", "created_at", "expires_at", "last_used_at", "last_used_ip", "revoked_at"}
+)
+
+func serviceAccountRows(disabled bool) *sqlmock.Rows {
+	return sqlmock.NewRows(serviceAccountColumns).AddRow(5, "deploy-bot", "", "ops", disabled, time.Now())
+}
+
+func serviceAccountCredentialRows(kind, fingerprint string, expiresAt, revokedAt *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows(serviceAccountCredentialColumns).AddRow(3, 5, kind, "ci", fingerprint, "", "",
+		time.Now().Add(-time.Hour), expiresAt, nil, "", revokedAt)
+}
+
+// testCertificate returns a self-signed client certificate valid until
+// notAfter, parsed and PEM encoded.
+func testCertificate(t *testing.T, notAfter time.Time) (*x509.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deploy-bot", Organization: []string{"Example"}},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestServiceAccountCreate(t *testing.T) {
+	s, mock := newTestServiceAccountService(t)
+	groupColumns := []string{"id", "name", "description", "require_mfa", "created_at"}
+
+	mock.ExpectQuery("FROM groups WHERE name").WithArgs("nobody").WillReturnRows(sqlmock.NewRows(groupColumns))
+	if _, err := s.Create(&models.CreateServiceAccountRequest{Name: "deploy-bot", UserGroup: "nobody"}); !errors.Is(err, ErrUnknownGroup) {
+		t.Errorf("Create in a missing group = %v, want ErrUnknownGroup", err)
+	}
+
+	mock.ExpectQuery("FROM groups WHERE name").WithArgs("ops").
+		WillReturnRows(sqlmock.NewRows(groupColumns).AddRow(1, "ops", "", false, time.Now()))
+	mock.ExpectQuery("FROM service_accounts WHERE name").WithArgs("deploy-bot").WillReturnRows(serviceAccountRows(false))
+	if _, err := s.Create(&models.CreateServiceAccountRequest{Name: "deploy-bot", UserGroup: "ops"}); err != ErrServiceAccountExists {
+		t.Errorf("Create with a taken name = %v, want ErrServiceAccountExists", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceAccountKey(t *testing.T) {
+	s, mock := newTestServiceAccountService(t)
+
+	fingerprint, prefix, expiresAt := &captureArg{}, &captureArg{}, &captureArg{}
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectQuery("INSERT INTO service_account_credentials").
+		WithArgs(5, ServiceAccountKey, "ci", fingerprint, prefix, "", expiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+	resp, err := s.CreateKey(5, &models.CreateServiceAccountKeyRequest{Name: "ci", ExpiresInDays: 7})
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+
+	// Only the key's hash is stored
+	if !strings.HasPrefix(resp.Key, ServiceAccountKeyPrefix) || fingerprint.value != hashRefreshToken(resp.Key) ||
+		!strings.HasPrefix(resp.Key, prefix.value.(string)) {
+		t.Errorf("key %q stored as %v, prefix %v", resp.Key, fingerprint.value, prefix.value)
+	}
+	if expiry := time.Until(expiresAt.value.(time.Time)); expiry < 6*24*time.Hour || expiry > 7*24*time.Hour {
+		t.Errorf("key expires in %s, want 7 days", expiry)
+	}
+
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountKey, hashRefreshToken(resp.Key)).
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountKey, hashRefreshToken(resp.Key), nil, nil))
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectExec("UPDATE service_account_credentials SET last_used_at").WithArgs(sqlmock.AnyArg(), "192.0.2.1", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	account, cred, err := s.AuthenticateKey(resp.Key, "192.0.2.1")
+	if err != nil || account.ID != 5 || cred.ID != 3 {
+		t.Fatalf("AuthenticateKey = %+v, %+v, %v", account, cred, err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WillReturnRows(sqlmock.NewRows(serviceAccountCredentialColumns))
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountKey, "", &past, nil))
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountKey, "", nil, &past))
+	for _, name := range []string{"unknown", "expired", "revoked"} {
+		if _, _, err := s.AuthenticateKey(resp.Key, "192.0.2.1"); err != ErrInvalidServiceAccountCredential {
+			t.Errorf("AuthenticateKey(%s) = %v, want ErrInvalidServiceAccountCredential", name, err)
+		}
+	}
+
+	// Revoking is scoped to the account
+	mock.ExpectExec("UPDATE service_account_credentials SET revoked_at").WithArgs(sqlmock.AnyArg(), 3, 6).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.RevokeCredential(6, 3); err != ErrServiceAccountCredentialNotFound {
+		t.Errorf("RevokeCredential(other account) = %v, want ErrServiceAccountCredentialNotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceAccountCertificate(t *testing.T) {
+	s, mock := newTestServiceAccountService(t)
+	cert, certPEM := testCertificate(t, time.Now().Add(30*24*time.Hour))
+	fingerprint := certificateFingerprint(cert)
+
+	_, expiredPEM := testCertificate(t, time.Now().Add(-time.Hour))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")}))
+	for name, pemData := range map[string]string{"not PEM": "certificate", "a key": keyPEM, "expired": expiredPEM} {
+		mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+		if _, err := s.AddCertificate(5, &models.AddServiceAccountCertificateRequest{Certificate: pemData}); !errors.Is(err, ErrInvalidCertificate) {
+			t.Errorf("AddCertificate(%s) = %v, want ErrInvalidCertificate", name, err)
+		}
+	}
+
+	expiresAt := &captureArg{}
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountCertificate, fingerprint).
+		WillReturnRows(sqlmock.NewRows(serviceAccountCredentialColumns))
+	mock.ExpectQuery("INSERT INTO service_account_credentials").
+		WithArgs(5, ServiceAccountCertificate, "ci", fingerprint, "", "CN=deploy-bot,O=Example", expiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+	if _, err := s.AddCertificate(5, &models.AddServiceAccountCertificateRequest{Name: "ci", Certificate: "\n" + certPEM}); err != nil {
+		t.Fatalf("AddCertificate: %v", err)
+	}
+	// The pin ends with the certificate
+	if stored := expiresAt.value.(time.Time); !stored.Equal(cert.NotAfter) {
+		t.Errorf("pin expires at %s, want %s", stored, cert.NotAfter)
+	}
+
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(6).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountCertificate, fingerprint).
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountCertificate, fingerprint, nil, nil))
+	if _, err := s.AddCertificate(6, &models.AddServiceAccountCertificateRequest{Certificate: certPEM}); err != ErrCertificateAlreadyPinned {
+		t.Errorf("AddCertificate(pinned elsewhere) = %v, want ErrCertificateAlreadyPinned", err)
+	}
+
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountCertificate, fingerprint).
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountCertificate, fingerprint, &cert.NotAfter, nil))
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectExec("UPDATE service_account_credentials SET last_used_at").WithArgs(sqlmock.AnyArg(), "192.0.2.1", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if account, _, err := s.AuthenticateCertificate(cert, "192.0.2.1"); err != nil || account.ID != 5 {
+		t.Fatalf("AuthenticateCertificate = %+v, %v", account, err)
+	}
+
+	// Another certificate with the same subject isn't the pinned one
+	other, _ := testCertificate(t, cert.NotAfter)
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").
+		WithArgs(ServiceAccountCertificate, certificateFingerprint(other)).
+		WillReturnRows(sqlmock.NewRows(serviceAccountCredentialColumns))
+	if _, _, err := s.AuthenticateCertificate(other, "192.0.2.1"); err != ErrInvalidServiceAccountCredential {
+		t.Errorf("AuthenticateCertificate(same subject) = %v, want ErrInvalidServiceAccountCredential", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceAccountDisabled(t *testing.T) {
+	s, mock := newTestServiceAccountService(t)
+	cert, _ := testCertificate(t, time.Now().Add(time.Hour))
+
+	disabled := true
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(false))
+	mock.ExpectExec("UPDATE service_accounts SET").WithArgs("", "ops", true, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	if account, err := s.Update(5, &models.UpdateServiceAccountRequest{Disabled: &disabled}); err != nil || !account.Disabled {
+		t.Fatalf("Update = %+v, %v", account, err)
+	}
+
+	// Neither keys nor certificates work, and the use isn't recorded
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountKey, sqlmock.AnyArg()).
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountKey, "", nil, nil))
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(true))
+	if _, _, err := s.AuthenticateKey(ServiceAccountKeyPrefix+"key", "192.0.2.1"); err != ErrServiceAccountDisabled {
+		t.Errorf("AuthenticateKey = %v, want ErrServiceAccountDisabled", err)
+	}
+	mock.ExpectQuery("FROM service_account_credentials WHERE kind").WithArgs(ServiceAccountCertificate, sqlmock.AnyArg()).
+		WillReturnRows(serviceAccountCredentialRows(ServiceAccountCertificate, "", nil, nil))
+	mock.ExpectQuery("FROM service_accounts WHERE id").WithArgs(5).WillReturnRows(serviceAccountRows(true))
+	if _, _, err := s.AuthenticateCertificate(cert, "192.0.2.1"); err != ErrServiceAccountDisabled {
+		t.Errorf("AuthenticateCertificate = %v, want ErrServiceAccountDisabled", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
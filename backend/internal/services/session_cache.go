@@ -0,0 +1,34 @@
+package services
+
+import (
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrSessionEnded = errors.New("session has ended")
+
+// sessionStateEntry is whether a session is still live, cached so checking
+// the session of an access token doesn't cost a query per request.
+type sessionStateEntry struct {
+	userID    int
+	ended     bool
+	expiresAt time.Time
+}
+
+func newSessionStateCache(sessionRepo *repository.SessionRepository, ttl time.Duration) *ttlCache[int, sessionStateEntry] {
+	return newTTLCache(ttl, func(sessionID int) (sessionStateEntry, error) {
+		session, err := sessionRepo.FindByID(sessionID)
+		if err != nil && err != sql.ErrNoRows {
+			return sessionStateEntry{}, err
+		}
+		entry := sessionStateEntry{ended: true}
+		if session != nil {
+			entry.userID = session.UserID
+			entry.ended = session.RevokedAt != nil
+			entry.expiresAt = session.ExpiresAt
+		}
+		return entry, nil
+	})
+}
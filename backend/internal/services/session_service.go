@@ -0,0 +1,264 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// Reasons recorded when a session ends.
+const (
+	SessionLogout  = "logout"
+	SessionRevoked = "revoked"
+	SessionReuse   = "refresh_token_reuse"
+
+	SessionPasswordChange = "password_change"
+	SessionPolicy         = "policy"
+	SessionSuspended      = "suspended"
+)
+
+// SessionService keeps logins alive with rotating refresh tokens. Every
+// refresh hands out a new refresh token and retires the old one; if a retired
+// token comes back, either the client or a thief holds a copy, so the whole
+// session is revoked.
+type SessionService struct {
+	sessionRepo *repository.SessionRepository
+	userRepo    *repository.UserRepository
+	authService *AuthService
+	idleTTL     time.Duration
+	maxAge      time.Duration
+	states      *ttlCache[int, sessionStateEntry]
+}
+
+// NewSessionService ends sessions that go unrefreshed for idleTTL, and all
+// sessions after maxAge. Whether a session is still live is cached for
+// stateTTL.
+func NewSessionService(sessionRepo *repository.SessionRepository, userRepo *repository.UserRepository,
+	authService *AuthService, idleTTL, maxAge, stateTTL time.Duration) *SessionService {
+	return &SessionService{
+		sessionRepo: sessionRepo,
+		userRepo:    userRepo,
+		authService: authService,
+		idleTTL:     idleTTL,
+		maxAge:      maxAge,
+		states:      newSessionStateCache(sessionRepo, stateTTL),
+	}
+}
+
+// CheckSession rejects access tokens whose session was logged out, revoked
+// or has expired, so ending a session also ends the access tokens issued in
+// it rather than only its refreshes.
+func (s *SessionService) CheckSession(sessionID, userID int) error {
+	entry, err := s.states.get(sessionID)
+	if err != nil {
+		return err
+	}
+	if entry.ended || entry.userID != userID || !time.Now().Before(entry.expiresAt) {
+		return ErrSessionEnded
+	}
+	return nil
+}
+
+// Start opens a session for a user authenticated with method (one of the
+// AuthMethod constants), records it as their last login, and returns its
+// first token pair.
+func (s *SessionService) Start(user *models.User, method, ip, userAgent string) (*models.AuthResponse, error) {
+	if err := checkAccount(user); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	session := &models.Session{
+		UserID:     user.ID,
+		IPAddress:  ip,
+		UserAgent:  userAgent,
+		AuthMethod: method,
+		ExpiresAt:  s.expiry(now, now),
+	}
+	if err := s.sessionRepo.Create(session); err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.RecordLogin(user.ID, ip, now); err != nil {
+		return nil, err
+	}
+	return s.issue(user, session.ID)
+}
+
+// Refresh exchanges a refresh token for a new token pair. The returned
+// session id is set whenever the token was recognised, even on error.
+func (s *SessionService) Refresh(refreshToken, ip, userAgent string) (*models.AuthResponse, int, error) {
+	sessionID, reused, err := s.sessionRepo.UseRefreshToken(hashRefreshToken(refreshToken))
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	session, err := s.sessionRepo.FindByID(sessionID)
+	if err != nil {
+		return nil, sessionID, err
+	}
+	if reused {
+		if _, err := s.revoke(session, SessionReuse); err != nil {
+			return nil, sessionID, err
+		}
+		return nil, sessionID, ErrRefreshTokenReused
+	}
+
+	now := time.Now().UTC()
+	if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return nil, sessionID, ErrInvalidRefreshToken
+	}
+
+	// Reload the user so role and group changes reach the new access token
+	user, err := s.userRepo.FindByID(session.UserID)
+	if err == sql.ErrNoRows {
+		return nil, sessionID, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, sessionID, err
+	}
+	if checkAccount(user) != nil {
+		if _, err := s.revoke(session, SessionSuspended); err != nil {
+			return nil, sessionID, err
+		}
+		return nil, sessionID, ErrInvalidRefreshToken
+	}
+
+	// Policy changes also reach sessions opened before them
+	if err := s.authService.CheckAuthMethod(user, session.AuthMethod); err != nil {
+		if errors.Is(err, ErrPhishingResistantRequired) {
+			if _, err := s.revoke(session, SessionPolicy); err != nil {
+				return nil, sessionID, err
+			}
+		}
+		return nil, sessionID, err
+	}
+
+	if err := s.sessionRepo.Touch(session.ID, ip, userAgent, s.expiry(session.CreatedAt, now)); err != nil {
+		return nil, sessionID, err
+	}
+	s.states.invalidate(session.ID)
+	resp, err := s.issue(user, session.ID)
+	return resp, sessionID, err
+}
+
+// Logout ends the session a refresh token belongs to. Unknown tokens are
+// ignored; the returned session id is 0 for them.
+func (s *SessionService) Logout(refreshToken string) (int, error) {
+	sessionID, _, err := s.sessionRepo.UseRefreshToken(hashRefreshToken(refreshToken))
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	session, err := s.sessionRepo.FindByID(sessionID)
+	if err != nil {
+		return sessionID, err
+	}
+	_, err = s.revoke(session, SessionLogout)
+	return sessionID, err
+}
+
+// List returns a user's active sessions, flagging currentID as the caller's own.
+func (s *SessionService) List(userID, currentID int) ([]models.Session, error) {
+	sessions, err := s.sessionRepo.FindActiveByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	return sessions, nil
+}
+
+// AuthMethod returns how a session was authenticated.
+func (s *SessionService) AuthMethod(sessionID int) (string, error) {
+	session, err := s.sessionRepo.FindByID(sessionID)
+	if err != nil {
+		return "", err
+	}
+	return session.AuthMethod, nil
+}
+
+func (s *SessionService) Revoke(userID, sessionID int) error {
+	revoked, err := s.sessionRepo.Revoke(sessionID, userID, SessionRevoked)
+	s.states.invalidate(sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *SessionService) RevokeAll(userID int, reason string) (int, error) {
+	count, err := s.sessionRepo.RevokeAllForUser(userID, reason)
+	s.states.invalidateWhere(func(entry sessionStateEntry) bool { return entry.userID == userID })
+	return count, err
+}
+
+func (s *SessionService) revoke(session *models.Session, reason string) (bool, error) {
+	revoked, err := s.sessionRepo.Revoke(session.ID, session.UserID, reason)
+	s.states.invalidate(session.ID)
+	return revoked, err
+}
+
+func (s *SessionService) issue(user *models.User, sessionID int) (*models.AuthResponse, error) {
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sessionRepo.CreateRefreshToken(sessionID, hashRefreshToken(refreshToken)); err != nil {
+		return nil, err
+	}
+
+	token, err := s.authService.GenerateToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.AuthResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.authService.AccessTokenTTL().Seconds()),
+		User:         *user,
+	}, nil
+}
+
+// expiry is the idle deadline, capped by the session's maximum age.
+func (s *SessionService) expiry(createdAt, now time.Time) time.Time {
+	expiresAt := now.Add(s.idleTTL)
+	if limit := createdAt.UTC().Add(s.maxAge); expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
+}
+
+func newRefreshToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
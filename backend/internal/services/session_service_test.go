@@ -0,0 +1,270 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testTokenSigner signs with a fresh Ed25519 key.
+func testTokenSigner(t *testing.T) *TokenSigner {
+	t.Helper()
+	private, _, _, err := GenerateTokenSigningKey("EdDSA", 0)
+	if err != nil {
+		t.Fatalf("GenerateTokenSigningKey: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, private, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SIGNING_KEYS", path)
+	t.Setenv("JWT_VERIFY_KEYS", "")
+	signer, err := NewTokenSignerFromEnv()
+	if err != nil {
+		t.Fatalf("NewTokenSignerFromEnv: %v", err)
+	}
+	return signer
+}
+
+var testUserColumns = []string{"id", "email", "password", "role", "user_group", "created_at", "token_generation",
+	"auth_source", "external_id", "status", "suspended_reason", "status_changed_at", "expires_at", "last_login_at",
+	"last_login_ip"}
+
+func userRows(users ...*models.User) *sqlmock.Rows {
+	rows := sqlmock.NewRows(testUserColumns)
+	for _, u := range users {
+		rows.AddRow(u.ID, u.Email, u.Password, u.Role, u.UserGroup, u.CreatedAt, u.TokenGeneration, u.AuthSource,
+			u.ExternalID, u.Status, u.SuspendedReason, u.StatusChangedAt, u.ExpiresAt, u.LastLoginAt, u.LastLoginIP)
+	}
+	return rows
+}
+
+func testUser(id int, email string) *models.User {
+	return &models.User{ID: id, Email: email, Role: "user", UserGroup: "junior", AuthSource: AuthSourceLocal,
+		Status: UserActive, CreatedAt: time.Now()}
+}
+
+var testSessionColumns = []string{"id", "user_id", "ip_address", "user_agent", "auth_method", "created_at",
+	"last_used_at", "expires_at", "revoked_at", "revoked_reason"}
+
+func sessionRows(id, userID int, expiresAt time.Time, revokedAt *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows(testSessionColumns).AddRow(id, userID, "", "", AuthMethodPassword,
+		time.Now().Add(-time.Hour), time.Now(), expiresAt, revokedAt, "")
+}
+
+func newTestSessionService(t *testing.T) (*SessionService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	auth := testAuthService(t, db)
+	sessions := NewSessionService(repository.NewSessionRepository(db), auth.userRepo, auth, time.Hour, 24*time.Hour, time.Minute)
+	return sessions, mock
+}
+
+func expectUseRefreshToken(mock sqlmock.Sqlmock, token string, sessionID int) {
+	mock.ExpectQuery("UPDATE refresh_tokens SET used_at").WithArgs(sqlmock.AnyArg(), hashRefreshToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id"}).AddRow(sessionID))
+}
+
+func expectReusedRefreshToken(mock sqlmock.Sqlmock, token string, sessionID int) {
+	mock.ExpectQuery("UPDATE refresh_tokens SET used_at").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT session_id FROM refresh_tokens").WithArgs(hashRefreshToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id"}).AddRow(sessionID))
+}
+
+func TestSessionRefreshRotatesRefreshToken(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+	user := testUser(3, "alice@example.com")
+
+	expectUseRefreshToken(mock, "old-token", 5)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(user))
+	mock.ExpectExec("UPDATE sessions SET last_used_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	newHash := &captureArg{}
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(5, newHash).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, sessionID, err := sessions.Refresh("old-token", "10.0.0.1", "test")
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if sessionID != 5 || resp.RefreshToken == "old-token" || hashRefreshToken(resp.RefreshToken) != newHash.value {
+		t.Fatalf("Refresh did not hand out a new stored refresh token: %+v", resp)
+	}
+	claims, err := sessions.authService.ParseToken(resp.Token)
+	if err != nil {
+		t.Fatalf("ParseToken: %v", err)
+	}
+	if claims["sid"] != float64(5) || claims["user_id"] != float64(3) {
+		t.Fatalf("access token claims = %v", claims)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRefreshTokenReuseRevokesSession(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+
+	// An access token of the session works until the reuse is detected
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	if err := sessions.CheckSession(5, 3); err != nil {
+		t.Fatalf("CheckSession before reuse: %v", err)
+	}
+
+	expectReusedRefreshToken(mock, "stolen-token", 5)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionReuse, 5, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, _, err := sessions.Refresh("stolen-token", "", ""); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("Refresh(reused) = %v, want ErrRefreshTokenReused", err)
+	}
+
+	now := time.Now()
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, now.Add(time.Hour), &now))
+	if err := sessions.CheckSession(5, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("CheckSession after reuse = %v, want ErrSessionEnded", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionLogoutEndsAccessTokens(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	if err := sessions.CheckSession(5, 3); err != nil {
+		t.Fatalf("CheckSession: %v", err)
+	}
+
+	expectUseRefreshToken(mock, "token", 5)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionLogout, 5, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := sessions.Logout("token"); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+
+	now := time.Now()
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, now.Add(time.Hour), &now))
+	if err := sessions.CheckSession(5, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("CheckSession after logout = %v, want ErrSessionEnded", err)
+	}
+}
+
+func TestSessionRevokeEndsAccessTokens(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+	now := time.Now()
+
+	for _, id := range []int{5, 6} {
+		mock.ExpectQuery("FROM sessions WHERE id").WithArgs(id).WillReturnRows(sessionRows(id, 3, now.Add(time.Hour), nil))
+		if err := sessions.CheckSession(id, 3); err != nil {
+			t.Fatalf("CheckSession(%d): %v", id, err)
+		}
+	}
+
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionRevoked, 5, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := sessions.Revoke(3, 5); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, now.Add(time.Hour), &now))
+	if err := sessions.CheckSession(5, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("CheckSession after Revoke = %v, want ErrSessionEnded", err)
+	}
+
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionSuspended, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := sessions.RevokeAll(3, SessionSuspended); err != nil {
+		t.Fatalf("RevokeAll: %v", err)
+	}
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(6).WillReturnRows(sessionRows(6, 3, now.Add(time.Hour), &now))
+	if err := sessions.CheckSession(6, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("CheckSession after RevokeAll = %v, want ErrSessionEnded", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSession(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, time.Now().Add(time.Hour), nil))
+	for i := 0; i < 3; i++ {
+		// Cached after the first lookup
+		if err := sessions.CheckSession(5, 3); err != nil {
+			t.Fatalf("CheckSession: %v", err)
+		}
+	}
+	if err := sessions.CheckSession(5, 4); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("CheckSession(another user's session) = %v, want ErrSessionEnded", err)
+	}
+
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(6).WillReturnRows(sessionRows(6, 3, time.Now().Add(-time.Second), nil))
+	if err := sessions.CheckSession(6, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("CheckSession(expired) = %v, want ErrSessionEnded", err)
+	}
+
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(7).WillReturnRows(sqlmock.NewRows(testSessionColumns))
+	if err := sessions.CheckSession(7, 3); !errors.Is(err, ErrSessionEnded) {
+		t.Errorf("CheckSession(missing) = %v, want ErrSessionEnded", err)
+	}
+
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(8).WillReturnError(errors.New("connection refused"))
+	if err := sessions.CheckSession(8, 3); err == nil || errors.Is(err, ErrSessionEnded) {
+		t.Errorf("CheckSession(database down) = %v, want the database error", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRefreshRefusesEndedSessions(t *testing.T) {
+	sessions, mock := newTestSessionService(t)
+	now := time.Now()
+
+	expectUseRefreshToken(mock, "revoked", 5)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(5).WillReturnRows(sessionRows(5, 3, now.Add(time.Hour), &now))
+	if _, _, err := sessions.Refresh("revoked", "", ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(revoked session) = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	expectUseRefreshToken(mock, "expired", 6)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(6).WillReturnRows(sessionRows(6, 3, now.Add(-time.Minute), nil))
+	if _, _, err := sessions.Refresh("expired", "", ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(expired session) = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	suspended := testUser(3, "alice@example.com")
+	suspended.Status = UserSuspended
+	expectUseRefreshToken(mock, "suspended", 7)
+	mock.ExpectQuery("FROM sessions WHERE id").WithArgs(7).WillReturnRows(sessionRows(7, 3, now.Add(time.Hour), nil))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(suspended))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), SessionSuspended, 7, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, _, err := sessions.Refresh("suspended", "", ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(suspended user) = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	mock.ExpectQuery("UPDATE refresh_tokens SET used_at").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT session_id FROM refresh_tokens").WillReturnError(sql.ErrNoRows)
+	if _, _, err := sessions.Refresh("unknown", "", ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh(unknown) = %v, want ErrInvalidRefreshToken", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
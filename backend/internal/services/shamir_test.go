@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	mathrand "math/rand"
+	"testing"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			p := gfMul(byte(a), byte(b))
+			if p != gfMulSlow(byte(a), byte(b)) {
+				t.Fatalf("gfMul(%d, %d) disagrees with gfMulSlow", a, b)
+			}
+			if gfDiv(p, byte(b)) != byte(a) {
+				t.Fatalf("gfDiv(gfMul(%d, %d), %d) != %d", a, b, b, a)
+			}
+		}
+	}
+}
+
+func TestShamirThresholdRecovery(t *testing.T) {
+	secret := []byte("correct horse battery staple 32b")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("SplitSecret: %v", err)
+	}
+
+	subsets := [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}}
+	for _, subset := range subsets {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		got, err := CombineShares(picked)
+		if err != nil {
+			t.Fatalf("CombineShares(%v): %v", subset, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("CombineShares(%v) = %q", subset, got)
+		}
+	}
+}
+
+func TestShamirBelowThresholdDoesNotRecover(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("SplitSecret: %v", err)
+	}
+
+	got, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatalf("CombineShares: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("two shares of a 3-of-5 split recovered the secret")
+	}
+}
+
+func TestShamirRejectsDuplicateAndMalformedShares(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("SplitSecret: %v", err)
+	}
+
+	zeroIndex := append([]byte{0}, shares[1][1:]...)
+	tests := map[string][][]byte{
+		"none":             nil,
+		"duplicate":        {shares[0], shares[0]},
+		"same index":       {shares[0], append([]byte{shares[0][0]}, shares[1][1:]...)},
+		"zero index":       {shares[0], zeroIndex},
+		"different length": {shares[0], shares[1][:len(shares[1])-1]},
+		"index only":       {{1}, {2}},
+	}
+	for name, input := range tests {
+		if _, err := CombineShares(input); err == nil {
+			t.Errorf("%s: CombineShares accepted bad shares", name)
+		}
+	}
+}
+
+func TestShamirCorruptedShareChangesSecret(t *testing.T) {
+	secret := []byte("another secret")
+	shares, _ := SplitSecret(secret, 3, 2)
+	shares[1][3] ^= 0x40
+
+	got, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatalf("CombineShares: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("a corrupted share still recovered the secret")
+	}
+}
+
+func TestShamirRandomRoundTrip(t *testing.T) {
+	rng := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		secret := make([]byte, 1+rng.Intn(64))
+		rand.Read(secret)
+		n := 1 + rng.Intn(20)
+		threshold := 1 + rng.Intn(n)
+
+		shares, err := SplitSecret(secret, n, threshold)
+		if err != nil {
+			t.Fatalf("SplitSecret(n=%d, k=%d): %v", n, threshold, err)
+		}
+		rng.Shuffle(len(shares), func(a, b int) { shares[a], shares[b] = shares[b], shares[a] })
+
+		got, err := CombineShares(shares[:threshold])
+		if err != nil {
+			t.Fatalf("CombineShares(n=%d, k=%d): %v", n, threshold, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("round trip n=%d k=%d: got %x, want %x", n, threshold, got, secret)
+		}
+	}
+}
+
+func TestSplitSecretValidatesParameters(t *testing.T) {
+	for _, tt := range []struct{ n, k, size int }{{3, 4, 8}, {3, 0, 8}, {256, 2, 8}, {3, 2, 0}} {
+		if _, err := SplitSecret(make([]byte, tt.size), tt.n, tt.k); err == nil {
+			t.Errorf("SplitSecret(size %d, n=%d, k=%d) accepted bad parameters", tt.size, tt.n, tt.k)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streaming authenticated encryption for documents, following the STREAM
+// construction: the plaintext is cut into fixed-size chunks, each sealed with
+// AES-GCM under a nonce made of a random per-file prefix, the chunk counter and
+// a flag marking the final chunk. Reordering, dropping or truncating chunks all
+// fail authentication.
+//
+// Layout: magic | nonce prefix | sealed chunk... (each chunk plus GCM tag)
+
+const (
+	streamChunkSize   = 64 * 1024
+	streamPrefixSize  = 7
+	streamMagic       = "CSDOC1"
+	streamOverhead    = 16
+	streamSealedChunk = streamChunkSize + streamOverhead
+)
+
+var ErrStreamCorrupt = errors.New("encrypted document is corrupt or has been tampered with")
+
+// DocumentKeyAAD ties a document's wrapped data key to the document, so a key
+// copied onto another document's row fails to unwrap.
+func DocumentKeyAAD(documentID int) []byte {
+	return []byte(fmt.Sprintf("document:%d|field:wrapped_key", documentID))
+}
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptingReader struct {
+	aead    cipher.AEAD
+	src     io.Reader
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	out     bytes.Buffer
+	done    bool
+}
+
+// NewEncryptingReader returns a reader yielding the encrypted form of src.
+func NewEncryptingReader(key []byte, src io.Reader) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	r := &encryptingReader{
+		aead:   aead,
+		src:    src,
+		prefix: prefix,
+		// One byte more than a chunk, to know whether the chunk is the last
+		plain: make([]byte, 0, streamChunkSize+1),
+	}
+	r.out.WriteString(streamMagic)
+	r.out.Write(prefix)
+	return r, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+func (r *encryptingReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain[len(r.plain):cap(r.plain)])
+	r.plain = r.plain[:len(r.plain)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := len(r.plain) <= streamChunkSize
+	chunk := r.plain
+	if !last {
+		chunk = r.plain[:streamChunkSize]
+	}
+	if r.counter == ^uint32(0) {
+		return errors.New("document too large to encrypt")
+	}
+
+	r.out.Write(r.aead.Seal(nil, streamNonce(r.prefix, r.counter, last), chunk, nil))
+	r.counter++
+
+	if last {
+		r.done = true
+		r.plain = r.plain[:0]
+		return nil
+	}
+	// Keep the extra byte for the next chunk
+	r.plain = append(r.plain[:0], r.plain[streamChunkSize:]...)
+	return nil
+}
+
+type decryptingReader struct {
+	aead    cipher.AEAD
+	src     io.Reader
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	out     bytes.Buffer
+	done    bool
+}
+
+// NewDecryptingReader returns a reader yielding the plaintext of an encrypted
+// document, failing with ErrStreamCorrupt if any chunk doesn't authenticate.
+func NewDecryptingReader(key []byte, src io.Reader) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(streamMagic)+streamPrefixSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamCorrupt
+	}
+
+	return &decryptingReader{
+		aead:   aead,
+		src:    src,
+		prefix: header[len(streamMagic):],
+		sealed: make([]byte, 0, streamSealedChunk+1),
+	}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+func (r *decryptingReader) openNext() error {
+	n, err := io.ReadFull(r.src, r.sealed[len(r.sealed):cap(r.sealed)])
+	r.sealed = r.sealed[:len(r.sealed)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := len(r.sealed) <= streamSealedChunk
+	chunk := r.sealed
+	if !last {
+		chunk = r.sealed[:streamSealedChunk]
+	}
+
+	plain, err := r.aead.Open(nil, streamNonce(r.prefix, r.counter, last), chunk, nil)
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+	r.out.Write(plain)
+	r.counter++
+
+	if last {
+		r.done = true
+		return nil
+	}
+	r.sealed = append(r.sealed[:0], r.sealed[streamSealedChunk:]...)
+	return nil
+}
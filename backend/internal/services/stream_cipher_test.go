@@ -0,0 +1,157 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptDocument(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	r, err := NewEncryptingReader(key, bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatalf("NewEncryptingReader: %v", err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	return sealed
+}
+
+func decryptDocument(key, sealed []byte) ([]byte, error) {
+	r, err := NewDecryptingReader(key, bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// chunkAt returns the byte range of sealed chunk i.
+func chunkAt(i int) (int, int) {
+	start := len(streamMagic) + streamPrefixSize + i*streamSealedChunk
+	return start, start + streamSealedChunk
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, _ := NewDataKey()
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		sealed := encryptDocument(t, key, plaintext)
+		chunks := (size + streamChunkSize - 1) / streamChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		if want := len(streamMagic) + streamPrefixSize + size + chunks*streamOverhead; len(sealed) != want {
+			t.Errorf("size %d: sealed %d bytes, want %d", size, len(sealed), want)
+		}
+
+		got, err := decryptDocument(key, sealed)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestStreamRejectsTruncation(t *testing.T) {
+	key, _ := NewDataKey()
+	plaintext := make([]byte, 3*streamChunkSize+100)
+	sealed := encryptDocument(t, key, plaintext)
+
+	_, end := chunkAt(1)
+	cuts := map[string]int{
+		"whole chunks dropped": end,
+		"mid chunk":            end - 1000,
+		"last byte":            len(sealed) - 1,
+		"header only":          len(streamMagic) + streamPrefixSize,
+		"partial header":       3,
+	}
+	for name, cut := range cuts {
+		if _, err := decryptDocument(key, sealed[:cut]); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%s: decrypt = %v, want ErrStreamCorrupt", name, err)
+		}
+	}
+}
+
+func TestStreamRejectsReorderedChunks(t *testing.T) {
+	key, _ := NewDataKey()
+	plaintext := make([]byte, 3*streamChunkSize)
+	rand.Read(plaintext)
+	sealed := encryptDocument(t, key, plaintext)
+
+	s0, e0 := chunkAt(0)
+	s1, e1 := chunkAt(1)
+	swapped := append([]byte(nil), sealed[:s0]...)
+	swapped = append(swapped, sealed[s1:e1]...)
+	swapped = append(swapped, sealed[s0:e0]...)
+	swapped = append(swapped, sealed[e1:]...)
+
+	if _, err := decryptDocument(key, swapped); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("decrypt(reordered) = %v, want ErrStreamCorrupt", err)
+	}
+}
+
+func TestStreamLastChunkFlag(t *testing.T) {
+	key, _ := NewDataKey()
+	plaintext := make([]byte, 2*streamChunkSize+5)
+	rand.Read(plaintext)
+	sealed := encryptDocument(t, key, plaintext)
+	aead, _ := newStreamAEAD(key)
+	prefix := sealed[len(streamMagic) : len(streamMagic)+streamPrefixSize]
+
+	// Middle chunks are sealed without the last flag, so dropping everything
+	// after one doesn't pass as a complete, shorter document
+	s1, e1 := chunkAt(1)
+	if _, err := aead.Open(nil, streamNonce(prefix, 1, false), sealed[s1:e1], nil); err != nil {
+		t.Fatalf("chunk 1 does not open as a middle chunk: %v", err)
+	}
+	if _, err := decryptDocument(key, sealed[:e1]); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("decrypt(without final chunk) = %v, want ErrStreamCorrupt", err)
+	}
+
+	// The final chunk only opens with the last flag set
+	s2, _ := chunkAt(2)
+	if _, err := aead.Open(nil, streamNonce(prefix, 2, false), sealed[s2:], nil); err == nil {
+		t.Fatal("final chunk opened without the last flag")
+	}
+	if _, err := aead.Open(nil, streamNonce(prefix, 2, true), sealed[s2:], nil); err != nil {
+		t.Fatalf("final chunk does not open with the last flag: %v", err)
+	}
+
+	// Appending a chunk after the final one is detected
+	if _, err := decryptDocument(key, append(append([]byte(nil), sealed...), sealed[s1:e1]...)); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("decrypt(chunk appended) = %v, want ErrStreamCorrupt", err)
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key, _ := NewDataKey()
+	plaintext := make([]byte, streamChunkSize+10)
+	sealed := encryptDocument(t, key, plaintext)
+
+	positions := map[string]int{
+		"magic":        0,
+		"nonce prefix": len(streamMagic),
+		"first chunk":  len(streamMagic) + streamPrefixSize + 10,
+		"last tag":     len(sealed) - 1,
+	}
+	for name, pos := range positions {
+		tampered := append([]byte(nil), sealed...)
+		tampered[pos] ^= 0x01
+		if _, err := decryptDocument(key, tampered); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%s flipped: decrypt = %v, want ErrStreamCorrupt", name, err)
+		}
+	}
+
+	otherKey, _ := NewDataKey()
+	if _, err := decryptDocument(otherKey, sealed); !errors.Is(err, ErrStreamCorrupt) {
+		t.Errorf("decrypt with another key = %v, want ErrStreamCorrupt", err)
+	}
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"credential-store/internal/repository"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// tokenGenerationEntry is a user's current token generation, status and
+// expiry, cached so checking a token doesn't cost a query per request.
+type tokenGenerationEntry struct {
+	generation int
+	status     string
+	expiresAt  *time.Time
+	deleted    bool
+}
+
+func newTokenGenerationCache(userRepo *repository.UserRepository, ttl time.Duration) *ttlCache[int, tokenGenerationEntry] {
+	return newTTLCache(ttl, func(userID int) (tokenGenerationEntry, error) {
+		generation, status, expiresAt, err := userRepo.FindTokenState(userID)
+		if err != nil && err != sql.ErrNoRows {
+			return tokenGenerationEntry{}, err
+		}
+		return tokenGenerationEntry{
+			generation: generation,
+			status:     status,
+			expiresAt:  expiresAt,
+			deleted:    err == sql.ErrNoRows,
+		}, nil
+	})
+}
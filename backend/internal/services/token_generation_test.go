@@ -0,0 +1,143 @@
+package services
+
+import (
+	"credential-store/internal/models"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func tokenStateRows(generation int, status string, expiresAt *time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"token_generation", "status", "expires_at"}).AddRow(generation, status, expiresAt)
+}
+
+func TestCheckToken(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name       string
+		generation int
+		status     string
+		expiresAt  *time.Time
+		want       error
+	}{
+		{"current", 2, UserActive, nil, nil},
+		{"not expired yet", 2, UserActive, &future, nil},
+		{"older generation", 3, UserActive, nil, ErrTokenRevoked},
+		{"suspended", 2, UserSuspended, nil, ErrAccountSuspended},
+		{"expired", 2, UserActive, &past, ErrAccountExpired},
+	}
+	for _, tt := range tests {
+		s, mock := newTestAuthService(t)
+		mock.ExpectQuery("SELECT token_generation, status, expires_at FROM users").WithArgs(1).
+			WillReturnRows(tokenStateRows(tt.generation, tt.status, tt.expiresAt))
+		if err := s.CheckToken(1, 2); err != tt.want {
+			t.Errorf("%s: CheckToken = %v, want %v", tt.name, err, tt.want)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// Deleted users' tokens are revoked
+	s, mock := newTestAuthService(t)
+	mock.ExpectQuery("SELECT token_generation").WithArgs(5).WillReturnError(sql.ErrNoRows)
+	if err := s.CheckToken(5, 1); err != ErrTokenRevoked {
+		t.Errorf("CheckToken(deleted) = %v, want ErrTokenRevoked", err)
+	}
+}
+
+func TestCheckTokenCachesState(t *testing.T) {
+	s, mock := newTestAuthService(t)
+
+	// Failed lookups aren't cached
+	mock.ExpectQuery("SELECT token_generation").WithArgs(1).WillReturnError(sql.ErrConnDone)
+	if err := s.CheckToken(1, 1); err != sql.ErrConnDone {
+		t.Fatalf("CheckToken = %v, want the database error", err)
+	}
+
+	mock.ExpectQuery("SELECT token_generation").WithArgs(1).WillReturnRows(tokenStateRows(1, UserActive, nil))
+	for i := 0; i < 3; i++ {
+		if err := s.CheckToken(1, 1); err != nil {
+			t.Fatalf("CheckToken: %v", err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change made by another instance shows once the entry is stale
+	s.generations.mu.Lock()
+	entry := s.generations.entries[1]
+	entry.fetchedAt = time.Now().Add(-2 * time.Minute)
+	s.generations.entries[1] = entry
+	s.generations.mu.Unlock()
+	mock.ExpectQuery("SELECT token_generation").WithArgs(1).WillReturnRows(tokenStateRows(2, UserActive, nil))
+	if err := s.CheckToken(1, 1); err != ErrTokenRevoked {
+		t.Fatalf("CheckToken after another instance bumped the generation = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenGenerationInvalidatedOnChange(t *testing.T) {
+	alice := testUser(1, "alice@example.com")
+	tests := []struct {
+		name   string
+		change func(s *AuthService, mock sqlmock.Sqlmock) error
+	}{
+		{"update", func(s *AuthService, mock sqlmock.Sqlmock) error {
+			mock.ExpectQuery("FROM users WHERE id").WithArgs(1).WillReturnRows(userRows(alice))
+			mock.ExpectQuery("UPDATE users SET email").
+				WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(2))
+			_, err := s.UpdateUser("1", &models.UpdateUserRequest{Role: "admin"})
+			return err
+		}},
+		{"delete", func(s *AuthService, mock sqlmock.Sqlmock) error {
+			mock.ExpectExec("DELETE FROM users").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			return s.DeleteUser("1")
+		}},
+		{"password change", func(s *AuthService, mock sqlmock.Sqlmock) error {
+			mock.ExpectExec("UPDATE users SET password").WithArgs(sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			return s.SetPassword(alice, "a new password")
+		}},
+		{"suspension", func(s *AuthService, mock sqlmock.Sqlmock) error {
+			mock.ExpectExec("UPDATE users SET status").WithArgs(UserSuspended, SuspendedByAdmin, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			return s.SetStatus(1, UserSuspended, SuspendedByAdmin)
+		}},
+		{"expiry", func(s *AuthService, mock sqlmock.Sqlmock) error {
+			mock.ExpectExec("UPDATE users SET expires_at").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("FROM users WHERE id").WithArgs(1).WillReturnRows(userRows(alice))
+			_, err := s.SetExpiry(1, nil)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		s, mock := newTestAuthService(t)
+		var err error
+		if s.passwords, err = NewPasswordPolicy(PasswordRules{}, ""); err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery("SELECT token_generation").WithArgs(1).WillReturnRows(tokenStateRows(1, UserActive, nil))
+		if err := s.CheckToken(1, 1); err != nil {
+			t.Fatalf("%s: CheckToken before: %v", tt.name, err)
+		}
+
+		if err := tt.change(s, mock); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// The old token stops working on this instance at once, not after the TTL
+		mock.ExpectQuery("SELECT token_generation").WithArgs(1).WillReturnRows(tokenStateRows(2, UserActive, nil))
+		if err := s.CheckToken(1, 1); err != ErrTokenRevoked {
+			t.Errorf("%s: CheckToken after = %v, want ErrTokenRevoked", tt.name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNoSigningKey = errors.New("JWT_SIGNING_KEYS is required: set at least one RS256 or EdDSA private key")
+
+// RSA keys shorter than this are refused.
+const minRSABits = 2048
+
+type tokenKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// nil for retired keys, which only verify
+	private crypto.Signer
+	public  crypto.PublicKey
+	// When the key starts signing; zero for right away
+	activeFrom time.Time
+}
+
+// TokenSigner signs access tokens with RSA (RS256) or Ed25519 (EdDSA) keys
+// and verifies them by the kid in their header. All keys are published as a
+// JWKS, so other services can verify our tokens.
+//
+//	JWT_SIGNING_KEYS  comma separated PEM private key files, each optionally
+//	                  followed by "@" and the RFC 3339 time it starts signing
+//	JWT_VERIFY_KEYS   comma separated PEM public key files of retired keys,
+//	                  still accepted until the tokens they signed expire
+//
+// Tokens are signed with the key that became active last. A key scheduled
+// for later is published, and accepted, right away, so verifiers already
+// know it when it takes over. Key ids are RFC 7638 thumbprints. Keys are
+// read once; changing them takes a restart.
+type TokenSigner struct {
+	keys []*tokenKey
+	jwks []byte
+}
+
+// NewTokenSignerFromEnv returns ErrNoSigningKey without a signing key, except
+// with DEV_MODE=true, where it makes up a key that lasts until the restart.
+func NewTokenSignerFromEnv() (*TokenSigner, error) {
+	s := &TokenSigner{}
+	for _, entry := range splitList(os.Getenv("JWT_SIGNING_KEYS")) {
+		path, activeFrom := entry, time.Time{}
+		if i := strings.LastIndexByte(entry, '@'); i >= 0 {
+			t, err := time.Parse(time.RFC3339, entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("JWT_SIGNING_KEYS: %q: %w", entry, err)
+			}
+			path, activeFrom = entry[:i], t
+		}
+		key, err := readPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS: %w", err)
+		}
+		private, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS: %s is not a private key", path)
+		}
+		if err := s.add(private.Public(), private, activeFrom); err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS: %s: %w", path, err)
+		}
+	}
+	for _, path := range splitList(os.Getenv("JWT_VERIFY_KEYS")) {
+		key, err := readPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFY_KEYS: %w", err)
+		}
+		if err := s.add(key, nil, time.Time{}); err != nil {
+			return nil, fmt.Errorf("JWT_VERIFY_KEYS: %s: %w", path, err)
+		}
+	}
+
+	if len(s.keys) == 0 || s.keys[0].private == nil {
+		if !IsDevMode() {
+			return nil, ErrNoSigningKey
+		}
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("WARNING: signing access tokens with a temporary key (DEV_MODE); they stop working on restart")
+		if err := s.add(private.Public(), private, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	if s.current(time.Now()) == nil {
+		return nil, errors.New("JWT_SIGNING_KEYS: no key is active yet")
+	}
+
+	set := jwkSet{Keys: make([]jwk, len(s.keys))}
+	for i, k := range s.keys {
+		set.Keys[i] = newJWK(k.public, k.method.Alg(), k.kid)
+	}
+	jwks, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	s.jwks = jwks
+	return s, nil
+}
+
+// add keeps signing keys ahead of retired ones.
+func (s *TokenSigner) add(public crypto.PublicKey, private crypto.Signer, activeFrom time.Time) error {
+	var method jwt.SigningMethod
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA keys must have at least %d bits", minRSABits)
+		}
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return errors.New("only RSA and Ed25519 keys are supported")
+	}
+	kid := newJWK(public, method.Alg(), "").Kid
+	for _, k := range s.keys {
+		if k.kid == kid {
+			return errors.New("the key is listed twice")
+		}
+	}
+
+	key := &tokenKey{kid: kid, method: method, private: private, public: public, activeFrom: activeFrom}
+	if private == nil {
+		s.keys = append(s.keys, key)
+		return nil
+	}
+	i := 0
+	for i < len(s.keys) && s.keys[i].private != nil {
+		i++
+	}
+	s.keys = append(s.keys[:i], append([]*tokenKey{key}, s.keys[i:]...)...)
+	return nil
+}
+
+// current is the signing key that became active last, the first listed if
+// several did at once.
+func (s *TokenSigner) current(now time.Time) *tokenKey {
+	var current *tokenKey
+	for _, k := range s.keys {
+		if k.private == nil || k.activeFrom.After(now) {
+			continue
+		}
+		if current == nil || k.activeFrom.After(current.activeFrom) {
+			current = k
+		}
+	}
+	return current
+}
+
+// KeyID is the kid of the key signing tokens now.
+func (s *TokenSigner) KeyID() string {
+	return s.current(time.Now()).kid
+}
+
+func (s *TokenSigner) Sign(claims jwt.Claims) (string, error) {
+	key := s.current(time.Now())
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token's signature and expiry and returns its claims.
+func (s *TokenSigner) Parse(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, k := range s.keys {
+			if k.kid == kid {
+				if token.Method.Alg() != k.method.Alg() {
+					return nil, errors.New("token algorithm does not match its key")
+				}
+				return k.public, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set document.
+func (s *TokenSigner) JWKS() []byte {
+	return s.jwks
+}
+
+// GenerateTokenSigningKey makes a new signing key for alg, RS256 or EdDSA,
+// and returns it and its public half as PEM, along with its kid.
+func GenerateTokenSigningKey(alg string, rsaBits int) (private, public []byte, kid string, err error) {
+	var key crypto.Signer
+	switch alg {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case jwt.SigningMethodRS256.Alg():
+		if rsaBits < minRSABits {
+			return nil, nil, "", fmt.Errorf("RSA keys must have at least %d bits", minRSABits)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	default:
+		return nil, nil, "", fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	private = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+	public = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	return private, public, newJWK(key.Public(), alg, "").Kid, nil
+}
+
+func readPEMKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
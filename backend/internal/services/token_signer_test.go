@@ -0,0 +1,275 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeSigningKey writes a new key pair for alg to dir and returns the paths
+// of its private and public halves, and its kid.
+func writeSigningKey(t *testing.T, dir, name, alg string) (string, string, string) {
+	t.Helper()
+	private, public, kid, err := GenerateTokenSigningKey(alg, minRSABits)
+	if err != nil {
+		t.Fatalf("GenerateTokenSigningKey(%s): %v", alg, err)
+	}
+	privatePath := filepath.Join(dir, name+".pem")
+	publicPath := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(privatePath, private, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, public, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath, kid
+}
+
+func readSigningKey(t *testing.T, path string) crypto.Signer {
+	t.Helper()
+	key, err := readPEMKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(crypto.Signer)
+}
+
+func newTestTokenSigner(t *testing.T, signing, verify string) *TokenSigner {
+	t.Helper()
+	t.Setenv("DEV_MODE", "")
+	t.Setenv("JWT_SIGNING_KEYS", signing)
+	t.Setenv("JWT_VERIFY_KEYS", verify)
+	s, err := NewTokenSignerFromEnv()
+	if err != nil {
+		t.Fatalf("NewTokenSignerFromEnv: %v", err)
+	}
+	return s
+}
+
+// signWith signs claims as if by key, under the given alg and kid.
+func signWith(t *testing.T, key crypto.Signer, method jwt.SigningMethod, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestTokenSignerKeyIDIsThumbprint(t *testing.T) {
+	// The examples of RFC 7638 section 3.1 and RFC 8037 appendix A.3
+	n, _ := base64URL.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	x, _ := base64URL.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	tests := []struct {
+		name   string
+		public crypto.PublicKey
+		alg    string
+		want   string
+	}{
+		{"RSA", &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}, "RS256", "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"},
+		{"Ed25519", ed25519.PublicKey(x), "EdDSA", "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"},
+	}
+	for _, tt := range tests {
+		if got := newJWK(tt.public, tt.alg, "").Kid; got != tt.want {
+			t.Errorf("%s: kid %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, alg := range []string{"RS256", "EdDSA"} {
+		private, _, kid := writeSigningKey(t, dir, alg, alg)
+		s := newTestTokenSigner(t, private, "")
+		public := readSigningKey(t, private).Public()
+		if want := newJWK(public, alg, "").Kid; s.KeyID() != want || kid != want {
+			t.Errorf("%s: signer kid %q, generated kid %q, want %q", alg, s.KeyID(), kid, want)
+		}
+	}
+}
+
+func TestTokenSignerActivationTime(t *testing.T) {
+	dir := t.TempDir()
+	current, _, currentKid := writeSigningKey(t, dir, "current", "EdDSA")
+	next, _, nextKid := writeSigningKey(t, dir, "next", "RS256")
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		signing string
+		want    string
+	}{
+		{"not active yet", current + "," + next + "@" + future, currentKid},
+		{"active", current + "," + next + "@" + past, nextKid},
+		{"listed first, active later", next + "@" + future + "," + current, currentKid},
+		{"both always active", current + "," + next, currentKid},
+	}
+	for _, tt := range tests {
+		s := newTestTokenSigner(t, tt.signing, "")
+		if got := s.KeyID(); got != tt.want {
+			t.Errorf("%s: signing with %q, want %q", tt.name, got, tt.want)
+		}
+		token, err := s.Sign(jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", tt.name, err)
+		}
+		parsed, _, _ := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		if parsed.Header["kid"] != tt.want {
+			t.Errorf("%s: token kid %v, want %q", tt.name, parsed.Header["kid"], tt.want)
+		}
+	}
+
+	// A key scheduled for later already verifies, so instances that switched
+	// early aren't rejected
+	s := newTestTokenSigner(t, current+","+next+"@"+future, "")
+	if _, err := s.Parse(signWith(t, readSigningKey(t, next), jwt.SigningMethodRS256, nextKid)); err != nil {
+		t.Errorf("Parse(token of scheduled key) = %v", err)
+	}
+
+	t.Setenv("JWT_SIGNING_KEYS", next+"@"+future)
+	if _, err := NewTokenSignerFromEnv(); err == nil {
+		t.Error("NewTokenSignerFromEnv accepted keys none of which is active")
+	}
+	t.Setenv("JWT_SIGNING_KEYS", next+"@tomorrow")
+	if _, err := NewTokenSignerFromEnv(); err == nil {
+		t.Error("NewTokenSignerFromEnv accepted an activation time that isn't RFC 3339")
+	}
+}
+
+func TestTokenSignerParse(t *testing.T) {
+	dir := t.TempDir()
+	current, _, currentKid := writeSigningKey(t, dir, "current", "EdDSA")
+	_, retiredPublic, retiredKid := writeSigningKey(t, dir, "retired", "RS256")
+	retired := readSigningKey(t, filepath.Join(dir, "retired.pem"))
+	stranger, _, strangerKid := writeSigningKey(t, dir, "stranger", "EdDSA")
+	s := newTestTokenSigner(t, current, retiredPublic)
+
+	own, err := s.Sign(jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	expired := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(-time.Minute).Unix()})
+	expired.Header["kid"] = currentKid
+	expiredToken, _ := expired.SignedString(readSigningKey(t, current))
+	noExpiry := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"user_id": 1})
+	noExpiry.Header["kid"] = currentKid
+	noExpiryToken, _ := noExpiry.SignedString(readSigningKey(t, current))
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	hmacToken.Header["kid"] = currentKid
+	hmacSigned, _ := hmacToken.SignedString([]byte("shared secret"))
+	noneToken := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	noneToken.Header["kid"] = currentKid
+	noneSigned, _ := noneToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"signed now", own, true},
+		{"retired key", signWith(t, retired, jwt.SigningMethodRS256, retiredKid), true},
+		{"unknown kid", signWith(t, readSigningKey(t, stranger), jwt.SigningMethodEdDSA, strangerKid), false},
+		{"stranger claiming our kid", signWith(t, readSigningKey(t, stranger), jwt.SigningMethodEdDSA, currentKid), false},
+		{"no kid", signWith(t, readSigningKey(t, current), jwt.SigningMethodEdDSA, ""), false},
+		{"alg of another key type", signWith(t, retired, jwt.SigningMethodRS256, currentKid), false},
+		{"RSA key under PS256", signWith(t, retired, jwt.SigningMethodPS256, retiredKid), false},
+		{"HMAC", hmacSigned, false},
+		{"none", noneSigned, false},
+		{"expired", expiredToken, false},
+		{"without expiry", noExpiryToken, false},
+	}
+	for _, tt := range tests {
+		_, err := s.Parse(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Parse = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// Retired keys only verify
+	if s.KeyID() != currentKid {
+		t.Errorf("signing with %q, want %q", s.KeyID(), currentKid)
+	}
+}
+
+func TestTokenSignerJWKS(t *testing.T) {
+	dir := t.TempDir()
+	current, _, currentKid := writeSigningKey(t, dir, "current", "EdDSA")
+	next, _, nextKid := writeSigningKey(t, dir, "next", "RS256")
+	_, retiredPublic, retiredKid := writeSigningKey(t, dir, "retired", "RS256")
+	s := newTestTokenSigner(t, current+","+next+"@"+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), retiredPublic)
+
+	var set jwkSet
+	if err := json.Unmarshal(s.JWKS(), &set); err != nil {
+		t.Fatalf("JWKS is not JSON: %v", err)
+	}
+	want := []struct{ kid, kty, alg string }{
+		{currentKid, "OKP", "EdDSA"},
+		{nextKid, "RSA", "RS256"},
+		{retiredKid, "RSA", "RS256"},
+	}
+	if len(set.Keys) != len(want) {
+		t.Fatalf("JWKS has %d keys, want %d: %s", len(set.Keys), len(want), s.JWKS())
+	}
+	for i, w := range want {
+		k := set.Keys[i]
+		if k.Kid != w.kid || k.Kty != w.kty || k.Alg != w.alg || k.Use != "sig" {
+			t.Errorf("key %d: %+v, want kid %s, kty %s, alg %s, use sig", i, k, w.kid, w.kty, w.alg)
+		}
+		// Published keys hash to their kid, and verify what we sign
+		if k.thumbprint() != k.Kid {
+			t.Errorf("key %d: thumbprint %q, kid %q", i, k.thumbprint(), k.Kid)
+		}
+		if k.publicKey() == nil {
+			t.Errorf("key %d does not parse back: %+v", i, k)
+		}
+	}
+	if strings.Contains(string(s.JWKS()), `"d"`) {
+		t.Error("JWKS contains private key material")
+	}
+
+	keys := set.publicKeys()
+	token, _ := s.Sign(jwt.MapClaims{"user_id": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	_, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return pickJWK(keys, kid), nil
+	})
+	if err != nil {
+		t.Errorf("token does not verify against the JWKS: %v", err)
+	}
+}
+
+func TestTokenSignerRefusesWeakKeys(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	path := filepath.Join(dir, "weak.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DEV_MODE", "")
+	t.Setenv("JWT_VERIFY_KEYS", "")
+	t.Setenv("JWT_SIGNING_KEYS", path)
+	if _, err := NewTokenSignerFromEnv(); err == nil {
+		t.Error("NewTokenSignerFromEnv accepted a 1024 bit RSA key")
+	}
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	if _, err := NewTokenSignerFromEnv(); err != ErrNoSigningKey {
+		t.Errorf("NewTokenSignerFromEnv without keys = %v, want ErrNoSigningKey", err)
+	}
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 seed of RFC 6238 appendix B, "12345678901234567890".
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// Appendix B lists 8 digit codes; ours are their last 6 digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		now := time.Unix(v.unix, 0)
+		if got := totpCode([]byte("12345678901234567890"), totpStep(now)); got != v.code {
+			t.Errorf("T=%d: code %s, want %s", v.unix, got, v.code)
+		}
+		step, ok := matchTOTP(rfc6238Secret, v.code, now)
+		if !ok || step != totpStep(now) {
+			t.Errorf("T=%d: matchTOTP = %d, %v; want step %d", v.unix, step, ok, totpStep(now))
+		}
+	}
+}
+
+func TestTOTPSkewWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := "050471"
+
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		if _, ok := matchTOTP(rfc6238Secret, code, now.Add(offset)); !ok {
+			t.Errorf("code rejected %v from its step", offset)
+		}
+	}
+	for _, offset := range []time.Duration{-90 * time.Second, 90 * time.Second} {
+		if _, ok := matchTOTP(rfc6238Secret, code, now.Add(offset)); ok {
+			t.Errorf("code accepted %v from its step", offset)
+		}
+	}
+
+	// The matched step is the code's own, not the current one, so replay
+	// protection holds across the window
+	if step, _ := matchTOTP(rfc6238Secret, code, now.Add(30*time.Second)); step != totpStep(now) {
+		t.Errorf("matched step %d, want %d", step, totpStep(now))
+	}
+}
+
+func TestTOTPRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	if _, ok := matchTOTP(rfc6238Secret, "050 471", now); !ok {
+		t.Error("code with a space rejected")
+	}
+	if _, ok := matchTOTP(strings.ToLower(rfc6238Secret), "050471", now); !ok {
+		t.Error("lower-case secret rejected")
+	}
+	for _, code := range []string{"", "50471", "0504710", "05047a"} {
+		if _, ok := matchTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", "050471", now); ok {
+		t.Error("code accepted for an undecodable secret")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := totpEncoding.DecodeString(secret); err != nil || len(key) != totpSecretSize {
+		t.Fatalf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+
+	u, err := url.Parse(totpProvisioningURI("Credential Store", "alice@example.com", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Credential Store:alice@example.com" {
+		t.Errorf("URI = %s", u)
+	}
+	if q.Get("secret") != secret || q.Get("issuer") != "Credential Store" || q.Get("digits") != "6" ||
+		q.Get("period") != "30" || q.Get("algorithm") != "SHA1" {
+		t.Errorf("URI parameters = %v", q)
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache remembers values fetched from the database for a short while, so
+// checks made on every request don't each cost a query. Changes made through
+// this instance invalidate the entry at once; changes made by other instances
+// are picked up within the TTL.
+type ttlCache[K comparable, V any] struct {
+	fetch func(K) (V, error)
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	entries map[K]ttlCacheEntry[V]
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	fetchedAt time.Time
+}
+
+// maxTTLCacheEntries is a cheap bound on memory; entries are refetched on
+// demand.
+const maxTTLCacheEntries = 10000
+
+func newTTLCache[K comparable, V any](ttl time.Duration, fetch func(K) (V, error)) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		fetch:   fetch,
+		ttl:     ttl,
+		entries: make(map[K]ttlCacheEntry[V]),
+	}
+}
+
+func (c *ttlCache[K, V]) get(key K) (V, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < c.ttl {
+		return entry.value, nil
+	}
+
+	value, err := c.fetch(key)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) > maxTTLCacheEntries {
+		c.entries = make(map[K]ttlCacheEntry[V])
+	}
+	c.entries[key] = ttlCacheEntry[V]{value: value, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return value, nil
+}
+
+func (c *ttlCache[K, V]) invalidate(key K) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+// invalidateWhere drops every entry whose value matches.
+func (c *ttlCache[K, V]) invalidateWhere(match func(V) bool) {
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if match(entry.value) {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+}
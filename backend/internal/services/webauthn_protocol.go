@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The parts of WebAuthn (Level 2) needed to check registrations and
+// assertions: a CBOR subset, authenticator data and COSE public keys.
+// Attestation statements are not verified; the server asks for "none".
+
+// COSE algorithms offered to authenticators, in order of preference.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+var webauthnAlgorithms = []int{coseES256, coseEdDSA, coseRS256}
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+	flagExtensions   = 0x80
+)
+
+var errWebAuthnMalformed = errors.New("malformed WebAuthn response")
+
+// decodeWebAuthnBase64 accepts base64url with or without padding, as browsers
+// and libraries differ.
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64URL.DecodeString(string(bytes.TrimRight([]byte(s), "=")))
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// parseClientData checks the ceremony type and challenge; the origin is left
+// to the caller.
+func parseClientData(raw []byte, ceremony string, challenge []byte) (*clientData, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, errWebAuthnMalformed
+	}
+	if cd.Type != ceremony {
+		return nil, fmt.Errorf("unexpected ceremony type %q", cd.Type)
+	}
+	got, err := decodeWebAuthnBase64(cd.Challenge)
+	if err != nil || !bytes.Equal(got, challenge) {
+		return nil, errors.New("challenge mismatch")
+	}
+	if cd.CrossOrigin {
+		return nil, errors.New("cross-origin ceremonies are not allowed")
+	}
+	return &cd, nil
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key, as encoded by the authenticator
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errWebAuthnMalformed
+	}
+	ad := &authenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+
+	if ad.Flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, errWebAuthnMalformed
+		}
+		ad.AAGUID = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return nil, errWebAuthnMalformed
+		}
+		ad.CredentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		_, n, err := decodeCBOR(rest, 0)
+		if err != nil {
+			return nil, errWebAuthnMalformed
+		}
+		ad.PublicKey = rest[:n]
+		rest = rest[n:]
+	}
+	if ad.Flags&flagExtensions != 0 {
+		_, n, err := decodeCBOR(rest, 0)
+		if err != nil {
+			return nil, errWebAuthnMalformed
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, errWebAuthnMalformed
+	}
+	return ad, nil
+}
+
+func (ad *authenticatorData) checkRPID(rpID string) error {
+	sum := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, sum[:]) {
+		return errors.New("credential belongs to another relying party")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errors.New("user presence was not confirmed")
+	}
+	return nil
+}
+
+// parseAttestationObject returns the attestation format and the authenticator
+// data inside it.
+func parseAttestationObject(raw []byte) (string, []byte, error) {
+	v, n, err := decodeCBOR(raw, 0)
+	if err != nil || n != len(raw) {
+		return "", nil, errWebAuthnMalformed
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return "", nil, errWebAuthnMalformed
+	}
+	format, _ := m["fmt"].(string)
+	authData, ok := m["authData"].([]byte)
+	if format == "" || !ok {
+		return "", nil, errWebAuthnMalformed
+	}
+	return format, authData, nil
+}
+
+// parseCOSEKey reads an ES256, EdDSA (Ed25519) or RS256 public key.
+func parseCOSEKey(raw []byte) (int, crypto.PublicKey, error) {
+	v, n, err := decodeCBOR(raw, 0)
+	if err != nil || n != len(raw) {
+		return 0, nil, errWebAuthnMalformed
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errWebAuthnMalformed
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+
+	switch {
+	case alg == coseES256 && kty == 2 && crv == 1:
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errWebAuthnMalformed
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return 0, nil, errWebAuthnMalformed
+		}
+		return coseES256, key, nil
+	case alg == coseEdDSA && kty == 1 && crv == 6:
+		x, _ := m[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errWebAuthnMalformed
+		}
+		return coseEdDSA, ed25519.PublicKey(x), nil
+	case alg == coseRS256 && kty == 3:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errWebAuthnMalformed
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return coseRS256, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported credential algorithm %d", alg)
+}
+
+// verifyAssertionSignature checks a signature over authenticator data
+// followed by the hash of the client data.
+func verifyAssertionSignature(coseKey, authData, clientDataJSON, signature []byte) error {
+	alg, key, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	valid := false
+	switch alg {
+	case coseES256:
+		digest := sha256.Sum256(signed)
+		valid = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case coseEdDSA:
+		valid = ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case coseRS256:
+		digest := sha256.Sum256(signed)
+		valid = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+const cborMaxDepth = 16
+
+// decodeCBOR decodes one item of the deterministic CBOR subset WebAuthn
+// uses: integers, byte and text strings, arrays, maps and simple values.
+// Integers become int64 and maps map[interface{}]interface{}. It returns the
+// item and its length in bytes.
+func decodeCBOR(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, 0, errWebAuthnMalformed
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	arg, n, err := cborArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, 0, errWebAuthnMalformed
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errWebAuthnMalformed
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errWebAuthnMalformed
+		}
+		end := n + int(arg)
+		if major == 2 {
+			return append([]byte{}, data[n:end]...), end, nil
+		}
+		return string(data[n:end]), end, nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errWebAuthnMalformed
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, size, err := decodeCBOR(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += size
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errWebAuthnMalformed
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, size, err := decodeCBOR(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errWebAuthnMalformed
+			}
+			value, size, err := decodeCBOR(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+	}
+	// Tags, floats and indefinite lengths don't occur in WebAuthn structures
+	return nil, 0, errWebAuthnMalformed
+}
+
+func cborArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24 && len(data) >= 2:
+		return uint64(data[1]), 2, nil
+	case info == 25 && len(data) >= 3:
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26 && len(data) >= 5:
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27 && len(data) >= 9:
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, errWebAuthnMalformed
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// cborMap is a CBOR map with its pairs in encoding order.
+type cborMap [][2]interface{}
+
+// cborEncode encodes the CBOR subset WebAuthn structures use.
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n < 1<<32:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(item)...)
+		}
+		return out
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, cborEncode(pair[0])...)
+			out = append(out, cborEncode(pair[1])...)
+		}
+		return out
+	}
+	panic("cborEncode: unsupported type")
+}
+
+func es256COSEKey(pub *ecdsa.PublicKey) []byte {
+	return cborEncode(cborMap{{1, 2}, {3, coseES256}, {-1, 1},
+		{-2, pub.X.FillBytes(make([]byte, 32))}, {-3, pub.Y.FillBytes(make([]byte, 32))}})
+}
+
+// signedData is what an authenticator signs for an assertion.
+func signedData(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	return append(append([]byte{}, authData...), clientDataHash[:]...)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	encoded := cborEncode(cborMap{
+		{"fmt", "none"},
+		{1, -7},
+		{-2, []byte{1, 2, 3}},
+		{"list", []interface{}{0, 23, 24, 255, 256, 65536, 1 << 40, -1, -25, true, false}},
+	})
+	v, n, err := decodeCBOR(encoded, 0)
+	if err != nil || n != len(encoded) {
+		t.Fatalf("decodeCBOR = %d bytes, %v", n, err)
+	}
+	m := v.(map[interface{}]interface{})
+	if m["fmt"] != "none" || m[int64(1)] != int64(-7) || !bytes.Equal(m[int64(-2)].([]byte), []byte{1, 2, 3}) {
+		t.Fatalf("decoded %v", m)
+	}
+	want := []interface{}{int64(0), int64(23), int64(24), int64(255), int64(256), int64(65536), int64(1 << 40),
+		int64(-1), int64(-25), true, false}
+	list := m["list"].([]interface{})
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("list[%d] = %v, want %v", i, list[i], want[i])
+		}
+	}
+
+	// Items are self-delimiting; trailing bytes are left to the caller
+	if _, n, err := decodeCBOR(append(cborEncode(7), 0x00), 0); err != nil || n != 1 {
+		t.Errorf("decodeCBOR with trailing data = %d, %v", n, err)
+	}
+}
+
+func TestDecodeCBORRejectsMalformedInput(t *testing.T) {
+	nested := []byte{}
+	for i := 0; i <= cborMaxDepth+1; i++ {
+		nested = append(nested, 0x81) // array of one
+	}
+	nested = append(nested, 0x00)
+
+	cases := map[string][]byte{
+		"empty":                {},
+		"truncated argument":   {0x19, 0x01},
+		"truncated bytes":      {0x45, 1, 2},
+		"huge length":          {0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00},
+		"huge array":           {0x9a, 0xff, 0xff, 0xff, 0xff},
+		"truncated map":        {0xa2, 0x01, 0x02},
+		"indefinite length":    {0x5f, 0x41, 0x00, 0xff},
+		"tag":                  {0xc0, 0x60},
+		"float":                {0xfa, 0x3f, 0x80, 0x00, 0x00},
+		"byte string map key":  {0xa1, 0x41, 0x00, 0x01},
+		"array map key":        {0xa1, 0x80, 0x01},
+		"negative overflow":    {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"reserved info":        {0x1c},
+		"nesting beyond limit": nested,
+	}
+	for name, data := range cases {
+		if _, _, err := decodeCBOR(data, 0); !errors.Is(err, errWebAuthnMalformed) {
+			t.Errorf("%s: decodeCBOR = %v, want errWebAuthnMalformed", name, err)
+		}
+	}
+}
+
+func TestParseAttestationObjectRejectsMalformedInput(t *testing.T) {
+	authData := make([]byte, 37)
+	valid := cborEncode(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", authData}})
+	if format, got, err := parseAttestationObject(valid); err != nil || format != "none" || !bytes.Equal(got, authData) {
+		t.Fatalf("parseAttestationObject = %q, %v", format, err)
+	}
+
+	cases := map[string][]byte{
+		"trailing bytes":   append(append([]byte{}, valid...), 0x00),
+		"truncated":        valid[:len(valid)-1],
+		"not a map":        cborEncode([]interface{}{"none"}),
+		"no format":        cborEncode(cborMap{{"authData", authData}}),
+		"text authData":    cborEncode(cborMap{{"fmt", "none"}, {"authData", "data"}}),
+		"missing authData": cborEncode(cborMap{{"fmt", "none"}}),
+		"garbage":          []byte("not cbor at all"),
+	}
+	for name, data := range cases {
+		if _, _, err := parseAttestationObject(data); err == nil {
+			t.Errorf("%s: parseAttestationObject accepted it", name)
+		}
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	coseKey := es256COSEKey(&key.PublicKey)
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	aaguid := bytes.Repeat([]byte{0xab}, 16)
+	credentialID := []byte("credential-1")
+
+	raw := append(rpIDHash[:], flagUserPresent|flagAttestedData|flagExtensions, 0, 0, 0, 9)
+	raw = append(raw, aaguid...)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(credentialID)))
+	raw = append(raw, credentialID...)
+	raw = append(raw, coseKey...)
+	raw = append(raw, cborEncode(cborMap{{"credProtect", 2}})...)
+
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		t.Fatalf("parseAuthenticatorData: %v", err)
+	}
+	if ad.SignCount != 9 || !bytes.Equal(ad.AAGUID, aaguid) || !bytes.Equal(ad.CredentialID, credentialID) ||
+		!bytes.Equal(ad.PublicKey, coseKey) {
+		t.Fatalf("parsed %+v", ad)
+	}
+	if err := ad.checkRPID("example.com"); err != nil {
+		t.Errorf("checkRPID: %v", err)
+	}
+	if err := ad.checkRPID("evil.example"); err == nil {
+		t.Error("checkRPID accepted another relying party")
+	}
+
+	ad.Flags &^= flagUserPresent
+	if err := ad.checkRPID("example.com"); err == nil {
+		t.Error("checkRPID accepted data without user presence")
+	}
+
+	header := 37 + 16 + 2
+	cases := map[string][]byte{
+		"short":                 raw[:36],
+		"trailing bytes":        append(append([]byte{}, raw...), 0x00),
+		"truncated extensions":  raw[:len(raw)-1],
+		"truncated public key":  raw[:header+len(credentialID)+len(coseKey)-1],
+		"truncated attestation": raw[:40],
+		"empty credential id":   append(append(append([]byte{}, raw[:37+16]...), 0, 0), raw[header+len(credentialID):]...),
+		"oversized credential":  append(append(append([]byte{}, raw[:37+16]...), 0x04, 0x00), raw[header:]...),
+	}
+	for name, data := range cases {
+		if _, err := parseAuthenticatorData(data); !errors.Is(err, errWebAuthnMalformed) {
+			t.Errorf("%s: parseAuthenticatorData = %v, want errWebAuthnMalformed", name, err)
+		}
+	}
+}
+
+func TestParseClientData(t *testing.T) {
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	encoded := base64URL.EncodeToString(challenge)
+
+	valid := []byte(`{"type":"webauthn.get","challenge":"` + encoded + `","origin":"https://example.com"}`)
+	cd, err := parseClientData(valid, "webauthn.get", challenge)
+	if err != nil || cd.Origin != "https://example.com" {
+		t.Fatalf("parseClientData = %+v, %v", cd, err)
+	}
+	// Padded base64url from some clients
+	padded := []byte(`{"type":"webauthn.get","challenge":"` + encoded + `=","origin":"https://example.com"}`)
+	if _, err := parseClientData(padded, "webauthn.get", challenge); err != nil {
+		t.Errorf("parseClientData(padded challenge): %v", err)
+	}
+
+	cases := map[string]string{
+		"wrong ceremony": `{"type":"webauthn.create","challenge":"` + encoded + `","origin":"https://example.com"}`,
+		"wrong challenge": `{"type":"webauthn.get","challenge":"` + base64URL.EncodeToString([]byte("other")) +
+			`","origin":"https://example.com"}`,
+		"cross origin": `{"type":"webauthn.get","challenge":"` + encoded +
+			`","origin":"https://example.com","crossOrigin":true}`,
+		"not json": `type=webauthn.get`,
+	}
+	for name, raw := range cases {
+		if _, err := parseClientData([]byte(raw), "webauthn.get", challenge); err == nil {
+			t.Errorf("%s: parseClientData accepted it", name)
+		}
+	}
+}
+
+func TestVerifyAssertionSignatureAlgorithms(t *testing.T) {
+	authData := bytes.Repeat([]byte{0x01}, 37)
+	clientDataJSON := []byte(`{"type":"webauthn.get"}`)
+	signed := signedData(authData, clientDataJSON)
+	digest := sha256.Sum256(signed)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecSig, _ := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	edSig := ed25519.Sign(edPriv, signed)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaSig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	rsaCOSE := cborEncode(cborMap{{1, 3}, {3, coseRS256}, {-1, rsaKey.N.Bytes()},
+		{-2, big.NewInt(int64(rsaKey.E)).Bytes()}})
+
+	keys := map[string]struct {
+		cose, sig []byte
+	}{
+		"ES256": {es256COSEKey(&ecKey.PublicKey), ecSig},
+		"EdDSA": {cborEncode(cborMap{{1, 1}, {3, coseEdDSA}, {-1, 6}, {-2, []byte(edPub)}}), edSig},
+		"RS256": {rsaCOSE, rsaSig},
+	}
+	for name, k := range keys {
+		if err := verifyAssertionSignature(k.cose, authData, clientDataJSON, k.sig); err != nil {
+			t.Errorf("%s: valid signature rejected: %v", name, err)
+		}
+		tampered := append([]byte{}, authData...)
+		tampered[36]++
+		if err := verifyAssertionSignature(k.cose, tampered, clientDataJSON, k.sig); err == nil {
+			t.Errorf("%s: signature accepted over changed authenticator data", name)
+		}
+		if err := verifyAssertionSignature(k.cose, authData, []byte(`{}`), k.sig); err == nil {
+			t.Errorf("%s: signature accepted over changed client data", name)
+		}
+	}
+}
+
+func TestParseCOSEKeyRejectsBadKeys(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	x := ecKey.PublicKey.X.FillBytes(make([]byte, 32))
+
+	cases := map[string][]byte{
+		"point off curve":  cborEncode(cborMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, x}, {-3, x}}),
+		"short coordinate": cborEncode(cborMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, x[:31]}, {-3, x}}),
+		"wrong curve":      cborEncode(cborMap{{1, 2}, {3, coseES256}, {-1, 2}, {-2, x}, {-3, x}}),
+		"short Ed25519":    cborEncode(cborMap{{1, 1}, {3, coseEdDSA}, {-1, 6}, {-2, x[:31]}}),
+		"small RSA":        cborEncode(cborMap{{1, 3}, {3, coseRS256}, {-1, make([]byte, 128)}, {-2, []byte{1, 0, 1}}}),
+		"unsupported alg":  cborEncode(cborMap{{1, 2}, {3, -35}, {-1, 2}, {-2, x}, {-3, x}}),
+		"not a map":        cborEncode([]interface{}{1, 2}),
+		"trailing bytes":   append(es256COSEKey(&ecKey.PublicKey), 0x00),
+	}
+	for name, raw := range cases {
+		if _, _, err := parseCOSEKey(raw); err == nil {
+			t.Errorf("%s: parseCOSEKey accepted it", name)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"credential-store/internal/repository"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrWebAuthnCeremony   = errors.New("invalid or expired security key request; start again")
+	ErrWebAuthnFailed     = errors.New("security key verification failed")
+	ErrWebAuthnRegistered = errors.New("this security key is already registered")
+	ErrWebAuthnNotFound   = errors.New("security key not found")
+)
+
+const (
+	webauthnCeremonyTTL = 5 * time.Minute
+	webauthnNameMax     = 100
+)
+
+// WebAuthnService runs the WebAuthn registration and authentication
+// ceremonies for security keys and passkeys. A credential either completes
+// the MFA challenge of a password login, or logs in on its own as a passkey,
+// in which case the authenticator must have verified the user (PIN or
+// biometrics).
+//
+// The challenge of each ceremony travels in a short-lived token signed with a
+// key derived from JWT_SECRET, so any server instance can finish it; finished
+// ceremonies are remembered until they expire so none completes twice.
+type WebAuthnService struct {
+	repo        *repository.WebAuthnRepository
+	userRepo    *repository.UserRepository
+	mfa         *MFAService
+	authService *AuthService
+	rpID        string
+	rpName      string
+	origins     map[string]bool
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewWebAuthnService serves the relying party rpID (the site's domain) to
+// pages loaded from one of origins.
+func NewWebAuthnService(repo *repository.WebAuthnRepository, userRepo *repository.UserRepository, mfa *MFAService,
+	authService *AuthService, rpID, rpName string, origins []string) *WebAuthnService {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[strings.TrimRight(origin, "/")] = true
+		}
+	}
+	return &WebAuthnService{
+		repo:        repo,
+		userRepo:    userRepo,
+		mfa:         mfa,
+		authService: authService,
+		rpID:        rpID,
+		rpName:      rpName,
+		origins:     allowed,
+		used:        make(map[string]time.Time),
+	}
+}
+
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type ceremonyClaims struct {
+	Ceremony  string `json:"ceremony"`
+	UserID    int    `json:"user_id,omitempty"`
+	Challenge string `json:"challenge"`
+	Handle    string `json:"handle,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// BeginRegistration returns the options for navigator.credentials.create().
+func (s *WebAuthnService) BeginRegistration(user *models.User) (*models.WebAuthnOptions, error) {
+	handle, err := s.repo.UserHandle(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if handle == nil {
+		if handle, err = randomBytes(32); err != nil {
+			return nil, err
+		}
+	}
+
+	existing, err := s.repo.FindByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make([]credentialDescriptor, 0, len(existing))
+	for _, cred := range existing {
+		exclude = append(exclude, describeCredential(cred))
+	}
+
+	params := make([]map[string]interface{}, 0, len(webauthnAlgorithms))
+	for _, alg := range webauthnAlgorithms {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+
+	challenge, token, err := s.newCeremony("webauthn.create", user.ID, handle)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebAuthnOptions{
+		CeremonyToken: token,
+		PublicKey: map[string]interface{}{
+			"challenge": base64URL.EncodeToString(challenge),
+			"rp":        map[string]string{"id": s.rpID, "name": s.rpName},
+			"user": map[string]string{
+				"id":          base64URL.EncodeToString(handle),
+				"name":        user.Email,
+				"displayName": user.Email,
+			},
+			"pubKeyCredParams":   params,
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+			"timeout":     webauthnCeremonyTTL.Milliseconds(),
+		},
+	}, nil
+}
+
+// FinishRegistration checks the authenticator's response and stores the new
+// credential.
+func (s *WebAuthnService) FinishRegistration(userID int, req *models.WebAuthnRegisterRequest) (*models.WebAuthnCredential, error) {
+	claims, err := s.parseCeremony(req.CeremonyToken, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID != userID {
+		return nil, ErrWebAuthnCeremony
+	}
+	challenge, _ := decodeWebAuthnBase64(claims.Challenge)
+	handle, _ := decodeWebAuthnBase64(claims.Handle)
+
+	resp := &req.Credential.Response
+	clientDataJSON, err := decodeWebAuthnBase64(resp.ClientDataJSON)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	attestation, err := decodeWebAuthnBase64(resp.AttestationObject)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	if err := s.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	format, rawAuthData, err := parseAttestationObject(attestation)
+	if err != nil {
+		return nil, webauthnFailure("registration", err)
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, webauthnFailure("registration", err)
+	}
+	if err := authData.checkRPID(s.rpID); err != nil {
+		return nil, webauthnFailure("registration", err)
+	}
+	if authData.CredentialID == nil {
+		return nil, webauthnFailure("registration", errors.New("no attested credential"))
+	}
+	if _, _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, webauthnFailure("registration", err)
+	}
+	if !s.markCeremonyUsed(claims) {
+		return nil, ErrWebAuthnCeremony
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Security key"
+	}
+	if len(name) > webauthnNameMax {
+		name = name[:webauthnNameMax]
+	}
+	cred := &models.WebAuthnCredential{
+		UserID:       userID,
+		CredentialID: authData.CredentialID,
+		PublicKey:    authData.PublicKey,
+		UserHandle:   handle,
+		SignCount:    authData.SignCount,
+		Name:         name,
+		AAGUID:       formatAAGUID(authData.AAGUID),
+		Transports:   resp.Transports,
+		UserVerified: authData.Flags&flagUserVerified != 0,
+	}
+	created, err := s.repo.Create(cred)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrWebAuthnRegistered
+	}
+	log.Printf("WebAuthn: user %d registered a credential (attestation %s)", userID, format)
+	return cred, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get(). With the
+// challenge token of a password login it asks for one of that user's
+// credentials; without, for any passkey of this site.
+func (s *WebAuthnService) BeginLogin(challengeToken string) (*models.WebAuthnOptions, error) {
+	userID := 0
+	allow := []credentialDescriptor{}
+	userVerification := "required"
+
+	if challengeToken != "" {
+		challenge, err := s.mfa.parseChallenge(challengeToken)
+		if err != nil {
+			return nil, err
+		}
+		userID = challenge.userID
+		creds, err := s.repo.FindByUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(creds) == 0 {
+			return nil, ErrNoSecurityKey
+		}
+		for _, cred := range creds {
+			allow = append(allow, describeCredential(cred))
+		}
+		userVerification = "preferred"
+	}
+
+	challenge, token, err := s.newCeremony("webauthn.get", userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebAuthnOptions{
+		CeremonyToken: token,
+		PublicKey: map[string]interface{}{
+			"challenge":        base64URL.EncodeToString(challenge),
+			"rpId":             s.rpID,
+			"allowCredentials": allow,
+			"userVerification": userVerification,
+			"timeout":          webauthnCeremonyTTL.Milliseconds(),
+		},
+	}, nil
+}
+
+// FinishLogin verifies an assertion and returns the user it authenticates and
+// how: AuthMethodSecurityKey as a second factor, AuthMethodPasskey on its own.
+func (s *WebAuthnService) FinishLogin(req *models.WebAuthnLoginRequest) (*models.User, string, error) {
+	claims, err := s.parseCeremony(req.CeremonyToken, "webauthn.get")
+	if err != nil {
+		return nil, "", err
+	}
+	challenge, _ := decodeWebAuthnBase64(claims.Challenge)
+
+	// As a second factor, the password login's challenge must still be open
+	method, jti := AuthMethodPasskey, ""
+	if claims.UserID != 0 {
+		challenge, err := s.mfa.parseChallenge(req.ChallengeToken)
+		if err != nil {
+			return nil, "", err
+		}
+		if challenge.userID != claims.UserID {
+			return nil, "", ErrWebAuthnCeremony
+		}
+		jti = challenge.jti
+		method = AuthMethodSecurityKey
+	}
+
+	cred, err := s.verifyAssertion(claims, challenge, &req.Credential, method == AuthMethodPasskey)
+	if err != nil {
+		if jti != "" && errors.Is(err, ErrWebAuthnFailed) {
+			s.mfa.recordFailure(jti)
+		}
+		return nil, "", err
+	}
+	if !s.markCeremonyUsed(claims) {
+		return nil, "", ErrWebAuthnCeremony
+	}
+	if jti != "" {
+		s.mfa.markUsed(jti)
+	}
+
+	user, err := s.userRepo.FindByID(cred.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, method, nil
+}
+
+func (s *WebAuthnService) verifyAssertion(claims *ceremonyClaims, challenge []byte,
+	credential *models.WebAuthnCredentialResponse, requireUV bool) (*models.WebAuthnCredential, error) {
+	rawID, err := decodeWebAuthnBase64(credential.RawID)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	cred, err := s.repo.FindByCredentialID(rawID)
+	if err == sql.ErrNoRows {
+		return nil, ErrWebAuthnFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID != 0 && cred.UserID != claims.UserID {
+		return nil, ErrWebAuthnFailed
+	}
+
+	resp := &credential.Response
+	if claims.UserID == 0 {
+		// A passkey names its user; it must be the one it was registered for
+		handle, err := decodeWebAuthnBase64(resp.UserHandle)
+		if err != nil || !bytes.Equal(handle, cred.UserHandle) {
+			return nil, ErrWebAuthnFailed
+		}
+	}
+
+	clientDataJSON, err := decodeWebAuthnBase64(resp.ClientDataJSON)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	rawAuthData, err := decodeWebAuthnBase64(resp.AuthenticatorData)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	signature, err := decodeWebAuthnBase64(resp.Signature)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	if err := s.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, webauthnFailure("login", err)
+	}
+	if err := authData.checkRPID(s.rpID); err != nil {
+		return nil, webauthnFailure("login", err)
+	}
+	if requireUV && authData.Flags&flagUserVerified == 0 {
+		return nil, webauthnFailure("login", errors.New("passkey login without user verification"))
+	}
+	if err := verifyAssertionSignature(cred.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		return nil, webauthnFailure("login", err)
+	}
+
+	// Authenticators with a counter must increase it; a lower value means
+	// the credential was cloned
+	if (authData.SignCount != 0 || cred.SignCount != 0) && authData.SignCount <= cred.SignCount {
+		log.Printf("WebAuthn: credential %d of user %d presented counter %d, expected more than %d; possible clone",
+			cred.ID, cred.UserID, authData.SignCount, cred.SignCount)
+		return nil, ErrWebAuthnFailed
+	}
+	updated, err := s.repo.RecordUse(cred.ID, cred.SignCount, authData.SignCount)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, ErrWebAuthnFailed
+	}
+	return cred, nil
+}
+
+func (s *WebAuthnService) List(userID int) ([]models.WebAuthnCredential, error) {
+	return s.repo.FindByUser(userID)
+}
+
+// Delete removes one of the user's credentials, unless it is the last second
+// factor their group requires, or the last key of an admin who must use one.
+func (s *WebAuthnService) Delete(user *models.User, id int) error {
+	creds, err := s.repo.FindByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, cred := range creds {
+		found = found || cred.ID == id
+	}
+	if !found {
+		return ErrWebAuthnNotFound
+	}
+
+	if len(creds) == 1 {
+		required, err := s.authService.RequiresPhishingResistant(user)
+		if err != nil {
+			return err
+		}
+		if required {
+			return ErrPhishingResistantRequired
+		}
+	}
+	if err := s.mfa.checkCanRemoveFactor(user); err != nil {
+		return err
+	}
+
+	deleted, err := s.repo.Delete(id, user.ID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrWebAuthnNotFound
+	}
+	return nil
+}
+
+func (s *WebAuthnService) checkClientData(raw []byte, ceremony string, challenge []byte) error {
+	cd, err := parseClientData(raw, ceremony, challenge)
+	if err != nil {
+		return webauthnFailure(ceremony, err)
+	}
+	if !s.origins[cd.Origin] {
+		return webauthnFailure(ceremony, fmt.Errorf("origin %q is not allowed", cd.Origin))
+	}
+	return nil
+}
+
+func (s *WebAuthnService) newCeremony(ceremony string, userID int, handle []byte) ([]byte, string, error) {
+	challenge, err := randomBytes(32)
+	if err != nil {
+		return nil, "", err
+	}
+	claims := ceremonyClaims{
+		Ceremony:  ceremony,
+		UserID:    userID,
+		Challenge: base64URL.EncodeToString(challenge),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(webauthnCeremonyTTL)),
+		},
+	}
+	if handle != nil {
+		claims.Handle = base64URL.EncodeToString(handle)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(webauthnCeremonyKey())
+	return challenge, token, err
+}
+
+func (s *WebAuthnService) parseCeremony(tokenString, ceremony string) (*ceremonyClaims, error) {
+	claims := &ceremonyClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return webauthnCeremonyKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid || claims.Ceremony != ceremony || claims.ExpiresAt == nil {
+		return nil, ErrWebAuthnCeremony
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, done := s.used[claims.Challenge]; done {
+		return nil, ErrWebAuthnCeremony
+	}
+	return claims, nil
+}
+
+// markCeremonyUsed returns false if the ceremony was completed meanwhile.
+func (s *WebAuthnService) markCeremonyUsed(claims *ceremonyClaims) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for challenge, expiresAt := range s.used {
+		if now.After(expiresAt) {
+			delete(s.used, challenge)
+		}
+	}
+	if _, done := s.used[claims.Challenge]; done {
+		return false
+	}
+	s.used[claims.Challenge] = claims.ExpiresAt.Time
+	return true
+}
+
+// webauthnFailure logs why a ceremony failed; the client only learns that it
+// did.
+func webauthnFailure(ceremony string, err error) error {
+	log.Printf("WebAuthn %s rejected: %v", ceremony, err)
+	return ErrWebAuthnFailed
+}
+
+func describeCredential(cred models.WebAuthnCredential) credentialDescriptor {
+	return credentialDescriptor{
+		Type:       "public-key",
+		ID:         base64URL.EncodeToString(cred.CredentialID),
+		Transports: cred.Transports,
+	}
+}
+
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+}
+
+func webauthnCeremonyKey() []byte {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte("webauthn-ceremony"))
+	return mac.Sum(nil)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,414 @@
+package services
+
+import (
+	"bytes"
+	"credential-store/internal/models"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+var testWebAuthnColumns = []string{"id", "user_id", "credential_id", "public_key", "user_handle", "sign_count",
+	"name", "aaguid", "transports", "user_verified", "created_at", "last_used_at"}
+
+// softAuthenticator is an ES256 authenticator in software. Tests change its
+// fields to produce the responses of misbehaving or hostile clients.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	aaguid       []byte
+	handle       []byte
+	rpID         string
+	origin       string
+	flags        byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		aaguid:       bytes.Repeat([]byte{0x2f}, 16),
+		rpID:         testRPID,
+		origin:       testOrigin,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, opts *models.WebAuthnOptions) []byte {
+	publicKey := opts.PublicKey.(map[string]interface{})
+	raw, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": publicKey["challenge"],
+		"origin":    a.origin,
+	})
+	return raw
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedData
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, a.aaguid...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, es256COSEKey(&a.key.PublicKey)...)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create().
+func (a *softAuthenticator) create(opts *models.WebAuthnOptions) models.WebAuthnCredentialResponse {
+	user := opts.PublicKey.(map[string]interface{})["user"].(map[string]string)
+	a.handle, _ = decodeWebAuthnBase64(user["id"])
+
+	var cred models.WebAuthnCredentialResponse
+	cred.RawID = base64URL.EncodeToString(a.credentialID)
+	cred.Type = "public-key"
+	cred.Response.ClientDataJSON = base64URL.EncodeToString(a.clientData("webauthn.create", opts))
+	cred.Response.AttestationObject = base64URL.EncodeToString(cborEncode(cborMap{
+		{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", a.authData(true)}}))
+	cred.Response.Transports = []string{"usb"}
+	return cred
+}
+
+// get answers navigator.credentials.get().
+func (a *softAuthenticator) get(opts *models.WebAuthnOptions) models.WebAuthnCredentialResponse {
+	clientDataJSON := a.clientData("webauthn.get", opts)
+	authData := a.authData(false)
+	digest := sha256.Sum256(signedData(authData, clientDataJSON))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	var cred models.WebAuthnCredentialResponse
+	cred.RawID = base64URL.EncodeToString(a.credentialID)
+	cred.Type = "public-key"
+	cred.Response.ClientDataJSON = base64URL.EncodeToString(clientDataJSON)
+	cred.Response.AuthenticatorData = base64URL.EncodeToString(authData)
+	cred.Response.Signature = base64URL.EncodeToString(signature)
+	cred.Response.UserHandle = base64URL.EncodeToString(a.handle)
+	return cred
+}
+
+// stored is the credential as the server keeps it after registration.
+func (a *softAuthenticator) stored(id, userID int, signCount uint32) models.WebAuthnCredential {
+	return models.WebAuthnCredential{ID: id, UserID: userID, CredentialID: a.credentialID,
+		PublicKey: es256COSEKey(&a.key.PublicKey), UserHandle: a.handle, SignCount: signCount, Name: "Key"}
+}
+
+func webauthnRows(creds ...models.WebAuthnCredential) *sqlmock.Rows {
+	rows := sqlmock.NewRows(testWebAuthnColumns)
+	for _, c := range creds {
+		rows.AddRow(c.ID, c.UserID, c.CredentialID, c.PublicKey, c.UserHandle, int64(c.SignCount), c.Name, c.AAGUID,
+			"", c.UserVerified, time.Now(), nil)
+	}
+	return rows
+}
+
+func newTestWebAuthnService(t *testing.T) (*WebAuthnService, sqlmock.Sqlmock) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	mfa, mock := newTestMFAService(t)
+	return NewWebAuthnService(mfa.webauthnRepo, mfa.userRepo, mfa, mfa.authService, testRPID, "Credential Store",
+		[]string{testOrigin + "/"}), mock
+}
+
+func beginRegistration(t *testing.T, s *WebAuthnService, mock sqlmock.Sqlmock) *models.WebAuthnOptions {
+	t.Helper()
+	mock.ExpectQuery("SELECT user_handle FROM webauthn_credentials").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"user_handle"}))
+	mock.ExpectQuery("FROM webauthn_credentials WHERE user_id").WithArgs(3).WillReturnRows(webauthnRows())
+	opts, err := s.BeginRegistration(testUser(3, "alice@example.com"))
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	return opts
+}
+
+// register runs a registration ceremony for user 3 with the authenticator.
+func register(t *testing.T, s *WebAuthnService, mock sqlmock.Sqlmock, a *softAuthenticator) (*models.WebAuthnCredential, error) {
+	t.Helper()
+	opts := beginRegistration(t, s, mock)
+	return s.FinishRegistration(3, &models.WebAuthnRegisterRequest{CeremonyToken: opts.CeremonyToken,
+		Name: "YubiKey", Credential: a.create(opts)})
+}
+
+func expectCredential(mock sqlmock.Sqlmock, stored models.WebAuthnCredential) {
+	mock.ExpectQuery("FROM webauthn_credentials WHERE credential_id").WithArgs(stored.CredentialID).
+		WillReturnRows(webauthnRows(stored))
+}
+
+// passkeyLogin runs a passwordless login with the authenticator.
+func passkeyLogin(t *testing.T, s *WebAuthnService, a *softAuthenticator) (*models.User, string, error) {
+	t.Helper()
+	opts, err := s.BeginLogin("")
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	return s.FinishLogin(&models.WebAuthnLoginRequest{CeremonyToken: opts.CeremonyToken, Credential: a.get(opts)})
+}
+
+func TestWebAuthnRegisterAndPasskeyLogin(t *testing.T) {
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+
+	opts := beginRegistration(t, s, mock)
+	publicKey := &captureArg{}
+	mock.ExpectQuery("INSERT INTO webauthn_credentials").
+		WithArgs(3, a.credentialID, publicKey, sqlmock.AnyArg(), int64(0), "YubiKey",
+			"2f2f2f2f-2f2f-2f2f-2f2f-2f2f2f2f2f2f", "usb", true).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	cred, err := s.FinishRegistration(3, &models.WebAuthnRegisterRequest{CeremonyToken: opts.CeremonyToken,
+		Name: "YubiKey", Credential: a.create(opts)})
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if cred.ID != 7 || !bytes.Equal(cred.UserHandle, a.handle) || len(a.handle) != 32 {
+		t.Fatalf("registered %+v", cred)
+	}
+	if _, _, err := parseCOSEKey(publicKey.value.([]byte)); err != nil {
+		t.Fatalf("stored public key: %v", err)
+	}
+
+	a.signCount = 1
+	expectCredential(mock, a.stored(7, 3, 0))
+	mock.ExpectExec("UPDATE webauthn_credentials SET sign_count").WithArgs(int64(1), sqlmock.AnyArg(), 7, int64(0)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(testUser(3, "alice@example.com")))
+	user, method, err := passkeyLogin(t, s, a)
+	if err != nil || user.ID != 3 || method != AuthMethodPasskey {
+		t.Fatalf("FinishLogin = %v, %q, %v", user, method, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnSecurityKeyCompletesMFAChallenge(t *testing.T) {
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+	a.handle = []byte("handle")
+	stored := a.stored(7, 3, 4)
+
+	challengeToken, err := s.mfa.newChallengeToken(3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("FROM webauthn_credentials WHERE user_id").WithArgs(3).WillReturnRows(webauthnRows(stored))
+	opts, err := s.BeginLogin(challengeToken)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+
+	// A second factor needs presence only; the password was the first
+	a.flags = flagUserPresent
+	a.signCount = 5
+	mock.ExpectQuery("FROM webauthn_credentials WHERE credential_id").WillReturnRows(webauthnRows(stored))
+	mock.ExpectExec("UPDATE webauthn_credentials SET sign_count").WithArgs(int64(5), sqlmock.AnyArg(), 7, int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM users WHERE id").WithArgs(3).WillReturnRows(userRows(testUser(3, "alice@example.com")))
+	user, method, err := s.FinishLogin(&models.WebAuthnLoginRequest{CeremonyToken: opts.CeremonyToken,
+		ChallengeToken: challengeToken, Credential: a.get(opts)})
+	if err != nil || user.ID != 3 || method != AuthMethodSecurityKey {
+		t.Fatalf("FinishLogin = %v, %q, %v", user, method, err)
+	}
+
+	// The challenge is used up
+	if _, err := s.BeginLogin(challengeToken); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Errorf("BeginLogin(used challenge) = %v, want ErrInvalidMFAChallenge", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnRegistrationRejectsBadResponses(t *testing.T) {
+	cases := map[string]func(a *softAuthenticator){
+		"no user presence": func(a *softAuthenticator) { a.flags = flagUserVerified },
+		"other RP ID":      func(a *softAuthenticator) { a.rpID = "evil.example" },
+		"other origin":     func(a *softAuthenticator) { a.origin = "https://evil.example" },
+		"insecure origin":  func(a *softAuthenticator) { a.origin = "http://example.com" },
+		"subdomain origin": func(a *softAuthenticator) { a.origin = "https://login.example.com" },
+	}
+	for name, mutate := range cases {
+		s, mock := newTestWebAuthnService(t)
+		a := newSoftAuthenticator(t)
+		mutate(a)
+		if _, err := register(t, s, mock, a); !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("%s: FinishRegistration = %v, want ErrWebAuthnFailed", name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestWebAuthnRegistrationRejectsMalformedCBOR(t *testing.T) {
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+
+	attestations := map[string][]byte{
+		"truncated":               cborEncode(cborMap{{"fmt", "none"}, {"authData", a.authData(true)}})[:40],
+		"indefinite map":          {0xbf, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0xff},
+		"authData trailing bytes": cborEncode(cborMap{{"fmt", "none"}, {"authData", append(a.authData(false)[:37:37], 0)}}),
+		"no credential":           cborEncode(cborMap{{"fmt", "none"}, {"authData", a.authData(false)}}),
+		"trailing bytes":          append(cborEncode(cborMap{{"fmt", "none"}, {"authData", a.authData(true)}}), 0),
+		"json, not cbor":          []byte(`{"fmt":"none"}`),
+	}
+	for name, attestation := range attestations {
+		opts := beginRegistration(t, s, mock)
+		cred := a.create(opts)
+		cred.Response.AttestationObject = base64URL.EncodeToString(attestation)
+		_, err := s.FinishRegistration(3, &models.WebAuthnRegisterRequest{CeremonyToken: opts.CeremonyToken, Credential: cred})
+		if !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("%s: FinishRegistration = %v, want ErrWebAuthnFailed", name, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnCeremonyCompletesOnce(t *testing.T) {
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+
+	opts := beginRegistration(t, s, mock)
+	req := &models.WebAuthnRegisterRequest{CeremonyToken: opts.CeremonyToken, Credential: a.create(opts)}
+
+	if _, err := s.FinishRegistration(4, req); !errors.Is(err, ErrWebAuthnCeremony) {
+		t.Errorf("FinishRegistration(another user) = %v, want ErrWebAuthnCeremony", err)
+	}
+	mock.ExpectQuery("INSERT INTO webauthn_credentials").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	if _, err := s.FinishRegistration(3, req); err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if _, err := s.FinishRegistration(3, req); !errors.Is(err, ErrWebAuthnCeremony) {
+		t.Errorf("FinishRegistration(replayed) = %v, want ErrWebAuthnCeremony", err)
+	}
+
+	// A registration ceremony doesn't pass for a login one
+	if _, _, err := s.FinishLogin(&models.WebAuthnLoginRequest{CeremonyToken: opts.CeremonyToken}); !errors.Is(err, ErrWebAuthnCeremony) {
+		t.Errorf("FinishLogin(registration ceremony) = %v, want ErrWebAuthnCeremony", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnLoginRejectsBadAssertions(t *testing.T) {
+	cases := map[string]func(a *softAuthenticator){
+		"no user presence":             func(a *softAuthenticator) { a.flags = flagUserVerified },
+		"passkey without verification": func(a *softAuthenticator) { a.flags = flagUserPresent },
+		"other RP ID":                  func(a *softAuthenticator) { a.rpID = "evil.example" },
+		"other origin":                 func(a *softAuthenticator) { a.origin = "https://evil.example" },
+		"other user handle":            func(a *softAuthenticator) { a.handle = []byte("someone else") },
+	}
+	for name, mutate := range cases {
+		s, mock := newTestWebAuthnService(t)
+		a := newSoftAuthenticator(t)
+		a.handle = []byte("handle")
+		stored := a.stored(7, 3, 0)
+		a.signCount = 1
+		mutate(a)
+		expectCredential(mock, stored)
+		if _, _, err := passkeyLogin(t, s, a); !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("%s: FinishLogin = %v, want ErrWebAuthnFailed", name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// A key other than the registered one
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+	a.handle = []byte("handle")
+	stored := newSoftAuthenticator(t).stored(7, 3, 0)
+	stored.CredentialID, stored.UserHandle = a.credentialID, a.handle
+	a.signCount = 1
+	expectCredential(mock, stored)
+	if _, _, err := passkeyLogin(t, s, a); !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishLogin(wrong key) = %v, want ErrWebAuthnFailed", err)
+	}
+
+	// Unknown credential
+	opts, _ := s.BeginLogin("")
+	mock.ExpectQuery("FROM webauthn_credentials WHERE credential_id").WillReturnRows(webauthnRows())
+	_, _, err := s.FinishLogin(&models.WebAuthnLoginRequest{CeremonyToken: opts.CeremonyToken, Credential: a.get(opts)})
+	if !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishLogin(unknown credential) = %v, want ErrWebAuthnFailed", err)
+	}
+}
+
+func TestWebAuthnSignCount(t *testing.T) {
+	cases := []struct {
+		name        string
+		stored, got uint32
+		ok          bool
+	}{
+		{"increases", 10, 11, true},
+		{"regresses", 10, 5, false},
+		{"repeats", 10, 10, false},
+		{"drops to zero", 10, 0, false},
+		{"counterless authenticator", 0, 0, true},
+	}
+	for _, tc := range cases {
+		s, mock := newTestWebAuthnService(t)
+		a := newSoftAuthenticator(t)
+		a.handle = []byte("handle")
+		a.signCount = tc.got
+		expectCredential(mock, a.stored(7, 3, tc.stored))
+		if tc.ok {
+			mock.ExpectExec("UPDATE webauthn_credentials SET sign_count").
+				WithArgs(int64(tc.got), sqlmock.AnyArg(), 7, int64(tc.stored)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("FROM users WHERE id").WillReturnRows(userRows(testUser(3, "alice@example.com")))
+		}
+		_, _, err := passkeyLogin(t, s, a)
+		if tc.ok && err != nil {
+			t.Errorf("%s: FinishLogin = %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("%s: FinishLogin = %v, want ErrWebAuthnFailed", tc.name, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	// A concurrent login with the same counter value got there first
+	s, mock := newTestWebAuthnService(t)
+	a := newSoftAuthenticator(t)
+	a.handle = []byte("handle")
+	a.signCount = 11
+	expectCredential(mock, a.stored(7, 3, 10))
+	mock.ExpectExec("UPDATE webauthn_credentials SET sign_count").WillReturnResult(sqlmock.NewResult(0, 0))
+	if _, _, err := passkeyLogin(t, s, a); !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("FinishLogin(raced) = %v, want ErrWebAuthnFailed", err)
+	}
+}
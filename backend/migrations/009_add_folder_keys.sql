@@ -0,0 +1,3 @@
+-- Per-folder data encryption key, wrapped by the master key-ring.
+-- Existing folders get a key generated lazily the first time it is needed.
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS wrapped_key TEXT;
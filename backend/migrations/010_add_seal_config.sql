@@ -0,0 +1,10 @@
+-- Shamir seal configuration. The master key itself is never stored; key_check
+-- lets the server confirm that submitted unseal shares rebuild the right key.
+CREATE TABLE IF NOT EXISTS seal_config (
+    id INTEGER PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    secret_shares INTEGER NOT NULL,
+    secret_threshold INTEGER NOT NULL,
+    key_version INTEGER NOT NULL,
+    key_check VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
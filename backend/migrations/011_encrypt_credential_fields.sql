@@ -0,0 +1,3 @@
+-- Usernames can now be stored encrypted, which no longer fits in 255 characters.
+-- Existing plaintext usernames and notes are encrypted by POST /api/sys/rewrap.
+ALTER TABLE credentials ALTER COLUMN username TYPE TEXT;
@@ -0,0 +1,3 @@
+-- Per-document data encryption key, wrapped by the master key-ring.
+-- Documents uploaded before encryption at rest have no key and are served as is.
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS wrapped_key TEXT;
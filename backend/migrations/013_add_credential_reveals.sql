@@ -0,0 +1,12 @@
+-- Every time a credential field is revealed in plaintext, who did it and when.
+CREATE TABLE IF NOT EXISTS credential_reveals (
+    id SERIAL PRIMARY KEY,
+    credential_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    field VARCHAR(32) NOT NULL,
+    ip_address VARCHAR(64),
+    revealed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_credential_reveals_credential ON credential_reveals(credential_id);
+CREATE INDEX IF NOT EXISTS idx_credential_reveals_user ON credential_reveals(user_id, revealed_at);
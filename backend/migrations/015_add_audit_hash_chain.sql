@@ -0,0 +1,26 @@
+-- Each audit event carries the hash of the one before it, so removing, editing
+-- or reordering events breaks the chain. Events recorded before this migration
+-- stay unchained and are reported as such by verification.
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS prev_hash CHAR(64);
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS hash CHAR(64);
+
+-- Signed snapshots of the chain head. The signing key lives outside the
+-- database, so truncating the chain back past a checkpoint is detectable.
+CREATE TABLE IF NOT EXISTS audit_checkpoints (
+    id SERIAL PRIMARY KEY,
+    event_id BIGINT NOT NULL,
+    event_hash CHAR(64) NOT NULL,
+    key_id VARCHAR(32) NOT NULL,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+DROP TRIGGER IF EXISTS audit_checkpoints_no_update ON audit_checkpoints;
+CREATE TRIGGER audit_checkpoints_no_update
+    BEFORE UPDATE OR DELETE ON audit_checkpoints
+    FOR EACH ROW EXECUTE FUNCTION reject_audit_event_change();
+
+DROP TRIGGER IF EXISTS audit_checkpoints_no_truncate ON audit_checkpoints;
+CREATE TRIGGER audit_checkpoints_no_truncate
+    BEFORE TRUNCATE ON audit_checkpoints
+    FOR EACH STATEMENT EXECUTE FUNCTION reject_audit_event_change();
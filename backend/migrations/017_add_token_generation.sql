@@ -0,0 +1,3 @@
+-- Access tokens carry the generation they were issued under. Bumping it
+-- invalidates every token the user holds, without waiting for expiry.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_generation INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,33 @@
+-- WebAuthn credentials (security keys and passkeys). The public key is the
+-- COSE_Key the authenticator returned; user_handle is the random id given to
+-- the authenticator for the user, the same for all of a user's credentials.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    user_handle BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    name VARCHAR(100) NOT NULL,
+    aaguid UUID,
+    transports VARCHAR(255),
+    user_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user ON webauthn_credentials(user_id);
+
+-- Login policy, a single row.
+CREATE TABLE IF NOT EXISTS auth_policy (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    -- Admins must log in with a security key or passkey
+    admin_require_phishing_resistant BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO auth_policy (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
+
+-- How each session was authenticated, so a stricter policy also applies to
+-- sessions opened before it
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS auth_method VARCHAR(20) NOT NULL DEFAULT 'password';
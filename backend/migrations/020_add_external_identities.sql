@@ -0,0 +1,7 @@
+-- Where an account comes from: 'local' accounts log in with their password,
+-- others through the identity provider that provisioned them. external_id is
+-- the provider's stable id for the user (the OIDC "sub" claim).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_source VARCHAR(20) NOT NULL DEFAULT 'local';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_external_id ON users(auth_source, external_id) WHERE external_id IS NOT NULL;
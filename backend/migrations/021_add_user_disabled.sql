@@ -0,0 +1,3 @@
+-- Disabled users can't log in. Directory sync disables users who left the
+-- directory, keeping their account and history.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
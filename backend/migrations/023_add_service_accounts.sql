@@ -0,0 +1,37 @@
+-- Non-human identities for automation. They are not users: they have no
+-- password, belong to a group for folder permissions, and authenticate with
+-- an API key or a client certificate, both kept in service_account_credentials
+-- by SHA-256 fingerprint (of the key, or of the certificate's DER encoding).
+CREATE TABLE IF NOT EXISTS service_accounts (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT,
+    user_group VARCHAR(50) NOT NULL,
+    disabled BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS service_account_credentials (
+    id SERIAL PRIMARY KEY,
+    service_account_id INTEGER NOT NULL REFERENCES service_accounts(id) ON DELETE CASCADE,
+    kind VARCHAR(16) NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    fingerprint CHAR(64) NOT NULL UNIQUE,
+    prefix VARCHAR(16),
+    subject VARCHAR(255),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(64),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_service_account_credentials_account ON service_account_credentials(service_account_id);
+
+-- Reveals by service accounts have no user
+ALTER TABLE credential_reveals ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE credential_reveals ADD COLUMN IF NOT EXISTS service_account_id INTEGER
+    REFERENCES service_accounts(id) ON DELETE CASCADE;
+
+-- NULL for users, 'service_account' when actor_id is a service account
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS actor_type VARCHAR(32);
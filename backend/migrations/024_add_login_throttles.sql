@@ -0,0 +1,12 @@
+-- Failed logins per account (the lowercased email, whether or not a user has
+-- it) and per source IP, for backoff and temporary lockout. Rows are keyed by
+-- what was tried, not by users.id, so unknown emails are throttled just like
+-- real ones.
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope VARCHAR(16) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
@@ -0,0 +1,13 @@
+-- Single-use links emailed to users: invitations to set a first password and
+-- password resets. Only the SHA-256 of the token is stored.
+CREATE TABLE IF NOT EXISTS password_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(16) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_tokens_user ON password_tokens(user_id);
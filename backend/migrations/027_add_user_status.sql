@@ -0,0 +1,20 @@
+-- Suspended users keep their account, credentials and documents but can't
+-- log in, and their tokens stop working. suspended_reason says who suspended
+-- them: an admin, the directory sync, or the expiry and inactivity job.
+-- Accounts with expires_at are suspended once it passes.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_reason VARCHAR(16);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_ip VARCHAR(45);
+
+-- Only the directory sync disabled users so far
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'disabled') THEN
+        UPDATE users SET status = 'suspended', suspended_reason = 'directory', status_changed_at = CURRENT_TIMESTAMP
+        WHERE disabled;
+        ALTER TABLE users DROP COLUMN disabled;
+    END IF;
+END $$;
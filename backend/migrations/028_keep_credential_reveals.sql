@@ -0,0 +1,16 @@
+-- Reveal history outlives the users and service accounts who revealed: the
+-- row keeps who it was by email or name, and the id is cleared on delete.
+ALTER TABLE credential_reveals ADD COLUMN IF NOT EXISTS user_email VARCHAR(255);
+ALTER TABLE credential_reveals ADD COLUMN IF NOT EXISTS service_account_name VARCHAR(100);
+
+UPDATE credential_reveals cr SET user_email = u.email
+FROM users u WHERE cr.user_id = u.id AND cr.user_email IS NULL;
+UPDATE credential_reveals cr SET service_account_name = sa.name
+FROM service_accounts sa WHERE cr.service_account_id = sa.id AND cr.service_account_name IS NULL;
+
+ALTER TABLE credential_reveals DROP CONSTRAINT IF EXISTS credential_reveals_user_id_fkey;
+ALTER TABLE credential_reveals ADD CONSTRAINT credential_reveals_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE credential_reveals DROP CONSTRAINT IF EXISTS credential_reveals_service_account_id_fkey;
+ALTER TABLE credential_reveals ADD CONSTRAINT credential_reveals_service_account_id_fkey
+    FOREIGN KEY (service_account_id) REFERENCES service_accounts(id) ON DELETE SET NULL;
@@ -0,0 +1,193 @@
+import { useEffect, useState } from 'react';
+import api from '../services/api';
+
+const SCOPES = [
+  'credentials:read',
+  'credentials:write',
+  'documents:read',
+  'documents:write',
+  'services:read',
+  'services:write',
+];
+
+export default function ApiTokens({ folders = [], onClose, onSuccess }) {
+  const [tokens, setTokens] = useState([]);
+  const [name, setName] = useState('');
+  const [scopes, setScopes] = useState(['credentials:read']);
+  const [folderId, setFolderId] = useState('');
+  const [expiresInDays, setExpiresInDays] = useState(90);
+  const [created, setCreated] = useState(null);
+  const [error, setError] = useState('');
+  const [loading, setLoading] = useState(false);
+
+  const loadTokens = async () => {
+    try {
+      const response = await api.get('/auth/tokens');
+      setTokens(response.data || []);
+    } catch (err) {
+      setError(err.response?.data?.error || 'Failed to load API tokens');
+    }
+  };
+
+  useEffect(() => {
+    loadTokens();
+  }, []);
+
+  // Only credential scopes make sense for a token limited to a folder
+  const availableScopes = folderId ? SCOPES.filter((scope) => scope.startsWith('credentials:')) : SCOPES;
+
+  const toggleScope = (scope) => {
+    setScopes((current) => (current.includes(scope) ? current.filter((s) => s !== scope) : [...current, scope]));
+  };
+
+  const selectFolder = (value) => {
+    setFolderId(value);
+    if (value) setScopes((current) => current.filter((scope) => scope.startsWith('credentials:')));
+  };
+
+  const createToken = async (e) => {
+    e.preventDefault();
+    setError('');
+    setLoading(true);
+    try {
+      const response = await api.post('/auth/tokens', {
+        name,
+        scopes,
+        folder_id: folderId ? parseInt(folderId) : null,
+        expires_in_days: parseInt(expiresInDays) || 0,
+      });
+      setCreated(response.data.token);
+      setName('');
+      onSuccess?.('API token created');
+      await loadTokens();
+    } catch (err) {
+      setError(err.response?.data?.error || 'Failed to create API token');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const revokeToken = async (token) => {
+    if (!window.confirm(`Revoke API token "${token.name}"? Anything using it stops working.`)) return;
+    setError('');
+    try {
+      await api.delete(`/auth/tokens/${token.id}`);
+      onSuccess?.('API token revoked');
+      await loadTokens();
+    } catch (err) {
+      setError(err.response?.data?.error || 'Failed to revoke API token');
+    }
+  };
+
+  const folderName = (id) => folders.find((folder) => folder.id === id)?.name || `folder ${id}`;
+
+  return (
+    <div className="fixed inset-0 bg-black bg-opacity-50 flex items-center justify-center z-50">
+      <div className="bg-white dark:bg-gray-800 rounded-lg p-6 w-full max-w-lg space-y-4 max-h-screen overflow-y-auto">
+        <h2 className="text-2xl font-bold text-gray-900 dark:text-white">API Tokens</h2>
+
+        {error && (
+          <div className="p-3 bg-red-100 dark:bg-red-900 text-red-700 dark:text-red-200 rounded">
+            {error}
+          </div>
+        )}
+
+        {created && (
+          <div className="space-y-2 text-sm text-gray-700 dark:text-gray-300">
+            <p>Copy your new token now. It will not be shown again.</p>
+            <div className="p-3 rounded bg-gray-100 dark:bg-gray-900 font-mono break-all text-gray-900 dark:text-white">
+              {created}
+            </div>
+            <p>Send it as <span className="font-mono">Authorization: Bearer &lt;token&gt;</span>.</p>
+          </div>
+        )}
+
+        {tokens.length === 0 ? (
+          <p className="text-sm text-gray-700 dark:text-gray-300">
+            No API tokens yet. Tokens let scripts and CI pipelines call the API as you.
+          </p>
+        ) : (
+          <ul className="space-y-2">
+            {tokens.map((token) => (
+              <li key={token.id} className="flex items-center justify-between text-sm text-gray-700 dark:text-gray-300">
+                <span>
+                  {token.name} <span className="font-mono text-xs">{token.prefix}…</span>
+                  <span className="block text-xs text-gray-500 dark:text-gray-400">
+                    {token.scopes.join(', ')}
+                    {token.folder_id && ` in ${folderName(token.folder_id)}`}
+                    {' · '}
+                    expires {new Date(token.expires_at).toLocaleDateString()}
+                    {' · '}
+                    {token.last_used_at ? `last used ${new Date(token.last_used_at).toLocaleDateString()}` : 'never used'}
+                  </span>
+                </span>
+                <button
+                  onClick={() => revokeToken(token)}
+                  className="text-red-600 dark:text-red-400 hover:underline"
+                >
+                  Revoke
+                </button>
+              </li>
+            ))}
+          </ul>
+        )}
+
+        <form onSubmit={createToken} className="space-y-3 border-t border-gray-200 dark:border-gray-700 pt-4">
+          <h3 className="font-semibold text-gray-900 dark:text-white">New Token</h3>
+          <input
+            type="text"
+            value={name}
+            onChange={(e) => setName(e.target.value)}
+            placeholder="Name, e.g. deploy pipeline"
+            className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+            required
+          />
+          <select
+            value={folderId}
+            onChange={(e) => selectFolder(e.target.value)}
+            className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+          >
+            <option value="">All folders you can access</option>
+            {folders.map((folder) => (
+              <option key={folder.id} value={folder.id}>Only {folder.name}</option>
+            ))}
+          </select>
+          <div className="grid grid-cols-2 gap-2">
+            {availableScopes.map((scope) => (
+              <label key={scope} className="flex items-center space-x-2 text-sm text-gray-700 dark:text-gray-300">
+                <input type="checkbox" checked={scopes.includes(scope)} onChange={() => toggleScope(scope)} />
+                <span className="font-mono">{scope}</span>
+              </label>
+            ))}
+          </div>
+          <label className="flex items-center space-x-2 text-sm text-gray-700 dark:text-gray-300">
+            <span>Expires in</span>
+            <input
+              type="number"
+              min="1"
+              value={expiresInDays}
+              onChange={(e) => setExpiresInDays(e.target.value)}
+              className="w-24 px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+            />
+            <span>days</span>
+          </label>
+          <button
+            type="submit"
+            disabled={loading || scopes.length === 0}
+            className="w-full bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+          >
+            {loading ? 'Creating...' : 'Create Token'}
+          </button>
+        </form>
+
+        <button
+          type="button"
+          onClick={onClose}
+          className="w-full bg-gray-300 dark:bg-gray-600 hover:bg-gray-400 dark:hover:bg-gray-500 text-gray-900 dark:text-white px-4 py-2 rounded-md"
+        >
+          Close
+        </button>
+      </div>
+    </div>
+  );
+}
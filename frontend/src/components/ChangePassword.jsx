@@ -1,6 +1,6 @@
 import { useState } from 'react';
 import { useAuth } from '../context/AuthContext';
-import api from '../services/api';
+import api, { errorMessage } from '../services/api';
 
 export default function ChangePassword({ onClose, onSuccess }) {
   const { user } = useAuth();
@@ -21,21 +21,21 @@ export default function ChangePassword({ onClose, onSuccess }) {
       return;
     }
 
-    if (formData.new_password.length < 6) {
-      setError('New password must be at least 6 characters');
-      return;
-    }
-
     setLoading(true);
     try {
-      await api.put('/auth/change-password', {
+      const response = await api.put('/auth/change-password', {
         current_password: formData.current_password,
         new_password: formData.new_password
       });
+      // Changing the password revokes all tokens; continue with the new session
+      if (response.data.token) {
+        localStorage.setItem('token', response.data.token);
+        localStorage.setItem('refresh_token', response.data.refresh_token);
+      }
       onSuccess?.('Password changed successfully');
       onClose();
     } catch (err) {
-      setError(err.response?.data?.error || 'Failed to change password');
+      setError(errorMessage(err, 'Failed to change password'));
     } finally {
       setLoading(false);
     }
@@ -78,7 +78,6 @@ export default function ChangePassword({ onClose, onSuccess }) {
               onChange={(e) => setFormData({ ...formData, new_password: e.target.value })}
               className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
               required
-              minLength={6}
             />
           </div>
 
@@ -92,7 +91,6 @@ export default function ChangePassword({ onClose, onSuccess }) {
               onChange={(e) => setFormData({ ...formData, confirm_password: e.target.value })}
               className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
               required
-              minLength={6}
             />
           </div>
 
@@ -17,9 +17,10 @@ const CredentialForm = ({ credential, folders, onClose, isDark }) => {
       setFormData({
         folder_id: credential.folder_id,
         service_name: credential.service_name,
-        username: credential.username,
-        password: credential.password,
-        notes: credential.notes || ''
+        // Secrets are not part of the list response; blank means unchanged
+        username: '',
+        password: '',
+        notes: ''
       })
     } else if (folders && folders.length > 0) {
       // Set first folder as default for new credentials
@@ -111,7 +112,7 @@ const CredentialForm = ({ credential, folders, onClose, isDark }) => {
 
           <div className="mb-4">
             <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
-              Username *
+              Username {!credential && '*'}
             </label>
             <input
               type="text"
@@ -122,14 +123,14 @@ const CredentialForm = ({ credential, folders, onClose, isDark }) => {
                   ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' 
                   : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
               }`}
-              placeholder="Enter username or email"
-              required
+              placeholder={credential ? 'Leave blank to keep current username' : 'Enter username or email'}
+              required={!credential}
             />
           </div>
 
           <div className="mb-4">
             <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
-              Password *
+              Password {!credential && '*'}
             </label>
             <input
               type="password"
@@ -140,8 +141,8 @@ const CredentialForm = ({ credential, folders, onClose, isDark }) => {
                   ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' 
                   : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
               }`}
-              placeholder="Enter password"
-              required
+              placeholder={credential ? 'Leave blank to keep current password' : 'Enter password'}
+              required={!credential}
             />
           </div>
 
@@ -158,7 +159,7 @@ const CredentialForm = ({ credential, folders, onClose, isDark }) => {
                   : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
               }`}
               rows="3"
-              placeholder="Additional information (optional)"
+              placeholder={credential ? 'Leave blank to keep current notes' : 'Additional information (optional)'}
             />
           </div>
 
@@ -1,14 +1,53 @@
-import { useState } from 'react'
+import { useState, useRef, useEffect } from 'react'
+import api from '../services/api'
+
+// Revealed values are dropped again after this long
+const REVEAL_TIMEOUT_MS = 30000
 
 const CredentialList = ({ credentials, onEdit, onDelete, isAdmin, isDark }) => {
-  const [showPassword, setShowPassword] = useState({})
+  const [revealed, setRevealed] = useState({})
   const [copiedField, setCopiedField] = useState(null)
+  const [revealError, setRevealError] = useState(null)
+  const timers = useRef({})
+
+  useEffect(() => () => Object.values(timers.current).forEach(clearTimeout), [])
+
+  // Secrets are not in the list response; each one is fetched, and the
+  // reveal recorded, only when the user asks for it
+  const reveal = async (id, field) => {
+    const key = `${field}-${id}`
+    if (revealed[key] !== undefined) {
+      return revealed[key]
+    }
+    try {
+      setRevealError(null)
+      const response = await api.post(`/credentials/${id}/reveal`, { field })
+      const value = response.data.value
+      setRevealed(prev => ({ ...prev, [key]: value }))
+      clearTimeout(timers.current[key])
+      timers.current[key] = setTimeout(() => hide(key), REVEAL_TIMEOUT_MS)
+      return value
+    } catch (err) {
+      setRevealError({ key, message: err.response?.data?.error || 'Failed to reveal' })
+      return null
+    }
+  }
 
-  const togglePassword = (id) => {
-    setShowPassword(prev => ({ ...prev, [id]: !prev[id] }))
+  const hide = (key) => {
+    clearTimeout(timers.current[key])
+    setRevealed(prev => {
+      const next = { ...prev }
+      delete next[key]
+      return next
+    })
   }
 
-  const copyToClipboard = async (text, fieldId) => {
+  const copyToClipboard = async (id, field) => {
+    const fieldId = `${field}-${id}`
+    const text = await reveal(id, field)
+    if (text === null) {
+      return
+    }
     try {
       await navigator.clipboard.writeText(text)
       setCopiedField(fieldId)
@@ -18,6 +57,77 @@ const CredentialList = ({ credentials, onEdit, onDelete, isAdmin, isDark }) => {
     }
   }
 
+  const renderSecret = (cred, field, label) => {
+    const key = `${field}-${cred.id}`
+    const value = revealed[key]
+    const shown = value !== undefined
+
+    return (
+      <div key={key} className={`rounded-lg p-4 mb-3 border ${
+        isDark ? 'bg-gray-900 border-gray-700' : 'bg-gray-50 border-gray-200'
+      }`}>
+        <div className="flex items-center justify-between">
+          <div className="flex-1 min-w-0">
+            <span className={`text-sm font-medium block mb-2 ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>{label}:</span>
+            {field === 'notes' && shown ? (
+              <p className={`text-sm leading-relaxed ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>{value}</p>
+            ) : (
+              <code className={`font-mono text-sm break-all ${isDark ? 'text-white' : 'text-gray-900'}`}>
+                {shown ? value : '••••••••••••'}
+              </code>
+            )}
+            {revealError?.key === key && (
+              <span className={`text-xs block mt-1 ${isDark ? 'text-red-300' : 'text-red-600'}`}>{revealError.message}</span>
+            )}
+          </div>
+          <div className="flex space-x-2 ml-3">
+            {field !== 'notes' && (
+              <button
+                onClick={() => copyToClipboard(cred.id, field)}
+                className={`px-3 py-1.5 rounded-lg transition-all duration-200 text-sm font-medium border flex items-center space-x-2 ${
+                  copiedField === key
+                    ? isDark
+                      ? 'bg-green-900 border-green-700 text-green-200'
+                      : 'bg-green-50 border-green-300 text-green-700'
+                    : isDark 
+                      ? 'bg-gray-800 hover:bg-gray-700 text-gray-300 border-gray-700' 
+                      : 'bg-white hover:bg-gray-50 text-gray-700 border-gray-300'
+                }`}
+                title={`Copy ${field}`}
+              >
+                {copiedField === key ? (
+                  <>
+                    <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                      <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M5 13l4 4L19 7" />
+                    </svg>
+                    <span>Copied!</span>
+                  </>
+                ) : (
+                  <>
+                    <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                      <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M8 16H6a2 2 0 01-2-2V6a2 2 0 012-2h8a2 2 0 012 2v2m-6 12h8a2 2 0 002-2v-8a2 2 0 00-2-2h-8a2 2 0 00-2 2v8a2 2 0 002 2z" />
+                    </svg>
+                    <span>Copy</span>
+                  </>
+                )}
+              </button>
+            )}
+            <button
+              onClick={() => shown ? hide(key) : reveal(cred.id, field)}
+              className={`px-3 py-1.5 rounded-lg transition-colors duration-200 text-sm font-medium border ${
+                isDark 
+                  ? 'bg-gray-800 hover:bg-gray-700 text-gray-300 border-gray-700' 
+                  : 'bg-white hover:bg-gray-50 text-gray-700 border-gray-300'
+              }`}
+            >
+              {shown ? 'Hide' : 'Show'}
+            </button>
+          </div>
+        </div>
+      </div>
+    )
+  }
+
   if (!credentials || credentials.length === 0) {
     return (
       <div className={`rounded-xl p-12 text-center border ${
@@ -80,110 +190,9 @@ const CredentialList = ({ credentials, onEdit, onDelete, isAdmin, isDark }) => {
               )}
             </div>
 
-            <div className={`rounded-lg p-4 mb-3 border ${
-              isDark ? 'bg-gray-900 border-gray-700' : 'bg-gray-50 border-gray-200'
-            }`}>
-              <div className="flex items-center justify-between">
-                <div className="flex-1">
-                  <span className={`text-sm font-medium block mb-2 ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Username:</span>
-                  <code className={`font-mono text-sm ${isDark ? 'text-white' : 'text-gray-900'}`}>
-                    {cred.username}
-                  </code>
-                </div>
-                <button
-                  onClick={() => copyToClipboard(cred.username, `username-${cred.id}`)}
-                  className={`ml-3 px-3 py-1.5 rounded-lg transition-all duration-200 text-sm font-medium border flex items-center space-x-2 ${
-                    copiedField === `username-${cred.id}`
-                      ? isDark
-                        ? 'bg-green-900 border-green-700 text-green-200'
-                        : 'bg-green-50 border-green-300 text-green-700'
-                      : isDark 
-                        ? 'bg-gray-800 hover:bg-gray-700 text-gray-300 border-gray-700' 
-                        : 'bg-white hover:bg-gray-50 text-gray-700 border-gray-300'
-                  }`}
-                  title="Copy username"
-                >
-                  {copiedField === `username-${cred.id}` ? (
-                    <>
-                      <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                        <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M5 13l4 4L19 7" />
-                      </svg>
-                      <span>Copied!</span>
-                    </>
-                  ) : (
-                    <>
-                      <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                        <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M8 16H6a2 2 0 01-2-2V6a2 2 0 012-2h8a2 2 0 012 2v2m-6 12h8a2 2 0 002-2v-8a2 2 0 00-2-2h-8a2 2 0 00-2 2v8a2 2 0 002 2z" />
-                      </svg>
-                      <span>Copy</span>
-                    </>
-                  )}
-                </button>
-              </div>
-            </div>
-
-            <div className={`rounded-lg p-4 mb-3 border ${
-              isDark ? 'bg-gray-900 border-gray-700' : 'bg-gray-50 border-gray-200'
-            }`}>
-              <div className="flex items-center justify-between">
-                <div className="flex items-center space-x-3 flex-1">
-                  <span className={`text-sm font-medium ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Password:</span>
-                  <code className={`font-mono text-sm ${isDark ? 'text-white' : 'text-gray-900'}`}>
-                    {showPassword[cred.id] ? cred.password : '••••••••••••'}
-                  </code>
-                </div>
-                <div className="flex space-x-2">
-                  <button
-                    onClick={() => copyToClipboard(cred.password, `password-${cred.id}`)}
-                    className={`px-3 py-1.5 rounded-lg transition-all duration-200 text-sm font-medium border flex items-center space-x-2 ${
-                      copiedField === `password-${cred.id}`
-                        ? isDark
-                          ? 'bg-green-900 border-green-700 text-green-200'
-                          : 'bg-green-50 border-green-300 text-green-700'
-                        : isDark 
-                          ? 'bg-gray-800 hover:bg-gray-700 text-gray-300 border-gray-700' 
-                          : 'bg-white hover:bg-gray-50 text-gray-700 border-gray-300'
-                    }`}
-                    title="Copy password"
-                  >
-                    {copiedField === `password-${cred.id}` ? (
-                      <>
-                        <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                          <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M5 13l4 4L19 7" />
-                        </svg>
-                        <span>Copied!</span>
-                      </>
-                    ) : (
-                      <>
-                        <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
-                          <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M8 16H6a2 2 0 01-2-2V6a2 2 0 012-2h8a2 2 0 012 2v2m-6 12h8a2 2 0 002-2v-8a2 2 0 00-2-2h-8a2 2 0 00-2 2v8a2 2 0 002 2z" />
-                        </svg>
-                        <span>Copy</span>
-                      </>
-                    )}
-                  </button>
-                  <button
-                    onClick={() => togglePassword(cred.id)}
-                    className={`px-3 py-1.5 rounded-lg transition-colors duration-200 text-sm font-medium border ${
-                      isDark 
-                        ? 'bg-gray-800 hover:bg-gray-700 text-gray-300 border-gray-700' 
-                        : 'bg-white hover:bg-gray-50 text-gray-700 border-gray-300'
-                    }`}
-                  >
-                    {showPassword[cred.id] ? 'Hide' : 'Show'}
-                  </button>
-                </div>
-              </div>
-            </div>
-
-            {cred.notes && (
-              <div className={`rounded-lg p-4 border ${
-                isDark ? 'bg-gray-900 border-gray-700' : 'bg-gray-50 border-gray-200'
-              }`}>
-                <span className={`text-sm font-medium block mb-2 ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Notes:</span>
-                <p className={`text-sm leading-relaxed ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>{cred.notes}</p>
-              </div>
-            )}
+            {renderSecret(cred, 'username', 'Username')}
+            {renderSecret(cred, 'password', 'Password')}
+            {cred.has_notes && renderSecret(cred, 'notes', 'Notes')}
 
             {isAdmin && (
               <div className={`mt-4 pt-4 border-t ${isDark ? 'border-gray-700' : 'border-gray-200'}`}>
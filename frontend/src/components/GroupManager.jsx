@@ -5,7 +5,7 @@ const GroupManager = ({ isDark, onUpdate }) => {
   const [groups, setGroups] = useState([])
   const [showCreateForm, setShowCreateForm] = useState(false)
   const [editingGroup, setEditingGroup] = useState(null)
-  const [formData, setFormData] = useState({ name: '', description: '' })
+  const [formData, setFormData] = useState({ name: '', description: '', require_mfa: false })
   const [loading, setLoading] = useState(false)
 
   useEffect(() => {
@@ -29,7 +29,7 @@ const GroupManager = ({ isDark, onUpdate }) => {
     try {
       await api.post('/groups', formData)
       setShowCreateForm(false)
-      setFormData({ name: '', description: '' })
+      setFormData({ name: '', description: '', require_mfa: false })
       fetchGroups()
       onUpdate?.()
     } catch (error) {
@@ -47,7 +47,7 @@ const GroupManager = ({ isDark, onUpdate }) => {
     try {
       await api.put(`/groups/${editingGroup.id}`, formData)
       setEditingGroup(null)
-      setFormData({ name: '', description: '' })
+      setFormData({ name: '', description: '', require_mfa: false })
       fetchGroups()
       onUpdate?.()
     } catch (error) {
@@ -73,13 +73,13 @@ const GroupManager = ({ isDark, onUpdate }) => {
 
   const startEdit = (group) => {
     setEditingGroup(group)
-    setFormData({ name: group.name, description: group.description })
+    setFormData({ name: group.name, description: group.description, require_mfa: group.require_mfa })
   }
 
   const cancelEdit = () => {
     setEditingGroup(null)
     setShowCreateForm(false)
-    setFormData({ name: '', description: '' })
+    setFormData({ name: '', description: '', require_mfa: false })
   }
 
   return (
@@ -129,7 +129,7 @@ const GroupManager = ({ isDark, onUpdate }) => {
                 required
               />
             </div>
-            <div className="mb-6">
+            <div className="mb-4">
               <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
                 Description
               </label>
@@ -145,6 +145,17 @@ const GroupManager = ({ isDark, onUpdate }) => {
                 placeholder="Brief description of the group"
               />
             </div>
+            <div className="mb-6">
+              <label className={`flex items-center space-x-2 text-sm font-semibold ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+                <input
+                  type="checkbox"
+                  checked={formData.require_mfa}
+                  onChange={(e) => setFormData({ ...formData, require_mfa: e.target.checked })}
+                  className="w-4 h-4"
+                />
+                <span>Require two-factor authentication</span>
+              </label>
+            </div>
             <div className="flex gap-3">
               <button
                 type="submit"
@@ -183,6 +194,13 @@ const GroupManager = ({ isDark, onUpdate }) => {
                 <p className={`text-sm mt-1 ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
                   {group.description || 'No description'}
                 </p>
+                {group.require_mfa && (
+                  <span className={`inline-flex items-center mt-2 px-2 py-0.5 rounded-md text-xs font-medium ${
+                    isDark ? 'bg-green-900/50 text-green-200' : 'bg-green-100 text-green-700'
+                  }`}>
+                    2FA required
+                  </span>
+                )}
               </div>
               <div className="flex gap-2">
                 <button
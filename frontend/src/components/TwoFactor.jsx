@@ -0,0 +1,280 @@
+import { useEffect, useState } from 'react';
+import api from '../services/api';
+import { createCredential, isWebAuthnSupported } from '../services/webauthn';
+
+// Shows a new TOTP secret; the otpauth:// link opens authenticator apps on
+// phones, elsewhere the secret is typed in
+export function EnrollmentDetails({ enrollment }) {
+  return (
+    <div className="space-y-2 text-sm text-gray-700 dark:text-gray-300">
+      <p>Add this account to your authenticator app, then enter the 6-digit code it shows.</p>
+      <div className="p-3 rounded bg-gray-100 dark:bg-gray-900 font-mono break-all text-gray-900 dark:text-white">
+        {enrollment.secret}
+      </div>
+      <a href={enrollment.provisioning_uri} className="text-blue-600 dark:text-blue-400 underline break-all">
+        Open in authenticator app
+      </a>
+    </div>
+  );
+}
+
+export function RecoveryCodeList({ codes }) {
+  return (
+    <div className="space-y-2 text-sm text-gray-700 dark:text-gray-300">
+      <p>
+        Save these recovery codes somewhere safe. Each one signs you in once if you lose your
+        device. They will not be shown again.
+      </p>
+      <div className="grid grid-cols-2 gap-2 p-3 rounded bg-gray-100 dark:bg-gray-900 font-mono text-gray-900 dark:text-white">
+        {codes.map((code) => (
+          <span key={code}>{code}</span>
+        ))}
+      </div>
+    </div>
+  );
+}
+
+export default function TwoFactor({ onClose, onSuccess }) {
+  const [status, setStatus] = useState(null);
+  const [enrollment, setEnrollment] = useState(null);
+  const [recoveryCodes, setRecoveryCodes] = useState(null);
+  const [securityKeys, setSecurityKeys] = useState([]);
+  const [keyName, setKeyName] = useState('');
+  const [code, setCode] = useState('');
+  const [error, setError] = useState('');
+  const [loading, setLoading] = useState(false);
+
+  const loadStatus = async () => {
+    try {
+      const response = await api.get('/auth/mfa');
+      setStatus(response.data);
+      const keys = await api.get('/auth/webauthn/credentials');
+      setSecurityKeys(keys.data || []);
+    } catch (err) {
+      setError(err.response?.data?.error || 'Failed to load two-factor status');
+    }
+  };
+
+  useEffect(() => {
+    loadStatus();
+  }, []);
+
+  const run = async (action) => {
+    setError('');
+    setLoading(true);
+    try {
+      await action();
+      setCode('');
+    } catch (err) {
+      setError(err.response?.data?.error || (err.name === 'NotAllowedError' ? 'Security key request was cancelled' : 'Request failed'));
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const startEnrollment = () => run(async () => {
+    const response = await api.post('/auth/mfa/totp');
+    setEnrollment(response.data);
+  });
+
+  const enable = (e) => {
+    e.preventDefault();
+    run(async () => {
+      const response = await api.post('/auth/mfa/totp/enable', { code });
+      setEnrollment(null);
+      setRecoveryCodes(response.data.recovery_codes);
+      onSuccess?.('Two-factor authentication enabled');
+      await loadStatus();
+    });
+  };
+
+  const disable = () => run(async () => {
+    await api.delete('/auth/mfa/totp', { data: { code } });
+    onSuccess?.('Two-factor authentication disabled');
+    await loadStatus();
+  });
+
+  const regenerate = () => run(async () => {
+    const response = await api.post('/auth/mfa/recovery-codes', { code });
+    setRecoveryCodes(response.data.recovery_codes);
+    await loadStatus();
+  });
+
+  const addSecurityKey = (e) => {
+    e.preventDefault();
+    run(async () => {
+      const options = await api.post('/auth/webauthn/register/begin');
+      const credential = await createCredential(options.data.publicKey);
+      await api.post('/auth/webauthn/register/finish', {
+        ceremony_token: options.data.ceremony_token,
+        name: keyName,
+        credential,
+      });
+      setKeyName('');
+      onSuccess?.('Security key added');
+      await loadStatus();
+    });
+  };
+
+  const removeSecurityKey = (key) => {
+    if (!window.confirm(`Remove security key "${key.name}"?`)) return;
+    run(async () => {
+      await api.delete(`/auth/webauthn/credentials/${key.id}`);
+      onSuccess?.('Security key removed');
+      await loadStatus();
+    });
+  };
+
+  const codeInput = (
+    <input
+      type="text"
+      inputMode="numeric"
+      autoComplete="one-time-code"
+      value={code}
+      onChange={(e) => setCode(e.target.value)}
+      placeholder="6-digit code"
+      className="w-full px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+      required
+    />
+  );
+
+  return (
+    <div className="fixed inset-0 bg-black bg-opacity-50 flex items-center justify-center z-50">
+      <div className="bg-white dark:bg-gray-800 rounded-lg p-6 w-full max-w-md space-y-4">
+        <h2 className="text-2xl font-bold text-gray-900 dark:text-white">
+          Two-Factor Authentication
+        </h2>
+
+        {error && (
+          <div className="p-3 bg-red-100 dark:bg-red-900 text-red-700 dark:text-red-200 rounded">
+            {error}
+          </div>
+        )}
+
+        {recoveryCodes && <RecoveryCodeList codes={recoveryCodes} />}
+
+        {status && !status.enabled && !enrollment && (
+          <div className="space-y-3">
+            <p className="text-sm text-gray-700 dark:text-gray-300">
+              {status.required
+                ? 'Your group requires two-factor authentication.'
+                : 'Protect your account with a code from an authenticator app.'}
+            </p>
+            <button
+              onClick={startEnrollment}
+              disabled={loading}
+              className="w-full bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+            >
+              Set Up Authenticator App
+            </button>
+          </div>
+        )}
+
+        {enrollment && (
+          <form onSubmit={enable} className="space-y-3">
+            <EnrollmentDetails enrollment={enrollment} />
+            {codeInput}
+            <button
+              type="submit"
+              disabled={loading}
+              className="w-full bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+            >
+              {loading ? 'Verifying...' : 'Enable'}
+            </button>
+          </form>
+        )}
+
+        {status?.enabled && (
+          <div className="space-y-3">
+            <p className="text-sm text-gray-700 dark:text-gray-300">
+              Two-factor authentication is on. {status.recovery_codes_remaining} recovery codes left.
+            </p>
+            {codeInput}
+            <div className="flex gap-2">
+              <button
+                onClick={regenerate}
+                disabled={loading || !code}
+                className="flex-1 bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+              >
+                New Recovery Codes
+              </button>
+              {!status.required && (
+                <button
+                  onClick={disable}
+                  disabled={loading || !code}
+                  className="flex-1 bg-red-600 hover:bg-red-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+                >
+                  Disable
+                </button>
+              )}
+            </div>
+          </div>
+        )}
+
+        {status && (
+          <div className="space-y-3 border-t border-gray-200 dark:border-gray-700 pt-4">
+            <h3 className="font-semibold text-gray-900 dark:text-white">Security Keys and Passkeys</h3>
+            {securityKeys.length === 0 ? (
+              <p className="text-sm text-gray-700 dark:text-gray-300">
+                No security keys yet. A security key or passkey can replace the code, and a passkey
+                signs you in without a password.
+              </p>
+            ) : (
+              <ul className="space-y-2">
+                {securityKeys.map((key) => (
+                  <li key={key.id} className="flex items-center justify-between text-sm text-gray-700 dark:text-gray-300">
+                    <span>
+                      {key.name}
+                      <span className="block text-xs text-gray-500 dark:text-gray-400">
+                        {key.last_used_at
+                          ? `Last used ${new Date(key.last_used_at).toLocaleDateString()}`
+                          : `Added ${new Date(key.created_at).toLocaleDateString()}`}
+                      </span>
+                    </span>
+                    <button
+                      onClick={() => removeSecurityKey(key)}
+                      disabled={loading}
+                      className="text-red-600 dark:text-red-400 hover:underline disabled:opacity-50"
+                    >
+                      Remove
+                    </button>
+                  </li>
+                ))}
+              </ul>
+            )}
+            {isWebAuthnSupported() ? (
+              <form onSubmit={addSecurityKey} className="flex gap-2">
+                <input
+                  type="text"
+                  value={keyName}
+                  onChange={(e) => setKeyName(e.target.value)}
+                  placeholder="Name (optional)"
+                  className="flex-1 px-3 py-2 border border-gray-300 dark:border-gray-600 rounded-md bg-white dark:bg-gray-700 text-gray-900 dark:text-white"
+                />
+                <button
+                  type="submit"
+                  disabled={loading}
+                  className="bg-blue-600 hover:bg-blue-700 text-white px-4 py-2 rounded-md disabled:opacity-50"
+                >
+                  Add Key
+                </button>
+              </form>
+            ) : (
+              <p className="text-sm text-gray-500 dark:text-gray-400">
+                This browser does not support security keys.
+              </p>
+            )}
+          </div>
+        )}
+
+        <button
+          type="button"
+          onClick={onClose}
+          className="w-full bg-gray-300 dark:bg-gray-600 hover:bg-gray-400 dark:hover:bg-gray-500 text-gray-900 dark:text-white px-4 py-2 rounded-md"
+        >
+          Close
+        </button>
+      </div>
+    </div>
+  );
+}
@@ -1,5 +1,13 @@
 import { useState, useEffect } from 'react'
-import api from '../services/api'
+import api, { errorMessage } from '../services/api'
+
+// Expiry dates are picked as local days; an account works through the whole day
+const toDateInput = (iso) => {
+  if (!iso) return ''
+  const d = new Date(iso)
+  return `${d.getFullYear()}-${String(d.getMonth() + 1).padStart(2, '0')}-${String(d.getDate()).padStart(2, '0')}`
+}
+const fromDateInput = (date) => date ? new Date(`${date}T23:59:59`).toISOString() : null
 
 const UserManager = ({ isDark }) => {
   const [users, setUsers] = useState([])
@@ -10,8 +18,11 @@ const UserManager = ({ isDark }) => {
     email: '',
     password: '',
     role: 'user',
-    user_group: ''
+    user_group: '',
+    expires_at: ''
   })
+  // New users can be emailed an invitation to choose their own password
+  const [invite, setInvite] = useState(false)
   const [loading, setLoading] = useState(false)
 
   useEffect(() => {
@@ -45,18 +56,30 @@ const UserManager = ({ isDark }) => {
   const handleSubmit = async (e) => {
     e.preventDefault()
     setLoading(true)
+    const { expires_at, ...userData } = formData
     try {
+      let userId
       if (editingUser) {
-        await api.put(`/users/${editingUser.id}`, formData)
+        await api.put(`/users/${editingUser.id}`, userData)
+        userId = editingUser.id
+      } else if (invite) {
+        const { password, ...invitation } = userData
+        userId = (await api.post('/users/invite', invitation)).data.id
       } else {
-        await api.post('/users', formData)
+        userId = (await api.post('/users', userData)).data.id
+      }
+      if (expires_at !== toDateInput(editingUser?.expires_at)) {
+        await api.put(`/users/${userId}/expiry`, { expires_at: fromDateInput(expires_at) })
       }
-      setFormData({ email: '', password: '', role: 'user', user_group: groups.length > 0 ? groups[0].name : '' })
+      setFormData({ email: '', password: '', role: 'user', user_group: groups.length > 0 ? groups[0].name : '', expires_at: '' })
       setShowCreateForm(false)
       setEditingUser(null)
+      setInvite(false)
       fetchUsers()
     } catch (error) {
-      alert('Failed to save user')
+      alert(errorMessage(error, 'Failed to save user'))
+      // The invited user exists even if the email didn't go out
+      fetchUsers()
     } finally {
       setLoading(false)
     }
@@ -68,13 +91,14 @@ const UserManager = ({ isDark }) => {
       email: user.email,
       password: '',
       role: user.role,
-      user_group: user.user_group
+      user_group: user.user_group,
+      expires_at: toDateInput(user.expires_at)
     })
     setShowCreateForm(true)
   }
 
   const handleDelete = async (id) => {
-    if (!window.confirm('Are you sure you want to delete this user?')) return
+    if (!window.confirm('Delete this user along with their credentials and documents? Suspend them instead to keep those.')) return
     try {
       await api.delete(`/users/${id}`)
       fetchUsers()
@@ -83,10 +107,39 @@ const UserManager = ({ isDark }) => {
     }
   }
 
+  const handleUnlock = async (id) => {
+    try {
+      await api.post(`/users/${id}/unlock`)
+      fetchUsers()
+    } catch (error) {
+      alert('Failed to unlock user')
+    }
+  }
+
+  const handleStatus = async (user, status) => {
+    if (status === 'suspended' && !window.confirm(`Suspend ${user.email}? They are logged out, and their data is kept.`)) return
+    try {
+      await api.put(`/users/${user.id}/status`, { status })
+      fetchUsers()
+    } catch (error) {
+      alert(errorMessage(error, 'Failed to update user status'))
+    }
+  }
+
+  const handleResendInvite = async (id) => {
+    try {
+      await api.post(`/users/${id}/invite`)
+      alert('Invitation sent')
+    } catch (error) {
+      alert(errorMessage(error, 'Failed to send invitation'))
+    }
+  }
+
   const handleCancel = () => {
     setShowCreateForm(false)
     setEditingUser(null)
-    setFormData({ email: '', password: '', role: 'user', user_group: groups.length > 0 ? groups[0].name : '' })
+    setInvite(false)
+    setFormData({ email: '', password: '', role: 'user', user_group: groups.length > 0 ? groups[0].name : '', expires_at: '' })
   }
 
   return (
@@ -117,9 +170,19 @@ const UserManager = ({ isDark }) => {
                 <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
                   Password {editingUser && '(leave empty to keep current, or enter new password to reset)'}
                 </label>
-                <input type="password" value={formData.password} onChange={(e) => setFormData({ ...formData, password: e.target.value })} className={`w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 ${isDark ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'}`} placeholder="Enter password" required={!editingUser} />
+                {invite ? (
+                  <p className={`py-3 text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>The user chooses a password through the emailed link</p>
+                ) : (
+                  <input type="password" value={formData.password} onChange={(e) => setFormData({ ...formData, password: e.target.value })} className={`w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 ${isDark ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'}`} placeholder="Enter password" required={!editingUser} />
+                )}
               </div>
             </div>
+            {!editingUser && (
+              <label className={`flex items-center space-x-2 mb-4 text-sm ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+                <input type="checkbox" checked={invite} onChange={(e) => setInvite(e.target.checked)} />
+                <span>Email an invitation instead of setting a password</span>
+              </label>
+            )}
             <div className="grid grid-cols-2 gap-4 mb-6">
               <div>
                 <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>Role *</label>
@@ -140,9 +203,13 @@ const UserManager = ({ isDark }) => {
                   )}
                 </select>
               </div>
+              <div>
+                <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>Account expires (leave empty for never)</label>
+                <input type="date" value={formData.expires_at} onChange={(e) => setFormData({ ...formData, expires_at: e.target.value })} className={`w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 ${isDark ? 'bg-gray-900 border-gray-700 text-white' : 'bg-white border-gray-300 text-gray-900'}`} />
+              </div>
             </div>
             <div className="flex gap-3">
-              <button type="submit" disabled={loading} className="px-6 py-3 bg-gradient-to-r from-blue-600 to-blue-500 text-white rounded-lg hover:from-blue-500 hover:to-blue-400 disabled:from-gray-700 disabled:to-gray-600 transition-all duration-200 font-semibold shadow-lg shadow-blue-500/50">{loading ? 'Saving...' : editingUser ? 'Update User' : 'Create User'}</button>
+              <button type="submit" disabled={loading} className="px-6 py-3 bg-gradient-to-r from-blue-600 to-blue-500 text-white rounded-lg hover:from-blue-500 hover:to-blue-400 disabled:from-gray-700 disabled:to-gray-600 transition-all duration-200 font-semibold shadow-lg shadow-blue-500/50">{loading ? 'Saving...' : editingUser ? 'Update User' : invite ? 'Send Invitation' : 'Create User'}</button>
               <button type="button" onClick={handleCancel} className={`px-6 py-3 rounded-lg transition-colors duration-200 font-semibold border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Cancel</button>
             </div>
           </form>
@@ -157,17 +224,50 @@ const UserManager = ({ isDark }) => {
               <th className={`px-6 py-4 text-left text-xs font-semibold uppercase tracking-wider ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Role</th>
               <th className={`px-6 py-4 text-left text-xs font-semibold uppercase tracking-wider ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Group</th>
               <th className={`px-6 py-4 text-left text-xs font-semibold uppercase tracking-wider ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Created</th>
+              <th className={`px-6 py-4 text-left text-xs font-semibold uppercase tracking-wider ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Last Login</th>
               <th className={`px-6 py-4 text-right text-xs font-semibold uppercase tracking-wider ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>Actions</th>
             </tr>
           </thead>
           <tbody className={`divide-y ${isDark ? 'divide-gray-700' : 'divide-gray-200'}`}>
             {users.map((user) => (
               <tr key={user.id} className={isDark ? 'hover:bg-gray-750 transition-colors' : 'hover:bg-gray-50 transition-colors'}>
-                <td className={`px-6 py-4 text-sm ${isDark ? 'text-white' : 'text-gray-900'}`}>{user.email}</td>
+                <td className={`px-6 py-4 text-sm ${isDark ? 'text-white' : 'text-gray-900'}`}>
+                  {user.email}
+                  {user.auth_source && user.auth_source !== 'local' && (
+                    <span className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium uppercase ${isDark ? 'bg-gray-700 text-gray-300' : 'bg-gray-100 text-gray-700'}`}>{user.auth_source}</span>
+                  )}
+                  {user.status === 'suspended' && (
+                    <span title={`Suspended${user.suspended_reason ? ` (${user.suspended_reason})` : ''}${user.status_changed_at ? ` on ${new Date(user.status_changed_at).toLocaleString()}` : ''}`} className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium uppercase ${isDark ? 'bg-red-900/50 text-red-200' : 'bg-red-100 text-red-700'}`}>suspended</span>
+                  )}
+                  {user.status !== 'suspended' && user.expires_at && new Date(user.expires_at) <= new Date() && (
+                    <span className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium uppercase ${isDark ? 'bg-red-900/50 text-red-200' : 'bg-red-100 text-red-700'}`}>expired</span>
+                  )}
+                  {user.expires_at && new Date(user.expires_at) > new Date() && (
+                    <span title={`Expires ${new Date(user.expires_at).toLocaleString()}`} className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium ${isDark ? 'bg-gray-700 text-gray-300' : 'bg-gray-100 text-gray-700'}`}>expires {new Date(user.expires_at).toLocaleDateString()}</span>
+                  )}
+                  {user.pending_invite && (
+                    <span title="Hasn't chosen a password yet" className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium uppercase ${isDark ? 'bg-green-900/50 text-green-200' : 'bg-green-100 text-green-800'}`}>invited</span>
+                  )}
+                  {user.locked_until && (
+                    <span title={`Locked until ${new Date(user.locked_until).toLocaleString()}`} className={`ml-2 inline-flex items-center px-2 py-0.5 rounded text-xs font-medium uppercase ${isDark ? 'bg-yellow-900/50 text-yellow-200' : 'bg-yellow-100 text-yellow-800'}`}>locked</span>
+                  )}
+                </td>
                 <td className="px-6 py-4"><span className={`inline-flex items-center px-2.5 py-0.5 rounded text-xs font-medium ${isDark ? 'bg-blue-900 text-blue-200' : 'bg-blue-100 text-blue-800'}`}>{user.role}</span></td>
                 <td className="px-6 py-4"><span className={`inline-flex items-center px-2.5 py-0.5 rounded text-xs font-medium ${isDark ? 'bg-purple-900 text-purple-200' : 'bg-purple-100 text-purple-800'}`}>{user.user_group}</span></td>
                 <td className={`px-6 py-4 text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>{new Date(user.created_at).toLocaleDateString()}</td>
+                <td title={user.last_login_ip || ''} className={`px-6 py-4 text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>{user.last_login_at ? new Date(user.last_login_at).toLocaleString() : 'Never'}</td>
                 <td className="px-6 py-4 text-right space-x-2">
+                  {user.pending_invite && user.status !== 'suspended' && (
+                    <button onClick={() => handleResendInvite(user.id)} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Resend Invite</button>
+                  )}
+                  {user.locked_until && (
+                    <button onClick={() => handleUnlock(user.id)} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Unlock</button>
+                  )}
+                  {user.status === 'suspended' ? (
+                    <button onClick={() => handleStatus(user, 'active')} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Reactivate</button>
+                  ) : (
+                    <button onClick={() => handleStatus(user, 'suspended')} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Suspend</button>
+                  )}
                   <button onClick={() => handleEdit(user)} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-gray-700 hover:bg-gray-600 text-white border-gray-600' : 'bg-gray-100 hover:bg-gray-200 text-gray-700 border-gray-300'}`}>Edit</button>
                   <button onClick={() => handleDelete(user.id)} className={`px-3 py-1.5 rounded-lg transition-colors text-sm font-medium border ${isDark ? 'bg-red-900/50 hover:bg-red-900 text-red-200 border-red-800' : 'bg-red-50 hover:bg-red-100 text-red-700 border-red-200'}`}>Delete</button>
                 </td>
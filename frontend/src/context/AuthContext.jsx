@@ -1,6 +1,7 @@
 import { createContext, useState, useContext, useEffect } from 'react'
 import { useNavigate } from 'react-router-dom'
-import api from '../services/api'
+import api, { clearSession, refreshSession } from '../services/api'
+import { getAssertion } from '../services/webauthn'
 
 const AuthContext = createContext(null)
 
@@ -19,6 +20,15 @@ export const AuthProvider = ({ children }) => {
       const expirationTime = payload.exp * 1000 // Convert to milliseconds
       const currentTime = Date.now()
 
+      // Refresh a little early, so links carrying the token (document
+      // view/download) never go out with an expired one
+      if (localStorage.getItem('refresh_token')) {
+        if (currentTime >= expirationTime - 120000) {
+          refreshSession().catch(() => logout())
+        }
+        return true
+      }
+
       if (currentTime >= expirationTime) {
         // Token expired, logout
         logout()
@@ -53,16 +63,68 @@ export const AuthProvider = ({ children }) => {
     return () => clearInterval(interval)
   }, [])
 
-  const login = async (email, password) => {
-    const response = await api.post('/auth/login', { email, password })
-    const { token, user } = response.data
-    
+  const startSession = ({ token, refresh_token, user }) => {
     localStorage.setItem('token', token)
+    localStorage.setItem('refresh_token', refresh_token)
     localStorage.setItem('user', JSON.stringify(user))
     api.defaults.headers.common['Authorization'] = `Bearer ${token}`
     setUser(user)
-    
-    return user
+  }
+
+  // Resolves to the MFA challenge instead of the user when a second factor
+  // is needed; finish with verifyMFA
+  const login = async (email, password) => {
+    const response = await api.post('/auth/login', { email, password })
+    if (response.data.mfa_required) {
+      return response.data
+    }
+
+    startSession(response.data)
+    return response.data.user
+  }
+
+  // Takes { code } or { recovery_code }; the response carries recovery_codes
+  // when the login completed an enrollment
+  const verifyMFA = async (challengeToken, factor) => {
+    const response = await api.post('/auth/mfa/verify', { challenge_token: challengeToken, ...factor })
+    startSession(response.data)
+    return response.data
+  }
+
+  // With the challenge token of a password login the security key is the
+  // second factor; without one it is a passwordless passkey login
+  const loginWithSecurityKey = async (challengeToken) => {
+    const body = challengeToken ? { challenge_token: challengeToken } : {}
+    const options = await api.post('/auth/webauthn/login/begin', body)
+    const credential = await getAssertion(options.data.publicKey)
+    const response = await api.post('/auth/webauthn/login/finish', {
+      ceremony_token: options.data.ceremony_token,
+      challenge_token: challengeToken,
+      credential,
+    })
+    startSession(response.data)
+    return response.data.user
+  }
+
+  // Single sign-on: the flow token waits in sessionStorage while the browser
+  // visits the identity provider, which redirects back to /login/oidc
+  const beginOIDC = async () => {
+    const response = await api.post('/auth/oidc/begin')
+    sessionStorage.setItem('oidc_flow_token', response.data.flow_token)
+    window.location.assign(response.data.authorization_url)
+  }
+
+  // Resolves like login: to the user, or to an MFA challenge
+  const completeOIDC = async (code, state) => {
+    const flowToken = sessionStorage.getItem('oidc_flow_token')
+    sessionStorage.removeItem('oidc_flow_token')
+    const response = await api.post('/auth/oidc/callback', { code, state, flow_token: flowToken || '' })
+    if (response.data.mfa_required) {
+      return response.data
+    }
+
+    startSession(response.data)
+    return response.data.user
   }
 
   const signup = async (email, password, role = 'user') => {
@@ -78,14 +140,18 @@ export const AuthProvider = ({ children }) => {
   }
 
   const logout = () => {
-    localStorage.removeItem('token')
-    localStorage.removeItem('user')
+    const refreshToken = localStorage.getItem('refresh_token')
+    if (refreshToken) {
+      // Best effort: end the session server-side too
+      api.post('/auth/logout', { refresh_token: refreshToken }).catch(() => {})
+    }
+    clearSession()
     delete api.defaults.headers.common['Authorization']
     setUser(null)
   }
 
   return (
-    <AuthContext.Provider value={{ user, login, signup, logout, loading }}>
+    <AuthContext.Provider value={{ user, login, verifyMFA, loginWithSecurityKey, beginOIDC, completeOIDC, signup, logout, loading }}>
       {children}
     </AuthContext.Provider>
   )
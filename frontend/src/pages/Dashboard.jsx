@@ -11,6 +11,8 @@ import UserManager from '../components/UserManager'
 import DocumentManager from '../components/DocumentManager'
 import GroupManager from '../components/GroupManager'
 import ChangePassword from '../components/ChangePassword'
+import TwoFactor from '../components/TwoFactor'
+import ApiTokens from '../components/ApiTokens'
 import Toast from '../components/Toast'
 
 const Dashboard = () => {
@@ -26,6 +28,8 @@ const Dashboard = () => {
   const [activeTab, setActiveTab] = useState('credentials')
   const [toast, setToast] = useState(null)
   const [showChangePassword, setShowChangePassword] = useState(false)
+  const [showTwoFactor, setShowTwoFactor] = useState(false)
+  const [showApiTokens, setShowApiTokens] = useState(false)
   const [showProfileMenu, setShowProfileMenu] = useState(false)
   const [searchQuery, setSearchQuery] = useState('')
   const [serviceSearchQuery, setServiceSearchQuery] = useState('')
@@ -104,8 +108,7 @@ const Dashboard = () => {
     ? credentials.filter(cred => {
         const matchesFolder = cred.folder_id === selectedFolder.id
         const matchesSearch = searchQuery === '' || 
-          cred.service_name?.toLowerCase().includes(searchQuery.toLowerCase()) ||
-          cred.username?.toLowerCase().includes(searchQuery.toLowerCase())
+          cred.service_name?.toLowerCase().includes(searchQuery.toLowerCase())
         return matchesFolder && matchesSearch
       })
     : []
@@ -311,6 +314,40 @@ const Dashboard = () => {
                           <span className="text-sm font-medium">Change Password</span>
                         </button>
 
+                        <button
+                          onClick={() => {
+                            setShowTwoFactor(true)
+                            setShowProfileMenu(false)
+                          }}
+                          className={`w-full px-4 py-2.5 text-left flex items-center space-x-3 transition-colors ${
+                            isDark 
+                              ? 'hover:bg-gray-700 text-gray-300' 
+                              : 'hover:bg-gray-50 text-gray-700'
+                          }`}
+                        >
+                          <svg className="w-5 h-5" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                            <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M12 18h.01M8 21h8a2 2 0 002-2V5a2 2 0 00-2-2H8a2 2 0 00-2 2v14a2 2 0 002 2z" />
+                          </svg>
+                          <span className="text-sm font-medium">Two-Factor Authentication</span>
+                        </button>
+
+                        <button
+                          onClick={() => {
+                            setShowApiTokens(true)
+                            setShowProfileMenu(false)
+                          }}
+                          className={`w-full px-4 py-2.5 text-left flex items-center space-x-3 transition-colors ${
+                            isDark 
+                              ? 'hover:bg-gray-700 text-gray-300' 
+                              : 'hover:bg-gray-50 text-gray-700'
+                          }`}
+                        >
+                          <svg className="w-5 h-5" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+                            <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M10 20l4-16m4 4l4 4-4 4M6 16l-4-4 4-4" />
+                          </svg>
+                          <span className="text-sm font-medium">API Tokens</span>
+                        </button>
+
                         <div className={`my-1 border-t ${isDark ? 'border-gray-700' : 'border-gray-200'}`} />
 
                         <button
@@ -621,6 +658,21 @@ const Dashboard = () => {
           />
         )}
 
+        {showTwoFactor && (
+          <TwoFactor
+            onClose={() => setShowTwoFactor(false)}
+            onSuccess={showToast}
+          />
+        )}
+
+        {showApiTokens && (
+          <ApiTokens
+            folders={folders}
+            onClose={() => setShowApiTokens(false)}
+            onSuccess={showToast}
+          />
+        )}
+
         {showServiceForm && (
           <ServiceForm
             service={editingService}
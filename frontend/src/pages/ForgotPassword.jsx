@@ -0,0 +1,84 @@
+import { useState } from 'react'
+import { Link } from 'react-router-dom'
+import { useTheme } from '../context/ThemeContext'
+import api, { errorMessage } from '../services/api'
+
+// Asks for a password reset link. The answer is the same whether or not the
+// email has an account
+const ForgotPassword = () => {
+  const [email, setEmail] = useState('')
+  const [message, setMessage] = useState('')
+  const [error, setError] = useState('')
+  const [loading, setLoading] = useState(false)
+  const { isDark } = useTheme()
+
+  const handleSubmit = async (e) => {
+    e.preventDefault()
+    setError('')
+    setLoading(true)
+
+    try {
+      const response = await api.post('/auth/reset/request', { email })
+      setMessage(response.data.message)
+    } catch (err) {
+      setError(errorMessage(err, 'Failed to request a reset link'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <div className={`min-h-screen flex items-center justify-center ${isDark ? 'bg-gray-900' : 'bg-gray-50'}`}>
+      <div className="max-w-md w-full px-6">
+        <div className={`rounded-2xl shadow-2xl p-8 border ${isDark ? 'bg-gray-800 border-gray-700' : 'bg-white border-gray-200'}`}>
+          <h2 className={`text-xl font-bold text-center mb-6 ${isDark ? 'text-white' : 'text-gray-900'}`}>
+            Reset Password
+          </h2>
+
+          {error && (
+            <div className={`px-4 py-3 rounded-lg mb-6 text-sm border ${isDark ? 'bg-red-900/50 border-red-800 text-red-200' : 'bg-red-50 border-red-200 text-red-800'}`}>
+              {error}
+            </div>
+          )}
+
+          {message ? (
+            <p className={`text-sm ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+              {message.charAt(0).toUpperCase() + message.slice(1)}. Check your inbox.
+            </p>
+          ) : (
+            <form onSubmit={handleSubmit}>
+              <div className="mb-6">
+                <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+                  Email Address
+                </label>
+                <input
+                  type="email"
+                  value={email}
+                  onChange={(e) => setEmail(e.target.value)}
+                  className={`w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 ${
+                    isDark ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
+                  }`}
+                  placeholder="your.email@company.com"
+                  required
+                />
+              </div>
+              <button
+                type="submit"
+                disabled={loading}
+                className="w-full bg-gradient-to-r from-blue-600 to-blue-500 text-white py-3 px-4 rounded-lg hover:from-blue-500 hover:to-blue-400 disabled:from-gray-700 disabled:to-gray-600 transition-all duration-200 shadow-lg shadow-blue-500/50 font-semibold"
+              >
+                {loading ? 'Sending...' : 'Email Me a Reset Link'}
+              </button>
+            </form>
+          )}
+
+          <div className={`mt-6 text-center text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+            <Link to="/login" className="hover:underline">Back to sign in</Link>
+          </div>
+        </div>
+      </div>
+    </div>
+  )
+}
+
+export default ForgotPassword
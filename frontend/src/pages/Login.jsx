@@ -1,16 +1,51 @@
-import { useState } from 'react'
-import { useNavigate, Link } from 'react-router-dom'
+import { useEffect, useState } from 'react'
+import { useNavigate, useLocation, Link } from 'react-router-dom'
 import { useAuth } from '../context/AuthContext'
 import { useTheme } from '../context/ThemeContext'
+import { EnrollmentDetails, RecoveryCodeList } from '../components/TwoFactor'
+import api from '../services/api'
+import { isWebAuthnSupported } from '../services/webauthn'
 
 const Login = () => {
   const [email, setEmail] = useState('')
   const [password, setPassword] = useState('')
   const [error, setError] = useState('')
   const [loading, setLoading] = useState(false)
-  const { login } = useAuth()
+  // Second step, when the account needs a TOTP code or security key
+  const [challenge, setChallenge] = useState(null)
+  const [enrollment, setEnrollment] = useState(null)
+  const [code, setCode] = useState('')
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false)
+  const [recoveryCodes, setRecoveryCodes] = useState(null)
+  const [sso, setSSO] = useState(null)
+  const { login, verifyMFA, loginWithSecurityKey, beginOIDC } = useAuth()
   const { isDark, toggleTheme } = useTheme()
   const navigate = useNavigate()
+  const location = useLocation()
+
+  const startChallenge = async (result) => {
+    if (result.mfa_setup_required) {
+      const response = await api.post('/auth/mfa/setup', { challenge_token: result.challenge_token })
+      setEnrollment(response.data)
+    }
+    setChallenge(result)
+  }
+
+  useEffect(() => {
+    api.get('/auth/oidc').then((response) => setSSO(response.data)).catch(() => {})
+
+    // A single sign-on login that needs a second factor continues here
+    const pending = location.state?.challenge
+    if (pending) {
+      setLoading(true)
+      startChallenge(pending)
+        .catch((err) => setError(err.response?.data?.error || 'Login failed'))
+        .finally(() => setLoading(false))
+    }
+    if (location.state?.error) {
+      setError(location.state.error)
+    }
+  }, [])
 
   const handleSubmit = async (e) => {
     e.preventDefault()
@@ -18,7 +53,11 @@ const Login = () => {
     setLoading(true)
 
     try {
-      await login(email, password)
+      const result = await login(email, password)
+      if (result.mfa_required) {
+        await startChallenge(result)
+        return
+      }
       navigate('/dashboard')
     } catch (err) {
       setError(err.response?.data?.error || 'Login failed')
@@ -27,6 +66,73 @@ const Login = () => {
     }
   }
 
+  const handleVerify = async (e) => {
+    e.preventDefault()
+    setError('')
+    setLoading(true)
+
+    try {
+      const factor = useRecoveryCode ? { recovery_code: code } : { code }
+      const result = await verifyMFA(challenge.challenge_token, factor)
+      if (result.recovery_codes) {
+        // Enrollment finished with this login; show the codes once
+        setRecoveryCodes(result.recovery_codes)
+        return
+      }
+      navigate('/dashboard')
+    } catch (err) {
+      setError(err.response?.data?.error || 'Verification failed')
+      setCode('')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const handleSSO = async () => {
+    setError('')
+    setLoading(true)
+
+    try {
+      await beginOIDC()
+    } catch (err) {
+      setError(err.response?.data?.error || 'Single sign-on is unavailable')
+      setLoading(false)
+    }
+  }
+
+  // Without a challenge token this is a passkey login
+  const handleSecurityKey = async (challengeToken) => {
+    setError('')
+    setLoading(true)
+
+    try {
+      await loginWithSecurityKey(challengeToken)
+      navigate('/dashboard')
+    } catch (err) {
+      setError(err.response?.data?.error || (err.name === 'NotAllowedError' ? 'Security key request was cancelled' : 'Security key login failed'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const methods = challenge?.methods || []
+  const codeAllowed = !!enrollment || methods.includes('totp')
+
+  const restart = () => {
+    setChallenge(null)
+    setEnrollment(null)
+    setCode('')
+    setUseRecoveryCode(false)
+    setError('')
+  }
+
+  const inputClass = `w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 focus:border-transparent transition-all duration-200 ${
+    isDark 
+      ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' 
+      : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
+  }`
+  const submitClass = "w-full bg-gradient-to-r from-blue-600 to-blue-500 text-white py-3 px-4 rounded-lg hover:from-blue-500 hover:to-blue-400 disabled:from-gray-700 disabled:to-gray-600 transition-all duration-200 shadow-lg shadow-blue-500/50 font-semibold"
+
   return (
     <div className={`min-h-screen flex items-center justify-center ${isDark ? 'bg-gray-900' : 'bg-gray-50'}`}>
       <div className="max-w-md w-full px-6">
@@ -63,7 +169,9 @@ const Login = () => {
         <div className={`rounded-2xl shadow-2xl p-8 border ${
           isDark ? 'bg-gray-800 border-gray-700' : 'bg-white border-gray-200'
         }`}>
-          <h2 className={`text-xl font-bold text-center mb-6 ${isDark ? 'text-white' : 'text-gray-900'}`}>Sign In</h2>
+          <h2 className={`text-xl font-bold text-center mb-6 ${isDark ? 'text-white' : 'text-gray-900'}`}>
+            {challenge ? 'Two-Factor Authentication' : 'Sign In'}
+          </h2>
           
           {error && (
             <div className={`px-4 py-3 rounded-lg mb-6 flex items-center space-x-2 border ${
@@ -78,6 +186,76 @@ const Login = () => {
             </div>
           )}
 
+          {recoveryCodes ? (
+            <div className="space-y-6">
+              <RecoveryCodeList codes={recoveryCodes} />
+              <button onClick={() => navigate('/dashboard')} className={submitClass}>
+                I have saved my recovery codes
+              </button>
+            </div>
+          ) : challenge ? (
+            <div>
+            {methods.includes('webauthn') && (
+              <div className={codeAllowed ? 'mb-6' : ''}>
+                <button
+                  type="button"
+                  onClick={() => handleSecurityKey(challenge.challenge_token)}
+                  disabled={loading || !isWebAuthnSupported()}
+                  className={submitClass}
+                >
+                  Use Security Key
+                </button>
+                {!codeAllowed && (
+                  <div className={`mt-4 text-right text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+                    <button type="button" onClick={restart} className="hover:underline">
+                      Start over
+                    </button>
+                  </div>
+                )}
+              </div>
+            )}
+            {codeAllowed && (
+            <form onSubmit={handleVerify}>
+              {enrollment && (
+                <div className="mb-5">
+                  <EnrollmentDetails enrollment={enrollment} />
+                </div>
+              )}
+              <div className="mb-6">
+                <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+                  {useRecoveryCode ? 'Recovery Code' : 'Authentication Code'}
+                </label>
+                <input
+                  type="text"
+                  inputMode={useRecoveryCode ? 'text' : 'numeric'}
+                  autoComplete="one-time-code"
+                  value={code}
+                  onChange={(e) => setCode(e.target.value)}
+                  className={inputClass}
+                  placeholder={useRecoveryCode ? 'xxxxx-xxxxx' : '6-digit code from your app'}
+                  autoFocus
+                  required
+                />
+              </div>
+
+              <button type="submit" disabled={loading} className={submitClass}>
+                {loading ? 'Verifying...' : 'Verify'}
+              </button>
+
+              <div className={`mt-4 flex justify-between text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+                {!enrollment ? (
+                  <button type="button" onClick={() => { setUseRecoveryCode(!useRecoveryCode); setCode('') }} className="hover:underline">
+                    {useRecoveryCode ? 'Use authenticator app' : 'Use a recovery code'}
+                  </button>
+                ) : <span />}
+                <button type="button" onClick={restart} className="hover:underline">
+                  Start over
+                </button>
+              </div>
+            </form>
+            )}
+            </div>
+          ) : (
           <form onSubmit={handleSubmit}>
             <div className="mb-5">
               <label className={`block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
@@ -113,6 +291,9 @@ const Login = () => {
                 placeholder="Enter your password"
                 required
               />
+              <div className={`mt-2 text-right text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+                <Link to="/forgot-password" className="hover:underline">Forgot password?</Link>
+              </div>
             </div>
 
             <button
@@ -122,7 +303,38 @@ const Login = () => {
             >
               {loading ? 'Signing in...' : 'Sign In'}
             </button>
+
+            {isWebAuthnSupported() && (
+              <button
+                type="button"
+                onClick={() => handleSecurityKey()}
+                disabled={loading}
+                className={`w-full mt-3 py-3 px-4 rounded-lg border font-semibold transition-colors duration-200 ${
+                  isDark
+                    ? 'border-gray-600 text-gray-200 hover:bg-gray-700'
+                    : 'border-gray-300 text-gray-700 hover:bg-gray-100'
+                }`}
+              >
+                Sign In with a Passkey
+              </button>
+            )}
+
+            {sso?.enabled && (
+              <button
+                type="button"
+                onClick={handleSSO}
+                disabled={loading}
+                className={`w-full mt-3 py-3 px-4 rounded-lg border font-semibold transition-colors duration-200 ${
+                  isDark
+                    ? 'border-gray-600 text-gray-200 hover:bg-gray-700'
+                    : 'border-gray-300 text-gray-700 hover:bg-gray-100'
+                }`}
+              >
+                Sign In with {sso.name}
+              </button>
+            )}
           </form>
+          )}
 
           <div className={`mt-6 p-4 rounded-lg border ${
             isDark ? 'bg-gray-900 border-gray-700' : 'bg-gray-50 border-gray-200'
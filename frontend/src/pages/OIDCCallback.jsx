@@ -0,0 +1,47 @@
+import { useEffect, useRef } from 'react'
+import { useNavigate, useSearchParams } from 'react-router-dom'
+import { useAuth } from '../context/AuthContext'
+import { useTheme } from '../context/ThemeContext'
+
+// The identity provider redirects here with the authorization code; errors
+// and MFA challenges go back to the login page
+const OIDCCallback = () => {
+  const [params] = useSearchParams()
+  const { completeOIDC } = useAuth()
+  const { isDark } = useTheme()
+  const navigate = useNavigate()
+  const started = useRef(false)
+
+  useEffect(() => {
+    // The code works once; don't redeem it twice under StrictMode
+    if (started.current) return
+    started.current = true
+
+    const code = params.get('code')
+    const state = params.get('state')
+    if (params.get('error') || !code || !state) {
+      navigate('/login', { replace: true, state: { error: params.get('error_description') || 'Single sign-on was cancelled' } })
+      return
+    }
+
+    completeOIDC(code, state)
+      .then((result) => {
+        if (result.mfa_required) {
+          navigate('/login', { replace: true, state: { challenge: result } })
+          return
+        }
+        navigate('/dashboard', { replace: true })
+      })
+      .catch((err) => {
+        navigate('/login', { replace: true, state: { error: err.response?.data?.error || 'Single sign-on failed' } })
+      })
+  }, [])
+
+  return (
+    <div className={`min-h-screen flex items-center justify-center ${isDark ? 'bg-gray-900 text-gray-300' : 'bg-gray-50 text-gray-700'}`}>
+      Signing in...
+    </div>
+  )
+}
+
+export default OIDCCallback
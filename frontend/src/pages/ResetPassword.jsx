@@ -0,0 +1,109 @@
+import { useEffect, useState } from 'react'
+import { Link } from 'react-router-dom'
+import { useTheme } from '../context/ThemeContext'
+import api, { errorMessage } from '../services/api'
+
+// Invitation and password reset emails link here, with the token in the URL
+// fragment so it never reaches a server log
+const ResetPassword = () => {
+  const [token] = useState(() => new URLSearchParams(window.location.hash.slice(1)).get('token') || '')
+  const [link, setLink] = useState(null)
+  const [password, setPassword] = useState('')
+  const [confirm, setConfirm] = useState('')
+  const [done, setDone] = useState(false)
+  const [error, setError] = useState('')
+  const [loading, setLoading] = useState(true)
+  const { isDark } = useTheme()
+
+  useEffect(() => {
+    // Keep the token out of the browser history
+    window.history.replaceState(null, '', window.location.pathname)
+    if (!token) {
+      setError('This link is invalid or has expired')
+      setLoading(false)
+      return
+    }
+    api.post('/auth/reset/verify', { token })
+      .then((response) => setLink(response.data))
+      .catch((err) => setError(errorMessage(err, 'This link is invalid or has expired')))
+      .finally(() => setLoading(false))
+  }, [])
+
+  const handleSubmit = async (e) => {
+    e.preventDefault()
+    setError('')
+    if (password !== confirm) {
+      setError('Passwords do not match')
+      return
+    }
+
+    setLoading(true)
+    try {
+      await api.post('/auth/reset', { token, password })
+      setDone(true)
+    } catch (err) {
+      setError(errorMessage(err, 'Failed to set the password'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const inputClass = `w-full px-4 py-3 border rounded-lg focus:outline-none focus:ring-2 focus:ring-blue-500 ${
+    isDark ? 'bg-gray-900 border-gray-700 text-white placeholder-gray-500' : 'bg-white border-gray-300 text-gray-900 placeholder-gray-400'
+  }`
+  const labelClass = `block text-sm font-semibold mb-2 ${isDark ? 'text-gray-300' : 'text-gray-700'}`
+
+  return (
+    <div className={`min-h-screen flex items-center justify-center ${isDark ? 'bg-gray-900' : 'bg-gray-50'}`}>
+      <div className="max-w-md w-full px-6">
+        <div className={`rounded-2xl shadow-2xl p-8 border ${isDark ? 'bg-gray-800 border-gray-700' : 'bg-white border-gray-200'}`}>
+          <h2 className={`text-xl font-bold text-center mb-2 ${isDark ? 'text-white' : 'text-gray-900'}`}>
+            {link?.purpose === 'invite' ? 'Welcome' : 'Choose a New Password'}
+          </h2>
+          {link && !done && (
+            <p className={`text-sm text-center mb-6 ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+              Set the password for {link.email}
+            </p>
+          )}
+
+          {error && (
+            <div className={`px-4 py-3 rounded-lg mb-6 text-sm border ${isDark ? 'bg-red-900/50 border-red-800 text-red-200' : 'bg-red-50 border-red-200 text-red-800'}`}>
+              {error}
+            </div>
+          )}
+
+          {done ? (
+            <p className={`text-sm text-center ${isDark ? 'text-gray-300' : 'text-gray-700'}`}>
+              Your password is set. You can now sign in.
+            </p>
+          ) : link && (
+            <form onSubmit={handleSubmit}>
+              <div className="mb-5">
+                <label className={labelClass}>New Password</label>
+                <input type="password" autoComplete="new-password" value={password} onChange={(e) => setPassword(e.target.value)} className={inputClass} required />
+              </div>
+              <div className="mb-6">
+                <label className={labelClass}>Confirm Password</label>
+                <input type="password" autoComplete="new-password" value={confirm} onChange={(e) => setConfirm(e.target.value)} className={inputClass} required />
+              </div>
+              <button
+                type="submit"
+                disabled={loading}
+                className="w-full bg-gradient-to-r from-blue-600 to-blue-500 text-white py-3 px-4 rounded-lg hover:from-blue-500 hover:to-blue-400 disabled:from-gray-700 disabled:to-gray-600 transition-all duration-200 shadow-lg shadow-blue-500/50 font-semibold"
+              >
+                {loading ? 'Saving...' : 'Set Password'}
+              </button>
+            </form>
+          )}
+
+          <div className={`mt-6 flex justify-between text-sm ${isDark ? 'text-gray-400' : 'text-gray-600'}`}>
+            <Link to="/login" className="hover:underline">Sign in</Link>
+            {!done && !link && !loading && <Link to="/forgot-password" className="hover:underline">Request a new link</Link>}
+          </div>
+        </div>
+      </div>
+    </div>
+  )
+}
+
+export default ResetPassword
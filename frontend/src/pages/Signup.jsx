@@ -1,6 +1,7 @@
 import { useState } from 'react'
 import { useNavigate, Link } from 'react-router-dom'
 import { useAuth } from '../context/AuthContext'
+import { errorMessage } from '../services/api'
 
 const Signup = () => {
   const [email, setEmail] = useState('')
@@ -19,7 +20,7 @@ const Signup = () => {
       await signup(email, password)
       navigate('/dashboard')
     } catch (err) {
-      setError(err.response?.data?.error || 'Signup failed')
+      setError(errorMessage(err, 'Signup failed'))
     } finally {
       setLoading(false)
     }
@@ -60,7 +61,6 @@ const Signup = () => {
               onChange={(e) => setPassword(e.target.value)}
               className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
               required
-              minLength={6}
             />
           </div>
 
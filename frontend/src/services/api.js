@@ -1,7 +1,9 @@
 import axios from 'axios'
 
+const baseURL = import.meta.env.VITE_API_URL || 'http://localhost:8080/api'
+
 const api = axios.create({
-  baseURL: import.meta.env.VITE_API_URL || 'http://localhost:8080/api',
+  baseURL,
   headers: {
     'Content-Type': 'application/json',
   },
@@ -18,13 +20,65 @@ api.interceptors.request.use(
   (error) => Promise.reject(error)
 )
 
+// Password policy rejections list each broken rule in violations
+export const errorMessage = (error, fallback) => {
+  const data = error.response?.data
+  if (data?.violations?.length) {
+    return `Password ${data.violations.map((v) => v.message).join(', ')}`
+  }
+  return data?.error || fallback
+}
+
+export const clearSession = () => {
+  localStorage.removeItem('token')
+  localStorage.removeItem('refresh_token')
+  localStorage.removeItem('user')
+}
+
+// Concurrent 401s share one refresh: a refresh token only works once, and
+// using it twice revokes the session
+let refreshing = null
+
+export const refreshSession = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refresh_token')
+    refreshing = (refreshToken
+      ? axios.post(`${baseURL}/auth/refresh`, { refresh_token: refreshToken })
+      : Promise.reject(new Error('no refresh token'))
+    )
+      .then((response) => {
+        const { token, refresh_token, user } = response.data
+        localStorage.setItem('token', token)
+        localStorage.setItem('refresh_token', refresh_token)
+        localStorage.setItem('user', JSON.stringify(user))
+        return token
+      })
+      .finally(() => {
+        refreshing = null
+      })
+  }
+  return refreshing
+}
+
+// A 401 from these means wrong credentials, not an expired token
+const isLoginStep = (url = '') =>
+  url.startsWith('/auth/login') || url.startsWith('/auth/mfa/verify') || url.startsWith('/auth/mfa/setup') ||
+  url.startsWith('/auth/webauthn/login') || url.startsWith('/auth/oidc')
+
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response?.status === 401) {
-      localStorage.removeItem('token')
-      localStorage.removeItem('user')
-      window.location.href = '/login'
+  async (error) => {
+    const original = error.config
+    if (error.response?.status === 401 && original && !original._retried && !isLoginStep(original.url)) {
+      original._retried = true
+      try {
+        const token = await refreshSession()
+        original.headers.Authorization = `Bearer ${token}`
+        return api(original)
+      } catch {
+        clearSession()
+        window.location.href = '/login'
+      }
     }
     return Promise.reject(error)
   }
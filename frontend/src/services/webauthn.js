@@ -0,0 +1,59 @@
+// The server sends and expects binary WebAuthn fields as base64url strings
+
+const toBuffer = (value) => {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/')
+  const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4)
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer
+}
+
+const toBase64url = (buffer) => {
+  if (!buffer) return ''
+  const bytes = String.fromCharCode(...new Uint8Array(buffer))
+  return btoa(bytes).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+const decodeDescriptors = (list = []) => list.map((cred) => ({ ...cred, id: toBuffer(cred.id) }))
+
+export const isWebAuthnSupported = () => typeof window !== 'undefined' && !!window.PublicKeyCredential
+
+export const createCredential = async (publicKey) => {
+  const credential = await navigator.credentials.create({
+    publicKey: {
+      ...publicKey,
+      challenge: toBuffer(publicKey.challenge),
+      user: { ...publicKey.user, id: toBuffer(publicKey.user.id) },
+      excludeCredentials: decodeDescriptors(publicKey.excludeCredentials),
+    },
+  })
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      attestationObject: toBase64url(credential.response.attestationObject),
+      transports: credential.response.getTransports?.() || [],
+    },
+  }
+}
+
+export const getAssertion = async (publicKey) => {
+  const credential = await navigator.credentials.get({
+    publicKey: {
+      ...publicKey,
+      challenge: toBuffer(publicKey.challenge),
+      allowCredentials: decodeDescriptors(publicKey.allowCredentials),
+    },
+  })
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      authenticatorData: toBase64url(credential.response.authenticatorData),
+      signature: toBase64url(credential.response.signature),
+      userHandle: toBase64url(credential.response.userHandle),
+    },
+  }
+}